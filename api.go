@@ -1,14 +1,16 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
-	"os"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
@@ -17,20 +19,43 @@ import (
 type APIServer struct {
 	listenAddress string
 	store         Storage
+	mailer        Mailer
+	publicURL     string
+	timeouts      ServerConfig
+	shuttingDown  atomic.Bool
+	now           func() time.Time
+
+	interestProducts []InterestProduct
+	limitRules       []LimitRule
+	rates            RateProvider
+	fxSpreadBps      int
+	creditProduct    CreditProduct
+	referralProgram  ReferralProgram
+	loginPolicy      LoginPolicy
 }
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
-	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
 	return json.NewEncoder(w).Encode(v)
 }
 
+// readJSON decodes the request body into v.
+func readJSON(r *http.Request, v any) error {
+	defer r.Body.Close()
+
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return invalid("Invalid request body: %s", err)
+	}
+	return nil
+}
+
 func makeHTTPHandleFunc(f apiFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if err := f(w, r); err != nil {
-			WriteJSON(w, http.StatusBadRequest, apiError{Error: err.Error()})
+			writeError(w, r, err)
 		}
 	}
 }
@@ -39,66 +64,493 @@ func NewAPIServer(listenAddress string, store Storage) *APIServer {
 	return &APIServer{
 		listenAddress: listenAddress,
 		store:         store,
+		mailer:        &FileMailer{From: defaultConfig().Mail.From},
+		publicURL:     defaultConfig().Mail.PublicURL,
+		timeouts:      defaultConfig().Server,
+		now:           time.Now,
+
+		interestProducts: defaultInterestProducts,
+		limitRules:       defaultLimitRules,
+		fxSpreadBps:      defaultConfig().FX.SpreadBps,
+		creditProduct:    defaultCreditProduct,
+		referralProgram:  defaultReferralProgram,
+		loginPolicy:      defaultLoginPolicy,
 	}
 }
 
-func (s *APIServer) Run() {
-	router := mux.NewRouter()
+// Run serves the API until ctx is done, then stops accepting connections and
+// waits up to the shutdown timeout for requests in flight to finish.
+func (s *APIServer) Run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.listenAddress,
+		Handler:           s.routes(),
+		ReadTimeout:       s.timeouts.ReadTimeout,
+		ReadHeaderTimeout: s.timeouts.ReadHeaderTimeout,
+		WriteTimeout:      s.timeouts.WriteTimeout,
+		IdleTimeout:       s.timeouts.IdleTimeout,
+	}
 
-	router.HandleFunc("/login", makeHTTPHandleFunc(s.handleLogin))
-	router.HandleFunc("/account", makeHTTPHandleFunc(s.handleAccount))
-	router.HandleFunc("/account/{id}", withJWTAuth(makeHTTPHandleFunc(s.handleGetUserByID), s.store))
-	router.HandleFunc("/account/{id}/update", withJWTAuth(makeHTTPHandleFunc(s.handleUserUpdate), s.store))
-	router.HandleFunc("/transfer", makeHTTPHandleFunc(s.handleTransaction))
-	http.Handle("/", router)
+	errs := make(chan error, 1)
+	go func() {
+		log.Println("JSON API running on port: ", s.listenAddress)
+		errs <- server.ListenAndServe()
+	}()
 
-	log.Println("JSON API running on port: ", s.listenAddress)
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
 
-	http.ListenAndServe(s.listenAddress, router)
-}
+	log.Println("Shutting down, draining requests in flight")
+	s.shuttingDown.Store(true)
 
-func (s *APIServer) handleAccount(w http.ResponseWriter, r *http.Request) error {
-	if r.Method == "GET" {
-		return s.handleGetAccount(w, r)
-	}
-	if r.Method == "POST" {
-		return s.handleCreateAccount(w, r)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.timeouts.ShutdownTimeout)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("Shutdown did not finish in %s: %w", s.timeouts.ShutdownTimeout, err)
 	}
-	return fmt.Errorf("method is not allowed %s", r.Method)
+
+	return nil
+}
+
+func (s *APIServer) routes() http.Handler {
+	router := mux.NewRouter()
+
+	router.HandleFunc("/healthz", s.handleHealthz).Methods("GET")
+	router.HandleFunc("/readyz", s.handleReadyz).Methods("GET")
+	router.HandleFunc("/login", makeHTTPHandleFunc(s.handleLogin))
+	router.HandleFunc("/login/2fa", withTokenPurpose(makeHTTPHandleFunc(s.handleLoginMFA), s.store, purposeMFA))
+	router.HandleFunc("/2fa/enroll", withTokenPurpose(makeHTTPHandleFunc(s.handleTOTPEnroll), s.store, "", purposeMFAEnroll))
+	router.HandleFunc("/2fa/confirm", withTokenPurpose(makeHTTPHandleFunc(s.handleTOTPConfirm), s.store, "", purposeMFAEnroll))
+	router.HandleFunc("/verify-email", makeHTTPHandleFunc(s.handleVerifyEmail))
+	router.HandleFunc("/verify-email/resend", withJWTAuth(makeHTTPHandleFunc(s.handleResendVerification), s.store))
+	router.HandleFunc("/password-reset", makeHTTPHandleFunc(s.handlePasswordReset))
+	router.HandleFunc("/password-reset/confirm", makeHTTPHandleFunc(s.handlePasswordResetConfirm))
+	router.HandleFunc("/token/refresh", makeHTTPHandleFunc(s.handleRefreshToken))
+	router.HandleFunc("/logout", withJWTAuth(makeHTTPHandleFunc(s.handleLogout), s.store))
+	router.HandleFunc("/account", withJWTAuth(withPolicy(ActionRead, noOwner, makeHTTPHandleFunc(s.handleGetAccount)), s.store)).Methods("GET")
+	router.HandleFunc("/account", withIdempotency(makeHTTPHandleFunc(s.handleCreateAccount), s.store)).Methods("POST")
+	router.HandleFunc("/account/{id}", withJWTAuth(withPolicy("", userOwner, makeHTTPHandleFunc(s.handleGetUserByID)), s.store))
+	router.HandleFunc("/account/{id}/update", withJWTAuth(withPolicy(ActionWrite, userOwner, makeHTTPHandleFunc(s.handleUserUpdate)), s.store))
+	router.HandleFunc("/account/{id}/transactions", withJWTAuth(withPolicy(ActionRead, accountOwner(s.store), makeHTTPHandleFunc(s.handleGetTransactions)), s.store))
+	router.HandleFunc("/user/{id}/referrals", withJWTAuth(withPolicy(ActionRead, userOwner, makeHTTPHandleFunc(s.handleGetReferrals)), s.store))
+	router.HandleFunc("/user/{id}/accounts", withJWTAuth(withPolicy("", userOwner, withIdempotency(makeHTTPHandleFunc(s.handleUserAccounts), s.store)), s.store))
+	router.HandleFunc("/accounts/{id}", withJWTAuth(withPolicy(ActionWrite, accountOwner(s.store), makeHTTPHandleFunc(s.handleCloseAccount)), s.store)).Methods("DELETE")
+	router.HandleFunc("/accounts/{id}/statements/{period}", withJWTAuth(withPolicy(ActionRead, accountOwner(s.store), makeHTTPHandleFunc(s.handleGetStatement)), s.store))
+	router.HandleFunc("/accounts/{id}/limits", withJWTAuth(withPolicy(ActionRead, accountOwner(s.store), makeHTTPHandleFunc(s.handleGetAccountLimits)), s.store))
+	router.HandleFunc("/admin/accounts/{id}/limits", withJWTAuth(withPolicy(ActionAdmin, noOwner, makeHTTPHandleFunc(s.handleAccountLimitOverride)), s.store))
+	router.HandleFunc("/scheduled-transfers", withJWTAuth(withIdempotency(makeHTTPHandleFunc(s.handleScheduledTransfers), s.store), s.store))
+	router.HandleFunc("/scheduled-transfers/{id}", withJWTAuth(withPolicy(ActionRead, scheduledTransferOwner(s.store), makeHTTPHandleFunc(s.handleScheduledTransfer)), s.store)).Methods("GET")
+	router.HandleFunc("/scheduled-transfers/{id}", withJWTAuth(withPolicy(ActionWrite, scheduledTransferOwner(s.store), makeHTTPHandleFunc(s.handleScheduledTransfer)), s.store)).Methods("DELETE")
+	router.HandleFunc("/scheduled-transfers/{id}/{action}", withJWTAuth(withPolicy(ActionWrite, scheduledTransferOwner(s.store), makeHTTPHandleFunc(s.handleScheduledTransferAction)), s.store))
+	router.HandleFunc("/accounts/{id}/credit", withJWTAuth(withPolicy(ActionRead, accountOwner(s.store), makeHTTPHandleFunc(s.handleGetCredit)), s.store))
+	router.HandleFunc("/admin/accounts/{id}/credit-limit", withJWTAuth(withPolicy(ActionAdmin, noOwner, makeHTTPHandleFunc(s.handleSetCreditLimit)), s.store))
+	router.HandleFunc("/accounts/{id}/balance", withJWTAuth(withPolicy(ActionRead, accountOwner(s.store), makeHTTPHandleFunc(s.handleGetBalance)), s.store))
+	router.HandleFunc("/accounts/{id}/holds", withJWTAuth(withPolicy("", accountOwner(s.store), withIdempotency(makeHTTPHandleFunc(s.handleAccountHolds), s.store)), s.store))
+	router.HandleFunc("/holds/{id}", withJWTAuth(withPolicy(ActionRead, holdOwner(s.store), makeHTTPHandleFunc(s.handleGetHold)), s.store))
+	router.HandleFunc("/holds/{id}/{action}", withJWTAuth(withPolicy(ActionWrite, holdOwner(s.store), withIdempotency(makeHTTPHandleFunc(s.handleHoldAction), s.store)), s.store))
+	router.HandleFunc("/transfer", withJWTAuth(withIdempotency(makeHTTPHandleFunc(s.handleTransaction), s.store), s.store))
+	router.HandleFunc("/fx/quote", withJWTAuth(makeHTTPHandleFunc(s.handleFXQuote), s.store))
+	router.HandleFunc("/journal/{id}", withJWTAuth(withPolicy(ActionRead, noOwner, makeHTTPHandleFunc(s.handleGetJournalEntry)), s.store))
+	router.HandleFunc("/journal/{id}/reverse", withJWTAuth(withPolicy(ActionAdmin, noOwner, makeHTTPHandleFunc(s.handleReverseJournalEntry)), s.store))
+	router.HandleFunc("/admin/users/{id}/lockout", withJWTAuth(withPolicy(ActionAdmin, noOwner, makeHTTPHandleFunc(s.handleUserLockout)), s.store))
+	router.HandleFunc("/admin/audit", withJWTAuth(withPolicy(ActionAdmin, noOwner, makeHTTPHandleFunc(s.handleGetAuditLog)), s.store))
+	router.HandleFunc("/ledger/{id}", withJWTAuth(withPolicy(ActionRead, accountOwner(s.store), makeHTTPHandleFunc(s.handleGetLedger)), s.store))
+	router.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, notFound("No route for %s", r.URL.Path))
+	})
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, r, methodNotAllowed(r.Method))
+	})
+
+	return withRequestID(router)
 }
 
 func (s *APIServer) handleLogin(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "POST" {
-		invalidMethod(w)
+		return methodNotAllowed(r.Method)
 	}
 
 	var loginReq LoginRequest
-	if err := json.NewDecoder(r.Body).Decode(&loginReq); err != nil {
+	if err := readJSON(r, &loginReq); err != nil {
+		return err
+	}
+
+	// Throttled attempts are refused before the password is checked, so
+	// waiting out a delay is the only way to make another guess.
+	now := s.now().UTC()
+	ipThrottle, err := s.checkLoginThrottle(ipKey(clientIP(r)), now)
+	if err != nil {
+		return err
+	}
+	emailThrottle, err := s.checkLoginThrottle(loginKey(loginReq.Email), now)
+	if err != nil {
 		return err
 	}
 
 	user, err := s.store.GetUserByEmail(loginReq.Email)
 	if err != nil {
-		return fmt.Errorf("Incorrect Email or Password")
+		s.audit(r, &AuditEvent{Action: AuditLoginFailed, TargetType: "user", TargetID: loginReq.Email})
+		s.recordLoginFailure(r, ipThrottle, now, "ip", clientIP(r))
+		s.recordLoginFailure(r, emailThrottle, now, "user", loginReq.Email)
+		return unauthorized("Incorrect Email or Password")
 	}
 
 	if !user.validatePassword(loginReq.Password) {
-		return fmt.Errorf("Incorrect Email or Password")
+		s.audit(r, &AuditEvent{ActorID: user.ID, ActorRole: user.Role, Action: AuditLoginFailed, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+		s.recordLoginFailure(r, ipThrottle, now, "ip", clientIP(r))
+		s.recordLoginFailure(r, emailThrottle, now, "user", strconv.Itoa(user.ID))
+		return unauthorized("Incorrect Email or Password")
 	}
 
-	token, err := createJWT(user)
+	enrollment, err := s.store.GetTOTPEnrollment(user.ID)
 	if err != nil {
 		return err
 	}
 
-	response := LoginResponse{
-		UserName: user.UserName,
-		Token:    token,
+	if enrollment != nil && enrollment.Enabled {
+		return s.writeMFAChallenge(w, user, purposeMFA)
+	}
+	if requiresMFA(user) {
+		return s.writeMFAChallenge(w, user, purposeMFAEnroll)
 	}
 
+	// Failures are only forgotten once the whole login succeeds, so a known
+	// password cannot be used to reset the count of wrong codes.
+	if err := s.store.ClearLoginFailures(emailThrottle.Key); err != nil {
+		return err
+	}
+
+	response, err := s.issueTokens(user, "")
+	if err != nil {
+		return err
+	}
+	s.audit(r, &AuditEvent{ActorID: user.ID, ActorRole: user.Role, Action: AuditLogin, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
 	return WriteJSON(w, http.StatusOK, response)
 }
 
+// writeMFAChallenge answers a correct password with a short lived partial
+// token instead of a session. A purposeMFA token can only be exchanged at
+// /login/2fa, a purposeMFAEnroll token can only be used to set up TOTP.
+func (s *APIServer) writeMFAChallenge(w http.ResponseWriter, user *User, purpose string) error {
+	claims := newPartialClaims(user, purpose)
+	token, err := signJWT(claims)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, MFAChallengeResponse{
+		UserName:           user.UserName,
+		MFAToken:           token,
+		ExpiresAt:          claims.ExpiresAt.Time,
+		EnrollmentRequired: purpose == purposeMFAEnroll,
+	})
+}
+
+// POST /login/2fa
+func (s *APIServer) handleLoginMFA(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	principal := principalFromContext(r.Context())
+
+	verifyReq := new(TOTPVerifyRequest)
+	if err := readJSON(r, verifyReq); err != nil {
+		return err
+	}
+
+	enrollment, err := s.store.GetTOTPEnrollment(principal.UserID)
+	if err != nil {
+		return err
+	}
+	if enrollment == nil || !enrollment.Enabled {
+		return conflict("Two-factor authentication is not enabled")
+	}
+
+	user, err := s.store.GetUserByID(principal.UserID)
+	if err != nil {
+		return err
+	}
+
+	// Wrong codes count towards the same lockout as wrong passwords.
+	now := s.now().UTC()
+	ipThrottle, err := s.checkLoginThrottle(ipKey(clientIP(r)), now)
+	if err != nil {
+		return err
+	}
+	emailThrottle, err := s.checkLoginThrottle(loginKey(user.Email), now)
+	if err != nil {
+		return err
+	}
+
+	var codeErr error
+	if verifyReq.RecoveryCode != "" {
+		if err := s.store.UseRecoveryCode(principal.UserID, hashRecoveryCode(verifyReq.RecoveryCode)); err != nil {
+			codeErr = unauthorized("Invalid recovery code")
+		}
+	} else {
+		codeErr = s.useTOTPCode(enrollment, verifyReq.Code)
+	}
+	if codeErr != nil {
+		s.audit(r, &AuditEvent{Action: AuditLoginFailed, TargetType: "user", TargetID: strconv.Itoa(principal.UserID)})
+		s.recordLoginFailure(r, ipThrottle, now, "ip", clientIP(r))
+		s.recordLoginFailure(r, emailThrottle, now, "user", strconv.Itoa(user.ID))
+		if err := s.recordMFAFailure(principal, now); err != nil {
+			return err
+		}
+		return codeErr
+	}
+
+	// The partial token is single use.
+	if err := s.store.RevokeAccessToken(principal.TokenID, principal.TokenExpiresAt); err != nil {
+		return err
+	}
+	if err := s.store.ClearLoginFailures(emailThrottle.Key); err != nil {
+		return err
+	}
+
+	response, err := s.issueTokens(user, "")
+	if err != nil {
+		return err
+	}
+	s.audit(r, &AuditEvent{Action: AuditLogin, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	return WriteJSON(w, http.StatusOK, response)
+}
+
+// POST /2fa/enroll starts (or restarts) TOTP enrollment for the caller.
+func (s *APIServer) handleTOTPEnroll(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	principal := principalFromContext(r.Context())
+
+	existing, err := s.store.GetTOTPEnrollment(principal.UserID)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.Enabled {
+		return conflict("Two-factor authentication is already enabled")
+	}
+
+	user, err := s.store.GetUserByID(principal.UserID)
+	if err != nil {
+		return err
+	}
+
+	enrollment := &TOTPEnrollment{
+		UserID:    user.ID,
+		Secret:    generateTOTPSecret(),
+		CreatedAt: s.now().UTC(),
+	}
+	if err := s.store.SaveTOTPEnrollment(enrollment); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, TOTPEnrollResponse{
+		Secret: enrollment.Secret,
+		URI:    totpURI(enrollment.Secret, user.Email),
+	})
+}
+
+// POST /2fa/confirm enables TOTP once the user sends a valid code, and hands
+// out the recovery codes. When called with an enrollment token it also
+// completes the login that required it.
+func (s *APIServer) handleTOTPConfirm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	principal := principalFromContext(r.Context())
+
+	verifyReq := new(TOTPVerifyRequest)
+	if err := readJSON(r, verifyReq); err != nil {
+		return err
+	}
+
+	enrollment, err := s.store.GetTOTPEnrollment(principal.UserID)
+	if err != nil {
+		return err
+	}
+	if enrollment == nil {
+		return conflict("Start enrollment at /2fa/enroll first")
+	}
+	if enrollment.Enabled {
+		return conflict("Two-factor authentication is already enabled")
+	}
+
+	if err := s.useTOTPCode(enrollment, verifyReq.Code); err != nil {
+		return err
+	}
+
+	codes, hashes := generateRecoveryCodes()
+	if err := s.store.EnableTOTP(principal.UserID, hashes); err != nil {
+		return err
+	}
+	s.audit(r, &AuditEvent{Action: AuditMFAEnable, TargetType: "user", TargetID: strconv.Itoa(principal.UserID)})
+
+	response := TOTPConfirmResponse{RecoveryCodes: codes}
+
+	if principal.Purpose == purposeMFAEnroll {
+		if err := s.store.RevokeAccessToken(principal.TokenID, principal.TokenExpiresAt); err != nil {
+			return err
+		}
+
+		user, err := s.store.GetUserByID(principal.UserID)
+		if err != nil {
+			return err
+		}
+
+		response.Login, err = s.issueTokens(user, "")
+		if err != nil {
+			return err
+		}
+		s.audit(r, &AuditEvent{Action: AuditLogin, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+	}
+
+	return WriteJSON(w, http.StatusOK, response)
+}
+
+// useTOTPCode checks code against the enrollment and burns its time step, so
+// a code seen by someone else cannot be replayed.
+func (s *APIServer) useTOTPCode(enrollment *TOTPEnrollment, code string) error {
+	step, ok := verifyTOTP(enrollment.Secret, code, s.now())
+	if !ok {
+		return unauthorized("Invalid two-factor code")
+	}
+
+	if err := s.store.UseTOTPStep(enrollment.UserID, step); err != nil {
+		return unauthorized("Invalid two-factor code")
+	}
+
+	return nil
+}
+
+// POST /token/refresh
+func (s *APIServer) handleRefreshToken(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	refreshReq := new(RefreshTokenRequest)
+	if err := readJSON(r, refreshReq); err != nil {
+		return err
+	}
+
+	current, err := s.store.GetRefreshToken(hashToken(refreshReq.RefreshToken))
+	if err != nil {
+		return unauthorized("Invalid refresh token")
+	}
+
+	if current.isRevoked() {
+		log.Printf("Refresh token reuse for user %d, revoking token family", current.UserID)
+		if err := s.store.RevokeRefreshTokenFamily(current.FamilyID); err != nil {
+			return err
+		}
+		return unauthorized("Invalid refresh token")
+	}
+
+	if current.isExpired(s.now().UTC()) {
+		return unauthorized("Invalid refresh token")
+	}
+
+	user, err := s.store.GetUserByID(current.UserID)
+	if err != nil {
+		return unauthorized("Invalid refresh token")
+	}
+
+	response, err := s.issueTokens(user, current.TokenHash)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, response)
+}
+
+// POST /logout revokes the access token used to call it and, when given, the
+// refresh token family it belongs to.
+func (s *APIServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	principal := principalFromContext(r.Context())
+
+	logoutReq := new(RefreshTokenRequest)
+	if r.ContentLength != 0 {
+		if err := readJSON(r, logoutReq); err != nil {
+			return err
+		}
+		defer r.Body.Close()
+	}
+
+	if logoutReq.RefreshToken != "" {
+		refresh, err := s.store.GetRefreshToken(hashToken(logoutReq.RefreshToken))
+		if err == nil && refresh.UserID == principal.UserID {
+			if err := s.store.RevokeRefreshTokenFamily(refresh.FamilyID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := s.store.RevokeAccessToken(principal.TokenID, principal.TokenExpiresAt); err != nil {
+		return err
+	}
+	s.audit(r, &AuditEvent{Action: AuditLogout, TargetType: "user", TargetID: strconv.Itoa(principal.UserID)})
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"loggedOut": "Token revoked"})
+}
+
+// issueTokens creates a new access token and refresh token for user. When
+// replacing is the hash of a refresh token, that token is rotated out in the
+// same step.
+func (s *APIServer) issueTokens(user *User, replacing string) (*LoginResponse, error) {
+	claims := newAccessClaims(user)
+	token, err := signJWT(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	familyID := ""
+	if replacing != "" {
+		current, err := s.store.GetRefreshToken(replacing)
+		if err != nil {
+			return nil, err
+		}
+		familyID = current.FamilyID
+	}
+
+	refreshToken, refresh := newRefreshToken(user.ID, familyID, s.now().UTC())
+	if replacing != "" {
+		err = s.store.RotateRefreshToken(replacing, refresh)
+	} else {
+		err = s.store.CreateRefreshToken(refresh)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A refresh continues a session; only a new sign in counts as a login.
+	if replacing == "" {
+		user.LastLogin = s.now().UTC()
+		if err := s.store.UpdateLastLogin(user.ID, user.LastLogin); err != nil {
+			return nil, err
+		}
+	}
+
+	return &LoginResponse{
+		UserName:     user.UserName,
+		Token:        token,
+		ExpiresAt:    claims.ExpiresAt.Time,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
 func (s *APIServer) handleGetUserByID(w http.ResponseWriter, r *http.Request) error {
 	if r.Method == "GET" {
 
@@ -119,7 +571,7 @@ func (s *APIServer) handleGetUserByID(w http.ResponseWriter, r *http.Request) er
 		return s.handleDeleteAccount(w, r)
 	}
 
-	return fmt.Errorf("Method not allowed %s", r.Method)
+	return methodNotAllowed(r.Method)
 }
 
 // GET /account
@@ -134,7 +586,7 @@ func (s *APIServer) handleGetAccount(w http.ResponseWriter, r *http.Request) err
 
 func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
 	createUserReq := new(CreateUserRequest)
-	if err := json.NewDecoder(r.Body).Decode(createUserReq); err != nil {
+	if err := readJSON(r, createUserReq); err != nil {
 		return err
 	}
 
@@ -148,32 +600,51 @@ func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request)
 		role = 3
 	}
 
-	var accType AccountType
+	// Anyone may register as a customer, but staff accounts can only be
+	// created by an admin.
+	if role != Customer {
+		r = r.WithContext(withPrincipal(r.Context(), principalFromToken(r, s.store)))
+		if !authorizeRequest(r, ActionAdmin, 0) {
+			return forbidden("Permission Denied")
+		}
+	}
 
-	if createUserReq.AccountType == "Checking" {
-		accType = 1
-	} else if createUserReq.AccountType == "Savings" {
-		accType = 2
-	} else {
-		return fmt.Errorf("Must specifiy 'Checking' or 'Savings' account")
+	accType, err := parseAccountType(createUserReq.AccountType)
+	if err != nil {
+		return err
+	}
+	currency, err := parseCurrency(createUserReq.Currency)
+	if err != nil {
+		return err
 	}
 
-	var referrerId int
+	var (
+		referrer   *User
+		referrerId int
+	)
 	if createUserReq.ReferrerID != "" {
-		referralAcc, err := s.store.GetUserByUserName(createUserReq.ReferrerID)
+		referrer, err = s.store.GetUserByUserName(createUserReq.ReferrerID)
 		if err != nil {
-			fmt.Println(err)
-			return fmt.Errorf("Referral Username invalid")
+			return invalidField("referrerID", "Referral Username invalid")
 		}
-		referrerId = referralAcc.ID
-		createUserReq.Balance = 100
+		referrerId = referrer.ID
 	}
 
-	user, account, err := NewUserAccount(createUserReq.Email, createUserReq.Password, createUserReq.FirstName, createUserReq.LastName, createUserReq.PhoneNumber, referrerId, int64(createUserReq.Balance), Role(role), AccountType(accType))
+	// The password is checked here, since the user only ever holds its hash.
+	if !validPassword(createUserReq.Password) {
+		return invalidField("password", passwordRule)
+	}
+
+	user, account, err := NewUserAccount(createUserReq.Email, createUserReq.Password, createUserReq.FirstName, createUserReq.LastName, createUserReq.PhoneNumber, referrerId, 0, Role(role), AccountType(accType))
 	if err != nil {
 		return err
 	}
 
+	account.Currency = currency
+	if accType == CreditAccount {
+		account.CreditLimit = s.openingCreditLimit(r)
+	}
+
 	if err := validateUserInfo(user); err != nil {
 		return err
 	}
@@ -182,19 +653,117 @@ func (s *APIServer) handleCreateAccount(w http.ResponseWriter, r *http.Request)
 		return err
 	}
 
-	tokenString, err := createJWT(user)
+	event := &AuditEvent{Action: AuditUserCreate, TargetType: "user", TargetID: strconv.Itoa(user.ID), Changes: auditChanges(nil, user)}
+	if principalFromContext(r.Context()) == nil {
+		event.ActorID, event.ActorRole = user.ID, user.Role
+	}
+	s.audit(r, event)
+
+	if err := s.startVerification(user, VerifyEmail); err != nil {
+		log.Println("Starting email verification failed:", err)
+	}
+
+	// The signup stands even if the referral cannot be recorded; it only
+	// costs the users their bonus.
+	if referrer != nil {
+		referral := s.referralProgram.newReferral(referrer, user, s.now().UTC())
+		if err := s.store.CreateReferral(referral, s.referralProgram.MaxPerReferrer); err != nil {
+			log.Println("Recording referral failed:", err)
+		}
+	}
+
+	return WriteJSON(w, http.StatusOK, user)
+}
+
+func (s *APIServer) handleUserAccounts(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		return s.handleGetUserAccounts(w, r)
+	}
+	if r.Method == "POST" {
+		return s.handleOpenAccount(w, r)
+	}
+	return methodNotAllowed(r.Method)
+}
+
+// GET /user/{id}/accounts
+func (s *APIServer) handleGetUserAccounts(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("JWT Token: ", tokenString)
+	fullAccount, err := s.store.GetAccountByUserID(id)
+	if err != nil {
+		return err
+	}
 
-	return WriteJSON(w, http.StatusOK, user)
+	return WriteJSON(w, http.StatusOK, fullAccount)
+}
+
+// POST /user/{id}/accounts opens another account for an existing user.
+func (s *APIServer) handleOpenAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	openReq := new(OpenAccountRequest)
+	if err := readJSON(r, openReq); err != nil {
+		return err
+	}
+
+	accType, err := parseAccountType(openReq.AccountType)
+	if err != nil {
+		return err
+	}
+	currency, err := parseCurrency(openReq.Currency)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.store.GetUserByID(id); err != nil {
+		return err
+	}
+
+	account := NewAccount(id, accType, currency)
+	if accType == CreditAccount {
+		account.CreditLimit = s.openingCreditLimit(r)
+	}
+	if err := s.store.CreateAccount(account); err != nil {
+		return err
+	}
+	s.audit(r, &AuditEvent{Action: AuditAccountOpen, TargetType: "account", TargetID: strconv.Itoa(account.ID), Changes: auditChanges(nil, account)})
+
+	return WriteJSON(w, http.StatusOK, account)
+}
+
+// DELETE /accounts/{id} closes a single account. Only empty accounts without
+// pending holds can be closed.
+func (s *APIServer) handleCloseAccount(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	before, err := s.store.GetAccountByID(id)
+	if err != nil {
+		return err
+	}
+
+	if err := s.store.CloseAccount(id); err != nil {
+		return err
+	}
+
+	after := *before
+	after.IsActiveAccount = false
+	s.audit(r, &AuditEvent{Action: AuditAccountClose, TargetType: "account", TargetID: strconv.Itoa(id), Changes: auditChanges(before, &after)})
+
+	return WriteJSON(w, http.StatusOK, map[string]int{"closed": id})
 }
 
 func (s *APIServer) handleUserUpdate(w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "PUT" {
-		return fmt.Errorf("Method not allowed")
+		return methodNotAllowed(r.Method)
 	}
 
 	id, err := getID(r)
@@ -202,15 +771,39 @@ func (s *APIServer) handleUserUpdate(w http.ResponseWriter, r *http.Request) err
 		return err
 	}
 
-	var data map[string]string
+	update := new(UpdateUserRequest)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	defer r.Body.Close()
+	if err := decoder.Decode(update); err != nil {
+		return invalid("Invalid update: %s", err)
+	}
+
+	if err := validateUserUpdate(update); err != nil {
+		return err
+	}
 
-	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+	before, err := s.store.GetUserByID(id)
+	if err != nil {
 		return err
 	}
 
-	if err := s.store.UpdateUser(id, data); err != nil {
+	user, err := s.store.UpdateUser(id, update)
+	if err != nil {
 		return err
 	}
+	s.audit(r, &AuditEvent{Action: AuditUserUpdate, TargetType: "user", TargetID: strconv.Itoa(id), Changes: auditChanges(before, user)})
+
+	if user.Email != before.Email {
+		if err := s.startVerification(user, VerifyEmail); err != nil {
+			log.Println("Starting email verification failed:", err)
+		}
+	}
+	if user.PhoneNumber != before.PhoneNumber && user.PhoneNumber != "" {
+		if err := s.startVerification(user, VerifyPhone); err != nil {
+			log.Println("Starting phone verification failed:", err)
+		}
+	}
 
 	return WriteJSON(w, http.StatusOK, map[string]string{"updated": "User Profile Updated"})
 }
@@ -221,112 +814,410 @@ func (s *APIServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request)
 		return err
 	}
 
+	before, err := s.store.GetUserByID(id)
+	if err != nil {
+		return err
+	}
+
 	if err := s.store.DeleteAccount(id); err != nil {
 		return err
 	}
 
+	after := *before
+	after.IsActive = false
+	s.audit(r, &AuditEvent{Action: AuditUserDeactivate, TargetType: "user", TargetID: strconv.Itoa(id), Changes: auditChanges(before, &after)})
+
 	return WriteJSON(w, http.StatusOK, map[string]int{"deleted": id})
 }
 
+// POST /transfer
 func (s *APIServer) handleTransaction(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+	if err := s.requireVerifiedEmail(r); err != nil {
+		return err
+	}
+
 	transactionReq := new(TransactionRequest)
-	if err := json.NewDecoder(r.Body).Decode(transactionReq); err != nil {
+	if err := readJSON(r, transactionReq); err != nil {
 		return err
 	}
-	defer r.Body.Close()
-	return WriteJSON(w, http.StatusOK, transactionReq)
+
+	// Money moved through the API is always a Transfer. Credits and Debits
+	// are the bank's own postings, such as interest, fees and opening
+	// balances.
+	if transactionReq.TransactionType != 0 && TransactionType(transactionReq.TransactionType) != Transfer {
+		return invalidField("transactionType", "Only transfers can be made, the bank posts credits and debits")
+	}
+
+	if transactionReq.Amount <= 0 {
+		return invalidField("amount", "Transfer amount must be greater than zero")
+	}
+
+	fromAccount, err := s.store.GetAccountByID(transactionReq.FromAccount)
+	if err != nil {
+		return err
+	}
+	if !authorizeRequest(r, ActionWrite, fromAccount.UserID) {
+		return forbidden("Permission Denied")
+	}
+
+	limits, _, err := s.transferLimits(fromAccount, principalFromContext(r.Context()).Role)
+	if err != nil {
+		return err
+	}
+
+	toAccount, err := s.store.GetAccountByID(transactionReq.ToAccount)
+	if err != nil {
+		return err
+	}
+	if toAccount.Currency != fromAccount.Currency {
+		return s.handleFXTransfer(w, r, fromAccount, toAccount, transactionReq, limits)
+	}
+
+	event := s.auditEvent(r, &AuditEvent{Action: AuditTransfer, TargetType: "transaction"})
+	transaction, err := s.store.Transfer(transactionReq.FromAccount, transactionReq.ToAccount, int64(transactionReq.Amount), Transfer, transactionReq.Description, event, limits...)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, transaction)
 }
 
-// JWT Functions
-func createJWT(user *User) (string, error) {
-	claims := &jwt.MapClaims{
-		"ExpiresAt":     15000,
-		"accountNumber": user.UserName,
+// handleFXTransfer converts the amount, in the source account's currency, at
+// the current rate less the spread and pays the result into toAccount.
+func (s *APIServer) handleFXTransfer(w http.ResponseWriter, r *http.Request, fromAccount, toAccount *Account, req *TransactionRequest, limits []TransferLimits) error {
+	conversion, err := quoteConversion(s.rates, s.fxSpreadBps, int64(req.Amount), fromAccount.Currency, toAccount.Currency, s.now().UTC())
+	if err != nil {
+		return err
 	}
+	conversion.FromAccount = fromAccount.ID
+	conversion.ToAccount = toAccount.ID
 
-	secret := os.Getenv("JWT_SECRET")
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	description := req.Description
+	if description == "" {
+		description = conversionDescription(conversion)
+	}
+
+	event := s.auditEvent(r, &AuditEvent{Action: AuditTransfer, TargetType: "fx_conversion"})
+	if err := s.store.TransferFX(conversion, Transfer, description, event, limits...); err != nil {
+		return err
+	}
 
-	return token.SignedString([]byte(secret))
+	return WriteJSON(w, http.StatusOK, conversion)
 }
 
-func withJWTAuth(handlerFunc http.HandlerFunc, store Storage) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("Calling JWT auth middleware")
+// GET /account/{id}/transactions where id is an account id
+func (s *APIServer) handleGetTransactions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
 
-		tokenString := r.Header.Get("x-jwt-token")
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
 
-		token, err := validateJWT(tokenString)
-		if err != nil {
-			log.Println("Invalid Token")
-			permissionDenied(w)
-			return
-		}
+	filter, err := parseTransactionFilter(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.store.GetAccountByID(id); err != nil {
+		return err
+	}
+
+	// Ask for one extra row to find out whether there is another page.
+	pageSize := filter.Limit
+	filter.Limit = pageSize + 1
 
-		if !token.Valid {
-			log.Println("Invalid Token")
-			permissionDenied(w)
+	entries, err := s.store.GetTransactionHistory(id, filter)
+	if err != nil {
+		return err
+	}
+
+	page := TransactionHistoryPage{Transactions: entries}
+	if len(entries) > pageSize {
+		page.Transactions = entries[:pageSize]
+		page.NextCursor = encodeCursor(page.Transactions[pageSize-1].ID)
+	}
+
+	return WriteJSON(w, http.StatusOK, page)
+}
+
+// GET /journal/{id}
+func (s *APIServer) handleGetJournalEntry(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	entry, err := s.store.GetJournalEntry(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, entry)
+}
+
+// POST /journal/{id}/reverse
+func (s *APIServer) handleReverseJournalEntry(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	reverseReq := new(ReverseJournalEntryRequest)
+	if err := readJSON(r, reverseReq); err != nil {
+		return err
+	}
+
+	if strings.TrimSpace(reverseReq.Description) == "" {
+		return invalidField("description", "A description of why the entry is reversed is required")
+	}
+
+	event := s.auditEvent(r, &AuditEvent{Action: AuditJournalReversal, TargetType: "journal_entry"})
+	reversal, err := s.store.ReverseJournalEntry(id, reverseReq.Description, event)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, reversal)
+}
+
+// GET /ledger/{id} where id is an account id
+func (s *APIServer) handleGetLedger(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	balance, err := s.store.GetLedgerBalance(id)
+	if err != nil {
+		return err
+	}
+
+	entries, err := s.store.GetJournalEntriesByAccount(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, AccountLedgerResponse{Balance: balance, Entries: entries})
+}
+
+// JWT Functions
+func createJWT(user *User) (string, error) {
+	return signJWT(newAccessClaims(user))
+}
+
+// withJWTAuth rejects requests without a valid token and puts the caller into
+// the request context for withPolicy and the handlers.
+func withJWTAuth(handlerFunc http.HandlerFunc, store Storage) http.HandlerFunc {
+	return withTokenPurpose(handlerFunc, store, "")
+}
+
+// withTokenPurpose is withJWTAuth for the few routes that accept the partial
+// tokens of a two step login. An empty purpose stands for a full token.
+func withTokenPurpose(handlerFunc http.HandlerFunc, store Storage, purposes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal := principalFromToken(r, store, purposes...)
+		if principal == nil {
+			writeError(w, r, unauthorized("A valid token is required"))
 			return
 		}
 
-		// userId, err := getID(r)
-		// if err != nil {
-		// 	permissionDenied(w)
-		// 	log.Println("No id in params")
-		// 	return
-		// }
-		// account, err := store.GetUserByID(userId)
-		// if err != nil {
-		// 	permissionDenied(w)
-		// 	log.Println("Invalid account number")
-		// 	return
-		// }
-		//
-		// claims := token.Claims.(jwt.MapClaims)
-		// if account.AccountNumber != int64(claims["accountNumber"].(float64)) {
-		// 	log.Println("Account numbers are not equal")
-		// 	permissionDenied(w)
-		// 	return
-		// }
-
-		handlerFunc(w, r)
+		handlerFunc(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	}
+}
+
+// principalFromToken returns the caller identified by the request's token, or
+// nil when there is no valid token. The user must still be active and hold
+// the role the token was issued for. Only full tokens are accepted unless
+// other purposes are listed.
+func principalFromToken(r *http.Request, store Storage, purposes ...string) *Principal {
+	tokenString := r.Header.Get("x-jwt-token")
+	if tokenString == "" {
+		return nil
+	}
+
+	claims, err := validateJWT(tokenString)
+	if err != nil {
+		log.Println("Invalid Token:", err)
+		return nil
+	}
+
+	if len(purposes) == 0 {
+		purposes = []string{""}
+	}
+	allowed := false
+	for _, purpose := range purposes {
+		allowed = allowed || claims.Purpose == purpose
+	}
+	if !allowed {
+		log.Printf("Token purpose %q not accepted here", claims.Purpose)
+		return nil
+	}
+
+	revoked, err := store.IsAccessTokenRevoked(claims.ID)
+	if err != nil || revoked {
+		log.Println("Revoked Token")
+		return nil
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		log.Println("Token has no user id")
+		return nil
+	}
+
+	user, err := store.GetUserByID(userID)
+	if err != nil {
+		log.Println("Token user not found:", err)
+		return nil
+	}
+	if user.Role != claims.Role {
+		log.Printf("Token role %d does not match user %d role %d", claims.Role, user.ID, user.Role)
+		return nil
+	}
+	if claims.IssuedAt == nil || claims.IssuedAt.Time.Before(user.PasswordChangedAt) {
+		log.Printf("Token was issued before user %d changed their password", user.ID)
+		return nil
+	}
+
+	return &Principal{
+		UserID:         user.ID,
+		Role:           user.Role,
+		TokenID:        claims.ID,
+		TokenExpiresAt: claims.ExpiresAt.Time,
+		Purpose:        claims.Purpose,
 	}
 }
 
 // validate functions
-func validateJWT(tokenString string) (*jwt.Token, error) {
-	secret := os.Getenv("JWT_SECRET")
+func validateJWT(tokenString string) (*authClaims, error) {
+	secret, err := jwtSecret()
+	if err != nil {
+		return nil, err
+	}
 
-	return jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
+	claims := new(authClaims)
+	token, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
 			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
 		}
-		return []byte(secret), nil
-	})
+		return secret, nil
+	}, jwt.WithValidMethods([]string{"HS256"}), jwt.WithIssuer(tokenIssuer), jwt.WithIssuedAt())
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, fmt.Errorf("Token is not valid")
+	}
+
+	// The parser only checks exp when it is present, so require it here.
+	if claims.ExpiresAt == nil || claims.ID == "" {
+		return nil, fmt.Errorf("Token is missing exp or jti")
+	}
+
+	return claims, nil
+}
+
+var (
+	emailRegex    = regexp.MustCompile(`^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`)
+	nameRegex     = regexp.MustCompile(`[^\p{L}\s'-]+`)
+	userNameRegex = regexp.MustCompile(`^\S{3,50}$`)
+	phoneRegex    = regexp.MustCompile(`^[0-9]{10}$`)
+)
+
+const nameRule = "Names cannot contain numbers or special characters, however apostrophes and hyphens are allowed"
+
+const passwordRule = "Password must be 6 or more characters, include a capital letter, and include a number"
+
+func validPassword(password string) bool {
+	return len(strings.TrimSpace(password)) >= 6 && regexp.MustCompile("[0-9]").MatchString(password) && regexp.MustCompile("[A-Z]").MatchString(password)
 }
 
 func validateUserInfo(info *User) error {
-	if strings.TrimSpace(info.Email) == "" || strings.TrimSpace(info.FirstName) == "" || strings.TrimSpace(info.LastName) == "" {
-		return fmt.Errorf("No whitespace or blank fields allowed")
+	errs := &ValidationError{}
+
+	for field, value := range map[string]string{"email": info.Email, "firstName": info.FirstName, "lastName": info.LastName} {
+		if strings.TrimSpace(value) == "" {
+			errs.add(field, "No whitespace or blank fields allowed")
+		}
 	}
 
-	emailRegex := `^[a-zA-Z0-9._%+-]+@[a-zA-Z0-9.-]+\.[a-zA-Z]{2,}$`
+	if !emailRegex.MatchString(info.Email) {
+		errs.add("email", "Email format is not valid")
+	}
+	if nameRegex.MatchString(info.FirstName) {
+		errs.add("firstName", nameRule)
+	}
+	if nameRegex.MatchString(info.LastName) {
+		errs.add("lastName", nameRule)
+	}
 
-	if !regexp.MustCompile(emailRegex).MatchString(info.Email) {
-		return fmt.Errorf("Email format is not valid")
+	return errs.orNil()
+}
+
+// validateUserUpdate checks every field the update sets, trimming the
+// surrounding whitespace first.
+func validateUserUpdate(update *UpdateUserRequest) error {
+	fields := map[string]*string{
+		"email":       update.Email,
+		"firstName":   update.FirstName,
+		"lastName":    update.LastName,
+		"userName":    update.UserName,
+		"phoneNumber": update.PhoneNumber,
 	}
 
-	nameRegex := `[^\p{L}\s'-]+`
+	empty := true
+	for _, value := range fields {
+		if value != nil {
+			*value = strings.TrimSpace(*value)
+			empty = false
+		}
+	}
+	if empty {
+		return invalid("No fields to update")
+	}
 
-	if regexp.MustCompile(nameRegex).MatchString(info.FirstName) || regexp.MustCompile(nameRegex).MatchString(info.LastName) {
-		return fmt.Errorf("Names cannot contain numbers or special characters, however apostrophes and hyphens are allowed")
+	errs := &ValidationError{}
+	for field, value := range fields {
+		if value != nil && *value == "" && field != "phoneNumber" {
+			errs.add(field, "No whitespace or blank fields allowed")
+		}
 	}
 
-	if len(strings.TrimSpace(info.Password)) < 6 || !regexp.MustCompile("[0-9]").MatchString(info.Password) || !regexp.MustCompile("[A-Z]").MatchString(info.Password) {
-		return fmt.Errorf("Password must be 6 or more characters, include a capital letter, and include a number")
+	if update.Email != nil && !emailRegex.MatchString(*update.Email) {
+		errs.add("email", "Email format is not valid")
+	}
+	if update.FirstName != nil && nameRegex.MatchString(*update.FirstName) {
+		errs.add("firstName", nameRule)
+	}
+	if update.LastName != nil && nameRegex.MatchString(*update.LastName) {
+		errs.add("lastName", nameRule)
+	}
+	if update.UserName != nil && !userNameRegex.MatchString(*update.UserName) {
+		errs.add("userName", "User name must be 3 to 50 characters without spaces")
+	}
+	if update.PhoneNumber != nil && *update.PhoneNumber != "" && !phoneRegex.MatchString(*update.PhoneNumber) {
+		errs.add("phoneNumber", "Phone number must be 10 digits")
 	}
 
-	return nil
+	return errs.orNil()
 }
 
 // Get Functions
@@ -334,7 +1225,7 @@ func getID(r *http.Request) (int, error) {
 	idStr := mux.Vars(r)["id"]
 	id, err := strconv.Atoi(idStr)
 	if err != nil {
-		return id, fmt.Errorf("Invalid id, given %s", idStr)
+		return id, invalidField("id", "Invalid id, given %s", idStr)
 	}
 
 	return id, nil
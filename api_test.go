@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateUserUpdate(t *testing.T) {
+	str := func(s string) *string { return &s }
+
+	assert.NotNil(t, validateUserUpdate(&UpdateUserRequest{}))
+	assert.NotNil(t, validateUserUpdate(&UpdateUserRequest{Email: str("not-an-email")}))
+	assert.NotNil(t, validateUserUpdate(&UpdateUserRequest{FirstName: str("  ")}))
+	assert.NotNil(t, validateUserUpdate(&UpdateUserRequest{LastName: str("Dr0p")}))
+	assert.NotNil(t, validateUserUpdate(&UpdateUserRequest{PhoneNumber: str("555-1234")}))
+
+	update := &UpdateUserRequest{Email: str(" new@mail.com "), PhoneNumber: str("")}
+	assert.Nil(t, validateUserUpdate(update))
+	assert.Equal(t, "new@mail.com", *update.Email)
+}
+
+func TestHandleUserUpdateRejectsUnknownFields(t *testing.T) {
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "safe@mail.com", 0)
+	server := NewAPIServer(":0", store)
+
+	for _, body := range []string{`{"password":"Hacked1"}`, `{"fk_role":1}`, `{"email":"x@mail.com', fk_role = '1"}`} {
+		req := httptest.NewRequest(http.MethodPut, "/account/1/update", strings.NewReader(body))
+		req = mux.SetURLVars(req, map[string]string{"id": "1"})
+		rec := httptest.NewRecorder()
+
+		makeHTTPHandleFunc(server.handleUserUpdate)(rec, req)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, body)
+	}
+
+	stored, err := store.GetUserByID(user.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "safe@mail.com", stored.Email)
+	assert.Equal(t, Customer, stored.Role)
+}
+
+func TestReadyzDuringShutdown(t *testing.T) {
+	server := NewAPIServer(":0", NewMemoryStore())
+	routes := server.routes()
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		routes.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, ready())
+	server.shuttingDown.Store(true)
+	assert.Equal(t, http.StatusServiceUnavailable, ready())
+}
+
+func TestHandleTransaction(t *testing.T) {
+	useTestJWTSecret(t)
+	store := NewMemoryStore()
+	server := NewAPIServer(":0", store)
+	owner, from := newTestCustomer(t, store, "payer@mail.com", 100_00)
+	stranger, _ := newTestCustomer(t, store, "stranger@mail.com", 0)
+	_, to := newTestCustomer(t, store, "payee@mail.com", 0)
+
+	principal := &Principal{UserID: owner.ID, Role: Customer}
+	transfer := func(req TransactionRequest) int {
+		return postJSON(server.handleTransaction, principal, req).Code
+	}
+
+	assert.Equal(t, http.StatusOK, transfer(TransactionRequest{FromAccount: from.ID, ToAccount: to.ID, Amount: 40_00}))
+	assert.Equal(t, http.StatusUnprocessableEntity, transfer(TransactionRequest{FromAccount: from.ID, ToAccount: to.ID, Amount: 100_00}))
+	assert.Equal(t, http.StatusUnprocessableEntity, transfer(TransactionRequest{FromAccount: from.ID, ToAccount: from.ID, Amount: 1_00}))
+	assert.Equal(t, http.StatusBadRequest, transfer(TransactionRequest{FromAccount: from.ID, ToAccount: to.ID, Amount: 0}))
+
+	// Customers cannot label their transfers as the bank's credits or debits.
+	assert.Equal(t, http.StatusBadRequest, transfer(TransactionRequest{FromAccount: from.ID, ToAccount: to.ID, Amount: 1_00, TransactionType: int(Credit)}))
+	history, _ := store.GetTransactionHistory(to.ID, TransactionFilter{Type: Transfer, Limit: 10})
+	assert.Len(t, history, 1)
+
+	// Only the owner can move money out of an account.
+	principal = &Principal{UserID: stranger.ID, Role: Customer}
+	assert.Equal(t, http.StatusForbidden, transfer(TransactionRequest{FromAccount: from.ID, ToAccount: to.ID, Amount: 1_00}))
+
+	payer, _ := store.GetAccountByID(from.ID)
+	payee, _ := store.GetAccountByID(to.ID)
+	assert.Equal(t, int64(60_00), payer.Balance)
+	assert.Equal(t, int64(40_00), payee.Balance)
+}
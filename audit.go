@@ -0,0 +1,342 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// Audited actions.
+const (
+	AuditLogin            = "user.login"
+	AuditLoginFailed      = "user.login_failed"
+	AuditLoginLockout     = "user.lockout"
+	AuditLoginUnlock      = "user.unlock"
+	AuditLogout           = "user.logout"
+	AuditUserCreate       = "user.create"
+	AuditUserUpdate       = "user.update"
+	AuditUserDeactivate   = "user.deactivate"
+	AuditMFAEnable        = "user.mfa_enable"
+	AuditEmailVerify      = "user.email_verify"
+	AuditPasswordReset    = "user.password_reset"
+	AuditAccountOpen      = "account.open"
+	AuditAccountClose     = "account.close"
+	AuditLimitOverride    = "account.limit_override"
+	AuditCreditLimit      = "account.credit_limit"
+	AuditTransfer         = "transfer.create"
+	AuditScheduleTransfer = "transfer.schedule"
+	AuditJournalReversal  = "journal.reverse"
+	AuditHoldAuthorize    = "hold.authorize"
+	AuditHoldCapture      = "hold.capture"
+	AuditHoldVoid         = "hold.void"
+)
+
+// auditChainLockKey is the Postgres advisory lock held while appending, so
+// that every event links to the one written right before it.
+const auditChainLockKey = 7_261_993_002
+
+// AuditEvent is one append-only row of the audit log. Every event stores the
+// hash of the event before it, so editing, removing or reordering rows breaks
+// the chain. Changes is kept as the exact JSON that was hashed.
+type AuditEvent struct {
+	ID         int             `json:"id"`
+	CreatedAt  time.Time       `json:"createdAt"`
+	ActorID    int             `json:"actorId"`
+	ActorRole  Role            `json:"actorRole"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"targetType"`
+	TargetID   string          `json:"targetId"`
+	Changes    json.RawMessage `json:"changes,omitempty"`
+	IP         string          `json:"ip"`
+	RequestID  string          `json:"requestId"`
+	PrevHash   string          `json:"prevHash"`
+	Hash       string          `json:"hash"`
+}
+
+// AuditChange is the value of one field before and after an action.
+type AuditChange struct {
+	Before any `json:"before"`
+	After  any `json:"after"`
+}
+
+// AuditFilter narrows the audit log. Zero values mean "no filter". Cursor is
+// the id of the last row of the previous page; only older rows are returned.
+type AuditFilter struct {
+	ActorID    int
+	Action     string
+	TargetType string
+	TargetID   string
+	From       time.Time
+	To         time.Time
+	Cursor     int
+	Limit      int
+}
+
+type AuditPage struct {
+	Events     []*AuditEvent `json:"events"`
+	NextCursor string        `json:"nextCursor,omitempty"`
+}
+
+// computeHash hashes the event's content together with prevHash. The fields
+// are encoded as a JSON array so no two events can produce the same input.
+func (e *AuditEvent) computeHash(prevHash string) string {
+	fields, _ := json.Marshal([]string{
+		prevHash,
+		e.CreatedAt.UTC().Format(time.RFC3339Nano),
+		strconv.Itoa(e.ActorID),
+		strconv.Itoa(int(e.ActorRole)),
+		e.Action,
+		e.TargetType,
+		e.TargetID,
+		string(e.Changes),
+		e.IP,
+		e.RequestID,
+	})
+
+	sum := sha256.Sum256(fields)
+	return hex.EncodeToString(sum[:])
+}
+
+// seal links the event to the previous one. Stores call it while holding the
+// lock on the end of the chain.
+func (e *AuditEvent) seal(prevHash string) {
+	// Postgres keeps microseconds, so hash what will be read back.
+	e.CreatedAt = e.CreatedAt.UTC().Truncate(time.Microsecond)
+	e.PrevHash = prevHash
+	e.Hash = e.computeHash(prevHash)
+}
+
+// auditChanges is the JSON of the fields that differ between before and
+// after, which are structs of the same type or nil. Fields hidden from JSON,
+// like the password hash, never appear.
+func auditChanges(before, after any) json.RawMessage {
+	toMap := func(v any) map[string]any {
+		m := map[string]any{}
+		if v == nil || (reflect.ValueOf(v).Kind() == reflect.Pointer && reflect.ValueOf(v).IsNil()) {
+			return m
+		}
+		b, err := json.Marshal(v)
+		if err == nil {
+			json.Unmarshal(b, &m)
+		}
+		return m
+	}
+
+	beforeMap, afterMap := toMap(before), toMap(after)
+	changes := map[string]AuditChange{}
+	for k, v := range beforeMap {
+		if !reflect.DeepEqual(v, afterMap[k]) {
+			changes[k] = AuditChange{Before: v, After: afterMap[k]}
+		}
+	}
+	for k, v := range afterMap {
+		if _, ok := beforeMap[k]; !ok {
+			changes[k] = AuditChange{After: v}
+		}
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	b, _ := json.Marshal(changes)
+	return b
+}
+
+// verifyAuditChain walks the whole audit log in order and returns how many
+// events it checked, or an error naming the first event that does not match.
+func verifyAuditChain(store Storage) (int, error) {
+	const batchSize = 500
+
+	prevHash := ""
+	afterID := 0
+	checked := 0
+
+	for {
+		events, err := store.GetAuditChain(afterID, batchSize)
+		if err != nil {
+			return checked, err
+		}
+
+		for _, event := range events {
+			if event.PrevHash != prevHash {
+				return checked, fmt.Errorf("Audit event %d does not link to the event before it", event.ID)
+			}
+			if event.computeHash(prevHash) != event.Hash {
+				return checked, fmt.Errorf("Audit event %d was modified", event.ID)
+			}
+			prevHash = event.Hash
+			afterID = event.ID
+			checked++
+		}
+
+		if len(events) < batchSize {
+			return checked, nil
+		}
+	}
+}
+
+// about points the event at the target and records what changed. Stores use
+// it for events written in the same transaction as the action, once the
+// target's ID and final state are known. A nil event stays nil.
+func (e *AuditEvent) about(targetID int, before, after any) *AuditEvent {
+	if e == nil {
+		return nil
+	}
+	e.TargetID = strconv.Itoa(targetID)
+	e.Changes = auditChanges(before, after)
+	return e
+}
+
+// auditEvent fills in who made the request through r, and from where. The
+// actor is the caller unless the event already names one, as for a login.
+func (s *APIServer) auditEvent(r *http.Request, event *AuditEvent) *AuditEvent {
+	if p := principalFromContext(r.Context()); p != nil && event.ActorID == 0 {
+		event.ActorID = p.UserID
+		event.ActorRole = p.Role
+	}
+
+	event.CreatedAt = s.now()
+	event.IP = clientIP(r)
+	event.RequestID = requestIDFromContext(r.Context())
+
+	return event
+}
+
+// audit records an action taken through r after it has happened. Money
+// movements and limit overrides pass their event to the store instead, so
+// that it is written in the same transaction.
+func (s *APIServer) audit(r *http.Request, event *AuditEvent) {
+	s.auditEvent(r, event)
+
+	if err := s.store.AppendAuditEvent(event); err != nil {
+		log.Printf("Writing audit event %s for %s %s failed: %v", event.Action, event.TargetType, event.TargetID, err)
+	}
+}
+
+// clientIP is the address the request came from. Forwarding headers are not
+// trusted, since any client can set them.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func parseAuditFilter(query url.Values) (AuditFilter, error) {
+	filter := AuditFilter{
+		Action:     query.Get("action"),
+		TargetType: query.Get("targetType"),
+		TargetID:   query.Get("targetId"),
+		Limit:      defaultHistoryLimit,
+	}
+
+	if v := query.Get("actor"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, invalidField("actor", "Invalid actor %s", v)
+		}
+		filter.ActorID = id
+	}
+
+	if v := query.Get("from"); v != "" {
+		from, _, err := parseHistoryTime(v)
+		if err != nil {
+			return filter, invalidField("from", "Invalid from date %s", v)
+		}
+		filter.From = from
+	}
+
+	if v := query.Get("to"); v != "" {
+		to, dateOnly, err := parseHistoryTime(v)
+		if err != nil {
+			return filter, invalidField("to", "Invalid to date %s", v)
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		filter.To = to
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.Cursor = cursor
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return filter, invalidField("limit", "Invalid limit %s", v)
+		}
+		if limit > maxHistoryLimit {
+			limit = maxHistoryLimit
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+func (f AuditFilter) matches(e *AuditEvent) bool {
+	if f.ActorID != 0 && e.ActorID != f.ActorID {
+		return false
+	}
+	if f.Action != "" && e.Action != f.Action {
+		return false
+	}
+	if f.TargetType != "" && e.TargetType != f.TargetType {
+		return false
+	}
+	if f.TargetID != "" && e.TargetID != f.TargetID {
+		return false
+	}
+	if !f.From.IsZero() && e.CreatedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !e.CreatedAt.Before(f.To) {
+		return false
+	}
+	if f.Cursor != 0 && e.ID >= f.Cursor {
+		return false
+	}
+	return true
+}
+
+// GET /admin/audit
+func (s *APIServer) handleGetAuditLog(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+
+	filter, err := parseAuditFilter(r.URL.Query())
+	if err != nil {
+		return err
+	}
+
+	pageSize := filter.Limit
+	filter.Limit = pageSize + 1
+
+	events, err := s.store.GetAuditEvents(filter)
+	if err != nil {
+		return err
+	}
+
+	page := AuditPage{Events: events}
+	if len(events) > pageSize {
+		page.Events = events[:pageSize]
+		page.NextCursor = encodeCursor(page.Events[pageSize-1].ID)
+	}
+
+	return WriteJSON(w, http.StatusOK, page)
+}
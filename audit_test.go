@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditChanges(t *testing.T) {
+	before := &User{ID: 1, Email: "old@mail.com", FirstName: "Ann", Password: "hash-one"}
+	after := &User{ID: 1, Email: "new@mail.com", FirstName: "Ann", Password: "hash-two"}
+
+	changes := map[string]AuditChange{}
+	assert.Nil(t, json.Unmarshal(auditChanges(before, after), &changes))
+
+	assert.Len(t, changes, 1)
+	assert.Equal(t, "old@mail.com", changes["email"].Before)
+	assert.Equal(t, "new@mail.com", changes["email"].After)
+	assert.Nil(t, auditChanges(before, before))
+}
+
+func TestAuditChainDetectsTampering(t *testing.T) {
+	store := NewMemoryStore()
+	for _, action := range []string{AuditLogin, AuditTransfer, AuditLogout} {
+		assert.Nil(t, store.AppendAuditEvent(&AuditEvent{ActorID: 1, Action: action, TargetType: "user", TargetID: "1"}))
+	}
+
+	checked, err := verifyAuditChain(store)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, checked)
+
+	store.auditLog[1].TargetID = "2"
+	checked, err = verifyAuditChain(store)
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, checked)
+}
+
+func TestUserUpdateIsAudited(t *testing.T) {
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "audited@mail.com", 0)
+	server := NewAPIServer(":0", store)
+
+	req := httptest.NewRequest(http.MethodPut, "/account/1/update", strings.NewReader(`{"firstName":"Changed"}`))
+	req = mux.SetURLVars(req, map[string]string{"id": "1"})
+	req = req.WithContext(withPrincipal(req.Context(), &Principal{UserID: user.ID, Role: Customer}))
+	rec := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleUserUpdate)(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	events, err := store.GetAuditEvents(AuditFilter{Action: AuditUserUpdate})
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, user.ID, events[0].ActorID)
+	assert.Equal(t, "1", events[0].TargetID)
+	assert.Contains(t, string(events[0].Changes), "Changed")
+	assert.NotContains(t, string(events[0].Changes), "password")
+}
+
+func TestTransferIsAuditedWithTheTransfer(t *testing.T) {
+	store := NewMemoryStore()
+	_, from := newTestCustomer(t, store, "payer@mail.com", 100)
+	_, to := newTestCustomer(t, store, "payee@mail.com", 0)
+
+	_, err := store.Transfer(from.ID, to.ID, 500, Transfer, "", &AuditEvent{ActorID: 1, Action: AuditTransfer, TargetType: "transaction"})
+	assert.NotNil(t, err)
+
+	events, err := store.GetAuditEvents(AuditFilter{Action: AuditTransfer})
+	assert.Nil(t, err)
+	assert.Len(t, events, 0)
+
+	transaction, err := store.Transfer(from.ID, to.ID, 40, Transfer, "", &AuditEvent{ActorID: 1, Action: AuditTransfer, TargetType: "transaction"})
+	assert.Nil(t, err)
+
+	events, err = store.GetAuditEvents(AuditFilter{Action: AuditTransfer})
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, strconv.Itoa(transaction.ID), events[0].TargetID)
+	assert.Contains(t, string(events[0].Changes), `"amount"`)
+}
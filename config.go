@@ -0,0 +1,349 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[redacted]"
+
+// Config is everything the server needs to start. It is built from the
+// defaults, then a YAML file, then environment variables and finally command
+// line flags, each overriding the one before.
+type Config struct {
+	ListenAddress string          `yaml:"listenAddress"`
+	Store         string          `yaml:"store"`
+	JWTSecret     string          `yaml:"jwtSecret"`
+	Server        ServerConfig    `yaml:"server"`
+	Database      DatabaseConfig  `yaml:"database"`
+	Interest      InterestConfig  `yaml:"interest"`
+	Scheduler     SchedulerConfig `yaml:"scheduler"`
+	Limits        []LimitRule     `yaml:"limits"`
+	FX            FXConfig        `yaml:"fx"`
+	Credit        CreditProduct   `yaml:"credit"`
+	Referral      ReferralProgram `yaml:"referral"`
+	Mail          MailConfig      `yaml:"mail"`
+	Login         LoginPolicy     `yaml:"login"`
+}
+
+// ServerConfig bounds how long a client may hold a connection, and how long
+// shutdown waits for requests in flight.
+type ServerConfig struct {
+	ReadTimeout       time.Duration `yaml:"readTimeout"`
+	ReadHeaderTimeout time.Duration `yaml:"readHeaderTimeout"`
+	WriteTimeout      time.Duration `yaml:"writeTimeout"`
+	IdleTimeout       time.Duration `yaml:"idleTimeout"`
+	ShutdownTimeout   time.Duration `yaml:"shutdownTimeout"`
+}
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	Name     string `yaml:"name"`
+	SSLMode  string `yaml:"sslMode"`
+}
+
+// SchedulerConfig sets how often due scheduled transfers are looked for.
+type SchedulerConfig struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// FXConfig sets where exchange rates come from and the spread taken on every
+// conversion, in basis points of the mid rate. Without a rates file, transfers
+// between currencies are refused.
+type FXConfig struct {
+	RatesFile string `yaml:"ratesFile"`
+	SpreadBps int    `yaml:"spreadBps"`
+}
+
+// MailConfig sets how mail to users is sent and the address of the web app
+// its links point to. Without an SMTP host, mail is appended to File, or
+// logged when no file is set.
+type MailConfig struct {
+	From      string     `yaml:"from"`
+	PublicURL string     `yaml:"publicURL"`
+	File      string     `yaml:"file"`
+	SMTP      SMTPConfig `yaml:"smtp"`
+}
+
+type SMTPConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+type InterestConfig struct {
+	Interval time.Duration     `yaml:"interval"`
+	Products []InterestProduct `yaml:"products"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		ListenAddress: ":3030",
+		Store:         "postgres",
+		Server: ServerConfig{
+			ReadTimeout:       10 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       2 * time.Minute,
+			ShutdownTimeout:   30 * time.Second,
+		},
+		Database: DatabaseConfig{
+			Host:     "localhost",
+			Port:     5432,
+			User:     "postgres",
+			Password: "postgres",
+			Name:     "gobank",
+			SSLMode:  "disable",
+		},
+		Interest: InterestConfig{
+			Interval: time.Hour,
+			Products: defaultInterestProducts,
+		},
+		Scheduler: SchedulerConfig{
+			Interval: time.Minute,
+		},
+		Limits: defaultLimitRules,
+		FX: FXConfig{
+			SpreadBps: 50,
+		},
+		Credit:   defaultCreditProduct,
+		Referral: defaultReferralProgram,
+		Login:    defaultLoginPolicy,
+		Mail: MailConfig{
+			From:      "no-reply@go-bank.local",
+			PublicURL: "http://localhost:3000",
+			SMTP: SMTPConfig{
+				Port: 587,
+			},
+		},
+	}
+}
+
+// LoadConfig reads the YAML file at path, when given, over the defaults and
+// then applies the environment. Flags are applied by the caller.
+func LoadConfig(path string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg := defaultConfig()
+
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		// Products and limits in the file replace the defaults rather
+		// than merging into them.
+		cfg.Interest.Products = nil
+		cfg.Limits = nil
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			return nil, fmt.Errorf("Config file %s: %w", path, err)
+		}
+		if cfg.Interest.Products == nil {
+			cfg.Interest.Products = defaultInterestProducts
+		}
+		if cfg.Limits == nil {
+			cfg.Limits = defaultLimitRules
+		}
+	}
+
+	if err := cfg.applyEnv(lookupEnv); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) applyEnv(lookupEnv func(string) (string, bool)) error {
+	fields := map[string]*string{
+		"GOBANK_LISTEN_ADDRESS": &c.ListenAddress,
+		"GOBANK_STORE":          &c.Store,
+		"JWT_SECRET":            &c.JWTSecret,
+		"GOBANK_DB_HOST":        &c.Database.Host,
+		"GOBANK_DB_USER":        &c.Database.User,
+		"GOBANK_DB_PASSWORD":    &c.Database.Password,
+		"GOBANK_DB_NAME":        &c.Database.Name,
+		"GOBANK_DB_SSLMODE":     &c.Database.SSLMode,
+		"GOBANK_FX_RATES_FILE":  &c.FX.RatesFile,
+		"GOBANK_MAIL_FILE":      &c.Mail.File,
+		"GOBANK_SMTP_HOST":      &c.Mail.SMTP.Host,
+		"GOBANK_SMTP_USERNAME":  &c.Mail.SMTP.Username,
+		"GOBANK_SMTP_PASSWORD":  &c.Mail.SMTP.Password,
+	}
+	for name, field := range fields {
+		if v, ok := lookupEnv(name); ok {
+			*field = v
+		}
+	}
+
+	if v, ok := lookupEnv("GOBANK_DB_PORT"); ok {
+		port, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("GOBANK_DB_PORT must be a number, given %s", v)
+		}
+		c.Database.Port = port
+	}
+
+	if v, ok := lookupEnv("GOBANK_SCHEDULER_INTERVAL"); ok {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("GOBANK_SCHEDULER_INTERVAL must be a duration, given %s", v)
+		}
+		c.Scheduler.Interval = interval
+	}
+
+	if v, ok := lookupEnv("GOBANK_INTEREST_INTERVAL"); ok {
+		interval, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("GOBANK_INTEREST_INTERVAL must be a duration, given %s", v)
+		}
+		c.Interest.Interval = interval
+	}
+
+	return nil
+}
+
+// Validate checks the configuration needed to serve requests.
+func (c *Config) Validate() error {
+	if strings.TrimSpace(c.JWTSecret) == "" {
+		return fmt.Errorf("No JWT secret configured, set jwtSecret in the config file or JWT_SECRET")
+	}
+	if c.ListenAddress == "" {
+		return fmt.Errorf("No listen address configured")
+	}
+	timeouts := []time.Duration{c.Server.ReadTimeout, c.Server.ReadHeaderTimeout, c.Server.WriteTimeout, c.Server.IdleTimeout, c.Server.ShutdownTimeout}
+	for _, timeout := range timeouts {
+		if timeout <= 0 {
+			return fmt.Errorf("Server timeouts must be positive")
+		}
+	}
+	if c.Interest.Interval <= 0 {
+		return fmt.Errorf("Interest interval must be positive")
+	}
+	if c.Scheduler.Interval <= 0 {
+		return fmt.Errorf("Scheduler interval must be positive")
+	}
+	if c.FX.SpreadBps < 0 || c.FX.SpreadBps >= 10_000 {
+		return fmt.Errorf("FX spread must be between 0 and 9999 basis points")
+	}
+	if _, err := mail.ParseAddress(c.Mail.From); err != nil {
+		return fmt.Errorf("Mail from address %q is not valid", c.Mail.From)
+	}
+	if u, err := url.Parse(c.Mail.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("Mail public URL %q must be an absolute URL", c.Mail.PublicURL)
+	}
+	for _, product := range c.Interest.Products {
+		if err := product.Validate(); err != nil {
+			return err
+		}
+	}
+	if err := c.Credit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Referral.Validate(); err != nil {
+		return err
+	}
+	if err := c.Login.Validate(); err != nil {
+		return err
+	}
+	for i, rule := range c.Limits {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("Limit rule %d: %w", i+1, err)
+		}
+	}
+
+	return c.validateStore()
+}
+
+func (c *Config) validateStore() error {
+	switch c.Store {
+	case "memory":
+		return nil
+	case "postgres":
+		if c.Database.Host == "" || c.Database.Name == "" || c.Database.User == "" {
+			return fmt.Errorf("Database host, name and user are required")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown store %q, use 'postgres' or 'memory'", c.Store)
+}
+
+// Redacted is a copy of the configuration that is safe to print.
+func (c *Config) Redacted() *Config {
+	copied := *c
+	if copied.JWTSecret != "" {
+		copied.JWTSecret = redacted
+	}
+	if copied.Database.Password != "" {
+		copied.Database.Password = redacted
+	}
+	if copied.Mail.SMTP.Password != "" {
+		copied.Mail.SMTP.Password = redacted
+	}
+	return &copied
+}
+
+// DSN is the lib/pq connection string for the database.
+func (d DatabaseConfig) DSN() string {
+	params := []struct{ key, value string }{
+		{"host", d.Host},
+		{"port", strconv.Itoa(d.Port)},
+		{"user", d.User},
+		{"password", d.Password},
+		{"dbname", d.Name},
+		{"sslmode", d.SSLMode},
+	}
+
+	parts := []string{}
+	for _, p := range params {
+		if p.value == "" {
+			continue
+		}
+		escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(p.value)
+		parts = append(parts, p.key+"='"+escaped+"'")
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func (t AccountType) MarshalYAML() (interface{}, error) {
+	return t.String(), nil
+}
+
+// UnmarshalYAML accepts an account type by name or by id.
+func (t *AccountType) UnmarshalYAML(value *yaml.Node) error {
+	if id, err := strconv.Atoi(value.Value); err == nil {
+		*t = AccountType(id)
+		return nil
+	}
+
+	parsed, err := parseAccountType(value.Value)
+	if err != nil {
+		return err
+	}
+	*t = parsed
+	return nil
+}
+
+func (r Role) MarshalYAML() (interface{}, error) {
+	return r.String(), nil
+}
+
+func (r *Role) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := parseRole(value.Value)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`listenAddress: ":8080"
+jwtSecret: from-file
+database:
+  host: db.internal
+  password: file-password
+interest:
+  interval: 30m
+  products:
+    - name: Bonus Savings
+      accountType: Savings
+      compounding: daily
+      tiers:
+        - minBalance: 0
+          apyBasisPoints: 400
+`), 0o600)
+	assert.Nil(t, err)
+
+	cfg, err := LoadConfig(path, env(map[string]string{"JWT_SECRET": "from-env", "GOBANK_DB_PORT": "6543"}))
+	assert.Nil(t, err)
+
+	assert.Equal(t, ":8080", cfg.ListenAddress)
+	assert.Equal(t, "from-env", cfg.JWTSecret)
+	assert.Equal(t, "db.internal", cfg.Database.Host)
+	assert.Equal(t, 6543, cfg.Database.Port)
+	assert.Equal(t, "gobank", cfg.Database.Name)
+	assert.Equal(t, 30*time.Minute, cfg.Interest.Interval)
+	assert.Len(t, cfg.Interest.Products, 1)
+	assert.Equal(t, Savings, cfg.Interest.Products[0].AccountType)
+	assert.Nil(t, cfg.Validate())
+
+	redactedCfg := cfg.Redacted()
+	assert.Equal(t, redacted, redactedCfg.JWTSecret)
+	assert.Equal(t, redacted, redactedCfg.Database.Password)
+	assert.Equal(t, "from-env", cfg.JWTSecret)
+}
+
+func TestConfigRequiresJWTSecret(t *testing.T) {
+	cfg, err := LoadConfig("", env(nil))
+	assert.Nil(t, err)
+	assert.NotNil(t, cfg.Validate())
+
+	cfg.JWTSecret = "secret"
+	assert.Nil(t, cfg.Validate())
+}
+
+func TestDatabaseDSNEscapes(t *testing.T) {
+	dsn := DatabaseConfig{Host: "localhost", Port: 5432, User: "bank", Password: `it's a \secret`, Name: "gobank"}.DSN()
+	assert.Equal(t, `host='localhost' port='5432' user='bank' password='it\'s a \\secret' dbname='gobank'`, dsn)
+}
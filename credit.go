@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// System accounts that receive what credit accounts are charged.
+const (
+	systemCreditInterest = "credit_interest_income"
+	systemCreditFees     = "credit_fee_income"
+)
+
+// CreditProduct is the terms of every Credit account. A Credit account's
+// balance goes negative as it is spent, down to minus its credit limit.
+// Billing cycles are calendar months in UTC; at the end of each one the
+// amount owed becomes the statement balance and a minimum payment is due
+// GraceDays later. Interest at APRBasisPoints (2499 is 24.99%) is charged on
+// the daily balances of a cycle only when the previous statement was not paid
+// in full by its due date, and LateFee is charged when less than the minimum
+// payment arrived by then.
+type CreditProduct struct {
+	DefaultLimit      int64 `json:"defaultLimit" yaml:"defaultLimit"`
+	APRBasisPoints    int64 `json:"aprBasisPoints" yaml:"aprBasisPoints"`
+	MinimumPaymentBps int64 `json:"minimumPaymentBps" yaml:"minimumPaymentBps"`
+	MinimumPayment    int64 `json:"minimumPayment" yaml:"minimumPayment"`
+	LateFee           int64 `json:"lateFee" yaml:"lateFee"`
+	GraceDays         int   `json:"graceDays" yaml:"graceDays"`
+}
+
+// CreditCycle is one closed billing cycle of a Credit account. It is settled
+// once its due date has passed and the payments made by then are known.
+type CreditCycle struct {
+	AccountID        int       `json:"accountId"`
+	Period           string    `json:"period"`
+	ClosedAt         time.Time `json:"closedAt"`
+	StatementBalance int64     `json:"statementBalance"`
+	MinimumPayment   int64     `json:"minimumPayment"`
+	InterestCharged  int64     `json:"interestCharged"`
+	DueDate          time.Time `json:"dueDate"`
+	Settled          bool      `json:"settled"`
+	PaidByDue        int64     `json:"paidByDue"`
+	LateFee          int64     `json:"lateFee"`
+}
+
+// CreditSummary is where a Credit account stands, with its cycles newest
+// first.
+type CreditSummary struct {
+	AccountID       int            `json:"accountId"`
+	CreditLimit     int64          `json:"creditLimit"`
+	Owed            int64          `json:"owed"`
+	AvailableCredit int64          `json:"availableCredit"`
+	APRBasisPoints  int64          `json:"aprBasisPoints"`
+	Cycles          []*CreditCycle `json:"cycles"`
+}
+
+type CreditLimitRequest struct {
+	CreditLimit int64 `json:"creditLimit"`
+}
+
+var defaultCreditProduct = CreditProduct{
+	DefaultLimit:      1_000_00,
+	APRBasisPoints:    2499,
+	MinimumPaymentBps: 300,
+	MinimumPayment:    25_00,
+	LateFee:           29_00,
+	GraceDays:         25,
+}
+
+func (p CreditProduct) Validate() error {
+	if p.DefaultLimit < 0 || p.APRBasisPoints < 0 || p.MinimumPaymentBps < 0 || p.MinimumPayment < 0 || p.LateFee < 0 {
+		return fmt.Errorf("Credit terms cannot be negative")
+	}
+	// A cycle's payment must be due before the next cycle closes, so its
+	// interest can depend on it.
+	if p.GraceDays < 1 || p.GraceDays > 27 {
+		return fmt.Errorf("Credit grace days must be between 1 and 27")
+	}
+	return nil
+}
+
+// minimumPayment is the larger of the floor and the percentage of the
+// statement balance, but never more than the statement balance.
+func (p CreditProduct) minimumPayment(statementBalance int64) int64 {
+	return min(statementBalance, max(p.MinimumPayment, (statementBalance*p.MinimumPaymentBps+5_000)/10_000))
+}
+
+// interest is the APR charged on a sum of daily balances owed, rounded to the
+// nearest minor unit.
+func (p CreditProduct) interest(owedDays int64) int64 {
+	return (owedDays*p.APRBasisPoints + 365*10_000/2) / (365 * 10_000)
+}
+
+// CreditEngine closes billing cycles and settles them once they are due. Like
+// the interest engine it keeps no state of its own, so after downtime CatchUp
+// works through every missed cycle in order.
+type CreditEngine struct {
+	store   Storage
+	product CreditProduct
+	now     func() time.Time
+}
+
+func NewCreditEngine(store Storage, product CreditProduct) *CreditEngine {
+	return &CreditEngine{
+		store:   store,
+		product: product,
+		now:     time.Now,
+	}
+}
+
+// Run catches up once and then again every interval until ctx is done.
+func (e *CreditEngine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.CatchUp(); err != nil {
+			log.Println("Credit billing failed:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CatchUp bills every Credit account. One that fails is logged and caught up
+// next time rather than holding up the accounts after it.
+func (e *CreditEngine) CatchUp() error {
+	accounts, err := e.store.GetAccountsByType(CreditAccount)
+	if err != nil {
+		return err
+	}
+
+	now := e.now().UTC()
+	for _, account := range accounts {
+		if err := e.catchUpAccount(account, now); err != nil {
+			log.Printf("Billing account %d: %v", account.ID, err)
+		}
+	}
+
+	return nil
+}
+
+// catchUpAccount settles every cycle that has fallen due and closes every
+// month that has ended, oldest first, since a cycle's interest depends on
+// whether the one before it was paid.
+func (e *CreditEngine) catchUpAccount(account *Account, now time.Time) error {
+	cycles, err := e.store.GetCreditCycles(account.ID)
+	if err != nil {
+		return err
+	}
+
+	opened := account.CreatedAt.UTC()
+	next := time.Date(opened.Year(), opened.Month(), 1, 0, 0, 0, 0, time.UTC)
+	var previous *CreditCycle
+	if len(cycles) > 0 {
+		previous = cycles[0]
+		last, _ := time.Parse("2006-01", previous.Period)
+		next = last.AddDate(0, 1, 0)
+	}
+
+	for {
+		for i := len(cycles) - 1; i >= 0; i-- {
+			if cycle := cycles[i]; !cycle.Settled && !now.Before(cycle.DueDate) {
+				if err := e.settle(account, cycle); err != nil {
+					return err
+				}
+			}
+		}
+
+		closedAt := next.AddDate(0, 1, 0)
+		if now.Before(closedAt) {
+			return nil
+		}
+
+		cycle, err := e.close(account, next, previous)
+		if err != nil {
+			return err
+		}
+		cycles = append([]*CreditCycle{cycle}, cycles...)
+		previous = cycle
+		next = closedAt
+	}
+}
+
+func (e *CreditEngine) close(account *Account, period time.Time, previous *CreditCycle) (*CreditCycle, error) {
+	closedAt := period.AddDate(0, 1, 0)
+
+	var interest int64
+	if previous != nil && previous.PaidByDue < previous.StatementBalance {
+		var owedDays int64
+		for day := period; day.Before(closedAt); day = day.AddDate(0, 0, 1) {
+			balance, err := e.store.GetBalanceAt(account.ID, day.AddDate(0, 0, 1))
+			if err != nil {
+				return nil, err
+			}
+			owedDays += max(-balance, 0)
+		}
+		interest = e.product.interest(owedDays)
+	}
+
+	balance, err := e.store.GetBalanceAt(account.ID, closedAt)
+	if err != nil {
+		return nil, err
+	}
+	statementBalance := max(-balance, 0) + interest
+
+	cycle := &CreditCycle{
+		AccountID:        account.ID,
+		Period:           period.Format("2006-01"),
+		ClosedAt:         closedAt,
+		StatementBalance: statementBalance,
+		MinimumPayment:   e.product.minimumPayment(statementBalance),
+		InterestCharged:  interest,
+		DueDate:          closedAt.AddDate(0, 0, e.product.GraceDays),
+	}
+	description := "Interest for " + cycle.Period
+	if err := e.store.CloseCreditCycle(cycle, systemCreditInterest, description); err != nil {
+		return nil, err
+	}
+
+	return cycle, nil
+}
+
+func (e *CreditEngine) settle(account *Account, cycle *CreditCycle) error {
+	paid, err := e.store.GetInflow(account.ID, cycle.ClosedAt, cycle.DueDate)
+	if err != nil {
+		return err
+	}
+
+	cycle.Settled = true
+	cycle.PaidByDue = paid
+	if paid < cycle.MinimumPayment {
+		cycle.LateFee = e.product.LateFee
+	}
+
+	description := "Late fee for " + cycle.Period
+	return e.store.SettleCreditCycle(cycle, systemCreditFees, description)
+}
+
+// payBy is the last day a payment counts towards the cycle.
+func (c *CreditCycle) payBy() time.Time {
+	return c.DueDate.Add(-time.Second)
+}
+
+// creditCharge is the value date of a charge made at t, one second before it
+// so it falls inside the cycle or day that t ends.
+func creditCharge(t time.Time) time.Time {
+	return t.Add(-time.Second)
+}
+
+// GET /accounts/{id}/credit
+func (s *APIServer) handleGetCredit(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.store.GetAccountByID(id)
+	if err != nil {
+		return err
+	}
+	if account.AccountType != CreditAccount {
+		return notFound("Account %d is not a Credit account", id)
+	}
+
+	balance, err := s.store.GetAccountBalance(id, s.now().UTC())
+	if err != nil {
+		return err
+	}
+	cycles, err := s.store.GetCreditCycles(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, CreditSummary{
+		AccountID:       id,
+		CreditLimit:     account.CreditLimit,
+		Owed:            max(-account.Balance, 0),
+		AvailableCredit: balance.AvailableBalance,
+		APRBasisPoints:  s.creditProduct.APRBasisPoints,
+		Cycles:          cycles,
+	})
+}
+
+// openingCreditLimit is the limit a new Credit account opened through r
+// starts with. Staff opening one grant the product's default; customers
+// opening their own get none until an admin sets a limit.
+func (s *APIServer) openingCreditLimit(r *http.Request) int64 {
+	if p := principalFromContext(r.Context()); p != nil && p.Role != Customer {
+		return s.creditProduct.DefaultLimit
+	}
+	return 0
+}
+
+// PUT /admin/accounts/{id}/credit-limit
+func (s *APIServer) handleSetCreditLimit(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	req := new(CreditLimitRequest)
+	if err := readJSON(r, req); err != nil {
+		return err
+	}
+	if req.CreditLimit < 0 {
+		return invalidField("creditLimit", "Credit limit cannot be negative")
+	}
+
+	before, err := s.store.GetAccountByID(id)
+	if err != nil {
+		return err
+	}
+	if before.AccountType != CreditAccount {
+		return unprocessable("Account %d is not a Credit account", id)
+	}
+
+	if err := s.store.SetCreditLimit(id, req.CreditLimit); err != nil {
+		return err
+	}
+
+	after := *before
+	after.CreditLimit = req.CreditLimit
+	s.audit(r, &AuditEvent{Action: AuditCreditLimit, TargetType: "account", TargetID: strconv.Itoa(id), Changes: auditChanges(before, &after)})
+
+	return WriteJSON(w, http.StatusOK, &after)
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// transferAt posts a transfer with a value date in the past.
+func transferAt(t *testing.T, store *MemoryStore, from, to int, amount int64, at time.Time) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	_, err := store.transferLocked(from, to, amount, Transfer, "", at)
+	assert.Nil(t, err)
+}
+
+func newTestCreditAccount(t *testing.T, store Storage, userID int, limit int64, createdAt time.Time) *Account {
+	account := NewAccount(userID, CreditAccount, defaultCurrency)
+	account.CreditLimit = limit
+	account.CreatedAt = createdAt
+	assert.Nil(t, store.CreateAccount(account))
+	return account
+}
+
+func TestOpenCreditAccount(t *testing.T) {
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "card@mail.com", 0)
+	_, merchant := newTestCustomer(t, store, "shop@mail.com", 0)
+	server := NewAPIServer(":0", store)
+
+	open := func(principal *Principal) *Account {
+		req := httptest.NewRequest(http.MethodPost, "/user/1/accounts", bytes.NewReader([]byte(`{"accountType":"Credit"}`)))
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(user.ID)})
+		req = req.WithContext(withPrincipal(req.Context(), principal))
+		rec := httptest.NewRecorder()
+		makeHTTPHandleFunc(server.handleOpenAccount)(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+
+		account := new(Account)
+		assert.Nil(t, json.NewDecoder(rec.Body).Decode(account))
+		assert.Equal(t, CreditAccount, account.AccountType)
+		return account
+	}
+
+	// A customer's own Credit account has nothing to spend until an admin
+	// sets a limit.
+	unapproved := open(&Principal{UserID: user.ID, Role: Customer})
+	assert.Equal(t, int64(0), unapproved.CreditLimit)
+	_, err := store.Transfer(unapproved.ID, merchant.ID, 1, Transfer, "", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, problemFor(err).Status)
+
+	credit := open(&Principal{UserID: 99, Role: Admin})
+	assert.Equal(t, defaultCreditProduct.DefaultLimit, credit.CreditLimit)
+
+	// Spending goes negative as far as the limit and no further.
+	_, err = store.Transfer(credit.ID, merchant.ID, 900_00, Transfer, "", nil)
+	assert.Nil(t, err)
+	_, err = store.Transfer(credit.ID, merchant.ID, 100_01, Transfer, "", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, problemFor(err).Status)
+
+	balance, _ := store.GetAccountBalance(credit.ID, time.Now())
+	assert.Equal(t, int64(-900_00), balance.LedgerBalance)
+	assert.Equal(t, int64(100_00), balance.AvailableBalance)
+}
+
+func TestCreditEngineChargesLateFeesAndInterest(t *testing.T) {
+	store := NewMemoryStore()
+	user, checking := newTestCustomer(t, store, "revolver@mail.com", 1_000_00)
+	_, merchant := newTestCustomer(t, store, "store@mail.com", 0)
+	opened := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	revolving := newTestCreditAccount(t, store, user.ID, 1_000_00, opened)
+	paidOff := newTestCreditAccount(t, store, user.ID, 1_000_00, opened)
+
+	transferAt(t, store, revolving.ID, merchant.ID, 300_00, time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC))
+	transferAt(t, store, paidOff.ID, merchant.ID, 200_00, time.Date(2026, 1, 10, 0, 0, 0, 0, time.UTC))
+	transferAt(t, store, checking.ID, paidOff.ID, 200_00, time.Date(2026, 2, 5, 0, 0, 0, 0, time.UTC))
+
+	engine := NewCreditEngine(store, defaultCreditProduct)
+	engine.now = func() time.Time { return time.Date(2026, 3, 1, 1, 0, 0, 0, time.UTC) }
+	assert.Nil(t, engine.CatchUp())
+
+	// January was not paid, so the late fee lands on February 25th and
+	// February is charged interest on its daily balances.
+	cycles, _ := store.GetCreditCycles(revolving.ID)
+	assert.Len(t, cycles, 2)
+	january, february := cycles[1], cycles[0]
+	assert.Equal(t, int64(300_00), january.StatementBalance)
+	assert.Equal(t, int64(25_00), january.MinimumPayment)
+	assert.True(t, january.Settled)
+	assert.Equal(t, int64(29_00), january.LateFee)
+	assert.Equal(t, int64(583), february.InterestCharged)
+	assert.Equal(t, int64(329_00+583), february.StatementBalance)
+	assert.False(t, february.Settled)
+
+	cycles, _ = store.GetCreditCycles(paidOff.ID)
+	assert.Len(t, cycles, 2)
+	assert.Zero(t, cycles[1].LateFee)
+	assert.Zero(t, cycles[0].InterestCharged)
+	assert.Zero(t, cycles[0].StatementBalance)
+
+	// Running again changes nothing.
+	assert.Nil(t, engine.CatchUp())
+	account, _ := store.GetAccountByID(revolving.ID)
+	assert.Equal(t, int64(-(329_00 + 583)), account.Balance)
+}
+
+// brokenCyclesStore fails to read the cycles of one account.
+type brokenCyclesStore struct {
+	Storage
+	broken int
+}
+
+func (s brokenCyclesStore) GetCreditCycles(accountID int) ([]*CreditCycle, error) {
+	if accountID == s.broken {
+		return nil, fmt.Errorf("cycles of account %d are unreadable", accountID)
+	}
+	return s.Storage.GetCreditCycles(accountID)
+}
+
+func TestCreditEngineBillsPastAFailingAccount(t *testing.T) {
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "billed@mail.com", 0)
+	opened := time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	broken := newTestCreditAccount(t, store, user.ID, 1_000_00, opened)
+	billed := newTestCreditAccount(t, store, user.ID, 1_000_00, opened)
+
+	engine := NewCreditEngine(brokenCyclesStore{Storage: store, broken: broken.ID}, defaultCreditProduct)
+	engine.now = func() time.Time { return time.Date(2026, 2, 1, 1, 0, 0, 0, time.UTC) }
+	assert.Nil(t, engine.CatchUp())
+
+	cycles, _ := store.GetCreditCycles(billed.ID)
+	assert.Len(t, cycles, 1)
+}
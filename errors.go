@@ -1,15 +1,243 @@
 package main
 
-import "net/http"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
 
-type apiError struct {
-	Error string `json:"error"`
+// The errors below are the domain errors handlers and stores return. Each
+// maps to one HTTP status; any other error is treated as internal, logged,
+// and answered with a generic 500 so database and library messages never
+// reach the client.
+
+type ValidationError struct {
+	Message string
+	Fields  map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Message != "" {
+		return e.Message
+	}
+
+	fields := make([]string, 0, len(e.Fields))
+	for field := range e.Fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	messages := make([]string, 0, len(fields))
+	for _, field := range fields {
+		messages = append(messages, e.Fields[field])
+	}
+	return strings.Join(messages, "; ")
+}
+
+// add records a problem with field, keeping the first one found.
+func (e *ValidationError) add(field, format string, args ...any) {
+	if e.Fields == nil {
+		e.Fields = map[string]string{}
+	}
+	if _, ok := e.Fields[field]; !ok {
+		e.Fields[field] = fmt.Sprintf(format, args...)
+	}
+}
+
+// orNil returns e when it holds a problem, so validators can collect every
+// field before returning.
+func (e *ValidationError) orNil() error {
+	if e.Message == "" && len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+type NotFoundError struct {
+	Message string
+}
+
+func (e *NotFoundError) Error() string { return e.Message }
+
+type ConflictError struct {
+	Message string
+}
+
+func (e *ConflictError) Error() string { return e.Message }
+
+// UnprocessableError is a well formed request that breaks a business rule,
+// such as spending more than the balance.
+type UnprocessableError struct {
+	Message string
 }
 
-func permissionDenied(w http.ResponseWriter) {
-	WriteJSON(w, http.StatusForbidden, apiError{Error: "Permission Denied"})
+func (e *UnprocessableError) Error() string { return e.Message }
+
+type UnauthorizedError struct {
+	Message string
+}
+
+func (e *UnauthorizedError) Error() string { return e.Message }
+
+// LimitExceededError is a transfer refused by a limit. Code says which one.
+type LimitExceededError struct {
+	Code    string
+	Message string
+}
+
+func (e *LimitExceededError) Error() string { return e.Message }
+
+// TooManyRequestsError asks the client to wait RetryAfter before trying again.
+type TooManyRequestsError struct {
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *TooManyRequestsError) Error() string { return e.Message }
+
+type ForbiddenError struct {
+	Message string
+}
+
+func (e *ForbiddenError) Error() string { return e.Message }
+
+type MethodNotAllowedError struct {
+	Method string
+}
+
+func (e *MethodNotAllowedError) Error() string { return "Method not allowed " + e.Method }
+
+// InternalError wraps a failure whose details must stay in the logs.
+type InternalError struct {
+	Err error
+}
+
+func (e *InternalError) Error() string { return e.Err.Error() }
+
+func (e *InternalError) Unwrap() error { return e.Err }
+
+func invalid(format string, args ...any) error {
+	return &ValidationError{Message: fmt.Sprintf(format, args...)}
+}
+
+func invalidField(field, format string, args ...any) error {
+	e := &ValidationError{}
+	e.add(field, format, args...)
+	return e
+}
+
+func notFound(format string, args ...any) error {
+	return &NotFoundError{Message: fmt.Sprintf(format, args...)}
+}
+
+func conflict(format string, args ...any) error {
+	return &ConflictError{Message: fmt.Sprintf(format, args...)}
+}
+
+func unprocessable(format string, args ...any) error {
+	return &UnprocessableError{Message: fmt.Sprintf(format, args...)}
+}
+
+func unauthorized(format string, args ...any) error {
+	return &UnauthorizedError{Message: fmt.Sprintf(format, args...)}
+}
+
+func limitExceeded(code, format string, args ...any) error {
+	return &LimitExceededError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func tooManyRequests(retryAfter time.Duration, format string, args ...any) error {
+	return &TooManyRequestsError{Message: fmt.Sprintf(format, args...), RetryAfter: retryAfter}
+}
+
+func forbidden(format string, args ...any) error {
+	return &ForbiddenError{Message: fmt.Sprintf(format, args...)}
+}
+
+func methodNotAllowed(method string) error {
+	return &MethodNotAllowedError{Method: method}
+}
+
+// Problem is an RFC 7807 problem details body.
+type Problem struct {
+	Type      string            `json:"type"`
+	Title     string            `json:"title"`
+	Status    int               `json:"status"`
+	Detail    string            `json:"detail,omitempty"`
+	Instance  string            `json:"instance,omitempty"`
+	RequestID string            `json:"requestId,omitempty"`
+	Code      string            `json:"code,omitempty"`
+	Errors    map[string]string `json:"errors,omitempty"`
+}
+
+// problemFor maps err to the problem sent to the client.
+func problemFor(err error) Problem {
+	var (
+		validation    *ValidationError
+		notFoundErr   *NotFoundError
+		conflictErr   *ConflictError
+		unprocessErr  *UnprocessableError
+		limitErr      *LimitExceededError
+		unauthorizErr *UnauthorizedError
+		forbiddenErr  *ForbiddenError
+		tooManyErr    *TooManyRequestsError
+		methodErr     *MethodNotAllowedError
+	)
+
+	switch {
+	case errors.As(err, &validation):
+		return Problem{Type: "/problems/validation", Status: http.StatusBadRequest, Detail: validation.Error(), Errors: validation.Fields}
+	case errors.As(err, &notFoundErr):
+		return Problem{Type: "/problems/not-found", Status: http.StatusNotFound, Detail: notFoundErr.Error()}
+	case errors.As(err, &conflictErr):
+		return Problem{Type: "/problems/conflict", Status: http.StatusConflict, Detail: conflictErr.Error()}
+	case errors.As(err, &limitErr):
+		return Problem{Type: "/problems/limit-exceeded", Status: http.StatusUnprocessableEntity, Detail: limitErr.Error(), Code: limitErr.Code}
+	case errors.As(err, &unprocessErr):
+		return Problem{Type: "/problems/unprocessable", Status: http.StatusUnprocessableEntity, Detail: unprocessErr.Error()}
+	case errors.As(err, &unauthorizErr):
+		return Problem{Type: "/problems/unauthorized", Status: http.StatusUnauthorized, Detail: unauthorizErr.Error()}
+	case errors.As(err, &forbiddenErr):
+		return Problem{Type: "/problems/forbidden", Status: http.StatusForbidden, Detail: forbiddenErr.Error()}
+	case errors.As(err, &tooManyErr):
+		return Problem{Type: "/problems/too-many-requests", Status: http.StatusTooManyRequests, Detail: tooManyErr.Error()}
+	case errors.As(err, &methodErr):
+		return Problem{Type: "/problems/method-not-allowed", Status: http.StatusMethodNotAllowed, Detail: methodErr.Error()}
+	default:
+		return Problem{Type: "/problems/internal", Status: http.StatusInternalServerError, Detail: "An unexpected error occurred"}
+	}
+}
+
+// writeError answers the request with the problem for err. Internal errors
+// are logged with the request id so a client report can be traced.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	problem := problemFor(err)
+	problem.Title = http.StatusText(problem.Status)
+	problem.Instance = r.URL.Path
+	problem.RequestID = requestIDFromContext(r.Context())
+
+	if problem.Status >= http.StatusInternalServerError {
+		log.Printf("Request %s %s %s failed: %v", problem.RequestID, r.Method, r.URL.Path, err)
+	}
+
+	var tooMany *TooManyRequestsError
+	if errors.As(err, &tooMany) {
+		seconds := int(math.Ceil(tooMany.RetryAfter.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(problem.Status)
+	json.NewEncoder(w).Encode(problem)
 }
 
-func invalidMethod(w http.ResponseWriter) {
-	WriteJSON(w, http.StatusForbidden, apiError{Error: "Invalid Method Used"})
+func permissionDenied(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, forbidden("Permission Denied"))
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProblemStatus(t *testing.T) {
+	cases := map[error]int{
+		invalid("Bad"):                          http.StatusBadRequest,
+		notFound("Account %d not found", 1):     http.StatusNotFound,
+		conflict("Email in use"):                http.StatusConflict,
+		unprocessable("Insufficient funds"):     http.StatusUnprocessableEntity,
+		unauthorized("Invalid token"):           http.StatusUnauthorized,
+		forbidden("Permission Denied"):          http.StatusForbidden,
+		methodNotAllowed("PATCH"):               http.StatusMethodNotAllowed,
+		fmt.Errorf("wrapped: %w", notFound("")): http.StatusNotFound,
+		sql.ErrConnDone:                         http.StatusInternalServerError,
+	}
+
+	for err, status := range cases {
+		assert.Equal(t, status, problemFor(err).Status, err.Error())
+	}
+}
+
+func TestWriteErrorHidesInternalErrors(t *testing.T) {
+	h := withRequestID(makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		return fmt.Errorf("pq: password authentication failed for user \"postgres\"")
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/account", nil)
+	req.Header.Set(requestIDHeader, "abc-123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	assert.Equal(t, "application/problem+json", rec.Header().Get("Content-Type"))
+	assert.Equal(t, "abc-123", rec.Header().Get(requestIDHeader))
+	assert.NotContains(t, rec.Body.String(), "postgres")
+
+	problem := new(Problem)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(problem))
+	assert.Equal(t, "abc-123", problem.RequestID)
+	assert.Equal(t, "/account", problem.Instance)
+}
+
+func TestValidationErrorFields(t *testing.T) {
+	err := validateUserInfo(&User{Email: "nope", FirstName: "J0hn", LastName: "Doe"})
+
+	problem := problemFor(err)
+	assert.Equal(t, http.StatusBadRequest, problem.Status)
+	assert.Contains(t, problem.Errors, "email")
+	assert.Contains(t, problem.Errors, "firstName")
+	assert.NotContains(t, problem.Errors, "lastName")
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// systemFX is the bank's position in each currency. A conversion pays the
+// source amount into the FX account of the source currency and the converted
+// amount out of the FX account of the target currency, so each journal entry
+// stays in one currency.
+const systemFX = "fx"
+
+// rateDecimals is the precision rates are kept at.
+const rateDecimals = 8
+
+var rateScale = big.NewInt(100_000_000)
+
+// Rate is a price in fixed point with rateDecimals places, 0.92345678 as
+// 92345678. It is written as a decimal string in JSON and YAML.
+type Rate int64
+
+// ExchangeRate is the mid-market price of one unit of From in units of To.
+type ExchangeRate struct {
+	From Currency  `json:"from"`
+	To   Currency  `json:"to"`
+	Rate Rate      `json:"rate"`
+	AsOf time.Time `json:"asOf"`
+}
+
+// RateProvider gives the current exchange rate between two currencies.
+type RateProvider interface {
+	Rate(from, to Currency) (*ExchangeRate, error)
+}
+
+// FXConversion records a transfer between accounts in different currencies:
+// what left the source account, what arrived, and the rate and spread used.
+type FXConversion struct {
+	ID              int       `json:"id"`
+	FromAccount     int       `json:"fromAccount"`
+	ToAccount       int       `json:"toAccount"`
+	Source          Money     `json:"source"`
+	Target          Money     `json:"target"`
+	MidRate         Rate      `json:"midRate"`
+	SpreadBps       int       `json:"spreadBps"`
+	AppliedRate     Rate      `json:"appliedRate"`
+	RateAsOf        time.Time `json:"rateAsOf"`
+	FromTransaction int       `json:"fromTransaction"`
+	ToTransaction   int       `json:"toTransaction"`
+	CreatedAt       time.Time `json:"createdAt"`
+}
+
+// FileRateProvider serves rates from a YAML file, for running without a
+// market data feed. Rates are quoted against one base currency and crossed
+// for every other pair:
+//
+//	base: USD
+//	asOf: 2024-06-03T00:00:00Z
+//	rates:
+//	  EUR: "0.92"
+//	  GBP: "0.785"
+type FileRateProvider struct {
+	Base  Currency          `yaml:"base"`
+	AsOf  time.Time         `yaml:"asOf"`
+	Rates map[Currency]Rate `yaml:"rates"`
+}
+
+func LoadFileRates(path string) (*FileRateProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	p := new(FileRateProvider)
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, fmt.Errorf("Rates file %s: %w", path, err)
+	}
+	if _, ok := minorUnits[p.Base]; !ok {
+		return nil, fmt.Errorf("Rates file %s: unsupported base currency %q", path, p.Base)
+	}
+	for currency, rate := range p.Rates {
+		if _, ok := minorUnits[currency]; !ok {
+			return nil, fmt.Errorf("Rates file %s: unsupported currency %q", path, currency)
+		}
+		if rate <= 0 {
+			return nil, fmt.Errorf("Rates file %s: rate for %s must be positive", path, currency)
+		}
+	}
+
+	return p, nil
+}
+
+func (p *FileRateProvider) Rate(from, to Currency) (*ExchangeRate, error) {
+	fromRate, err := p.baseRate(from)
+	if err != nil {
+		return nil, err
+	}
+	toRate, err := p.baseRate(to)
+	if err != nil {
+		return nil, err
+	}
+
+	cross := new(big.Rat).SetFrac(big.NewInt(int64(toRate)), big.NewInt(int64(fromRate)))
+	return &ExchangeRate{From: from, To: to, Rate: ratFromBig(cross), AsOf: p.AsOf}, nil
+}
+
+func (p *FileRateProvider) baseRate(c Currency) (Rate, error) {
+	if c == p.Base {
+		return Rate(rateScale.Int64()), nil
+	}
+	rate, ok := p.Rates[c]
+	if !ok {
+		return 0, unprocessable("No exchange rate for %s", c)
+	}
+	return rate, nil
+}
+
+// quoteConversion converts amount of from into to at the provider's rate less
+// the spread, rounding the converted amount down to its minor unit so the
+// bank never pays out more than the applied rate allows.
+func quoteConversion(rates RateProvider, spreadBps int, amount int64, from, to Currency, now time.Time) (*FXConversion, error) {
+	if rates == nil {
+		return nil, unprocessable("Currency conversion is not available")
+	}
+
+	rate, err := rates.Rate(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := new(big.Rat).Mul(rate.Rate.rat(), big.NewRat(int64(10_000-spreadBps), 10_000))
+	appliedRate := ratFromBig(applied)
+
+	// target = amount * rate * 10^(to units) / 10^(from units)
+	target := new(big.Rat).Mul(big.NewRat(amount, 1), appliedRate.rat())
+	target.Mul(target, new(big.Rat).SetFrac(pow10(to.MinorUnits()), pow10(from.MinorUnits())))
+	converted := new(big.Int).Quo(target.Num(), target.Denom())
+	if !converted.IsInt64() || converted.Sign() <= 0 {
+		return nil, unprocessable("%s is too small to convert to %s", Money{Amount: amount, Currency: from}, to)
+	}
+
+	return &FXConversion{
+		Source:      Money{Amount: amount, Currency: from},
+		Target:      Money{Amount: converted.Int64(), Currency: to},
+		MidRate:     rate.Rate,
+		SpreadBps:   spreadBps,
+		AppliedRate: appliedRate,
+		RateAsOf:    rate.AsOf,
+		CreatedAt:   now,
+	}, nil
+}
+
+// conversionDescription is used for both legs of a conversion when the
+// customer gives no description.
+func conversionDescription(c *FXConversion) string {
+	return fmt.Sprintf("Conversion of %s to %s at %s", c.Source, c.Target, c.AppliedRate)
+}
+
+// GET /fx/quote?from=USD&to=EUR&amount=10000 shows what a conversion would
+// give now, without moving any money.
+func (s *APIServer) handleFXQuote(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+
+	q := r.URL.Query()
+	from, err := parseCurrency(q.Get("from"))
+	if err != nil {
+		return invalidField("from", "Unsupported currency %s", q.Get("from"))
+	}
+	to, err := parseCurrency(q.Get("to"))
+	if err != nil {
+		return invalidField("to", "Unsupported currency %s", q.Get("to"))
+	}
+	if from == to {
+		return invalidField("to", "Cannot convert %s to itself", from)
+	}
+	amount, err := strconv.ParseInt(q.Get("amount"), 10, 64)
+	if err != nil || amount <= 0 {
+		return invalidField("amount", "Amount must be a positive number of minor units")
+	}
+
+	quote, err := quoteConversion(s.rates, s.fxSpreadBps, amount, from, to, s.now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, quote)
+}
+
+func (r Rate) rat() *big.Rat {
+	return new(big.Rat).SetFrac(big.NewInt(int64(r)), rateScale)
+}
+
+// ratFromBig rounds x to the nearest Rate.
+func ratFromBig(x *big.Rat) Rate {
+	scaled := new(big.Rat).Mul(x, new(big.Rat).SetInt(rateScale))
+	scaled.Add(scaled, big.NewRat(1, 2))
+	return Rate(new(big.Int).Quo(scaled.Num(), scaled.Denom()).Int64())
+}
+
+func pow10(n int) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+func parseRate(s string) (Rate, error) {
+	x, ok := new(big.Rat).SetString(strings.TrimSpace(s))
+	if !ok || x.Sign() < 0 {
+		return 0, fmt.Errorf("Invalid rate %q", s)
+	}
+	return ratFromBig(x), nil
+}
+
+// String writes the rate as a decimal without trailing zeros.
+func (r Rate) String() string {
+	s := r.rat().FloatString(rateDecimals)
+	s = strings.TrimRight(s, "0")
+	return strings.TrimSuffix(s, ".")
+}
+
+func (r Rate) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Quote(r.String())), nil
+}
+
+func (r *Rate) UnmarshalJSON(data []byte) error {
+	s, err := strconv.Unquote(string(data))
+	if err != nil {
+		s = string(data)
+	}
+	parsed, err := parseRate(s)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
+
+func (r Rate) MarshalYAML() (interface{}, error) {
+	return r.String(), nil
+}
+
+func (r *Rate) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := parseRate(value.Value)
+	if err != nil {
+		return err
+	}
+	*r = parsed
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testRates(t *testing.T) *FileRateProvider {
+	path := filepath.Join(t.TempDir(), "rates.yaml")
+	content := "base: USD\nasOf: 2024-06-03T00:00:00Z\nrates:\n  EUR: \"0.92\"\n  GBP: \"0.785\"\n  JPY: \"156.25\"\n"
+	assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+
+	rates, err := LoadFileRates(path)
+	assert.Nil(t, err)
+	return rates
+}
+
+func TestFormatMinor(t *testing.T) {
+	assert.Equal(t, "123.45 USD", Money{Amount: 12345, Currency: "USD"}.String())
+	assert.Equal(t, "-0.05 EUR", Money{Amount: -5, Currency: "EUR"}.String())
+	assert.Equal(t, "12345 JPY", Money{Amount: 12345, Currency: "JPY"}.String())
+}
+
+func TestFileRatesCrossThroughBase(t *testing.T) {
+	rates := testRates(t)
+
+	rate, err := rates.Rate("EUR", "GBP")
+	assert.Nil(t, err)
+	assert.Equal(t, "0.85326087", rate.Rate.String())
+
+	_, err = rates.Rate("USD", "CHF")
+	assert.NotNil(t, err)
+}
+
+func TestQuoteConversionTakesSpreadAndRoundsDown(t *testing.T) {
+	rates := testRates(t)
+
+	// 100.00 USD at 156.25 less 1% is 15468.75 JPY, paid as 15468.
+	quote, err := quoteConversion(rates, 100, 100_00, "USD", "JPY", time.Now())
+	assert.Nil(t, err)
+	assert.Equal(t, "156.25", quote.MidRate.String())
+	assert.Equal(t, "154.6875", quote.AppliedRate.String())
+	assert.Equal(t, Money{Amount: 15468, Currency: "JPY"}, quote.Target)
+
+	_, err = quoteConversion(nil, 100, 100_00, "USD", "JPY", time.Now())
+	assert.NotNil(t, err)
+}
+
+func TestTransferBetweenCurrencies(t *testing.T) {
+	store := NewMemoryStore()
+	user, usd := newTestCustomer(t, store, "traveller@mail.com", 500_00)
+	eur := NewAccount(user.ID, Checking, "EUR")
+	assert.Nil(t, store.CreateAccount(eur))
+
+	_, err := store.Transfer(usd.ID, eur.ID, 100_00, Transfer, "", nil)
+	assert.Equal(t, http.StatusUnprocessableEntity, problemFor(err).Status)
+
+	server := NewAPIServer(":0", store)
+	server.rates = testRates(t)
+	server.fxSpreadBps = 0
+
+	body, _ := json.Marshal(TransactionRequest{FromAccount: usd.ID, ToAccount: eur.ID, Amount: 100_00})
+	req := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader(body))
+	req = req.WithContext(withPrincipal(req.Context(), &Principal{UserID: user.ID, Role: Customer}))
+	rec := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleTransaction)(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	conversion := new(FXConversion)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(conversion))
+	assert.Equal(t, Money{Amount: 92_00, Currency: "EUR"}, conversion.Target)
+	assert.Equal(t, "0.92", conversion.AppliedRate.String())
+
+	usdAfter, _ := store.GetAccountByID(usd.ID)
+	eurAfter, _ := store.GetAccountByID(eur.ID)
+	assert.Equal(t, int64(400_00), usdAfter.Balance)
+	assert.Equal(t, int64(92_00), eurAfter.Balance)
+
+	// Each leg balances in its own currency against the bank's FX accounts.
+	usdFX, _ := store.GetSystemAccount(systemFX, "USD")
+	eurFX, _ := store.GetSystemAccount(systemFX, "EUR")
+	assert.Equal(t, int64(100_00), usdFX.Balance)
+	assert.Equal(t, int64(-92_00), eurFX.Balance)
+}
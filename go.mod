@@ -2,15 +2,17 @@ module github.com/JoshM-Yoru/go-bank
 
 go 1.21.1
 
-require github.com/gorilla/mux v1.8.0
+require (
+	github.com/golang-jwt/jwt/v5 v5.0.0
+	github.com/gorilla/mux v1.8.0
+	github.com/lib/pq v1.10.9
+	github.com/stretchr/testify v1.8.4
+	golang.org/x/crypto v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/golang-jwt/jwt/v5 v5.0.0 // indirect
-	github.com/lib/pq v1.10.9 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/objx v0.5.0 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
-	golang.org/x/crypto v0.14.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
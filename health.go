@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const readinessTimeout = 2 * time.Second
+
+// GET /healthz reports that the process is up.
+func (s *APIServer) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	WriteJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// GET /readyz reports whether the server should receive traffic: the store
+// must be reachable and the server must not be shutting down.
+func (s *APIServer) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	if s.shuttingDown.Load() {
+		WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "shutting down"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), readinessTimeout)
+	defer cancel()
+
+	if err := s.store.Ping(ctx); err != nil {
+		WriteJSON(w, http.StatusServiceUnavailable, map[string]string{"status": "store unavailable"})
+		return
+	}
+
+	WriteJSON(w, http.StatusOK, map[string]string{"status": "ready"})
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// systemHoldSettlement receives captured holds that name no other account.
+const systemHoldSettlement = "hold_settlement"
+
+const (
+	HoldPending  = "pending"
+	HoldCaptured = "captured"
+	HoldReleased = "released"
+	HoldExpired  = "expired"
+)
+
+const (
+	defaultHoldDuration = 7 * 24 * time.Hour
+	maxHoldDuration     = 30 * 24 * time.Hour
+)
+
+// Hold reserves Amount of an account's balance for a later capture, as for a
+// card authorization or an ACH debit in flight. While it is pending and not
+// expired it lowers the available balance but not the ledger balance.
+// Capturing posts CapturedAmount to ToAccount and releases the rest.
+type Hold struct {
+	ID             int        `json:"id"`
+	AccountID      int        `json:"accountId"`
+	ToAccount      int        `json:"toAccount"`
+	Amount         int64      `json:"amount"`
+	CapturedAmount int64      `json:"capturedAmount"`
+	Description    string     `json:"description"`
+	Status         string     `json:"status"`
+	TransactionID  int        `json:"transactionId,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	ExpiresAt      time.Time  `json:"expiresAt"`
+	ClosedAt       *time.Time `json:"closedAt,omitempty"`
+}
+
+// AccountBalance is the ledger balance, what is held of it, and what is left
+// to spend.
+type AccountBalance struct {
+	AccountID        int   `json:"accountId"`
+	LedgerBalance    int64 `json:"ledgerBalance"`
+	HeldAmount       int64 `json:"heldAmount"`
+	AvailableBalance int64 `json:"availableBalance"`
+}
+
+type AuthorizeHoldRequest struct {
+	Amount      int64      `json:"amount"`
+	ToAccount   int        `json:"toAccount"`
+	Description string     `json:"description"`
+	ExpiresAt   *time.Time `json:"expiresAt"`
+}
+
+type CaptureHoldRequest struct {
+	// Amount defaults to the whole hold.
+	Amount int64 `json:"amount"`
+}
+
+// holdOwner resolves the user who owns the account of the hold in the id
+// path variable.
+func holdOwner(store Storage) ownerResolver {
+	return func(r *http.Request) (int, error) {
+		id, err := getID(r)
+		if err != nil {
+			return 0, err
+		}
+
+		hold, err := store.GetHold(id)
+		if err != nil {
+			return 0, err
+		}
+
+		account, err := store.GetAccountByID(hold.AccountID)
+		if err != nil {
+			return 0, err
+		}
+
+		return account.UserID, nil
+	}
+}
+
+// releaseExpiredHolds marks holds past their expiry as expired every interval
+// until ctx is done. Expired holds already stop counting against the
+// available balance; this records that they are closed.
+func releaseExpiredHolds(ctx context.Context, s Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := s.ExpireHolds(time.Now().UTC()); err != nil {
+				log.Println("Releasing expired holds failed:", err)
+			}
+		}
+	}
+}
+
+// GET /accounts/{id}/balance
+func (s *APIServer) handleGetBalance(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	balance, err := s.store.GetAccountBalance(id, s.now().UTC())
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, balance)
+}
+
+// GET or POST /accounts/{id}/holds, where POST authorizes a new hold
+func (s *APIServer) handleAccountHolds(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "GET":
+		holds, err := s.store.GetHoldsByAccount(id)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, holds)
+	case "POST":
+		return s.handleAuthorizeHold(w, r, id)
+	}
+
+	return methodNotAllowed(r.Method)
+}
+
+// handleAuthorizeHold reserves money that a later capture moves, so it is
+// held to the same email verification and limits as a transfer.
+func (s *APIServer) handleAuthorizeHold(w http.ResponseWriter, r *http.Request, accountID int) error {
+	if err := s.requireVerifiedEmail(r); err != nil {
+		return err
+	}
+
+	req := new(AuthorizeHoldRequest)
+	if err := readJSON(r, req); err != nil {
+		return err
+	}
+
+	now := s.now().UTC()
+	expiresAt := now.Add(defaultHoldDuration)
+	if req.ExpiresAt != nil {
+		expiresAt = req.ExpiresAt.UTC()
+	}
+
+	if req.Amount <= 0 {
+		return invalidField("amount", "Hold amount must be greater than zero")
+	}
+	if !expiresAt.After(now) || expiresAt.After(now.Add(maxHoldDuration)) {
+		return invalidField("expiresAt", "Holds must expire within %d days", int(maxHoldDuration.Hours()/24))
+	}
+
+	account, err := s.store.GetAccountByID(accountID)
+	if err != nil {
+		return err
+	}
+
+	toAccount := req.ToAccount
+	if toAccount == 0 {
+		settlement, err := s.store.GetSystemAccount(systemHoldSettlement, account.Currency)
+		if err != nil {
+			return err
+		}
+		toAccount = settlement.ID
+	}
+	if toAccount == accountID {
+		return invalidField("toAccount", "Cannot hold funds for the same account")
+	}
+	payee, err := s.store.GetAccountByID(toAccount)
+	if err != nil {
+		return err
+	}
+	if payee.Currency != account.Currency {
+		return invalidField("toAccount", "Holds must be paid to an account in %s", account.Currency)
+	}
+
+	limits, _, err := s.transferLimits(account, principalFromContext(r.Context()).Role)
+	if err != nil {
+		return err
+	}
+
+	hold := &Hold{
+		AccountID:   accountID,
+		ToAccount:   toAccount,
+		Amount:      req.Amount,
+		Description: req.Description,
+		Status:      HoldPending,
+		CreatedAt:   now,
+		ExpiresAt:   expiresAt,
+	}
+	event := s.auditEvent(r, &AuditEvent{Action: AuditHoldAuthorize, TargetType: "hold"})
+	if err := s.store.AuthorizeHold(hold, event, limits...); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusCreated, hold)
+}
+
+// GET /holds/{id}
+func (s *APIServer) handleGetHold(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	hold, err := s.store.GetHold(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, hold)
+}
+
+// POST /holds/{id}/{action} where action is capture or void
+func (s *APIServer) handleHoldAction(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	var hold *Hold
+	switch mux.Vars(r)["action"] {
+	case "capture":
+		req := new(CaptureHoldRequest)
+		if r.ContentLength != 0 {
+			if err := readJSON(r, req); err != nil {
+				return err
+			}
+		}
+		if req.Amount < 0 {
+			return invalidField("amount", "Capture amount cannot be negative")
+		}
+
+		var limits []TransferLimits
+		if limits, err = s.holdCaptureLimits(r, id); err != nil {
+			return err
+		}
+
+		event := s.auditEvent(r, &AuditEvent{Action: AuditHoldCapture, TargetType: "hold"})
+		hold, err = s.store.CaptureHold(id, req.Amount, s.now().UTC(), event, limits...)
+	case "void":
+		event := s.auditEvent(r, &AuditEvent{Action: AuditHoldVoid, TargetType: "hold"})
+		hold, err = s.store.VoidHold(id, s.now().UTC(), event)
+	default:
+		return notFound("Unknown action %s", mux.Vars(r)["action"])
+	}
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, hold)
+}
+
+// checkHoldCapture checks that amount, or the whole hold when amount is
+// zero, can be captured from hold at now, and returns the amount to capture.
+func checkHoldCapture(hold *Hold, amount int64, now time.Time) (int64, error) {
+	if err := checkHoldPending(hold, now); err != nil {
+		return 0, err
+	}
+	if amount == 0 {
+		amount = hold.Amount
+	}
+	if amount > hold.Amount {
+		return 0, unprocessable("Cannot capture %s of a %s hold", formatAmount(amount), formatAmount(hold.Amount))
+	}
+	return amount, nil
+}
+
+func checkHoldPending(hold *Hold, now time.Time) error {
+	if hold.Status == HoldPending && !hold.ExpiresAt.After(now) {
+		return conflict("Hold %d expired at %s", hold.ID, hold.ExpiresAt.Format(time.RFC3339))
+	}
+	if hold.Status != HoldPending {
+		return conflict("Hold %d is %s", hold.ID, hold.Status)
+	}
+	return nil
+}
+
+// holdCaptureLimits checks that the caller may move money now, as for a
+// transfer, and returns the limits a capture of the hold is held to.
+func (s *APIServer) holdCaptureLimits(r *http.Request, id int) ([]TransferLimits, error) {
+	if err := s.requireVerifiedEmail(r); err != nil {
+		return nil, err
+	}
+
+	hold, err := s.store.GetHold(id)
+	if err != nil {
+		return nil, err
+	}
+	account, err := s.store.GetAccountByID(hold.AccountID)
+	if err != nil {
+		return nil, err
+	}
+
+	limits, _, err := s.transferLimits(account, principalFromContext(r.Context()).Role)
+	return limits, err
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHoldReducesAvailableBalance(t *testing.T) {
+	store := NewMemoryStore()
+	_, from := newTestCustomer(t, store, "card@mail.com", 100_00)
+	_, merchant := newTestCustomer(t, store, "merchant@mail.com", 0)
+	now := time.Now().UTC()
+
+	hold := &Hold{AccountID: from.ID, ToAccount: merchant.ID, Amount: 60_00, Status: HoldPending, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.Nil(t, store.AuthorizeHold(hold, nil))
+
+	balance, err := store.GetAccountBalance(from.ID, now)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100_00), balance.LedgerBalance)
+	assert.Equal(t, int64(60_00), balance.HeldAmount)
+	assert.Equal(t, int64(40_00), balance.AvailableBalance)
+
+	_, err = store.Transfer(from.ID, merchant.ID, 40_01, Transfer, "", nil)
+	assert.NotNil(t, err)
+	second := &Hold{AccountID: from.ID, ToAccount: merchant.ID, Amount: 40_01, Status: HoldPending, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.NotNil(t, store.AuthorizeHold(second, nil))
+
+	// A partial capture posts what was captured and releases the rest.
+	captured, err := store.CaptureHold(hold.ID, 45_00, now, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, HoldCaptured, captured.Status)
+	assert.NotZero(t, captured.TransactionID)
+
+	balance, _ = store.GetAccountBalance(from.ID, now)
+	assert.Equal(t, int64(55_00), balance.LedgerBalance)
+	assert.Equal(t, int64(55_00), balance.AvailableBalance)
+
+	_, err = store.CaptureHold(hold.ID, 0, now, nil)
+	assert.Equal(t, http.StatusConflict, problemFor(err).Status)
+}
+
+func TestExpiredHoldsAreReleased(t *testing.T) {
+	store := NewMemoryStore()
+	_, from := newTestCustomer(t, store, "expiry@mail.com", 100_00)
+	_, merchant := newTestCustomer(t, store, "hotel@mail.com", 0)
+	now := time.Now().UTC()
+
+	hold := &Hold{AccountID: from.ID, ToAccount: merchant.ID, Amount: 80_00, Status: HoldPending, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.Nil(t, store.AuthorizeHold(hold, nil))
+
+	later := now.Add(2 * time.Hour)
+	balance, _ := store.GetAccountBalance(from.ID, later)
+	assert.Zero(t, balance.HeldAmount)
+
+	_, err := store.CaptureHold(hold.ID, 0, later, nil)
+	assert.Equal(t, http.StatusConflict, problemFor(err).Status)
+
+	expired, err := store.ExpireHolds(later)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, expired)
+
+	hold, _ = store.GetHold(hold.ID)
+	assert.Equal(t, HoldExpired, hold.Status)
+	assert.Equal(t, now.Add(time.Hour), *hold.ClosedAt)
+}
+
+func TestAuthorizeAndVoidHold(t *testing.T) {
+	store := NewMemoryStore()
+	user, from := newTestCustomer(t, store, "void@mail.com", 100_00)
+	server := NewAPIServer(":0", store)
+
+	call := func(h apiFunc, method, path, body string, vars map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		req = mux.SetURLVars(req, vars)
+		req = req.WithContext(withPrincipal(req.Context(), &Principal{UserID: user.ID, Role: Customer}))
+		rec := httptest.NewRecorder()
+		makeHTTPHandleFunc(h)(rec, req)
+		return rec
+	}
+
+	accountVars := map[string]string{"id": strconv.Itoa(from.ID)}
+	rec := call(server.handleAccountHolds, http.MethodPost, "/accounts/1/holds", `{"amount":2500,"description":"Fuel"}`, accountVars)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	rec = call(server.handleAccountHolds, http.MethodPost, "/accounts/1/holds", `{"amount":2500,"expiresAt":"2000-01-01T00:00:00Z"}`, accountVars)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	vars := map[string]string{"id": "1", "action": "void"}
+	assert.Equal(t, http.StatusOK, call(server.handleHoldAction, http.MethodPost, "/holds/1/void", "", vars).Code)
+	vars["action"] = "capture"
+	assert.Equal(t, http.StatusConflict, call(server.handleHoldAction, http.MethodPost, "/holds/1/capture", "", vars).Code)
+
+	balance, _ := store.GetAccountBalance(from.ID, time.Now().UTC())
+	assert.Equal(t, int64(100_00), balance.AvailableBalance)
+}
+
+func TestHoldsFollowTransferChecks(t *testing.T) {
+	store := NewMemoryStore()
+	user, from := newTestCustomer(t, store, "held@mail.com", 20_000_00)
+	_, payee := newTestCustomer(t, store, "held-payee@mail.com", 0)
+	server := NewAPIServer(":0", store)
+
+	call := func(h apiFunc, path, body string, vars map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader([]byte(body)))
+		req = mux.SetURLVars(req, vars)
+		req = req.WithContext(withPrincipal(req.Context(), &Principal{UserID: user.ID, Role: Customer}))
+		rec := httptest.NewRecorder()
+		makeHTTPHandleFunc(h)(rec, req)
+		return rec
+	}
+	accountVars := map[string]string{"id": strconv.Itoa(from.ID)}
+	captureVars := map[string]string{"id": "1", "action": "capture"}
+
+	// A hold over the customer's transfer limit is refused up front.
+	rec := call(server.handleAccountHolds, "/accounts/1/holds", `{"amount":1500000,"toAccount":`+strconv.Itoa(payee.ID)+`}`, accountVars)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+
+	rec = call(server.handleAccountHolds, "/accounts/1/holds", `{"amount":50000,"toAccount":`+strconv.Itoa(payee.ID)+`}`, accountVars)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	// Limits that tighten before the capture apply to it.
+	server.limitRules = []LimitRule{{Role: Customer, TransferLimits: TransferLimits{MaxTransaction: 100_00}}}
+	assert.Equal(t, http.StatusUnprocessableEntity, call(server.handleHoldAction, "/holds/1/capture", "", captureVars).Code)
+	server.limitRules = nil
+
+	// So does losing a verified email address.
+	store.users[user.ID].EmailVerified = false
+	assert.Equal(t, http.StatusForbidden, call(server.handleHoldAction, "/holds/1/capture", "", captureVars).Code)
+	assert.Equal(t, http.StatusForbidden, call(server.handleAccountHolds, "/accounts/1/holds", `{"amount":100}`, accountVars).Code)
+
+	hold, _ := store.GetHold(1)
+	assert.Equal(t, HoldPending, hold.Status)
+	paid, _ := store.GetAccountByID(payee.ID)
+	assert.Equal(t, int64(0), paid.Balance)
+}
+
+func TestAccountWithPendingHoldsCannotClose(t *testing.T) {
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "closing@mail.com", 0)
+	_, merchant := newTestCustomer(t, store, "closing-shop@mail.com", 0)
+	now := time.Now().UTC()
+
+	card := NewAccount(user.ID, CreditAccount, defaultCurrency)
+	card.CreditLimit = 100_00
+	assert.Nil(t, store.CreateAccount(card))
+
+	hold := &Hold{AccountID: card.ID, ToAccount: merchant.ID, Amount: 20_00, Status: HoldPending, CreatedAt: now, ExpiresAt: now.Add(time.Hour)}
+	assert.Nil(t, store.AuthorizeHold(hold, nil))
+	assert.Equal(t, http.StatusUnprocessableEntity, problemFor(store.CloseAccount(card.ID)).Status)
+
+	_, err := store.VoidHold(hold.ID, now, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, store.CloseAccount(card.ID))
+}
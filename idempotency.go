@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyHeader    = "Idempotency-Key"
+	idempotencyKeyTTL    = 24 * time.Hour
+	maxIdempotencyKeyLen = 255
+
+	// idempotencyLease is how long a key stays in progress before a retry may
+	// take it over, in case the process died while running the request. It
+	// is well beyond the server's write timeout.
+	idempotencyLease = 2 * time.Minute
+)
+
+// IdempotencyRecord remembers the response to a request sent with an
+// Idempotency-Key header. Keys are scoped to the caller and the endpoint, so
+// two users picking the same key never see each other's responses. A record
+// that is not completed belongs to a request that is still running.
+type IdempotencyRecord struct {
+	Scope       string    `json:"scope"`
+	Key         string    `json:"key"`
+	RequestHash string    `json:"requestHash"`
+	Completed   bool      `json:"completed"`
+	StatusCode  int       `json:"statusCode"`
+	Body        []byte    `json:"-"`
+	CreatedAt   time.Time `json:"createdAt"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+}
+
+func (r *IdempotencyRecord) isExpired(now time.Time) bool {
+	return !now.Before(r.ExpiresAt)
+}
+
+// idempotencyScope is the caller and endpoint a key belongs to. Requests
+// without a principal, like opening a new account, share one anonymous scope.
+func idempotencyScope(r *http.Request) string {
+	caller := "anonymous"
+	if p := principalFromContext(r.Context()); p != nil {
+		caller = fmt.Sprintf("user:%d", p.UserID)
+	}
+	return caller + " " + r.Method + " " + r.URL.Path
+}
+
+func hashRequestBody(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotencyRecorder passes a response through to the client while keeping a
+// copy to store.
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// withIdempotency makes POST requests carrying an Idempotency-Key safe to
+// retry. The first request with a key runs the handler and stores its
+// response; a retry with the same body gets that response back without
+// running the handler again, a retry with a different body is rejected with
+// 422, and a retry while the first request is still running gets 409.
+// Responses with a 5xx status are not stored, and neither is a handler that
+// panicked, so the request can be retried.
+func withIdempotency(handlerFunc http.HandlerFunc, s Storage) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			handlerFunc(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeError(w, r, invalidField(idempotencyHeader, "%s must be at most %d characters", idempotencyHeader, maxIdempotencyKeyLen))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, invalid("Could not read request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		now := time.Now().UTC()
+		record := &IdempotencyRecord{
+			Scope:       idempotencyScope(r),
+			Key:         key,
+			RequestHash: hashRequestBody(body),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(idempotencyLease),
+		}
+
+		existing, err := s.BeginIdempotentRequest(record)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		if existing != nil {
+			replayIdempotentRequest(w, r, record, existing)
+			return
+		}
+
+		release := func() {
+			if err := s.ReleaseIdempotencyKey(record.Scope, record.Key); err != nil {
+				log.Println("Releasing idempotency key failed:", err)
+			}
+		}
+		defer func() {
+			if p := recover(); p != nil {
+				release()
+				panic(p)
+			}
+		}()
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		handlerFunc(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= http.StatusInternalServerError {
+			release()
+			return
+		}
+
+		record.Completed = true
+		record.StatusCode = rec.status
+		record.Body = rec.body.Bytes()
+		record.ExpiresAt = record.CreatedAt.Add(idempotencyKeyTTL)
+		if err := s.CompleteIdempotentRequest(record); err != nil {
+			log.Println("Storing idempotent response failed:", err)
+		}
+	}
+}
+
+func replayIdempotentRequest(w http.ResponseWriter, r *http.Request, record, existing *IdempotencyRecord) {
+	if existing.RequestHash != record.RequestHash {
+		writeError(w, r, unprocessable("%s was already used with a different request", idempotencyHeader))
+		return
+	}
+	if !existing.Completed {
+		writeError(w, r, conflict("A request with this %s is still in progress", idempotencyHeader))
+		return
+	}
+
+	// Handlers answer with JSON and errors with problem details.
+	contentType := "application/json"
+	if existing.StatusCode >= http.StatusBadRequest {
+		contentType = "application/problem+json"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(existing.StatusCode)
+	w.Write(existing.Body)
+}
+
+// purgeIdempotencyKeys deletes expired keys every interval until ctx is done.
+// Expired keys are already ignored, this only keeps the table small.
+func purgeIdempotencyKeys(ctx context.Context, s Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.DeleteExpiredIdempotencyKeys(time.Now().UTC()); err != nil {
+				log.Println("Purging idempotency keys failed:", err)
+			}
+		}
+	}
+}
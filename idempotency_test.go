@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func idempotentRequest(h http.HandlerFunc, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/transfer", strings.NewReader(body))
+	req.Header.Set(idempotencyHeader, key)
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func TestIdempotencyReplaysResponse(t *testing.T) {
+	calls := 0
+	h := withIdempotency(makeHTTPHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		calls++
+		return WriteJSON(w, http.StatusOK, map[string]int{"calls": calls})
+	}), NewMemoryStore())
+
+	first := idempotentRequest(h, "abc", `{"amount":100}`)
+	second := idempotentRequest(h, "abc", `{"amount":100}`)
+
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, http.StatusOK, second.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, "true", second.Header().Get("Idempotent-Replayed"))
+
+	different := idempotentRequest(h, "abc", `{"amount":200}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, different.Code)
+	assert.Equal(t, 1, calls)
+
+	idempotentRequest(h, "other", `{"amount":100}`)
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyReleasesServerErrors(t *testing.T) {
+	calls := 0
+	h := withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusInternalServerError)
+	}, NewMemoryStore())
+
+	idempotentRequest(h, "abc", `{}`)
+	idempotentRequest(h, "abc", `{}`)
+
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyReleasesPanics(t *testing.T) {
+	calls := 0
+	h := withIdempotency(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("handler failed")
+		}
+		w.WriteHeader(http.StatusOK)
+	}, NewMemoryStore())
+
+	assert.Panics(t, func() { idempotentRequest(h, "abc", `{}`) })
+	assert.Equal(t, http.StatusOK, idempotentRequest(h, "abc", `{}`).Code)
+	assert.Equal(t, 2, calls)
+}
+
+func TestIdempotencyLeaseExpires(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now().UTC()
+
+	// A request that never finished, say because the process died.
+	stuck := &IdempotencyRecord{Scope: "user:1 POST /transfer", Key: "abc", RequestHash: hashRequestBody([]byte(`{}`)), CreatedAt: now, ExpiresAt: now.Add(idempotencyLease)}
+	existing, err := store.BeginIdempotentRequest(stuck)
+	assert.Nil(t, err)
+	assert.Nil(t, existing)
+
+	retry := *stuck
+	existing, err = store.BeginIdempotentRequest(&retry)
+	assert.Nil(t, err)
+	assert.False(t, existing.Completed)
+
+	retry.CreatedAt = now.Add(idempotencyLease)
+	existing, err = store.BeginIdempotentRequest(&retry)
+	assert.Nil(t, err)
+	assert.Nil(t, existing)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"sort"
+	"time"
+)
+
+// System accounts are bank-owned accounts on the other side of postings that
+// do not come from a customer, such as interest paid out.
+const (
+	systemInterestExpense = "interest_expense"
+)
+
+type Compounding string
+
+const (
+	CompoundDaily   Compounding = "daily"
+	CompoundMonthly Compounding = "monthly"
+)
+
+// InterestTier pays APYBasisPoints (425 is 4.25%) on balances of at least
+// MinBalance minor units.
+type InterestTier struct {
+	MinBalance     int64 `json:"minBalance" yaml:"minBalance"`
+	APYBasisPoints int64 `json:"apyBasisPoints" yaml:"apyBasisPoints"`
+}
+
+// InterestProduct describes how an account type earns interest. Interest
+// accrues daily on the end of day balance and is paid out at the end of each
+// compounding period.
+type InterestProduct struct {
+	Name        string         `json:"name" yaml:"name"`
+	AccountType AccountType    `json:"accountType" yaml:"accountType"`
+	Compounding Compounding    `json:"compounding" yaml:"compounding"`
+	Tiers       []InterestTier `json:"tiers" yaml:"tiers"`
+}
+
+// InterestAccrual is one day of interest for one account, kept in millionths
+// of a minor unit so that small balances still add up.
+type InterestAccrual struct {
+	AccountID      int       `json:"accountId"`
+	Date           time.Time `json:"date"`
+	Balance        int64     `json:"balance"`
+	APYBasisPoints int64     `json:"apyBasisPoints"`
+	AmountMicros   int64     `json:"amountMicros"`
+	Posted         bool      `json:"posted"`
+	TransactionID  int       `json:"transactionId,omitempty"`
+}
+
+var defaultInterestProducts = []InterestProduct{
+	{
+		Name:        "Standard Savings",
+		AccountType: Savings,
+		Compounding: CompoundMonthly,
+		Tiers: []InterestTier{
+			{MinBalance: 100_00, APYBasisPoints: 50},
+			{MinBalance: 10_000_00, APYBasisPoints: 150},
+			{MinBalance: 25_000_00, APYBasisPoints: 250},
+		},
+	},
+}
+
+func (p InterestProduct) Validate() error {
+	if p.Compounding != CompoundDaily && p.Compounding != CompoundMonthly {
+		return fmt.Errorf("Interest product %q: compounding must be 'daily' or 'monthly'", p.Name)
+	}
+	if len(p.Tiers) == 0 {
+		return fmt.Errorf("Interest product %q has no tiers", p.Name)
+	}
+	for _, tier := range p.Tiers {
+		if tier.MinBalance < 0 || tier.APYBasisPoints < 0 {
+			return fmt.Errorf("Interest product %q has a negative tier", p.Name)
+		}
+	}
+	return nil
+}
+
+// tierFor returns the APY for balance: the highest tier whose minimum the
+// balance meets, or zero below the lowest tier.
+func (p InterestProduct) tierFor(balance int64) int64 {
+	tiers := append([]InterestTier{}, p.Tiers...)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinBalance < tiers[j].MinBalance })
+
+	var apy int64
+	for _, tier := range tiers {
+		if balance >= tier.MinBalance {
+			apy = tier.APYBasisPoints
+		}
+	}
+	return apy
+}
+
+// dailyAccrualMicros is one day's interest on balance at the given APY. The
+// APY is turned into the rate per compounding period first, so that paying
+// that rate every period earns exactly the advertised APY.
+func (p InterestProduct) dailyAccrualMicros(balance, apyBasisPoints int64, day time.Time) int64 {
+	if balance <= 0 || apyBasisPoints <= 0 {
+		return 0
+	}
+
+	apy := float64(apyBasisPoints) / 10_000
+	var daily float64
+
+	switch p.Compounding {
+	case CompoundDaily:
+		daily = math.Pow(1+apy, 1.0/daysInYear(day)) - 1
+	default:
+		monthly := math.Pow(1+apy, 1.0/12) - 1
+		daily = monthly / float64(daysInMonth(day))
+	}
+
+	return int64(math.Round(float64(balance) * daily * 1_000_000))
+}
+
+// endsPeriod reports whether day is the last day of a compounding period.
+func (p InterestProduct) endsPeriod(day time.Time) bool {
+	if p.Compounding == CompoundDaily {
+		return true
+	}
+	return day.AddDate(0, 0, 1).Month() != day.Month()
+}
+
+func daysInMonth(day time.Time) int {
+	first := time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return first.AddDate(0, 1, -1).Day()
+}
+
+func daysInYear(day time.Time) float64 {
+	first := time.Date(day.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+	return first.AddDate(1, 0, 0).Sub(first).Hours() / 24
+}
+
+// roundMicros rounds millionths of a minor unit to the nearest minor unit.
+func roundMicros(micros int64) int64 {
+	return (micros + 500_000) / 1_000_000
+}
+
+// interestValueDate is the last second of day. Interest is dated inside the
+// period it was earned in, so it counts towards the balances of the days
+// after it even when it is paid out during a catch-up.
+func interestValueDate(day time.Time) time.Time {
+	return startOfDay(day).AddDate(0, 0, 1).Add(-time.Second)
+}
+
+func startOfDay(t time.Time) time.Time {
+	t = t.UTC()
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// InterestEngine accrues interest on every account covered by a product. It
+// keeps no state of its own: the last accrued day of each account is read
+// from storage, so after downtime CatchUp backfills every missed day.
+type InterestEngine struct {
+	store    Storage
+	products []InterestProduct
+	now      func() time.Time
+}
+
+func NewInterestEngine(store Storage, products []InterestProduct) *InterestEngine {
+	return &InterestEngine{
+		store:    store,
+		products: products,
+		now:      time.Now,
+	}
+}
+
+// Run catches up once and then again every interval until ctx is done.
+func (e *InterestEngine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := e.CatchUp(); err != nil {
+			log.Println("Interest accrual failed:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CatchUp accrues every full day that has not been accrued yet, up to and
+// including yesterday, and pays out interest for every period that ended.
+func (e *InterestEngine) CatchUp() error {
+	through := startOfDay(e.now()).AddDate(0, 0, -1)
+
+	for _, product := range e.products {
+		accounts, err := e.store.GetAccountsByType(product.AccountType)
+		if err != nil {
+			return err
+		}
+
+		for _, account := range accounts {
+			if account.IsSystem {
+				continue
+			}
+			if err := e.catchUpAccount(product, account, through); err != nil {
+				return fmt.Errorf("Account %d: %w", account.ID, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (e *InterestEngine) catchUpAccount(product InterestProduct, account *Account, through time.Time) error {
+	last, err := e.store.GetLastInterestAccrual(account.ID)
+	if err != nil {
+		return err
+	}
+
+	day := startOfDay(account.CreatedAt)
+	if !last.IsZero() {
+		day = startOfDay(last).AddDate(0, 0, 1)
+	}
+
+	for ; !day.After(through); day = day.AddDate(0, 0, 1) {
+		balance, err := e.store.GetBalanceAt(account.ID, day.AddDate(0, 0, 1))
+		if err != nil {
+			return err
+		}
+
+		apy := product.tierFor(balance)
+		accrual := &InterestAccrual{
+			AccountID:      account.ID,
+			Date:           day,
+			Balance:        balance,
+			APYBasisPoints: apy,
+			AmountMicros:   product.dailyAccrualMicros(balance, apy, day),
+		}
+		if err := e.store.RecordInterestAccrual(accrual); err != nil {
+			return err
+		}
+
+		if product.endsPeriod(day) {
+			if _, err := e.store.PostInterest(account.ID, day, systemInterestExpense, interestDescription(product, day)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func interestDescription(product InterestProduct, day time.Time) string {
+	if product.Compounding == CompoundDaily {
+		return "Interest for " + day.Format("2006-01-02")
+	}
+	return "Interest for " + day.Format("2006-01")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInterestTierFor(t *testing.T) {
+	product := defaultInterestProducts[0]
+
+	assert.Equal(t, int64(0), product.tierFor(99_99))
+	assert.Equal(t, int64(50), product.tierFor(100_00))
+	assert.Equal(t, int64(150), product.tierFor(10_000_00))
+	assert.Equal(t, int64(250), product.tierFor(1_000_000_00))
+}
+
+func TestDailyAccrualEarnsAPY(t *testing.T) {
+	product := InterestProduct{Name: "Daily", Compounding: CompoundDaily, Tiers: []InterestTier{{APYBasisPoints: 500}}}
+
+	balance := float64(1_000_000_00)
+	day := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 365; i++ {
+		balance += float64(product.dailyAccrualMicros(int64(balance), 500, day)) / 1_000_000
+		day = day.AddDate(0, 0, 1)
+	}
+
+	assert.InDelta(t, 1_050_000_00, balance, 1)
+}
+
+func TestInterestEngineCatchUp(t *testing.T) {
+	store := NewMemoryStore()
+	user, account, err := NewUserAccount("saver@mail.com", "Password1", "Test", "Saver", "", 0, 10_000_00, Customer, Savings)
+	assert.Nil(t, err)
+	account.CreatedAt = time.Date(2026, 1, 1, 9, 0, 0, 0, time.UTC)
+	assert.Nil(t, store.CreateUser(user, account))
+
+	engine := NewInterestEngine(store, defaultInterestProducts)
+	engine.now = func() time.Time { return time.Date(2026, 3, 5, 12, 0, 0, 0, time.UTC) }
+
+	assert.Nil(t, engine.CatchUp())
+
+	// Two months ended, each paying roughly a twelfth of 1.5%.
+	updated, err := store.GetAccountByID(account.ID)
+	assert.Nil(t, err)
+	assert.InDelta(t, 10_000_00+2*1241, updated.Balance, 4)
+
+	last, err := store.GetLastInterestAccrual(account.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, time.Date(2026, 3, 4, 0, 0, 0, 0, time.UTC), last)
+
+	// Running again the same day changes nothing.
+	assert.Nil(t, engine.CatchUp())
+	again, err := store.GetAccountByID(account.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, updated.Balance, again.Balance)
+}
+
+func TestPostInterestCarriesFractionsForward(t *testing.T) {
+	store := NewMemoryStore()
+	_, account := newTestCustomer(t, store, "small@mail.com", 1_00)
+
+	day := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		date := day.AddDate(0, 0, i)
+		assert.Nil(t, store.RecordInterestAccrual(&InterestAccrual{AccountID: account.ID, Date: date, Balance: 1_00, AmountMicros: 300_000}))
+
+		transaction, err := store.PostInterest(account.ID, date, systemInterestExpense, "Interest")
+		assert.Nil(t, err)
+		if i == 0 {
+			// Three tenths of a cent is too little to pay and is kept for later.
+			assert.Nil(t, transaction)
+		} else {
+			assert.Equal(t, int64(1), transaction.Amount)
+		}
+	}
+
+	updated, err := store.GetAccountByID(account.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1_01), updated.Balance)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// systemOpeningBalance is the bank's equity, which pays in the balance an
+// account is opened with.
+const systemOpeningBalance = "opening_balance"
+
+const openingBalanceDescription = "Opening balance"
+
+// JournalEntry is a balanced group of postings. Entries are append-only: a
+// mistake is corrected by posting a reversal, never by editing the original.
+type JournalEntry struct {
+	ID            int       `json:"id"`
+	Description   string    `json:"description"`
+	TransactionID int       `json:"transactionId,omitempty"`
+	ReversesEntry int       `json:"reversesEntry,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	Postings      []Posting `json:"postings"`
+}
+
+// Posting is one side of a journal entry against a single account. Type is
+// either Debit or Credit and Amount is always positive.
+type Posting struct {
+	ID        int             `json:"id"`
+	EntryID   int             `json:"entryId"`
+	AccountID int             `json:"accountId"`
+	Type      TransactionType `json:"type"`
+	Amount    int64           `json:"amount"`
+}
+
+type LedgerBalance struct {
+	AccountID     int   `json:"accountId"`
+	Balance       int64 `json:"balance"`
+	LedgerBalance int64 `json:"ledgerBalance"`
+	InBalance     bool  `json:"inBalance"`
+}
+
+func NewTransferEntry(from, to int, amount int64, description string) *JournalEntry {
+	return &JournalEntry{
+		Description: description,
+		CreatedAt:   time.Now().UTC(),
+		Postings: []Posting{
+			{AccountID: from, Type: Debit, Amount: amount},
+			{AccountID: to, Type: Credit, Amount: amount},
+		},
+	}
+}
+
+// Validate checks that the entry has at least two postings, that every
+// posting is a positive debit or credit, and that debits equal credits.
+func (e *JournalEntry) Validate() error {
+	if len(e.Postings) < 2 {
+		return invalid("Journal entry needs at least two postings")
+	}
+
+	var debits, credits int64
+	for _, p := range e.Postings {
+		if p.Amount <= 0 {
+			return invalid("Posting amount must be greater than zero")
+		}
+
+		switch p.Type {
+		case Debit:
+			debits += p.Amount
+		case Credit:
+			credits += p.Amount
+		default:
+			return invalid("Posting must be a Debit or a Credit")
+		}
+	}
+
+	if debits != credits {
+		return invalid("Journal entry is not balanced: debits %d, credits %d", debits, credits)
+	}
+
+	return nil
+}
+
+// Reversal returns a new entry that undoes e by swapping the side of every
+// posting.
+func (e *JournalEntry) Reversal(description string) *JournalEntry {
+	reversal := &JournalEntry{
+		Description:   description,
+		ReversesEntry: e.ID,
+		CreatedAt:     time.Now().UTC(),
+		Postings:      make([]Posting, 0, len(e.Postings)),
+	}
+
+	for _, p := range e.Postings {
+		side := Debit
+		if p.Type == Debit {
+			side = Credit
+		}
+		reversal.Postings = append(reversal.Postings, Posting{AccountID: p.AccountID, Type: side, Amount: p.Amount})
+	}
+
+	return reversal
+}
+
+// accountIDs returns the distinct accounts touched by the entry in ascending
+// order, which is the order rows must be locked in.
+func (e *JournalEntry) accountIDs() []int {
+	seen := map[int]bool{}
+	ids := []int{}
+	for _, p := range e.Postings {
+		if !seen[p.AccountID] {
+			seen[p.AccountID] = true
+			ids = append(ids, p.AccountID)
+		}
+	}
+	sort.Ints(ids)
+
+	return ids
+}
+
+// balanceEffects is how much the entry changes the balance of each account it
+// touches.
+func (e *JournalEntry) balanceEffects() map[int]int64 {
+	effects := map[int]int64{}
+	for _, p := range e.Postings {
+		effects[p.AccountID] += p.balanceEffect()
+	}
+
+	return effects
+}
+
+// balanceEffect is how much the posting changes the account's balance.
+func (p Posting) balanceEffect() int64 {
+	if p.Type == Credit {
+		return p.Amount
+	}
+	return -p.Amount
+}
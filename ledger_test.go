@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalEntryValidate(t *testing.T) {
+	entry := NewTransferEntry(1, 2, 500, "rent")
+	assert.Nil(t, entry.Validate())
+
+	unbalanced := &JournalEntry{Postings: []Posting{
+		{AccountID: 1, Type: Debit, Amount: 500},
+		{AccountID: 2, Type: Credit, Amount: 400},
+	}}
+	assert.NotNil(t, unbalanced.Validate())
+
+	single := &JournalEntry{Postings: []Posting{{AccountID: 1, Type: Debit, Amount: 500}}}
+	assert.NotNil(t, single.Validate())
+
+	negative := &JournalEntry{Postings: []Posting{
+		{AccountID: 1, Type: Debit, Amount: -500},
+		{AccountID: 2, Type: Credit, Amount: -500},
+	}}
+	assert.NotNil(t, negative.Validate())
+
+	transfer := &JournalEntry{Postings: []Posting{
+		{AccountID: 1, Type: Transfer, Amount: 500},
+		{AccountID: 2, Type: Credit, Amount: 500},
+	}}
+	assert.NotNil(t, transfer.Validate())
+}
+
+func TestJournalEntryReversal(t *testing.T) {
+	entry := NewTransferEntry(1, 2, 500, "rent")
+	entry.ID = 7
+
+	reversal := entry.Reversal("refund")
+	assert.Nil(t, reversal.Validate())
+	assert.Equal(t, 7, reversal.ReversesEntry)
+
+	net := map[int]int64{}
+	for _, p := range append(entry.Postings, reversal.Postings...) {
+		net[p.AccountID] += p.balanceEffect()
+	}
+	assert.Equal(t, int64(0), net[1])
+	assert.Equal(t, int64(0), net[2])
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Codes sent with a refused transfer, so clients can tell the limits apart.
+const (
+	LimitMaxTransaction = "max_transaction"
+	LimitDailyOutflow   = "daily_outflow"
+	LimitMonthlyOutflow = "monthly_outflow"
+	LimitVelocity       = "velocity"
+)
+
+// Duration is a time.Duration written as "1h30m" in JSON and YAML.
+type Duration time.Duration
+
+// TransferLimits bound the money leaving one account. Zero means no limit.
+// Daily and monthly outflow reset at midnight UTC and on the first of the
+// month; the velocity limit counts transfers over the trailing window.
+type TransferLimits struct {
+	MaxTransaction int64    `json:"maxTransaction" yaml:"maxTransaction"`
+	DailyOutflow   int64    `json:"dailyOutflow" yaml:"dailyOutflow"`
+	MonthlyOutflow int64    `json:"monthlyOutflow" yaml:"monthlyOutflow"`
+	VelocityCount  int      `json:"velocityCount" yaml:"velocityCount"`
+	VelocityWindow Duration `json:"velocityWindow" yaml:"velocityWindow"`
+}
+
+// LimitRule applies its limits to transfers out of accounts of AccountType
+// made by callers with Role. A zero AccountType or Role matches any. Every
+// matching rule is enforced.
+type LimitRule struct {
+	AccountType    AccountType `yaml:"accountType,omitempty"`
+	Role           Role        `yaml:"role,omitempty"`
+	TransferLimits `yaml:",inline"`
+}
+
+// LimitOverride replaces every rule for one account. It is set by an admin.
+type LimitOverride struct {
+	AccountID int `json:"accountId"`
+	TransferLimits
+	Reason    string    `json:"reason"`
+	SetBy     int       `json:"setBy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+type LimitOverrideRequest struct {
+	TransferLimits
+	Reason string `json:"reason"`
+}
+
+// AccountLimits are the limits that apply to transfers out of an account.
+type AccountLimits struct {
+	AccountID int              `json:"accountId"`
+	Limits    []TransferLimits `json:"limits"`
+	Override  *LimitOverride   `json:"override,omitempty"`
+}
+
+var defaultLimitRules = []LimitRule{
+	{
+		Role: Customer,
+		TransferLimits: TransferLimits{
+			MaxTransaction: 10_000_00,
+			DailyOutflow:   25_000_00,
+			MonthlyOutflow: 100_000_00,
+			VelocityCount:  20,
+			VelocityWindow: Duration(time.Hour),
+		},
+	},
+	{
+		AccountType: Savings,
+		TransferLimits: TransferLimits{
+			VelocityCount:  6,
+			VelocityWindow: Duration(30 * 24 * time.Hour),
+		},
+	},
+}
+
+func (l TransferLimits) Validate() error {
+	if l.MaxTransaction < 0 || l.DailyOutflow < 0 || l.MonthlyOutflow < 0 || l.VelocityCount < 0 || l.VelocityWindow < 0 {
+		return invalid("Limits cannot be negative")
+	}
+	if l.VelocityCount > 0 && l.VelocityWindow == 0 {
+		return invalidField("velocityWindow", "A velocity limit needs a window")
+	}
+	return nil
+}
+
+func (r LimitRule) matches(accountType AccountType, role Role) bool {
+	return (r.AccountType == 0 || r.AccountType == accountType) && (r.Role == 0 || r.Role == role)
+}
+
+// outflowFunc returns the total and the number of transfers out of an
+// account since the given time.
+type outflowFunc func(since time.Time) (int64, int, error)
+
+// checkTransferLimits refuses amount when it would break any of limits.
+// Stores call it while holding the lock on the account, so concurrent
+// transfers cannot both fit under the same limit.
+func checkTransferLimits(limits []TransferLimits, amount int64, now time.Time, outflow outflowFunc) error {
+	now = now.UTC()
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	for _, l := range limits {
+		if l.MaxTransaction > 0 && amount > l.MaxTransaction {
+			return limitExceeded(LimitMaxTransaction, "Transfers are limited to %s each", formatAmount(l.MaxTransaction))
+		}
+
+		if l.DailyOutflow > 0 {
+			total, _, err := outflow(startOfDay(now))
+			if err != nil {
+				return err
+			}
+			if total+amount > l.DailyOutflow {
+				return limitExceeded(LimitDailyOutflow, "Transfer would exceed the daily limit of %s, %s left today", formatAmount(l.DailyOutflow), formatAmount(max(l.DailyOutflow-total, 0)))
+			}
+		}
+
+		if l.MonthlyOutflow > 0 {
+			total, _, err := outflow(startOfMonth)
+			if err != nil {
+				return err
+			}
+			if total+amount > l.MonthlyOutflow {
+				return limitExceeded(LimitMonthlyOutflow, "Transfer would exceed the monthly limit of %s, %s left this month", formatAmount(l.MonthlyOutflow), formatAmount(max(l.MonthlyOutflow-total, 0)))
+			}
+		}
+
+		if l.VelocityCount > 0 {
+			_, count, err := outflow(now.Add(-time.Duration(l.VelocityWindow)))
+			if err != nil {
+				return err
+			}
+			if count >= l.VelocityCount {
+				return limitExceeded(LimitVelocity, "No more than %d transfers are allowed every %s", l.VelocityCount, l.VelocityWindow)
+			}
+		}
+	}
+
+	return nil
+}
+
+// transferLimits returns the limits for transfers out of account made by a
+// caller with role, along with the account's override if it has one.
+func (s *APIServer) transferLimits(account *Account, role Role) ([]TransferLimits, *LimitOverride, error) {
+	return resolveTransferLimits(s.store, s.limitRules, account, role)
+}
+
+func resolveTransferLimits(store Storage, rules []LimitRule, account *Account, role Role) ([]TransferLimits, *LimitOverride, error) {
+	override, err := store.GetLimitOverride(account.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if override != nil {
+		return []TransferLimits{override.TransferLimits}, override, nil
+	}
+
+	limits := []TransferLimits{}
+	for _, rule := range rules {
+		if rule.matches(account.AccountType, role) {
+			limits = append(limits, rule.TransferLimits)
+		}
+	}
+	return limits, nil, nil
+}
+
+// GET /accounts/{id}/limits
+func (s *APIServer) handleGetAccountLimits(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.store.GetAccountByID(id)
+	if err != nil {
+		return err
+	}
+
+	role := Customer
+	if p := principalFromContext(r.Context()); p != nil {
+		role = p.Role
+	}
+
+	limits, override, err := s.transferLimits(account, role)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, AccountLimits{AccountID: account.ID, Limits: limits, Override: override})
+}
+
+// PUT or DELETE /admin/accounts/{id}/limits
+func (s *APIServer) handleAccountLimitOverride(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "PUT" && r.Method != "DELETE" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.store.GetAccountByID(id); err != nil {
+		return err
+	}
+
+	before, err := s.store.GetLimitOverride(id)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "DELETE" {
+		if before == nil {
+			return notFound("Account %d has no limit override", id)
+		}
+		event := s.auditEvent(r, &AuditEvent{Action: AuditLimitOverride, TargetType: "account", TargetID: strconv.Itoa(id), Changes: auditChanges(before, nil)})
+		if err := s.store.DeleteLimitOverride(id, event); err != nil {
+			return err
+		}
+
+		return WriteJSON(w, http.StatusOK, map[string]int{"removed": id})
+	}
+
+	req := new(LimitOverrideRequest)
+	if err := readJSON(r, req); err != nil {
+		return err
+	}
+	if err := req.Validate(); err != nil {
+		return err
+	}
+	if req.Reason == "" {
+		return invalidField("reason", "A reason is required to override limits")
+	}
+
+	override := &LimitOverride{
+		AccountID:      id,
+		TransferLimits: req.TransferLimits,
+		Reason:         req.Reason,
+		UpdatedAt:      s.now().UTC(),
+	}
+	if p := principalFromContext(r.Context()); p != nil {
+		override.SetBy = p.UserID
+	}
+
+	event := s.auditEvent(r, &AuditEvent{Action: AuditLimitOverride, TargetType: "account", TargetID: strconv.Itoa(id), Changes: auditChanges(before, override)})
+	if err := s.store.SetLimitOverride(override, event); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, override)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("Duration must be a string such as \"24h\"")
+	}
+	return d.parse(s)
+}
+
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d *Duration) UnmarshalYAML(value *yaml.Node) error {
+	return d.parse(value.Value)
+}
+
+func (d *Duration) parse(s string) error {
+	if s == "" {
+		*d = 0
+		return nil
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("Invalid duration %q", s)
+	}
+	*d = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func limitCode(err error) string {
+	if limitErr, ok := err.(*LimitExceededError); ok {
+		return limitErr.Code
+	}
+	return ""
+}
+
+func TestTransferLimits(t *testing.T) {
+	store := NewMemoryStore()
+	_, from := newTestCustomer(t, store, "limited@mail.com", 1_000_00)
+	_, to := newTestCustomer(t, store, "payee@mail.com", 0)
+
+	limits := []TransferLimits{
+		{MaxTransaction: 50_00, DailyOutflow: 80_00},
+		{VelocityCount: 3, VelocityWindow: Duration(time.Hour)},
+	}
+
+	_, err := store.Transfer(from.ID, to.ID, 50_01, Transfer, "", nil, limits...)
+	assert.Equal(t, LimitMaxTransaction, limitCode(err))
+
+	_, err = store.Transfer(from.ID, to.ID, 50_00, Transfer, "", nil, limits...)
+	assert.Nil(t, err)
+	_, err = store.Transfer(from.ID, to.ID, 30_01, Transfer, "", nil, limits...)
+	assert.Equal(t, LimitDailyOutflow, limitCode(err))
+
+	_, err = store.Transfer(from.ID, to.ID, 10_00, Transfer, "", nil, limits...)
+	assert.Nil(t, err)
+	_, err = store.Transfer(from.ID, to.ID, 10_00, Transfer, "", nil, limits...)
+	assert.Nil(t, err)
+	_, err = store.Transfer(from.ID, to.ID, 1, Transfer, "", nil, limits...)
+	assert.Equal(t, LimitVelocity, limitCode(err))
+
+	// Transfers without limits, such as interest, are never refused.
+	_, err = store.Transfer(from.ID, to.ID, 100_00, Transfer, "", nil)
+	assert.Nil(t, err)
+}
+
+func TestAdminLimitOverride(t *testing.T) {
+	store := NewMemoryStore()
+	customer, from := newTestCustomer(t, store, "override@mail.com", 20_000_00)
+	_, to := newTestCustomer(t, store, "override-payee@mail.com", 0)
+	server := NewAPIServer(":0", store)
+
+	transfer := func() *httptest.ResponseRecorder {
+		body, _ := json.Marshal(TransactionRequest{FromAccount: from.ID, ToAccount: to.ID, Amount: 15_000_00})
+		req := httptest.NewRequest(http.MethodPost, "/transfer", bytes.NewReader(body))
+		req = req.WithContext(withPrincipal(req.Context(), &Principal{UserID: customer.ID, Role: Customer}))
+		rec := httptest.NewRecorder()
+		makeHTTPHandleFunc(server.handleTransaction)(rec, req)
+		return rec
+	}
+
+	rec := transfer()
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	problem := new(Problem)
+	json.NewDecoder(rec.Body).Decode(problem)
+	assert.Equal(t, LimitMaxTransaction, problem.Code)
+
+	req := httptest.NewRequest(http.MethodPut, "/admin/accounts/1/limits", bytes.NewReader([]byte(`{"maxTransaction":2000000,"reason":"House deposit"}`)))
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(from.ID)})
+	req = req.WithContext(withPrincipal(req.Context(), &Principal{UserID: 99, Role: Admin}))
+	rec = httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleAccountLimitOverride)(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	assert.Equal(t, http.StatusOK, transfer().Code)
+
+	events, _ := store.GetAuditEvents(AuditFilter{Action: AuditLimitOverride})
+	assert.Len(t, events, 1)
+}
+
+func TestLoadConfigLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	err := os.WriteFile(path, []byte(`jwtSecret: secret
+limits:
+  - role: Customer
+    accountType: Checking
+    dailyOutflow: 500000
+    velocityCount: 5
+    velocityWindow: 10m
+`), 0o600)
+	assert.Nil(t, err)
+
+	cfg, err := LoadConfig(path, env(nil))
+	assert.Nil(t, err)
+	assert.Nil(t, cfg.Validate())
+
+	assert.Len(t, cfg.Limits, 1)
+	assert.Equal(t, Customer, cfg.Limits[0].Role)
+	assert.Equal(t, Checking, cfg.Limits[0].AccountType)
+	assert.Equal(t, int64(500000), cfg.Limits[0].DailyOutflow)
+	assert.Equal(t, Duration(10*time.Minute), cfg.Limits[0].VelocityWindow)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoginPolicy slows down and then stops password guessing. Failed logins are
+// counted per login email and per client address, and a count is forgotten
+// once Window passes without a failure. After DelayAfter failures each
+// further attempt at the same email must wait BaseDelay, doubling with every
+// failure up to MaxDelay. MaxFailures failures for an email, or MaxIPFailures
+// from an address, lock it out for Lockout.
+type LoginPolicy struct {
+	MaxFailures   int           `yaml:"maxFailures"`
+	MaxIPFailures int           `yaml:"maxIPFailures"`
+	Window        time.Duration `yaml:"window"`
+	DelayAfter    int           `yaml:"delayAfter"`
+	BaseDelay     time.Duration `yaml:"baseDelay"`
+	MaxDelay      time.Duration `yaml:"maxDelay"`
+	Lockout       time.Duration `yaml:"lockout"`
+}
+
+// LoginThrottle is the recent failed logins for one email or one address.
+type LoginThrottle struct {
+	Key         string     `json:"key"`
+	Failures    int        `json:"failures"`
+	LastFailure time.Time  `json:"lastFailure"`
+	LockedUntil *time.Time `json:"lockedUntil,omitempty"`
+}
+
+var defaultLoginPolicy = LoginPolicy{
+	MaxFailures:   10,
+	MaxIPFailures: 100,
+	Window:        15 * time.Minute,
+	DelayAfter:    2,
+	BaseDelay:     time.Second,
+	MaxDelay:      30 * time.Second,
+	Lockout:       15 * time.Minute,
+}
+
+func (p LoginPolicy) Validate() error {
+	if p.MaxFailures < 1 || p.MaxIPFailures < 1 {
+		return fmt.Errorf("Login failure limits must be at least 1")
+	}
+	if p.Window <= 0 || p.Lockout <= 0 {
+		return fmt.Errorf("Login window and lockout must be positive")
+	}
+	if p.DelayAfter < 0 || p.BaseDelay < 0 || p.MaxDelay < p.BaseDelay {
+		return fmt.Errorf("Login delays cannot be negative and maxDelay must be at least baseDelay")
+	}
+	return nil
+}
+
+// loginKey is the throttle key of a login email. Counting by email rather
+// than by user means unknown addresses are throttled the same way, so the
+// answers do not reveal which addresses have an account.
+func loginKey(email string) string {
+	return "email:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+// maxMFAAttempts is how many wrong codes one partial login token can take.
+// After that the password has to be entered again for a new token.
+const maxMFAAttempts = 5
+
+func mfaKey(tokenID string) string {
+	return "mfa:" + tokenID
+}
+
+func (p LoginPolicy) maxFailures(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return p.MaxIPFailures
+	}
+	return p.MaxFailures
+}
+
+// fail counts a failed login at now. Stores call it with the throttle locked.
+func (p LoginPolicy) fail(t *LoginThrottle, now time.Time) {
+	if now.Sub(t.LastFailure) > p.Window && !t.locked(now) {
+		t.Failures = 0
+	}
+	t.Failures++
+	t.LastFailure = now
+
+	if t.Failures >= p.maxFailures(t.Key) && !t.locked(now) {
+		until := now.Add(p.Lockout)
+		t.LockedUntil = &until
+	}
+}
+
+// retryAt is the earliest another login may be tried. Only emails are
+// delayed; an address shared by many users is only ever locked out.
+func (p LoginPolicy) retryAt(t *LoginThrottle, now time.Time) time.Time {
+	if t.locked(now) {
+		return *t.LockedUntil
+	}
+	if strings.HasPrefix(t.Key, "ip:") || t.Failures <= p.DelayAfter || now.Sub(t.LastFailure) > p.Window {
+		return time.Time{}
+	}
+
+	delay := p.MaxDelay
+	if doublings := t.Failures - p.DelayAfter - 1; doublings < 20 {
+		delay = min(p.BaseDelay<<doublings, p.MaxDelay)
+	}
+	return t.LastFailure.Add(delay)
+}
+
+func (t *LoginThrottle) locked(now time.Time) bool {
+	return t.LockedUntil != nil && now.Before(*t.LockedUntil)
+}
+
+// checkLoginThrottle returns the throttle for key, or an error when a login
+// may not be tried yet.
+func (s *APIServer) checkLoginThrottle(key string, now time.Time) (*LoginThrottle, error) {
+	throttle, err := s.store.GetLoginThrottle(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if retryAt := s.loginPolicy.retryAt(throttle, now); retryAt.After(now) {
+		if throttle.locked(now) {
+			return nil, tooManyRequests(retryAt.Sub(now), "Too many failed logins, try again after %s", retryAt.Format(time.RFC3339))
+		}
+		return nil, tooManyRequests(retryAt.Sub(now), "Too many failed logins, wait before trying again")
+	}
+
+	return throttle, nil
+}
+
+// recordLoginFailure counts a failed login against the throttle and audits
+// the lockout when this is the failure that caused it.
+func (s *APIServer) recordLoginFailure(r *http.Request, before *LoginThrottle, now time.Time, targetType, targetID string) {
+	after, err := s.store.RecordLoginFailure(before.Key, now, s.loginPolicy)
+	if err != nil {
+		log.Println("Recording failed login failed:", err)
+		return
+	}
+
+	if !before.locked(now) && after.locked(now) {
+		s.audit(r, &AuditEvent{Action: AuditLoginLockout, TargetType: targetType, TargetID: targetID, Changes: auditChanges(before, after)})
+	}
+}
+
+// recordMFAFailure counts a wrong code against the partial token and revokes
+// the token once it has had maxMFAAttempts of them.
+func (s *APIServer) recordMFAFailure(principal *Principal, now time.Time) error {
+	throttle, err := s.store.RecordLoginFailure(mfaKey(principal.TokenID), now, s.loginPolicy)
+	if err != nil {
+		return err
+	}
+	if throttle.Failures < maxMFAAttempts {
+		return nil
+	}
+
+	if err := s.store.RevokeAccessToken(principal.TokenID, principal.TokenExpiresAt); err != nil {
+		return err
+	}
+	return s.store.ClearLoginFailures(throttle.Key)
+}
+
+// GET or DELETE /admin/users/{id}/lockout, where DELETE unlocks the user's
+// login email
+func (s *APIServer) handleUserLockout(w http.ResponseWriter, r *http.Request) error {
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	user, err := s.store.GetUserByID(id)
+	if err != nil {
+		return err
+	}
+	throttle, err := s.store.GetLoginThrottle(loginKey(user.Email))
+	if err != nil {
+		return err
+	}
+
+	switch r.Method {
+	case "GET":
+		return WriteJSON(w, http.StatusOK, throttle)
+	case "DELETE":
+		if err := s.store.ClearLoginFailures(throttle.Key); err != nil {
+			return err
+		}
+		s.audit(r, &AuditEvent{Action: AuditLoginUnlock, TargetType: "user", TargetID: strconv.Itoa(id), Changes: auditChanges(throttle, &LoginThrottle{Key: throttle.Key})})
+
+		return WriteJSON(w, http.StatusOK, &LoginThrottle{Key: throttle.Key})
+	}
+
+	return methodNotAllowed(r.Method)
+}
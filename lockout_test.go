@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoginDelaysThenLocksOut(t *testing.T) {
+	useTestJWTSecret(t)
+	store := NewMemoryStore()
+	server := NewAPIServer(":0", store)
+	server.loginPolicy = LoginPolicy{MaxFailures: 4, MaxIPFailures: 100, Window: time.Hour, DelayAfter: 1, BaseDelay: time.Second, MaxDelay: time.Minute, Lockout: time.Hour}
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	server.now = func() time.Time { return now }
+	user, _ := newTestCustomer(t, store, "guessed@mail.com", 0)
+
+	wrong := LoginRequest{Email: user.Email, Password: "Wrong1234"}
+	assert.Equal(t, http.StatusUnauthorized, postJSON(server.handleLogin, nil, wrong).Code)
+	assert.Equal(t, http.StatusUnauthorized, postJSON(server.handleLogin, nil, wrong).Code)
+
+	// The second failure earns a one second wait, even for the right password.
+	rec := postJSON(server.handleLogin, nil, LoginRequest{Email: user.Email, Password: "Password1"})
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	now = now.Add(time.Second)
+	assert.Equal(t, http.StatusUnauthorized, postJSON(server.handleLogin, nil, wrong).Code)
+	rec = postJSON(server.handleLogin, nil, wrong)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+
+	now = now.Add(2 * time.Second)
+	assert.Equal(t, http.StatusUnauthorized, postJSON(server.handleLogin, nil, wrong).Code)
+
+	// The fourth failure locks the email for an hour.
+	now = now.Add(10 * time.Minute)
+	rec = postJSON(server.handleLogin, nil, LoginRequest{Email: user.Email, Password: "Password1"})
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "3000", rec.Header().Get("Retry-After"))
+
+	events, err := store.GetAuditEvents(AuditFilter{Action: AuditLoginLockout, Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+	assert.Equal(t, strconv.Itoa(user.ID), events[0].TargetID)
+
+	// Other emails from the same address are not affected.
+	other, _ := newTestCustomer(t, store, "other@mail.com", 0)
+	assert.Equal(t, http.StatusOK, postJSON(server.handleLogin, nil, LoginRequest{Email: other.Email, Password: "Password1"}).Code)
+
+	now = now.Add(time.Hour)
+	assert.Equal(t, http.StatusOK, postJSON(server.handleLogin, nil, LoginRequest{Email: user.Email, Password: "Password1"}).Code)
+
+	throttle, err := store.GetLoginThrottle(loginKey(user.Email))
+	assert.Nil(t, err)
+	assert.Equal(t, 0, throttle.Failures)
+
+	loggedIn, _ := store.GetUserByID(user.ID)
+	assert.Equal(t, now, loggedIn.LastLogin)
+}
+
+func TestLoginLocksOutAddress(t *testing.T) {
+	useTestJWTSecret(t)
+	store := NewMemoryStore()
+	server := NewAPIServer(":0", store)
+	server.loginPolicy = LoginPolicy{MaxFailures: 10, MaxIPFailures: 3, Window: time.Hour, DelayAfter: 10, BaseDelay: time.Second, MaxDelay: time.Minute, Lockout: time.Hour}
+	user, _ := newTestCustomer(t, store, "sprayed@mail.com", 0)
+
+	for _, email := range []string{"a@mail.com", "b@mail.com", "c@mail.com"} {
+		assert.Equal(t, http.StatusUnauthorized, postJSON(server.handleLogin, nil, LoginRequest{Email: email, Password: "Password1"}).Code)
+	}
+
+	assert.Equal(t, http.StatusTooManyRequests, postJSON(server.handleLogin, nil, LoginRequest{Email: user.Email, Password: "Password1"}).Code)
+}
+
+func TestAdminUnlocksUser(t *testing.T) {
+	useTestJWTSecret(t)
+	store := NewMemoryStore()
+	server := NewAPIServer(":0", store)
+	server.loginPolicy.MaxFailures = 1
+	user, _ := newTestCustomer(t, store, "locked@mail.com", 0)
+
+	assert.Equal(t, http.StatusUnauthorized, postJSON(server.handleLogin, nil, LoginRequest{Email: user.Email, Password: "Wrong1234"}).Code)
+	assert.Equal(t, http.StatusTooManyRequests, postJSON(server.handleLogin, nil, LoginRequest{Email: user.Email, Password: "Password1"}).Code)
+
+	req := httptest.NewRequest(http.MethodDelete, "/", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(user.ID)})
+	req = req.WithContext(withPrincipal(req.Context(), &Principal{UserID: 99, Role: Admin}))
+	rec := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleUserLockout)(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	events, err := store.GetAuditEvents(AuditFilter{Action: AuditLoginUnlock, Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, events, 1)
+
+	assert.Equal(t, http.StatusOK, postJSON(server.handleLogin, nil, LoginRequest{Email: user.Email, Password: "Password1"}).Code)
+}
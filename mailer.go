@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Email is a plain text message to one recipient.
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email to users.
+type Mailer interface {
+	Send(*Email) error
+}
+
+// NewMailer sends through the configured SMTP server, or without one writes
+// mail to the configured file or the log.
+func NewMailer(cfg MailConfig) Mailer {
+	if cfg.SMTP.Host == "" {
+		return &FileMailer{Path: cfg.File, From: cfg.From}
+	}
+
+	mailer := &SMTPMailer{
+		Addr: net.JoinHostPort(cfg.SMTP.Host, strconv.Itoa(cfg.SMTP.Port)),
+		From: cfg.From,
+	}
+	if cfg.SMTP.Username != "" {
+		mailer.Auth = smtp.PlainAuth("", cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.Host)
+	}
+	return mailer
+}
+
+// SMTPMailer sends mail through an SMTP server, using STARTTLS when the
+// server offers it. Auth is refused over an unencrypted connection to any
+// host but localhost.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+func (m *SMTPMailer) Send(e *Email) error {
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{e.To}, e.message(m.From, time.Now()))
+}
+
+// FileMailer appends every message to the file at Path, or writes it to the
+// log when Path is empty, for running without a mail server.
+type FileMailer struct {
+	Path string
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *FileMailer) Send(e *Email) error {
+	message := e.message(m.From, time.Now())
+	if m.Path == "" {
+		log.Printf("Mail to %s:\n%s", e.To, message)
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(message, "\r\n"...)); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// message formats the email for sending. Line breaks are stripped from the
+// headers so nothing can be injected into them.
+func (e *Email) message(from string, date time.Time) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", header.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", header.Replace(e.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", header.Replace(e.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(e.Body, "\n", "\r\n"))
+
+	return []byte(b.String())
+}
@@ -1,30 +1,222 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
-)
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"gopkg.in/yaml.v3"
+)
 
 func main() {
+	configPath := flag.String("config", os.Getenv("GOBANK_CONFIG"), "path to a YAML config file")
+	listen := flag.String("listen", "", "address to listen on, overrides the config")
+	storeKind := flag.String("store", "", "storage backend: postgres or memory, overrides the config")
+	printConfig := flag.Bool("print-config", false, "print the configuration with secrets redacted and exit")
 	seed := flag.Bool("seed", false, "seed the db with admin")
+	migrate := flag.String("migrate", "", "run schema migrations and exit: up, down or status")
+	accrueInterest := flag.Bool("accrue-interest", false, "catch up on interest accrual and exit")
+	verifyAudit := flag.Bool("verify-audit", false, "verify the audit log hash chain and exit")
 	flag.Parse()
 
-	store, err := NewPostgresStore()
+	cfg, err := LoadConfig(*configPath, os.LookupEnv)
 	if err != nil {
 		log.Fatal(err)
 	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddress = *listen
+		case "store":
+			cfg.Store = *storeKind
+		}
+	})
 
-	if err := store.Init(); err != nil {
+	if *printConfig {
+		if err := yaml.NewEncoder(os.Stdout).Encode(cfg.Redacted()); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *migrate != "" {
+		if cfg.Store != "postgres" {
+			log.Fatal("-migrate only works with the postgres store")
+		}
+		if err := cfg.validateStore(); err != nil {
+			log.Fatal(err)
+		}
+		if err := runMigrateCommand(cfg, *migrate); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *verifyAudit {
+		if cfg.Store != "postgres" {
+			log.Fatal("-verify-audit only works with the postgres store")
+		}
+		if err := cfg.validateStore(); err != nil {
+			log.Fatal(err)
+		}
+		if err := runVerifyAuditCommand(cfg); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err := cfg.Validate(); err != nil {
 		log.Fatal(err)
 	}
+	setJWTSecret(cfg.JWTSecret)
+
+	var rates RateProvider
+	if cfg.FX.RatesFile != "" {
+		fileRates, err := LoadFileRates(cfg.FX.RatesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		rates = fileRates
+	}
+
+	var store Storage
+	switch cfg.Store {
+	case "postgres":
+		pgStore, err := NewPostgresStore(cfg.Database.DSN())
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := pgStore.Init(); err != nil {
+			log.Fatal(err)
+		}
+		store = pgStore
+	case "memory":
+		fmt.Println("Using in-memory store, data will be lost on exit")
+		store = NewMemoryStore()
+	}
 
 	if *seed {
 		fmt.Println("Seeding the database")
 		generateSeeds(store)
 	}
 
-	server := NewAPIServer(":3030", store)
-	server.Run()
+	interest := NewInterestEngine(store, cfg.Interest.Products)
+	if *accrueInterest {
+		err := interest.CatchUp()
+		store.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Background jobs get the same signal and must stop before the store
+	// is closed.
+	var jobs sync.WaitGroup
+	jobs.Add(6)
+	go func() {
+		defer jobs.Done()
+		interest.Run(ctx, cfg.Interest.Interval)
+	}()
+	go func() {
+		defer jobs.Done()
+		NewCreditEngine(store, cfg.Credit).Run(ctx, cfg.Interest.Interval)
+	}()
+	go func() {
+		defer jobs.Done()
+		NewTransferScheduler(store, cfg.Limits).Run(ctx, cfg.Scheduler.Interval)
+	}()
+	go func() {
+		defer jobs.Done()
+		NewReferralEngine(store, cfg.Referral).Run(ctx, cfg.Scheduler.Interval)
+	}()
+	go func() {
+		defer jobs.Done()
+		purgeIdempotencyKeys(ctx, store, time.Hour)
+	}()
+	go func() {
+		defer jobs.Done()
+		releaseExpiredHolds(ctx, store, time.Minute)
+	}()
+
+	server := NewAPIServer(cfg.ListenAddress, store)
+	server.timeouts = cfg.Server
+	server.interestProducts = cfg.Interest.Products
+	server.limitRules = cfg.Limits
+	server.rates = rates
+	server.fxSpreadBps = cfg.FX.SpreadBps
+	server.creditProduct = cfg.Credit
+	server.referralProgram = cfg.Referral
+	server.loginPolicy = cfg.Login
+	server.mailer = NewMailer(cfg.Mail)
+	server.publicURL = strings.TrimSuffix(cfg.Mail.PublicURL, "/")
+	runErr := server.Run(ctx)
+
+	stop()
+	jobs.Wait()
+	if err := store.Close(); err != nil {
+		log.Println("Closing the store failed:", err)
+	}
+
+	if runErr != nil && runErr != http.ErrServerClosed {
+		log.Fatal(runErr)
+	}
+	log.Println("Server stopped")
+}
+
+func runMigrateCommand(cfg *Config, command string) error {
+	store, err := NewPostgresStore(cfg.Database.DSN())
+	if err != nil {
+		return err
+	}
+
+	switch command {
+	case "up":
+		return store.MigrateUp()
+	case "down":
+		return store.MigrateDown()
+	case "status":
+		statuses, err := store.MigrationStatus()
+		if err != nil {
+			return err
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied {
+				applied = "applied " + status.AppliedAt.Format(time.RFC3339)
+			}
+			fmt.Printf("%4d  %-30s %s\n", status.Version, status.Name, applied)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("Unknown migrate command %q, use up, down or status", command)
+}
+
+func runVerifyAuditCommand(cfg *Config) error {
+	store, err := NewPostgresStore(cfg.Database.DSN())
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	checked, err := verifyAuditChain(store)
+	if err != nil {
+		return fmt.Errorf("Audit log verification failed after %d intact events: %w", checked, err)
+	}
+
+	fmt.Printf("Audit log intact, %d events verified\n", checked)
+	return nil
 }
@@ -0,0 +1,1884 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryStore is an in-process Storage used for tests and local development.
+// It mirrors the behaviour of PostgresStore, including unique emails and user
+// names and soft deletes, and is safe for concurrent use.
+type MemoryStore struct {
+	mu sync.RWMutex
+
+	users          map[int]*User
+	accounts       map[int]*Account
+	transactions   map[int]*Transaction
+	journalEntries map[int]*JournalEntry
+	refreshTokens  map[string]*RefreshToken
+	revokedTokens  map[string]time.Time
+	totp           map[int]*TOTPEnrollment
+	recoveryCodes  map[int]map[string]bool
+	// systemAccounts is keyed by name and currency, as in "fx/EUR".
+	systemAccounts map[string]int
+	accruals       map[int]map[time.Time]*InterestAccrual
+	idempotency    map[string]*IdempotencyRecord
+	auditLog       []*AuditEvent
+	statements     map[string]*StoredStatement
+	limitOverrides map[int]*LimitOverride
+	scheduled      map[int]*ScheduledTransfer
+	scheduledRuns  []*ScheduledTransferRun
+	holds          map[int]*Hold
+	fxConversions  []*FXConversion
+	creditCycles   map[int]map[string]*CreditCycle
+	referrals      map[int]*Referral
+	loginThrottles map[string]*LoginThrottle
+
+	nextUserID        int
+	nextAccountID     int
+	nextTransactionID int
+	nextEntryID       int
+	nextPostingID     int
+	nextRefreshID     int
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:             map[int]*User{},
+		accounts:          map[int]*Account{},
+		transactions:      map[int]*Transaction{},
+		journalEntries:    map[int]*JournalEntry{},
+		refreshTokens:     map[string]*RefreshToken{},
+		revokedTokens:     map[string]time.Time{},
+		totp:              map[int]*TOTPEnrollment{},
+		recoveryCodes:     map[int]map[string]bool{},
+		systemAccounts:    map[string]int{},
+		accruals:          map[int]map[time.Time]*InterestAccrual{},
+		idempotency:       map[string]*IdempotencyRecord{},
+		statements:        map[string]*StoredStatement{},
+		limitOverrides:    map[int]*LimitOverride{},
+		scheduled:         map[int]*ScheduledTransfer{},
+		holds:             map[int]*Hold{},
+		creditCycles:      map[int]map[string]*CreditCycle{},
+		referrals:         map[int]*Referral{},
+		loginThrottles:    map[string]*LoginThrottle{},
+		nextUserID:        1,
+		nextAccountID:     1,
+		nextTransactionID: 1,
+		nextEntryID:       1,
+		nextPostingID:     1,
+		nextRefreshID:     1,
+	}
+}
+
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+func (s *MemoryStore) CreateUser(user *User, account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, existing := range s.users {
+		if existing.Email == user.Email || existing.UserName == user.UserName {
+			return conflict("Email in use")
+		}
+	}
+
+	if user.Role != Admin {
+		for _, existing := range s.accounts {
+			if existing.AccountNumber == account.AccountNumber {
+				return fmt.Errorf("Something went wrong, please try registering again")
+			}
+		}
+	}
+
+	user.ID = s.nextUserID
+	s.nextUserID++
+	stored := *user
+	s.users[user.ID] = &stored
+
+	if user.Role != Admin {
+		account.ID = s.nextAccountID
+		account.UserID = user.ID
+		account.Currency = accountCurrency(account)
+		s.nextAccountID++
+		storedAccount := *account
+		storedAccount.Balance = 0
+		s.accounts[account.ID] = &storedAccount
+
+		if account.Balance > 0 {
+			if err := s.openingBalanceLocked(account); err != nil {
+				// Leave nothing behind, as the Postgres transaction would.
+				delete(s.accounts, account.ID)
+				delete(s.users, user.ID)
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteAccount(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, account := range s.accounts {
+		if account.UserID == id {
+			account.IsActiveAccount = false
+		}
+	}
+
+	if user, ok := s.users[id]; ok {
+		user.IsActive = false
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateUser(id int, update *UpdateUserRequest) (*User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[id]
+	if !ok || !user.IsActive {
+		return nil, notFound("Account %d not found", id)
+	}
+
+	updated := *user
+	if update.Email != nil {
+		updated.EmailVerified = updated.EmailVerified && updated.Email == *update.Email
+		updated.Email = *update.Email
+	}
+	if update.FirstName != nil {
+		updated.FirstName = *update.FirstName
+	}
+	if update.LastName != nil {
+		updated.LastName = *update.LastName
+	}
+	if update.UserName != nil {
+		updated.UserName = *update.UserName
+	}
+	if update.PhoneNumber != nil {
+		updated.PhoneVerified = updated.PhoneVerified && updated.PhoneNumber == *update.PhoneNumber
+		updated.PhoneNumber = *update.PhoneNumber
+	}
+
+	for _, existing := range s.users {
+		if existing.ID != id && (existing.Email == updated.Email || existing.UserName == updated.UserName) {
+			return nil, conflict("Email or user name in use")
+		}
+	}
+
+	s.users[id] = &updated
+
+	copied := updated
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetUsers() ([]*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := []*User{}
+	for _, id := range sortedKeys(s.users) {
+		if user := s.users[id]; user.IsActive {
+			copied := *user
+			users = append(users, &copied)
+		}
+	}
+
+	return users, nil
+}
+
+func (s *MemoryStore) GetAccounts() ([]*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	accounts := []*Account{}
+	for _, id := range sortedKeys(s.accounts) {
+		if account := s.accounts[id]; account.IsActiveAccount {
+			copied := *account
+			accounts = append(accounts, &copied)
+		}
+	}
+
+	return accounts, nil
+}
+
+func (s *MemoryStore) GetUserByID(id int) (*User, error) {
+	return s.findUser(func(u *User) bool { return u.ID == id }, notFound("Account %d not found", id))
+}
+
+func (s *MemoryStore) GetUserByEmail(email string) (*User, error) {
+	return s.findUser(func(u *User) bool { return u.Email == email }, notFound("User %v not found", email))
+}
+
+func (s *MemoryStore) GetUserByUserName(username string) (*User, error) {
+	return s.findUser(func(u *User) bool { return u.UserName == username }, notFound("User %v not found", username))
+}
+
+func (s *MemoryStore) GetAccountByUserID(id int) (*FullAccount, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	user, ok := s.users[id]
+	if !ok || !user.IsActive {
+		return nil, notFound("Account %d not found", id)
+	}
+
+	full := &FullAccount{User: *user, Accounts: []Account{}}
+	for _, accountID := range sortedKeys(s.accounts) {
+		if account := s.accounts[accountID]; account.UserID == id && account.IsActiveAccount {
+			full.Accounts = append(full.Accounts, *account)
+		}
+	}
+
+	return full, nil
+}
+
+func (s *MemoryStore) CreateAccount(account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[account.UserID]
+	if !ok || !user.IsActive {
+		return notFound("Account %d not found", account.UserID)
+	}
+	for _, existing := range s.accounts {
+		if existing.AccountNumber == account.AccountNumber {
+			return fmt.Errorf("Something went wrong, please try again")
+		}
+	}
+
+	account.ID = s.nextAccountID
+	account.Currency = accountCurrency(account)
+	s.nextAccountID++
+	copied := *account
+	copied.Balance = 0
+	s.accounts[account.ID] = &copied
+
+	if account.Balance > 0 {
+		if err := s.openingBalanceLocked(account); err != nil {
+			delete(s.accounts, account.ID)
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) CloseAccount(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkAccounts([]int{id}); err != nil {
+		return err
+	}
+	if s.accounts[id].Balance != 0 {
+		return unprocessable("Account balance must be zero to close it")
+	}
+	if s.heldLocked(id, time.Now().UTC()) != 0 {
+		return unprocessable("Account has pending holds, capture or void them before closing it")
+	}
+	s.accounts[id].IsActiveAccount = false
+
+	return nil
+}
+
+func (s *MemoryStore) Transfer(from, to int, amount int64, txType TransactionType, description string, event *AuditEvent, limits ...TransferLimits) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	transaction, err := s.limitedTransferLocked(from, to, amount, txType, description, time.Now().UTC(), limits)
+	if err != nil {
+		return nil, err
+	}
+	s.appendAuditEventLocked(event.about(transaction.ID, nil, transaction))
+
+	copied := *transaction
+	return &copied, nil
+}
+
+func (s *MemoryStore) TransferFX(c *FXConversion, txType TransactionType, description string, event *AuditEvent, limits ...TransferLimits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sourceFX, err := s.systemAccountLocked(systemFX, c.Source.Currency)
+	if err != nil {
+		return err
+	}
+	targetFX, err := s.systemAccountLocked(systemFX, c.Target.Currency)
+	if err != nil {
+		return err
+	}
+
+	// Nothing can be rolled back here, so check the second leg before the
+	// first moves any money.
+	if err := s.checkAccounts([]int{targetFX.ID, c.ToAccount}); err != nil {
+		return err
+	}
+
+	out, err := s.limitedTransferLocked(c.FromAccount, sourceFX.ID, c.Source.Amount, txType, description, c.CreatedAt, limits)
+	if err != nil {
+		return err
+	}
+	in, err := s.transferLocked(targetFX.ID, c.ToAccount, c.Target.Amount, txType, description, c.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	c.ID = len(s.fxConversions) + 1
+	c.FromTransaction = out.ID
+	c.ToTransaction = in.ID
+	copied := *c
+	s.fxConversions = append(s.fxConversions, &copied)
+	s.appendAuditEventLocked(event.about(c.ID, nil, c))
+
+	return nil
+}
+
+// limitedTransferLocked is the in-memory equivalent of limitedTransferTx.
+func (s *MemoryStore) limitedTransferLocked(from, to int, amount int64, txType TransactionType, description string, now time.Time, limits []TransferLimits) (*Transaction, error) {
+	if len(limits) > 0 {
+		if err := s.checkAccounts([]int{from, to}); err != nil {
+			return nil, err
+		}
+		if err := s.checkLimitsLocked(from, amount, now, limits); err != nil {
+			return nil, err
+		}
+	}
+
+	return s.transferLocked(from, to, amount, txType, description, now)
+}
+
+// checkLimitsLocked is the in-memory equivalent of checkLimitsTx.
+func (s *MemoryStore) checkLimitsLocked(from int, amount int64, now time.Time, limits []TransferLimits) error {
+	return checkTransferLimits(limits, amount, now, func(since time.Time) (int64, int, error) {
+		var (
+			total int64
+			count int
+		)
+		for _, t := range s.transactions {
+			if t.FromAccount == from && !t.CreatedAt.Before(since) {
+				total += t.Amount
+				count++
+			}
+		}
+		return total, count, nil
+	})
+}
+
+// transferLocked is the in-memory equivalent of transferTx. The caller must
+// hold the write lock.
+func (s *MemoryStore) transferLocked(from, to int, amount int64, txType TransactionType, description string, createdAt time.Time) (*Transaction, error) {
+	if amount <= 0 {
+		return nil, invalidField("amount", "Transfer amount must be greater than zero")
+	}
+	if from == to {
+		return nil, unprocessable("Cannot transfer to the same account")
+	}
+
+	if err := s.checkAccounts([]int{from, to}); err != nil {
+		return nil, err
+	}
+	if err := s.checkFundsLocked(from, amount, createdAt); err != nil {
+		return nil, err
+	}
+
+	return s.insertTransferLocked(&Transaction{
+		FromAccount:     from,
+		ToAccount:       to,
+		Amount:          amount,
+		Description:     description,
+		CreatedAt:       createdAt,
+		TransactionType: txType,
+	})
+}
+
+// checkFundsLocked is the in-memory equivalent of checkFunds.
+func (s *MemoryStore) checkFundsLocked(accountID int, amount int64, now time.Time) error {
+	if account := s.accounts[accountID]; !account.IsSystem && account.Balance-s.heldLocked(accountID, now)+account.CreditLimit < amount {
+		return unprocessable("Insufficient funds")
+	}
+	return nil
+}
+
+// openingBalanceLocked is the in-memory equivalent of openingBalanceTx. The
+// stored account must have a zero balance.
+func (s *MemoryStore) openingBalanceLocked(account *Account) error {
+	equity, err := s.systemAccountLocked(systemOpeningBalance, account.Currency)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.insertTransferLocked(&Transaction{
+		FromAccount:     equity.ID,
+		ToAccount:       account.ID,
+		Amount:          account.Balance,
+		Description:     openingBalanceDescription,
+		CreatedAt:       account.CreatedAt,
+		TransactionType: Credit,
+	})
+	return err
+}
+
+// insertTransferLocked is the in-memory equivalent of insertTransferTx.
+func (s *MemoryStore) insertTransferLocked(transaction *Transaction) (*Transaction, error) {
+	transaction.ID = s.nextTransactionID
+	s.nextTransactionID++
+
+	// The transaction is only kept once its journal entry is posted.
+	entry := NewTransferEntry(transaction.FromAccount, transaction.ToAccount, transaction.Amount, transaction.Description)
+	entry.TransactionID = transaction.ID
+	entry.CreatedAt = transaction.CreatedAt
+	if err := s.insertJournalEntry(entry); err != nil {
+		return nil, err
+	}
+	s.transactions[transaction.ID] = transaction
+
+	return transaction, nil
+}
+
+func (s *MemoryStore) PostJournalEntry(entry *JournalEntry) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkAccounts(entry.accountIDs()); err != nil {
+		return err
+	}
+
+	return s.insertJournalEntry(entry)
+}
+
+func (s *MemoryStore) ReverseJournalEntry(id int, description string, event *AuditEvent) (*JournalEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	original, ok := s.journalEntries[id]
+	if !ok {
+		return nil, notFound("Journal entry %d not found", id)
+	}
+	if original.ReversesEntry != 0 {
+		return nil, unprocessable("Journal entry %d is itself a reversal", id)
+	}
+	for _, entry := range s.journalEntries {
+		if entry.ReversesEntry == id {
+			return nil, conflict("Journal entry %d has already been reversed", id)
+		}
+	}
+
+	reversal := original.Reversal(description)
+	if err := s.checkAccounts(reversal.accountIDs()); err != nil {
+		return nil, err
+	}
+	effects := reversal.balanceEffects()
+	for _, accountID := range reversal.accountIDs() {
+		if effect := effects[accountID]; effect < 0 {
+			if err := s.checkFundsLocked(accountID, -effect, reversal.CreatedAt); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if original.TransactionID != 0 {
+		forward := s.transactions[original.TransactionID]
+		transaction := &Transaction{
+			ID:              s.nextTransactionID,
+			FromAccount:     forward.ToAccount,
+			ToAccount:       forward.FromAccount,
+			Amount:          forward.Amount,
+			Description:     description,
+			CreatedAt:       reversal.CreatedAt,
+			TransactionType: forward.TransactionType,
+		}
+		s.nextTransactionID++
+		s.transactions[transaction.ID] = transaction
+		reversal.TransactionID = transaction.ID
+	}
+
+	if err := s.insertJournalEntry(reversal); err != nil {
+		return nil, err
+	}
+	s.appendAuditEventLocked(event.about(id, nil, reversal))
+
+	return copyJournalEntry(reversal), nil
+}
+
+func (s *MemoryStore) GetJournalEntry(id int) (*JournalEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entry, ok := s.journalEntries[id]
+	if !ok {
+		return nil, notFound("Journal entry %d not found", id)
+	}
+
+	return copyJournalEntry(entry), nil
+}
+
+func (s *MemoryStore) GetJournalEntriesByAccount(accountID int) ([]*JournalEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries := []*JournalEntry{}
+	for _, id := range sortedKeys(s.journalEntries) {
+		entry := s.journalEntries[id]
+		for _, p := range entry.Postings {
+			if p.AccountID == accountID {
+				entries = append(entries, copyJournalEntry(entry))
+				break
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+func (s *MemoryStore) GetLedgerBalance(accountID int) (*LedgerBalance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok := s.accounts[accountID]
+	if !ok {
+		return nil, notFound("Account %d not found", accountID)
+	}
+
+	ledger := &LedgerBalance{AccountID: accountID, Balance: account.Balance}
+	for _, entry := range s.journalEntries {
+		for _, p := range entry.Postings {
+			if p.AccountID == accountID {
+				ledger.LedgerBalance += p.balanceEffect()
+			}
+		}
+	}
+	ledger.InBalance = ledger.Balance == ledger.LedgerBalance
+
+	return ledger, nil
+}
+
+func (s *MemoryStore) GetAccountByID(id int) (*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok := s.accounts[id]
+	if !ok {
+		return nil, notFound("Account %d not found", id)
+	}
+
+	copied := *account
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetTransactionHistory(accountID int, filter TransactionFilter) ([]*TransactionHistoryEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if _, ok := s.accounts[accountID]; !ok {
+		return nil, notFound("Account %d not found", accountID)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+
+	// Running balances are summed forward through the journal, which holds
+	// every change to the balance, including the ones that have no
+	// transaction.
+	balances := map[int]int64{}
+	var balance int64
+	for _, id := range sortedKeys(s.journalEntries) {
+		entry := s.journalEntries[id]
+		effect, ok := entry.balanceEffects()[accountID]
+		if !ok {
+			continue
+		}
+		balance += effect
+		if entry.TransactionID != 0 {
+			balances[entry.TransactionID] = balance
+		}
+	}
+
+	ids := sortedKeys(s.transactions)
+	entries := []*TransactionHistoryEntry{}
+
+	for i := len(ids) - 1; i >= 0 && len(entries) < limit; i-- {
+		t := s.transactions[ids[i]]
+		if t.FromAccount != accountID && t.ToAccount != accountID {
+			continue
+		}
+
+		runningBalance := balances[t.ID]
+
+		if filter.Cursor != 0 && t.ID >= filter.Cursor {
+			continue
+		}
+		if !filter.matches(accountID, t) {
+			continue
+		}
+
+		entries = append(entries, &TransactionHistoryEntry{Transaction: *t, RunningBalance: runningBalance})
+	}
+
+	return entries, nil
+}
+
+func (s *MemoryStore) GetAccountsByType(accType AccountType) ([]*Account, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	accounts := []*Account{}
+	for _, id := range sortedKeys(s.accounts) {
+		if account := s.accounts[id]; account.AccountType == accType && account.IsActiveAccount {
+			copied := *account
+			accounts = append(accounts, &copied)
+		}
+	}
+
+	return accounts, nil
+}
+
+func (s *MemoryStore) GetSystemAccount(name string, currency Currency) (*Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, err := s.systemAccountLocked(name, currency)
+	if err != nil {
+		return nil, err
+	}
+
+	copied := *account
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetBalanceAt(accountID int, at time.Time) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok := s.accounts[accountID]
+	if !ok {
+		return 0, notFound("Account %d not found", accountID)
+	}
+
+	var balance int64
+	for _, entry := range s.journalEntries {
+		if entry.CreatedAt.Before(at) {
+			balance += entry.balanceEffects()[account.ID]
+		}
+	}
+
+	return balance, nil
+}
+
+func (s *MemoryStore) GetLastInterestAccrual(accountID int) (time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var last time.Time
+	for day := range s.accruals[accountID] {
+		if day.After(last) {
+			last = day
+		}
+	}
+
+	return last, nil
+}
+
+func (s *MemoryStore) RecordInterestAccrual(accrual *InterestAccrual) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	day := startOfDay(accrual.Date)
+	if s.accruals[accrual.AccountID] == nil {
+		s.accruals[accrual.AccountID] = map[time.Time]*InterestAccrual{}
+	}
+	if _, exists := s.accruals[accrual.AccountID][day]; exists {
+		return nil
+	}
+
+	copied := *accrual
+	copied.Date = day
+	s.accruals[accrual.AccountID][day] = &copied
+
+	return nil
+}
+
+func (s *MemoryStore) PostInterest(accountID int, through time.Time, systemAccount, description string) (*Transaction, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[accountID]
+	if !ok {
+		return nil, notFound("Account %d not found", accountID)
+	}
+	source, err := s.systemAccountLocked(systemAccount, account.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	unpaid := []*InterestAccrual{}
+	var micros int64
+	for day, accrual := range s.accruals[accountID] {
+		if !day.After(through) && !accrual.Posted {
+			unpaid = append(unpaid, accrual)
+			micros += accrual.AmountMicros
+		}
+	}
+
+	amount := roundMicros(micros)
+	if amount <= 0 {
+		return nil, nil
+	}
+
+	transaction, err := s.transferLocked(source.ID, accountID, amount, Credit, description, interestValueDate(through))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, accrual := range unpaid {
+		accrual.Posted = true
+		accrual.TransactionID = transaction.ID
+	}
+
+	copied := *transaction
+	return &copied, nil
+}
+
+// systemAccountLocked returns the named system account in currency, opening
+// it and the system user that owns it on first use. The caller must hold the
+// write lock.
+func (s *MemoryStore) systemAccountLocked(name string, currency Currency) (*Account, error) {
+	key := name + "/" + string(currency)
+	if id, ok := s.systemAccounts[key]; ok {
+		return s.accounts[id], nil
+	}
+
+	var owner *User
+	for _, user := range s.users {
+		if user.Email == systemUserEmail {
+			owner = user
+		}
+	}
+	if owner == nil {
+		owner = &User{
+			ID:        s.nextUserID,
+			Email:     systemUserEmail,
+			Password:  "!",
+			FirstName: "Bank",
+			LastName:  "System",
+			UserName:  "$bank.system",
+			CreatedAt: time.Now().UTC(),
+			Role:      Admin,
+		}
+		s.nextUserID++
+		s.users[owner.ID] = owner
+	}
+
+	account := &Account{
+		ID:              s.nextAccountID,
+		UserID:          owner.ID,
+		CreatedAt:       time.Now().UTC(),
+		AccountType:     Checking,
+		Currency:        currency,
+		IsActiveAccount: true,
+		IsSystem:        true,
+	}
+	s.nextAccountID++
+	s.accounts[account.ID] = account
+	s.systemAccounts[key] = account.ID
+
+	return account, nil
+}
+
+func (s *MemoryStore) CreateRefreshToken(token *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.insertRefreshToken(token)
+}
+
+func (s *MemoryStore) GetRefreshToken(tokenHash string) (*RefreshToken, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	token, ok := s.refreshTokens[tokenHash]
+	if !ok {
+		return nil, notFound("Refresh token not found")
+	}
+
+	copied := *token
+	return &copied, nil
+}
+
+func (s *MemoryStore) RotateRefreshToken(oldHash string, next *RefreshToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.refreshTokens[oldHash]
+	if !ok || current.isRevoked() {
+		return conflict("Refresh token already used")
+	}
+
+	revokedAt := next.CreatedAt
+	current.RevokedAt = &revokedAt
+	current.ReplacedBy = next.TokenHash
+
+	return s.insertRefreshToken(next)
+}
+
+func (s *MemoryStore) RevokeRefreshTokenFamily(familyID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, token := range s.refreshTokens {
+		if token.FamilyID == familyID && !token.isRevoked() {
+			token.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revokedTokens[jti] = expiresAt
+
+	return nil
+}
+
+func (s *MemoryStore) UseToken(jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, used := s.revokedTokens[jti]; used {
+		return invalidField("token", "Link has already been used")
+	}
+	s.revokedTokens[jti] = expiresAt
+
+	return nil
+}
+
+func (s *MemoryStore) RevokeUserRefreshTokens(userID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now().UTC()
+	for _, token := range s.refreshTokens {
+		if token.UserID == userID && !token.isRevoked() {
+			token.RevokedAt = &now
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) VerifyEmail(userID int, email string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok || !user.IsActive || user.Email != email {
+		return invalidField("token", "Link is invalid or has expired")
+	}
+	user.EmailVerified = true
+
+	return nil
+}
+
+func (s *MemoryStore) SetPassword(userID int, hash string, changedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.users[userID]
+	if !ok || !user.IsActive {
+		return notFound("Account %d not found", userID)
+	}
+	user.Password = hash
+	user.PasswordChangedAt = changedAt
+
+	return nil
+}
+
+func (s *MemoryStore) IsAccessTokenRevoked(jti string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, revoked := s.revokedTokens[jti]
+
+	return revoked, nil
+}
+
+func (s *MemoryStore) SaveTOTPEnrollment(enrollment *TOTPEnrollment) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.totp[enrollment.UserID]; ok && existing.Enabled {
+		return conflict("Two-factor authentication is already enabled")
+	}
+
+	copied := *enrollment
+	copied.Enabled = false
+	copied.ConfirmedAt = nil
+	copied.LastUsedStep = 0
+	s.totp[enrollment.UserID] = &copied
+
+	return nil
+}
+
+func (s *MemoryStore) GetTOTPEnrollment(userID int) (*TOTPEnrollment, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	enrollment, ok := s.totp[userID]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *enrollment
+	return &copied, nil
+}
+
+func (s *MemoryStore) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrollment, ok := s.totp[userID]
+	if !ok || enrollment.Enabled {
+		return conflict("No pending two-factor enrollment")
+	}
+
+	now := time.Now().UTC()
+	enrollment.Enabled = true
+	enrollment.ConfirmedAt = &now
+
+	codes := map[string]bool{}
+	for _, hash := range recoveryCodeHashes {
+		codes[hash] = true
+	}
+	s.recoveryCodes[userID] = codes
+
+	return nil
+}
+
+func (s *MemoryStore) UseTOTPStep(userID int, step int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	enrollment, ok := s.totp[userID]
+	if !ok || enrollment.LastUsedStep >= step {
+		return conflict("Two-factor code already used")
+	}
+	enrollment.LastUsedStep = step
+
+	return nil
+}
+
+func (s *MemoryStore) UseRecoveryCode(userID int, codeHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.recoveryCodes[userID][codeHash] {
+		return notFound("Recovery code not found")
+	}
+	delete(s.recoveryCodes[userID], codeHash)
+
+	return nil
+}
+
+func (s *MemoryStore) insertRefreshToken(token *RefreshToken) error {
+	if _, exists := s.refreshTokens[token.TokenHash]; exists {
+		return conflict("Refresh token already exists")
+	}
+
+	token.ID = s.nextRefreshID
+	s.nextRefreshID++
+	copied := *token
+	s.refreshTokens[token.TokenHash] = &copied
+
+	return nil
+}
+
+func (s *MemoryStore) findUser(match func(*User) bool, notFound error) (*User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, user := range s.users {
+		if user.IsActive && match(user) {
+			copied := *user
+			return &copied, nil
+		}
+	}
+
+	return nil, notFound
+}
+
+// checkAccounts is the in-memory equivalent of lockAccounts. The caller must
+// hold the write lock.
+func (s *MemoryStore) checkAccounts(ids []int) error {
+	currencies := map[int]Currency{}
+	for _, id := range ids {
+		account, ok := s.accounts[id]
+		if !ok {
+			return notFound("Account %d not found", id)
+		}
+		if !account.IsActiveAccount {
+			return unprocessable("Account %d is not active", id)
+		}
+		currencies[id] = account.Currency
+	}
+
+	return checkSameCurrency(ids, currencies)
+}
+
+// insertJournalEntry stores the entry and applies its postings to the account
+// balances. The caller must hold the write lock.
+func (s *MemoryStore) insertJournalEntry(entry *JournalEntry) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+
+	entry.ID = s.nextEntryID
+	s.nextEntryID++
+
+	for i := range entry.Postings {
+		p := &entry.Postings[i]
+		p.ID = s.nextPostingID
+		p.EntryID = entry.ID
+		s.nextPostingID++
+
+		s.accounts[p.AccountID].Balance += p.balanceEffect()
+	}
+
+	s.journalEntries[entry.ID] = copyJournalEntry(entry)
+
+	return nil
+}
+
+func copyJournalEntry(entry *JournalEntry) *JournalEntry {
+	copied := *entry
+	copied.Postings = append([]Posting{}, entry.Postings...)
+
+	return &copied
+}
+
+func sortedKeys[V any](m map[int]V) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+
+	return keys
+}
+
+func idempotencyMapKey(scope, key string) string {
+	return scope + "\x00" + key
+}
+
+func (s *MemoryStore) BeginIdempotentRequest(record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mapKey := idempotencyMapKey(record.Scope, record.Key)
+	if existing, ok := s.idempotency[mapKey]; ok && !existing.isExpired(record.CreatedAt) {
+		copied := *existing
+		copied.Body = append([]byte{}, existing.Body...)
+		return &copied, nil
+	}
+
+	copied := *record
+	copied.Completed = false
+	s.idempotency[mapKey] = &copied
+
+	return nil, nil
+}
+
+func (s *MemoryStore) CompleteIdempotentRequest(record *IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.idempotency[idempotencyMapKey(record.Scope, record.Key)]
+	if !ok {
+		return notFound("Idempotency key %s not found", record.Key)
+	}
+
+	existing.Completed = true
+	existing.StatusCode = record.StatusCode
+	existing.Body = append([]byte{}, record.Body...)
+	existing.ExpiresAt = record.ExpiresAt
+
+	return nil
+}
+
+func (s *MemoryStore) ReleaseIdempotencyKey(scope, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mapKey := idempotencyMapKey(scope, key)
+	if existing, ok := s.idempotency[mapKey]; ok && !existing.Completed {
+		delete(s.idempotency, mapKey)
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteExpiredIdempotencyKeys(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for mapKey, record := range s.idempotency {
+		if record.isExpired(now) {
+			delete(s.idempotency, mapKey)
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) AppendAuditEvent(event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.appendAuditEventLocked(event)
+
+	return nil
+}
+
+// appendAuditEventLocked chains event, if there is one, onto the log. Callers
+// hold the write lock, so the event lands with the change it records.
+func (s *MemoryStore) appendAuditEventLocked(event *AuditEvent) {
+	if event == nil {
+		return
+	}
+
+	prevHash := ""
+	if n := len(s.auditLog); n > 0 {
+		prevHash = s.auditLog[n-1].Hash
+	}
+
+	event.seal(prevHash)
+	event.ID = len(s.auditLog) + 1
+
+	copied := *event
+	s.auditLog = append(s.auditLog, &copied)
+}
+
+func (s *MemoryStore) GetAuditEvents(filter AuditFilter) ([]*AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+
+	events := []*AuditEvent{}
+	for i := len(s.auditLog) - 1; i >= 0 && len(events) < limit; i-- {
+		if filter.matches(s.auditLog[i]) {
+			copied := *s.auditLog[i]
+			events = append(events, &copied)
+		}
+	}
+
+	return events, nil
+}
+
+func (s *MemoryStore) GetAuditChain(afterID, limit int) ([]*AuditEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	events := []*AuditEvent{}
+	for _, event := range s.auditLog {
+		if event.ID > afterID && len(events) < limit {
+			copied := *event
+			events = append(events, &copied)
+		}
+	}
+
+	return events, nil
+}
+
+func statementKey(accountID int, period, format string) string {
+	return fmt.Sprintf("%d/%s/%s", accountID, period, format)
+}
+
+func (s *MemoryStore) GetStatement(accountID int, period, format string) (*StoredStatement, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	statement, ok := s.statements[statementKey(accountID, period, format)]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *statement
+	copied.Content = append([]byte{}, statement.Content...)
+	return &copied, nil
+}
+
+func (s *MemoryStore) SaveStatement(statement *StoredStatement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := statementKey(statement.AccountID, statement.Period, statement.Format)
+	if _, exists := s.statements[key]; exists {
+		return nil
+	}
+
+	copied := *statement
+	copied.Content = append([]byte{}, statement.Content...)
+	s.statements[key] = &copied
+
+	return nil
+}
+
+func (s *MemoryStore) GetLimitOverride(accountID int) (*LimitOverride, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	override, ok := s.limitOverrides[accountID]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *override
+	return &copied, nil
+}
+
+func (s *MemoryStore) SetLimitOverride(override *LimitOverride, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	copied := *override
+	s.limitOverrides[override.AccountID] = &copied
+	s.appendAuditEventLocked(event)
+
+	return nil
+}
+
+func (s *MemoryStore) DeleteLimitOverride(accountID int, event *AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.limitOverrides, accountID)
+	s.appendAuditEventLocked(event)
+	return nil
+}
+
+func (s *MemoryStore) CreateScheduledTransfer(st *ScheduledTransfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st.ID = len(s.scheduled) + 1
+	copied := *st
+	s.scheduled[st.ID] = &copied
+
+	return nil
+}
+
+func (s *MemoryStore) GetScheduledTransfer(id int) (*ScheduledTransfer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	st, ok := s.scheduled[id]
+	if !ok {
+		return nil, notFound("Scheduled transfer %d not found", id)
+	}
+
+	copied := *st
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetScheduledTransfersByUser(userID int) ([]*ScheduledTransfer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	transfers := []*ScheduledTransfer{}
+	for _, id := range sortedKeys(s.scheduled) {
+		if st := s.scheduled[id]; st.UserID == userID {
+			copied := *st
+			transfers = append(transfers, &copied)
+		}
+	}
+
+	return transfers, nil
+}
+
+func (s *MemoryStore) UpdateScheduledTransfer(st, previous *ScheduledTransfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.scheduled[st.ID]
+	if !ok {
+		return notFound("Scheduled transfer %d not found", st.ID)
+	}
+	if stored.Status != previous.Status || !stored.NextRunAt.Equal(previous.NextRunAt) || stored.Attempts != previous.Attempts {
+		return conflict("Scheduled transfer %d changed, try again", st.ID)
+	}
+
+	stored.Status = st.Status
+	stored.NextRunAt = st.NextRunAt
+	stored.Attempts = st.Attempts
+	stored.UpdatedAt = st.UpdatedAt
+
+	return nil
+}
+
+func (s *MemoryStore) GetDueScheduledTransfers(now time.Time, limit int) ([]*ScheduledTransfer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	due := []*ScheduledTransfer{}
+	for _, st := range s.scheduled {
+		if st.Status == ScheduledActive && !st.NextRunAt.After(now) {
+			copied := *st
+			due = append(due, &copied)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].NextRunAt.Before(due[j].NextRunAt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	return due, nil
+}
+
+func (s *MemoryStore) RunScheduledTransfer(st *ScheduledTransfer, now time.Time, limits []TransferLimits) (*ScheduledTransferRun, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.scheduled[st.ID]
+	if !ok || current.Status != ScheduledActive || current.NextRunAt.After(now) {
+		return nil, nil
+	}
+
+	run := &ScheduledTransferRun{
+		ID:                  len(s.scheduledRuns) + 1,
+		ScheduledTransferID: current.ID,
+		Attempt:             current.Attempts + 1,
+		RanAt:               now,
+		Status:              RunSucceeded,
+	}
+
+	transaction, runErr := s.limitedTransferLocked(current.FromAccount, current.ToAccount, current.Amount, Transfer, current.Description, now, limits)
+	if runErr != nil {
+		run.Status = RunFailed
+		run.Error = runError(runErr)
+	} else {
+		run.TransactionID = transaction.ID
+	}
+
+	updated := *current
+	if err := updated.recordRun(now, runErr); err != nil {
+		return nil, err
+	}
+	*current = updated
+	s.scheduledRuns = append(s.scheduledRuns, run)
+
+	copied := *run
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetScheduledTransferRuns(scheduledTransferID int) ([]*ScheduledTransferRun, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	runs := []*ScheduledTransferRun{}
+	for _, run := range s.scheduledRuns {
+		if run.ScheduledTransferID == scheduledTransferID {
+			copied := *run
+			runs = append(runs, &copied)
+		}
+	}
+
+	return runs, nil
+}
+
+// heldLocked is the in-memory equivalent of heldAmount. The caller must hold
+// the lock.
+func (s *MemoryStore) heldLocked(accountID int, now time.Time) int64 {
+	var held int64
+	for _, hold := range s.holds {
+		if hold.AccountID == accountID && hold.Status == HoldPending && hold.ExpiresAt.After(now) {
+			held += hold.Amount
+		}
+	}
+	return held
+}
+
+func (s *MemoryStore) GetAccountBalance(accountID int, now time.Time) (*AccountBalance, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	account, ok := s.accounts[accountID]
+	if !ok {
+		return nil, notFound("Account %d not found", accountID)
+	}
+
+	held := s.heldLocked(accountID, now)
+	return &AccountBalance{
+		AccountID:        accountID,
+		LedgerBalance:    account.Balance,
+		HeldAmount:       held,
+		AvailableBalance: account.Balance - held + account.CreditLimit,
+	}, nil
+}
+
+func (s *MemoryStore) AuthorizeHold(hold *Hold, event *AuditEvent, limits ...TransferLimits) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkAccounts([]int{hold.AccountID}); err != nil {
+		return err
+	}
+	if err := s.checkLimitsLocked(hold.AccountID, hold.Amount, hold.CreatedAt, limits); err != nil {
+		return err
+	}
+	if err := s.checkFundsLocked(hold.AccountID, hold.Amount, hold.CreatedAt); err != nil {
+		return err
+	}
+
+	hold.ID = len(s.holds) + 1
+	copied := *hold
+	s.holds[hold.ID] = &copied
+	s.appendAuditEventLocked(event.about(hold.ID, nil, hold))
+
+	return nil
+}
+
+func (s *MemoryStore) GetHold(id int) (*Hold, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hold, ok := s.holds[id]
+	if !ok {
+		return nil, notFound("Hold %d not found", id)
+	}
+
+	copied := *hold
+	return &copied, nil
+}
+
+func (s *MemoryStore) GetHoldsByAccount(accountID int) ([]*Hold, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := sortedKeys(s.holds)
+	holds := []*Hold{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		if hold := s.holds[ids[i]]; hold.AccountID == accountID {
+			copied := *hold
+			holds = append(holds, &copied)
+		}
+	}
+
+	return holds, nil
+}
+
+func (s *MemoryStore) CaptureHold(id int, amount int64, now time.Time, event *AuditEvent, limits ...TransferLimits) (*Hold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hold, ok := s.holds[id]
+	if !ok {
+		return nil, notFound("Hold %d not found", id)
+	}
+
+	amount, err := checkHoldCapture(hold, amount, now)
+	if err != nil {
+		return nil, err
+	}
+
+	// Close the hold first so its own reservation does not count, and
+	// reopen it if the transfer fails.
+	before := *hold
+	hold.Status = HoldCaptured
+	transaction, err := s.limitedTransferLocked(hold.AccountID, hold.ToAccount, amount, Debit, hold.Description, now, limits)
+	if err != nil {
+		*hold = before
+		return nil, err
+	}
+
+	hold.CapturedAmount = amount
+	hold.TransactionID = transaction.ID
+	hold.ClosedAt = &now
+	s.appendAuditEventLocked(event.about(id, &before, hold))
+
+	copied := *hold
+	return &copied, nil
+}
+
+func (s *MemoryStore) VoidHold(id int, now time.Time, event *AuditEvent) (*Hold, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hold, ok := s.holds[id]
+	if !ok {
+		return nil, notFound("Hold %d not found", id)
+	}
+	if err := checkHoldPending(hold, now); err != nil {
+		return nil, err
+	}
+
+	before := *hold
+	hold.Status = HoldReleased
+	hold.ClosedAt = &now
+	s.appendAuditEventLocked(event.about(id, &before, hold))
+
+	copied := *hold
+	return &copied, nil
+}
+
+func (s *MemoryStore) ExpireHolds(now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	expired := 0
+	for _, hold := range s.holds {
+		if hold.Status == HoldPending && !hold.ExpiresAt.After(now) {
+			closedAt := hold.ExpiresAt
+			hold.Status = HoldExpired
+			hold.ClosedAt = &closedAt
+			expired++
+		}
+	}
+
+	return expired, nil
+}
+
+func (s *MemoryStore) SetCreditLimit(accountID int, limit int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	account, ok := s.accounts[accountID]
+	if !ok {
+		return notFound("Account %d not found", accountID)
+	}
+	account.CreditLimit = limit
+
+	return nil
+}
+
+func (s *MemoryStore) GetInflow(accountID int, from, to time.Time) (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var total int64
+	for _, t := range s.transactions {
+		if t.ToAccount == accountID && !t.CreatedAt.Before(from) && t.CreatedAt.Before(to) {
+			total += t.Amount
+		}
+	}
+
+	return total, nil
+}
+
+func (s *MemoryStore) GetCreditCycles(accountID int) ([]*CreditCycle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	periods := []string{}
+	for period := range s.creditCycles[accountID] {
+		periods = append(periods, period)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(periods)))
+
+	cycles := []*CreditCycle{}
+	for _, period := range periods {
+		copied := *s.creditCycles[accountID][period]
+		cycles = append(cycles, &copied)
+	}
+
+	return cycles, nil
+}
+
+func (s *MemoryStore) GetCreditCycle(accountID int, period string) (*CreditCycle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	cycle, ok := s.creditCycles[accountID][period]
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *cycle
+	return &copied, nil
+}
+
+// chargeLocked is the in-memory equivalent of chargeTx.
+func (s *MemoryStore) chargeLocked(from int, systemAccount string, amount int64, description string, createdAt time.Time) error {
+	account, ok := s.accounts[from]
+	if !ok {
+		return notFound("Account %d not found", from)
+	}
+	income, err := s.systemAccountLocked(systemAccount, account.Currency)
+	if err != nil {
+		return err
+	}
+	if err := s.checkAccounts([]int{from, income.ID}); err != nil {
+		return err
+	}
+
+	_, err = s.insertTransferLocked(&Transaction{
+		FromAccount:     from,
+		ToAccount:       income.ID,
+		Amount:          amount,
+		Description:     description,
+		CreatedAt:       createdAt,
+		TransactionType: Debit,
+	})
+	return err
+}
+
+func (s *MemoryStore) CloseCreditCycle(cycle *CreditCycle, systemAccount, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.creditCycles[cycle.AccountID][cycle.Period]; exists {
+		return conflict("Cycle %s of account %d is already closed", cycle.Period, cycle.AccountID)
+	}
+
+	if cycle.InterestCharged > 0 {
+		if err := s.chargeLocked(cycle.AccountID, systemAccount, cycle.InterestCharged, description, creditCharge(cycle.ClosedAt)); err != nil {
+			return err
+		}
+	}
+
+	if s.creditCycles[cycle.AccountID] == nil {
+		s.creditCycles[cycle.AccountID] = map[string]*CreditCycle{}
+	}
+	copied := *cycle
+	s.creditCycles[cycle.AccountID][cycle.Period] = &copied
+
+	return nil
+}
+
+func (s *MemoryStore) SettleCreditCycle(cycle *CreditCycle, systemAccount, description string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.creditCycles[cycle.AccountID][cycle.Period]
+	if !ok || stored.Settled {
+		return conflict("Cycle %s of account %d is already settled", cycle.Period, cycle.AccountID)
+	}
+
+	if cycle.LateFee > 0 {
+		if err := s.chargeLocked(cycle.AccountID, systemAccount, cycle.LateFee, description, creditCharge(cycle.DueDate)); err != nil {
+			return err
+		}
+	}
+
+	stored.Settled = true
+	stored.PaidByDue = cycle.PaidByDue
+	stored.LateFee = cycle.LateFee
+
+	return nil
+}
+
+func (s *MemoryStore) CreateReferral(r *Referral, maxPerReferrer int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	open := 0
+	for _, referral := range s.referrals {
+		if referral.RefereeID == r.RefereeID {
+			return conflict("User %d was already referred", r.RefereeID)
+		}
+		if referral.ReferrerID == r.ReferrerID && (referral.Status == ReferralPending || referral.Status == ReferralPaid) {
+			open++
+		}
+	}
+	capReferral(r, open, maxPerReferrer)
+
+	r.ID = len(s.referrals) + 1
+	copied := *r
+	s.referrals[r.ID] = &copied
+
+	return nil
+}
+
+func (s *MemoryStore) GetReferralsByReferrer(userID int) ([]*Referral, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	ids := sortedKeys(s.referrals)
+	referrals := []*Referral{}
+	for i := len(ids) - 1; i >= 0; i-- {
+		if referral := s.referrals[ids[i]]; referral.ReferrerID == userID {
+			copied := *referral
+			referrals = append(referrals, &copied)
+		}
+	}
+
+	return referrals, nil
+}
+
+func (s *MemoryStore) GetPendingReferrals() ([]*Referral, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	referrals := []*Referral{}
+	for _, id := range sortedKeys(s.referrals) {
+		if referral := s.referrals[id]; referral.Status == ReferralPending {
+			copied := *referral
+			referrals = append(referrals, &copied)
+		}
+	}
+
+	return referrals, nil
+}
+
+func (s *MemoryStore) GetDeposits(userID int, from, to time.Time) ([]*Deposit, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deposits := []*Deposit{}
+	for _, id := range sortedKeys(s.transactions) {
+		t := s.transactions[id]
+		source, target := s.accounts[t.FromAccount], s.accounts[t.ToAccount]
+		if target.UserID != userID || source.UserID == userID || source.IsSystem {
+			continue
+		}
+		if t.CreatedAt.Before(from) || !t.CreatedAt.Before(to) {
+			continue
+		}
+		deposits = append(deposits, &Deposit{Transaction: *t, FromUserID: source.UserID, Currency: target.Currency})
+	}
+	sort.SliceStable(deposits, func(i, j int) bool { return deposits[i].CreatedAt.Before(deposits[j].CreatedAt) })
+
+	return deposits, nil
+}
+
+func (s *MemoryStore) PayReferral(r *Referral, referrerAccount, refereeAccount int, systemAccount string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stored, ok := s.referrals[r.ID]
+	if !ok {
+		return notFound("Referral %d not found", r.ID)
+	}
+	if stored.Status != ReferralPending {
+		return conflict("Referral %d is %s", r.ID, stored.Status)
+	}
+
+	promo, err := s.systemAccountLocked(systemAccount, r.Currency)
+	if err != nil {
+		return err
+	}
+
+	// Check both payees first so a failure leaves neither bonus paid.
+	payees := []int{}
+	if r.ReferrerBonus > 0 {
+		payees = append(payees, referrerAccount)
+	}
+	if r.RefereeBonus > 0 {
+		payees = append(payees, refereeAccount)
+	}
+	for _, payee := range payees {
+		if err := s.checkAccounts([]int{promo.ID, payee}); err != nil {
+			return err
+		}
+	}
+
+	if r.ReferrerBonus > 0 {
+		transaction, err := s.transferLocked(promo.ID, referrerAccount, r.ReferrerBonus, Credit, referralDescription, *r.ClosedAt)
+		if err != nil {
+			return err
+		}
+		r.ReferrerTransaction = transaction.ID
+	}
+	if r.RefereeBonus > 0 {
+		transaction, err := s.transferLocked(promo.ID, refereeAccount, r.RefereeBonus, Credit, referralDescription, *r.ClosedAt)
+		if err != nil {
+			return err
+		}
+		r.RefereeTransaction = transaction.ID
+	}
+
+	r.Status = ReferralPaid
+	copied := *r
+	s.referrals[r.ID] = &copied
+
+	return nil
+}
+
+func (s *MemoryStore) ExpireReferral(id int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	referral, ok := s.referrals[id]
+	if !ok || referral.Status != ReferralPending {
+		return conflict("Referral %d is not pending", id)
+	}
+
+	referral.Status = ReferralExpired
+	referral.ClosedAt = &at
+
+	return nil
+}
+
+func (s *MemoryStore) GetLoginThrottle(key string) (*LoginThrottle, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	throttle, ok := s.loginThrottles[key]
+	if !ok {
+		return &LoginThrottle{Key: key}, nil
+	}
+	copied := *throttle
+	return &copied, nil
+}
+
+func (s *MemoryStore) RecordLoginFailure(key string, now time.Time, policy LoginPolicy) (*LoginThrottle, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	throttle, ok := s.loginThrottles[key]
+	if !ok {
+		throttle = &LoginThrottle{Key: key}
+		s.loginThrottles[key] = throttle
+	}
+	policy.fail(throttle, now)
+
+	copied := *throttle
+	return &copied, nil
+}
+
+func (s *MemoryStore) ClearLoginFailures(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.loginThrottles, key)
+
+	return nil
+}
+
+func (s *MemoryStore) UpdateLastLogin(userID int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if user, ok := s.users[userID]; ok {
+		user.LastLogin = at
+	}
+
+	return nil
+}
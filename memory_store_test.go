@@ -0,0 +1,255 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestCustomer(t *testing.T, store Storage, email string, balance int64) (*User, *Account) {
+	user, account, err := NewUserAccount(email, "Password1", "Test", "Customer", "5555555555", 0, balance, Customer, Checking)
+	assert.Nil(t, err)
+	user.EmailVerified = true
+	assert.Nil(t, store.CreateUser(user, account))
+
+	return user, account
+}
+
+func TestMemoryStoreUniqueEmail(t *testing.T) {
+	store := NewMemoryStore()
+	newTestCustomer(t, store, "one@mail.com", 0)
+
+	user, account, err := NewUserAccount("one@mail.com", "Password1", "Other", "Person", "", 0, 0, Customer, Savings)
+	assert.Nil(t, err)
+	assert.NotNil(t, store.CreateUser(user, account))
+}
+
+func TestMemoryStoreSoftDelete(t *testing.T) {
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "gone@mail.com", 0)
+
+	assert.Nil(t, store.DeleteAccount(user.ID))
+
+	_, err := store.GetUserByID(user.ID)
+	assert.NotNil(t, err)
+
+	accounts, err := store.GetAccounts()
+	assert.Nil(t, err)
+	assert.Empty(t, accounts)
+}
+
+func TestMemoryStoreTransfer(t *testing.T) {
+	store := NewMemoryStore()
+	_, from := newTestCustomer(t, store, "from@mail.com", 1000)
+	_, to := newTestCustomer(t, store, "to@mail.com", 0)
+
+	_, err := store.Transfer(from.ID, to.ID, 5000, Transfer, "too much", nil)
+	assert.EqualError(t, err, "Insufficient funds")
+
+	transaction, err := store.Transfer(from.ID, to.ID, 400, Transfer, "rent", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(400), transaction.Amount)
+
+	ledger, err := store.GetLedgerBalance(to.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(400), ledger.Balance)
+	assert.True(t, ledger.InBalance)
+
+	// The opening balance is in the journal too.
+	ledger, err = store.GetLedgerBalance(from.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(600), ledger.Balance)
+	assert.True(t, ledger.InBalance)
+
+	entries, err := store.GetJournalEntriesByAccount(to.ID)
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+
+	_, err = store.ReverseJournalEntry(entries[0].ID, "sent by mistake", nil)
+	assert.Nil(t, err)
+	_, err = store.ReverseJournalEntry(entries[0].ID, "twice", nil)
+	assert.NotNil(t, err)
+
+	ledger, err = store.GetLedgerBalance(to.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), ledger.Balance)
+}
+
+func TestMemoryStoreReversalNeedsFunds(t *testing.T) {
+	store := NewMemoryStore()
+	_, from := newTestCustomer(t, store, "from@mail.com", 1000)
+	_, to := newTestCustomer(t, store, "to@mail.com", 0)
+	_, spent := newTestCustomer(t, store, "spent@mail.com", 0)
+
+	transaction, err := store.Transfer(from.ID, to.ID, 400, Transfer, "", nil)
+	assert.Nil(t, err)
+	_, err = store.Transfer(to.ID, spent.ID, 300, Transfer, "", nil)
+	assert.Nil(t, err)
+
+	entries, err := store.GetJournalEntriesByAccount(to.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, transaction.ID, entries[0].TransactionID)
+
+	_, err = store.ReverseJournalEntry(entries[0].ID, "sent by mistake", nil)
+	assert.EqualError(t, err, "Insufficient funds")
+
+	ledger, err := store.GetLedgerBalance(to.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(100), ledger.Balance)
+}
+
+func TestMemoryStoreTransferRejectsSameAccount(t *testing.T) {
+	store := NewMemoryStore()
+	_, account := newTestCustomer(t, store, "self@mail.com", 1000)
+
+	_, err := store.Transfer(account.ID, account.ID, 100, Transfer, "", nil)
+	assert.EqualError(t, err, "Cannot transfer to the same account")
+
+	stored, err := store.GetAccountByID(account.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1000), stored.Balance)
+}
+
+func TestMemoryStoreConcurrentTransfers(t *testing.T) {
+	store := NewMemoryStore()
+	_, a := newTestCustomer(t, store, "a@mail.com", 1000)
+	_, b := newTestCustomer(t, store, "b@mail.com", 1000)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			store.Transfer(a.ID, b.ID, 7, Transfer, "", nil)
+		}()
+		go func() {
+			defer wg.Done()
+			store.Transfer(b.ID, a.ID, 3, Transfer, "", nil)
+		}()
+	}
+	wg.Wait()
+
+	accounts, err := store.GetAccounts()
+	assert.Nil(t, err)
+
+	var total int64
+	for _, account := range accounts {
+		if !account.IsSystem {
+			total += account.Balance
+		}
+	}
+	assert.Equal(t, int64(2000), total)
+}
+
+func TestMemoryStoreTransactionHistory(t *testing.T) {
+	store := NewMemoryStore()
+	_, a := newTestCustomer(t, store, "a@mail.com", 1000)
+	_, b := newTestCustomer(t, store, "b@mail.com", 0)
+	_, c := newTestCustomer(t, store, "c@mail.com", 0)
+
+	store.Transfer(a.ID, b.ID, 100, Transfer, "", nil)
+	store.Transfer(a.ID, c.ID, 200, Transfer, "", nil)
+	store.Transfer(b.ID, a.ID, 50, Transfer, "", nil)
+
+	entries, err := store.GetTransactionHistory(a.ID, TransactionFilter{Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 4)
+	assert.Equal(t, int64(750), entries[0].RunningBalance)
+	assert.Equal(t, int64(700), entries[1].RunningBalance)
+	assert.Equal(t, int64(900), entries[2].RunningBalance)
+	assert.Equal(t, openingBalanceDescription, entries[3].Description)
+	assert.Equal(t, int64(1000), entries[3].RunningBalance)
+
+	entries, err = store.GetTransactionHistory(a.ID, TransactionFilter{Counterparty: b.ID, Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, int64(750), entries[0].RunningBalance)
+
+	page, err := store.GetTransactionHistory(a.ID, TransactionFilter{Limit: 1})
+	assert.Nil(t, err)
+	cursor, err := decodeCursor(encodeCursor(page[0].ID))
+	assert.Nil(t, err)
+
+	entries, err = store.GetTransactionHistory(a.ID, TransactionFilter{Cursor: cursor, MinAmount: 150, Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, int64(200), entries[0].Amount)
+}
+
+func TestMemoryStoreHistoryCountsJournalOnlyPostings(t *testing.T) {
+	store := NewMemoryStore()
+	_, a := newTestCustomer(t, store, "a@mail.com", 1000)
+	_, b := newTestCustomer(t, store, "b@mail.com", 500)
+
+	// An adjustment posted straight to the journal has no transaction.
+	assert.Nil(t, store.PostJournalEntry(NewTransferEntry(b.ID, a.ID, 200, "Adjustment")))
+	_, err := store.Transfer(a.ID, b.ID, 100, Transfer, "", nil)
+	assert.Nil(t, err)
+
+	entries, err := store.GetTransactionHistory(a.ID, TransactionFilter{Limit: 10})
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, int64(1100), entries[0].RunningBalance)
+	assert.Equal(t, int64(1000), entries[1].RunningBalance)
+}
+
+func TestMemoryStoreBalanceAtCountsJournalOnlyPostings(t *testing.T) {
+	store := NewMemoryStore()
+	_, a := newTestCustomer(t, store, "a@mail.com", 1000)
+	_, b := newTestCustomer(t, store, "b@mail.com", 500)
+
+	assert.Nil(t, store.PostJournalEntry(NewTransferEntry(b.ID, a.ID, 200, "Adjustment")))
+
+	balance, err := store.GetBalanceAt(a.ID, time.Now().Add(time.Hour))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1200), balance)
+
+	balance, err = store.GetBalanceAt(a.ID, a.CreatedAt)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), balance)
+}
+
+func TestMemoryStoreOpenAndCloseAccounts(t *testing.T) {
+	store := NewMemoryStore()
+	user, checking := newTestCustomer(t, store, "many@mail.com", 100)
+
+	savings := NewAccount(user.ID, Savings, defaultCurrency)
+	assert.Nil(t, store.CreateAccount(savings))
+
+	full, err := store.GetAccountByUserID(user.ID)
+	assert.Nil(t, err)
+	assert.Len(t, full.Accounts, 2)
+
+	assert.EqualError(t, store.CloseAccount(checking.ID), "Account balance must be zero to close it")
+
+	_, err = store.Transfer(checking.ID, savings.ID, 100, Transfer, "", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, store.CloseAccount(checking.ID))
+
+	full, err = store.GetAccountByUserID(user.ID)
+	assert.Nil(t, err)
+	assert.Len(t, full.Accounts, 1)
+	assert.Equal(t, savings.ID, full.Accounts[0].ID)
+}
+
+func TestMemoryStoreUpdateUserResetsVerification(t *testing.T) {
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "before@mail.com", 0)
+	store.users[user.ID].EmailVerified = true
+	store.users[user.ID].PhoneVerified = true
+
+	firstName := "Renamed"
+	updated, err := store.UpdateUser(user.ID, &UpdateUserRequest{FirstName: &firstName})
+	assert.Nil(t, err)
+	assert.Equal(t, "Renamed", updated.FirstName)
+	assert.True(t, updated.EmailVerified)
+
+	email := "after@mail.com"
+	updated, err = store.UpdateUser(user.ID, &UpdateUserRequest{Email: &email})
+	assert.Nil(t, err)
+	assert.Equal(t, "after@mail.com", updated.Email)
+	assert.False(t, updated.EmailVerified)
+	assert.True(t, updated.PhoneVerified)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migrationLockKey is the Postgres advisory lock held while migrating, so
+// several instances starting at once apply each migration exactly once.
+const migrationLockKey = 7_261_993_001
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type AppliedMigration struct {
+	Version   int       `json:"version"`
+	Name      string    `json:"name"`
+	Checksum  string    `json:"checksum"`
+	AppliedAt time.Time `json:"appliedAt"`
+}
+
+type MigrationStatus struct {
+	Version   int        `json:"version"`
+	Name      string     `json:"name"`
+	Applied   bool       `json:"applied"`
+	AppliedAt *time.Time `json:"appliedAt,omitempty"`
+}
+
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.Up + "\n-- down\n" + m.Down))
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyMigrations checks that the known migrations are in strictly
+// increasing order and that every applied migration is still known with an
+// unchanged checksum.
+func verifyMigrations(all []Migration, applied []AppliedMigration) error {
+	known := map[int]Migration{}
+	for i, m := range all {
+		if i > 0 && m.Version <= all[i-1].Version {
+			return fmt.Errorf("Migration %d is out of order", m.Version)
+		}
+		known[m.Version] = m
+	}
+
+	for _, a := range applied {
+		m, ok := known[a.Version]
+		if !ok {
+			return fmt.Errorf("Applied migration %d (%s) is unknown to this binary", a.Version, a.Name)
+		}
+		if m.Checksum() != a.Checksum {
+			return fmt.Errorf("Migration %d (%s) was changed after it was applied", a.Version, a.Name)
+		}
+	}
+
+	return nil
+}
+
+func pendingMigrations(all []Migration, applied []AppliedMigration) []Migration {
+	done := map[int]bool{}
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+
+	pending := []Migration{}
+	for _, m := range all {
+		if !done[m.Version] {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending
+}
+
+func migrationStatus(all []Migration, applied []AppliedMigration) []MigrationStatus {
+	appliedAt := map[int]time.Time{}
+	for _, a := range applied {
+		appliedAt[a.Version] = a.AppliedAt
+	}
+
+	statuses := []MigrationStatus{}
+	for _, m := range all {
+		status := MigrationStatus{Version: m.Version, Name: m.Name}
+		if at, ok := appliedAt[m.Version]; ok {
+			status.Applied = true
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses
+}
+
+func findMigration(all []Migration, version int) (Migration, bool) {
+	for _, m := range all {
+		if m.Version == version {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+// MigrateUp applies every pending migration in order.
+func (s *PostgresStore) MigrateUp() error {
+	return s.withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		if err := verifyMigrations(migrations, applied); err != nil {
+			return err
+		}
+
+		for _, m := range pendingMigrations(migrations, applied) {
+			log.Printf("Applying migration %d %s", m.Version, m.Name)
+			err := runMigration(conn, m.Up, `insert into schema_migrations (version, name, checksum, applied_at) values ($1, $2, $3, $4)`,
+				m.Version, m.Name, m.Checksum(), time.Now().UTC())
+			if err != nil {
+				return fmt.Errorf("Migration %d %s failed: %w", m.Version, m.Name, err)
+			}
+		}
+
+		return nil
+	})
+}
+
+// MigrateDown rolls back the most recently applied migration.
+func (s *PostgresStore) MigrateDown() error {
+	return s.withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		if err := verifyMigrations(migrations, applied); err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			return fmt.Errorf("No migrations to roll back")
+		}
+
+		last := applied[len(applied)-1]
+		m, _ := findMigration(migrations, last.Version)
+
+		log.Printf("Rolling back migration %d %s", m.Version, m.Name)
+		err = runMigration(conn, m.Down, `delete from schema_migrations where version = $1`, m.Version)
+		if err != nil {
+			return fmt.Errorf("Rolling back migration %d %s failed: %w", m.Version, m.Name, err)
+		}
+
+		return nil
+	})
+}
+
+func (s *PostgresStore) MigrationStatus() ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+
+	err := s.withMigrationLock(func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
+		if err != nil {
+			return err
+		}
+		if err := verifyMigrations(migrations, applied); err != nil {
+			return err
+		}
+
+		statuses = migrationStatus(migrations, applied)
+		return nil
+	})
+
+	return statuses, err
+}
+
+// withMigrationLock runs fn on a single connection holding the migration
+// advisory lock. Advisory locks belong to a session, so the lock, the
+// migrations and the unlock all have to use the same connection.
+func (s *PostgresStore) withMigrationLock(fn func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `select pg_advisory_lock($1)`, migrationLockKey); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `select pg_advisory_unlock($1)`, migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, `create table if not exists schema_migrations (
+        version int primary key,
+        name varchar(100) not null,
+        checksum varchar(64) not null,
+        applied_at timestamp not null
+    )`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+// runMigration runs a migration script and its bookkeeping statement in one
+// transaction.
+func runMigration(conn *sql.Conn, script, bookkeeping string, args ...interface{}) error {
+	ctx := context.Background()
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, bookkeeping, args...); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func appliedMigrations(conn *sql.Conn) ([]AppliedMigration, error) {
+	rows, err := conn.QueryContext(context.Background(), `select version, name, checksum, applied_at
+        from schema_migrations
+        order by version`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := []AppliedMigration{}
+	for rows.Next() {
+		var a AppliedMigration
+		if err := rows.Scan(&a.Version, &a.Name, &a.Checksum, &a.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied = append(applied, a)
+	}
+
+	return applied, rows.Err()
+}
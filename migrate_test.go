@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	assert.Nil(t, verifyMigrations(migrations, nil))
+
+	for _, m := range migrations {
+		assert.NotEmpty(t, m.Name)
+		assert.NotEmpty(t, m.Up)
+		assert.NotEmpty(t, m.Down, "migration %d has no down script", m.Version)
+	}
+}
+
+func TestVerifyMigrations(t *testing.T) {
+	all := []Migration{
+		{Version: 1, Name: "one", Up: "create table a (id int)", Down: "drop table a"},
+		{Version: 2, Name: "two", Up: "create table b (id int)", Down: "drop table b"},
+	}
+	applied := []AppliedMigration{{Version: 1, Name: "one", Checksum: all[0].Checksum(), AppliedAt: time.Now()}}
+
+	assert.Nil(t, verifyMigrations(all, applied))
+	assert.Equal(t, []Migration{all[1]}, pendingMigrations(all, applied))
+
+	statuses := migrationStatus(all, applied)
+	assert.True(t, statuses[0].Applied)
+	assert.False(t, statuses[1].Applied)
+
+	edited := append([]Migration{}, all...)
+	edited[0].Up = "create table a (id bigint)"
+	assert.NotNil(t, verifyMigrations(edited, applied))
+
+	assert.NotNil(t, verifyMigrations(all[1:], applied))
+	assert.NotNil(t, verifyMigrations([]Migration{all[1], all[0]}, nil))
+}
@@ -0,0 +1,435 @@
+package main
+
+// migrations is the schema history of the Postgres store, oldest first. An
+// applied migration must never be edited, since its checksum is recorded;
+// add a new one instead.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "baseline",
+		// The baseline matches the tables the store used to create on start
+		// up, so databases created before migrations existed adopt it as is.
+		Up: `create table if not exists role (
+    role_id serial primary key,
+    role_name varchar(10)
+);
+
+insert into role (role_id, role_name)
+values (1, 'Admin'), (2, 'Employee'), (3, 'Customer')
+on conflict (role_id) do nothing;
+
+select setval(pg_get_serial_sequence('role', 'role_id'), (select max(role_id) from role));
+
+create table if not exists user_profile (
+    user_id serial primary key,
+    email varchar(50) unique not null,
+    password varchar(100) not null,
+    first_name varchar(50) not null,
+    last_name varchar(50) not null,
+    user_name varchar(50) unique not null,
+    phone_number varchar(10),
+    referrer_id int,
+    created_at timestamp,
+    last_login timestamp,
+    fk_role int references role(role_id),
+    is_active_user boolean
+);
+
+create table if not exists account_type (
+    account_type_id serial primary key,
+    account_type_name varchar(20)
+);
+
+insert into account_type (account_type_id, account_type_name)
+values (1, 'Checking'), (2, 'Savings'), (3, 'Credit')
+on conflict (account_type_id) do nothing;
+
+select setval(pg_get_serial_sequence('account_type', 'account_type_id'), (select max(account_type_id) from account_type));
+
+create table if not exists account (
+    account_id serial primary key,
+    fk_user serial references user_profile(user_id),
+    account_number serial unique,
+    balance bigint,
+    created_at timestamp,
+    fk_account_type int references account_type(account_type_id),
+    is_active_account boolean
+);
+
+create table if not exists transaction_type (
+    transaction_type_id serial primary key,
+    transaction_name varchar(10)
+);
+
+-- Older databases seeded Credit as 1 and Debit as 2, the reverse of the
+-- TransactionType constants.
+insert into transaction_type (transaction_type_id, transaction_name)
+values (1, 'Debit'), (2, 'Credit'), (3, 'Transfer')
+on conflict (transaction_type_id) do update set transaction_name = excluded.transaction_name;
+
+select setval(pg_get_serial_sequence('transaction_type', 'transaction_type_id'), (select max(transaction_type_id) from transaction_type));
+
+create table if not exists transaction (
+    id serial primary key,
+    from_account int references account(account_id) not null,
+    to_account int references account(account_id) not null,
+    amount bigint not null,
+    description varchar(200),
+    created_at timestamp,
+    fk_transaction_type int references transaction_type(transaction_type_id)
+);
+
+create table if not exists journal_entry (
+    id serial primary key,
+    description varchar(200),
+    fk_transaction int references transaction(id),
+    reverses_entry int unique references journal_entry(id),
+    created_at timestamp not null
+);
+
+create table if not exists posting (
+    id serial primary key,
+    fk_journal_entry int references journal_entry(id) not null,
+    fk_account int references account(account_id) not null,
+    fk_transaction_type int not null,
+    amount bigint not null check (amount > 0)
+);
+
+create or replace function reject_ledger_change() returns trigger as $$
+begin
+    raise exception 'ledger rows are append-only';
+end;
+$$ language plpgsql;
+
+drop trigger if exists journal_entry_append_only on journal_entry;
+create trigger journal_entry_append_only
+    before update or delete on journal_entry
+    for each row execute function reject_ledger_change();
+
+drop trigger if exists posting_append_only on posting;
+create trigger posting_append_only
+    before update or delete on posting
+    for each row execute function reject_ledger_change();
+
+create table if not exists refresh_token (
+    id serial primary key,
+    fk_user int references user_profile(user_id) not null,
+    token_hash varchar(64) unique not null,
+    family_id varchar(32) not null,
+    created_at timestamp not null,
+    expires_at timestamp not null,
+    revoked_at timestamp,
+    replaced_by varchar(64)
+);
+
+create table if not exists revoked_token (
+    jti varchar(32) primary key,
+    expires_at timestamp not null
+);`,
+		Down: `drop table if exists revoked_token;
+drop table if exists refresh_token;
+drop table if exists posting;
+drop table if exists journal_entry;
+drop function if exists reject_ledger_change();
+drop table if exists transaction;
+drop table if exists transaction_type;
+drop table if exists account;
+drop table if exists account_type;
+drop table if exists user_profile;
+drop table if exists role;`,
+	}, {
+		Version: 2,
+		Name:    "totp",
+		Up: `create table user_totp (
+    fk_user int primary key references user_profile(user_id),
+    secret varchar(64) not null,
+    enabled boolean not null default false,
+    created_at timestamp not null,
+    confirmed_at timestamp,
+    last_used_step bigint not null default 0
+);
+
+create table recovery_code (
+    id serial primary key,
+    fk_user int references user_profile(user_id) not null,
+    code_hash varchar(64) not null,
+    used_at timestamp,
+    unique (fk_user, code_hash)
+);`,
+		Down: `drop table recovery_code;
+drop table user_totp;`,
+	},
+	{
+		Version: 3,
+		Name:    "interest",
+		Up: `alter table account add column is_system boolean not null default false;
+
+insert into user_profile (email, password, first_name, last_name, user_name, created_at, fk_role, is_active_user)
+values ('system@go-bank.local', '!', 'Bank', 'System', '$bank.system', now(), 1, false)
+on conflict (email) do nothing;
+
+create table system_account (
+    name varchar(30) primary key,
+    fk_account int unique not null references account(account_id)
+);
+
+create table interest_accrual (
+    fk_account int references account(account_id) not null,
+    accrual_date date not null,
+    balance bigint not null,
+    apy_basis_points int not null,
+    amount_micros bigint not null,
+    posted boolean not null default false,
+    fk_transaction int references transaction(id),
+    primary key (fk_account, accrual_date)
+);`,
+		// The system user and its accounts stay, since the ledger may
+		// already reference them.
+		Down: `drop table interest_accrual;
+drop table system_account;
+alter table account drop column is_system;`,
+	},
+	{
+		Version: 4,
+		Name:    "idempotency_key",
+		Up: `create table idempotency_key (
+    scope varchar(100) not null,
+    idempotency_key varchar(255) not null,
+    request_hash varchar(64) not null,
+    completed boolean not null default false,
+    status_code int,
+    response_body bytea,
+    created_at timestamp not null,
+    expires_at timestamp not null,
+    primary key (scope, idempotency_key)
+);
+
+create index idempotency_key_expires_at on idempotency_key (expires_at);`,
+		Down: `drop table idempotency_key;`,
+	},
+	{
+		Version: 5,
+		Name:    "contact_verification",
+		// Users from before verification existed are treated as verified.
+		Up: `alter table user_profile add column email_verified boolean not null default true;
+alter table user_profile add column phone_verified boolean not null default true;
+alter table user_profile alter column email_verified set default false;
+alter table user_profile alter column phone_verified set default false;`,
+		Down: `alter table user_profile drop column phone_verified;
+alter table user_profile drop column email_verified;`,
+	},
+	{
+		Version: 6,
+		Name:    "audit_log",
+		Up: `create table audit_log (
+    id serial primary key,
+    created_at timestamp not null,
+    actor_id int not null,
+    actor_role int not null,
+    action varchar(50) not null,
+    target_type varchar(30) not null,
+    target_id varchar(255) not null,
+    changes text,
+    ip varchar(45) not null,
+    request_id varchar(64) not null,
+    prev_hash varchar(64) not null,
+    hash varchar(64) unique not null
+);
+
+create index audit_log_actor on audit_log (actor_id);
+create index audit_log_target on audit_log (target_type, target_id);
+
+create trigger audit_log_append_only
+    before update or delete on audit_log
+    for each row execute function reject_ledger_change();`,
+		Down: `drop table audit_log;`,
+	},
+	{
+		Version: 7,
+		Name:    "account_statement",
+		Up: `create table account_statement (
+    fk_account int not null references account(account_id),
+    period char(7) not null,
+    format varchar(10) not null,
+    content bytea not null,
+    created_at timestamp not null,
+    primary key (fk_account, period, format)
+);
+
+create trigger account_statement_append_only
+    before update or delete on account_statement
+    for each row execute function reject_ledger_change();`,
+		Down: `drop table account_statement;`,
+	},
+	{
+		Version: 8,
+		Name:    "account_limit_override",
+		Up: `create table account_limit_override (
+    fk_account int primary key references account(account_id),
+    max_transaction bigint not null default 0,
+    daily_outflow bigint not null default 0,
+    monthly_outflow bigint not null default 0,
+    velocity_count int not null default 0,
+    velocity_window_seconds bigint not null default 0,
+    reason text not null,
+    set_by int not null references user_profile(user_id),
+    updated_at timestamp not null
+);
+
+create index transaction_from_account_created_at on transaction (from_account, created_at);`,
+		Down: `drop index transaction_from_account_created_at;
+drop table account_limit_override;`,
+	},
+	{
+		Version: 9,
+		Name:    "scheduled_transfer",
+		Up: `create table scheduled_transfer (
+    id serial primary key,
+    fk_user int not null references user_profile(user_id),
+    from_account int not null references account(account_id),
+    to_account int not null references account(account_id),
+    amount bigint not null check (amount > 0),
+    description varchar(255) not null default '',
+    schedule varchar(100) not null,
+    start_at timestamp not null,
+    next_run_at timestamp not null,
+    status varchar(20) not null,
+    attempts int not null default 0,
+    last_error text not null default '',
+    created_at timestamp not null,
+    updated_at timestamp not null
+);
+
+create index scheduled_transfer_due on scheduled_transfer (next_run_at) where status = 'active';
+create index scheduled_transfer_user on scheduled_transfer (fk_user);
+
+create table scheduled_transfer_run (
+    id serial primary key,
+    fk_scheduled_transfer int not null references scheduled_transfer(id),
+    attempt int not null,
+    ran_at timestamp not null,
+    status varchar(20) not null,
+    fk_transaction int references transaction(id),
+    error text not null default ''
+);
+
+create index scheduled_transfer_run_transfer on scheduled_transfer_run (fk_scheduled_transfer);`,
+		Down: `drop table scheduled_transfer_run;
+drop table scheduled_transfer;`,
+	},
+	{
+		Version: 10,
+		Name:    "account_hold",
+		Up: `create table account_hold (
+    id serial primary key,
+    fk_account int not null references account(account_id),
+    to_account int not null references account(account_id),
+    amount bigint not null check (amount > 0),
+    captured_amount bigint not null default 0,
+    description varchar(255) not null default '',
+    status varchar(20) not null,
+    fk_transaction int references transaction(id),
+    created_at timestamp not null,
+    expires_at timestamp not null,
+    closed_at timestamp
+);
+
+create index account_hold_pending on account_hold (fk_account, expires_at) where status = 'pending';`,
+		Down: `drop table account_hold;`,
+	},
+	{
+		Version: 11,
+		Name:    "currency",
+		Up: `alter table account add column currency char(3) not null default 'USD';
+
+alter table system_account add column currency char(3) not null default 'USD';
+alter table system_account drop constraint system_account_pkey;
+alter table system_account add primary key (name, currency);
+
+create table fx_conversion (
+    id serial primary key,
+    from_account int not null references account(account_id),
+    to_account int not null references account(account_id),
+    source_amount bigint not null check (source_amount > 0),
+    source_currency char(3) not null,
+    target_amount bigint not null check (target_amount > 0),
+    target_currency char(3) not null,
+    mid_rate numeric(20, 8) not null,
+    spread_bps int not null,
+    applied_rate numeric(20, 8) not null,
+    rate_as_of timestamp not null,
+    from_transaction int not null references transaction(id),
+    to_transaction int not null references transaction(id),
+    created_at timestamp not null
+);`,
+		Down: `drop table fx_conversion;
+alter table system_account drop constraint system_account_pkey;
+alter table system_account drop column currency;
+alter table system_account add primary key (name);
+alter table account drop column currency;`,
+	},
+	{
+		Version: 12,
+		Name:    "credit",
+		Up: `alter table account add column credit_limit bigint not null default 0 check (credit_limit >= 0);
+
+create table credit_cycle (
+    fk_account int not null references account(account_id),
+    period char(7) not null,
+    closed_at timestamp not null,
+    statement_balance bigint not null,
+    minimum_payment bigint not null,
+    interest_charged bigint not null,
+    due_date timestamp not null,
+    settled boolean not null default false,
+    paid_by_due bigint not null default 0,
+    late_fee bigint not null default 0,
+    primary key (fk_account, period)
+);
+
+create index transaction_to_account_created_at on transaction (to_account, created_at);`,
+		Down: `drop index transaction_to_account_created_at;
+drop table credit_cycle;
+alter table account drop column credit_limit;`,
+	},
+	{
+		Version: 13,
+		Name:    "referral",
+		Up: `create table referral (
+    id serial primary key,
+    fk_referrer int not null references user_profile(user_id),
+    fk_referee int not null unique references user_profile(user_id),
+    status varchar(20) not null,
+    reason varchar(255) not null default '',
+    currency char(3) not null,
+    referrer_bonus bigint not null default 0,
+    referee_bonus bigint not null default 0,
+    referrer_transaction int references transaction(id),
+    referee_transaction int references transaction(id),
+    created_at timestamp not null,
+    expires_at timestamp not null,
+    closed_at timestamp
+);
+
+create index referral_referrer on referral (fk_referrer);
+create index referral_pending on referral (expires_at) where status = 'pending';`,
+		Down: `drop table referral;`,
+	},
+	{
+		Version: 14,
+		Name:    "login_throttle",
+		Up: `create table login_throttle (
+    key varchar(320) primary key,
+    failures int not null default 0,
+    last_failure timestamp not null,
+    locked_until timestamp
+);`,
+		Down: `drop table login_throttle;`,
+	},
+	{
+		Version: 15,
+		Name:    "password_changed_at",
+		Up:      `alter table user_profile add column password_changed_at timestamp;`,
+		Down:    `alter table user_profile drop column password_changed_at;`,
+	},
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Currency is an ISO 4217 code such as USD.
+type Currency string
+
+const defaultCurrency Currency = "USD"
+
+// minorUnits is how many decimal places each supported currency has, which is
+// how many digits of an amount are below the major unit: cents for USD, none
+// for JPY.
+var minorUnits = map[Currency]int{
+	"USD": 2,
+	"EUR": 2,
+	"GBP": 2,
+	"CHF": 2,
+	"CAD": 2,
+	"AUD": 2,
+	"JPY": 0,
+}
+
+// Money is an amount in the minor units of its currency.
+type Money struct {
+	Amount   int64    `json:"amount"`
+	Currency Currency `json:"currency"`
+}
+
+func parseCurrency(code string) (Currency, error) {
+	c := Currency(strings.ToUpper(strings.TrimSpace(code)))
+	if c == "" {
+		return defaultCurrency, nil
+	}
+	if _, ok := minorUnits[c]; !ok {
+		return "", invalidField("currency", "Unsupported currency %s", code)
+	}
+	return c, nil
+}
+
+// MinorUnits is the number of decimal places of the currency.
+func (c Currency) MinorUnits() int {
+	if units, ok := minorUnits[c]; ok {
+		return units
+	}
+	return 2
+}
+
+// String writes the amount in major units followed by the currency, 12345 USD
+// as "123.45 USD".
+func (m Money) String() string {
+	return formatMinor(m.Amount, m.Currency.MinorUnits()) + " " + string(m.Currency)
+}
+
+// formatMinor writes an amount of minor units as a decimal with the given
+// number of places.
+func formatMinor(amount int64, units int) string {
+	sign := ""
+	if amount < 0 {
+		sign = "-"
+		amount = -amount
+	}
+	if units == 0 {
+		return fmt.Sprintf("%s%d", sign, amount)
+	}
+
+	scale := int64(1)
+	for i := 0; i < units; i++ {
+		scale *= 10
+	}
+	return fmt.Sprintf("%s%d.%0*d", sign, amount/scale, units, amount%scale)
+}
+
+// accountCurrency is the account's currency, the default for accounts opened
+// without one.
+func accountCurrency(account *Account) Currency {
+	if account.Currency == "" {
+		return defaultCurrency
+	}
+	return account.Currency
+}
+
+// checkSameCurrency refuses to move money directly between accounts in
+// different currencies, which must go through a conversion instead.
+func checkSameCurrency(ids []int, currencies map[int]Currency) error {
+	for _, id := range ids {
+		if currencies[id] != currencies[ids[0]] {
+			return unprocessable("Account %d is in %s but account %d is in %s", ids[0], currencies[ids[0]], id, currencies[id])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+type Action string
+
+const (
+	ActionRead   Action = "read"
+	ActionWrite  Action = "write"
+	ActionDelete Action = "delete"
+	ActionAdmin  Action = "admin"
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID         int
+	Role           Role
+	TokenID        string
+	TokenExpiresAt time.Time
+	Purpose        string
+}
+
+type principalKey struct{}
+
+// ownerResolver returns the id of the user that owns the resource a request
+// targets, or 0 when the resource does not belong to any one user.
+type ownerResolver func(r *http.Request) (int, error)
+
+func (r Role) String() string {
+	switch r {
+	case Admin:
+		return "Admin"
+	case Employee:
+		return "Employee"
+	case Customer:
+		return "Customer"
+	}
+	return fmt.Sprintf("Role(%d)", int(r))
+}
+
+func parseRole(name string) (Role, error) {
+	switch name {
+	case "Admin":
+		return Admin, nil
+	case "Employee":
+		return Employee, nil
+	case "Customer":
+		return Customer, nil
+	}
+	return 0, fmt.Errorf("Unknown role %q, use 'Admin', 'Employee' or 'Customer'", name)
+}
+
+// authorize is the access policy:
+//   - admins may do anything
+//   - employees may read any resource and change their own
+//   - customers may read and change only what they own
+//
+// Deletes and admin actions are reserved for admins.
+func authorize(p *Principal, action Action, ownerID int) bool {
+	if p == nil {
+		return false
+	}
+
+	owns := ownerID != 0 && ownerID == p.UserID
+
+	switch p.Role {
+	case Admin:
+		return true
+	case Employee:
+		return action == ActionRead || (action == ActionWrite && owns)
+	case Customer:
+		return (action == ActionRead || action == ActionWrite) && owns
+	}
+
+	return false
+}
+
+func actionForMethod(method string) Action {
+	switch method {
+	case "GET", "HEAD":
+		return ActionRead
+	case "DELETE":
+		return ActionDelete
+	}
+	return ActionWrite
+}
+
+func withPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func principalFromContext(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// authorizeRequest checks the caller of r against the policy and logs the
+// decision.
+func authorizeRequest(r *http.Request, action Action, ownerID int) bool {
+	p := principalFromContext(r.Context())
+	allowed := authorize(p, action, ownerID)
+
+	decision := "deny"
+	if allowed {
+		decision = "allow"
+	}
+
+	if p == nil {
+		log.Printf("policy %s: anonymous action=%s %s %s owner=%d", decision, action, r.Method, r.URL.Path, ownerID)
+	} else {
+		log.Printf("policy %s: user=%d role=%s action=%s %s %s owner=%d", decision, p.UserID, p.Role, action, r.Method, r.URL.Path, ownerID)
+	}
+
+	return allowed
+}
+
+// withPolicy only lets the request through when the caller may perform
+// action on the resource found by owner. An empty action is derived from the
+// request method. It must run inside withJWTAuth.
+func withPolicy(action Action, owner ownerResolver, handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ownerID, err := owner(r)
+		if err != nil {
+			log.Println("policy deny:", err)
+			permissionDenied(w, r)
+			return
+		}
+
+		required := action
+		if required == "" {
+			required = actionForMethod(r.Method)
+		}
+
+		if !authorizeRequest(r, required, ownerID) {
+			permissionDenied(w, r)
+			return
+		}
+
+		handlerFunc(w, r)
+	}
+}
+
+// userOwner is for routes whose {id} is a user id.
+func userOwner(r *http.Request) (int, error) {
+	return getID(r)
+}
+
+// accountOwner is for routes whose {id} is an account id.
+func accountOwner(store Storage) ownerResolver {
+	return func(r *http.Request) (int, error) {
+		id, err := getID(r)
+		if err != nil {
+			return 0, err
+		}
+
+		account, err := store.GetAccountByID(id)
+		if err != nil {
+			return 0, err
+		}
+
+		return account.UserID, nil
+	}
+}
+
+// noOwner is for resources that belong to the bank rather than a customer.
+func noOwner(r *http.Request) (int, error) {
+	return 0, nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorize(t *testing.T) {
+	admin := &Principal{UserID: 1, Role: Admin}
+	employee := &Principal{UserID: 2, Role: Employee}
+	customer := &Principal{UserID: 3, Role: Customer}
+
+	cases := []struct {
+		principal *Principal
+		action    Action
+		owner     int
+		allowed   bool
+	}{
+		{admin, ActionDelete, 3, true},
+		{admin, ActionAdmin, 0, true},
+		{employee, ActionRead, 3, true},
+		{employee, ActionRead, 0, true},
+		{employee, ActionWrite, 3, false},
+		{employee, ActionWrite, 2, true},
+		{employee, ActionDelete, 3, false},
+		{customer, ActionRead, 3, true},
+		{customer, ActionWrite, 3, true},
+		{customer, ActionRead, 4, false},
+		{customer, ActionRead, 0, false},
+		{customer, ActionDelete, 3, false},
+		{nil, ActionRead, 3, false},
+	}
+
+	for _, c := range cases {
+		assert.Equal(t, c.allowed, authorize(c.principal, c.action, c.owner), "%+v %s owner=%d", c.principal, c.action, c.owner)
+	}
+}
+
+func TestWithPolicyOwnership(t *testing.T) {
+	useTestJWTSecret(t)
+
+	store := NewMemoryStore()
+	alice, _ := newTestCustomer(t, store, "alice@mail.com", 0)
+	bob, _ := newTestCustomer(t, store, "bob@mail.com", 0)
+
+	server := NewAPIServer(":0", store)
+	router := mux.NewRouter()
+	router.HandleFunc("/account/{id}", withJWTAuth(withPolicy("", userOwner, makeHTTPHandleFunc(server.handleGetUserByID)), store))
+
+	token, err := createJWT(alice)
+	assert.Nil(t, err)
+
+	request := func(method string, id int) int {
+		req := httptest.NewRequest(method, "/account/"+strconv.Itoa(id), nil)
+		req.Header.Set("x-jwt-token", token)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, request("GET", alice.ID))
+	assert.Equal(t, http.StatusForbidden, request("GET", bob.ID))
+	assert.Equal(t, http.StatusForbidden, request("DELETE", alice.ID))
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// systemReferralPromo is the bank's marketing budget, which pays every
+// referral bonus.
+const systemReferralPromo = "referral_promo"
+
+// referralDescription is the description of every bonus transaction.
+const referralDescription = "Referral bonus"
+
+const (
+	ReferralPending  = "pending"
+	ReferralPaid     = "paid"
+	ReferralRejected = "rejected"
+	ReferralExpired  = "expired"
+)
+
+// ReferralProgram is the terms of the referral program. A referral qualifies
+// once the new user receives a deposit of at least MinDeposit in Currency
+// from another customer within QualifyWithin of signing up; both users are
+// then paid their bonus in Currency. Each referrer can have at most
+// MaxPerReferrer referrals pending or paid, and referrals beyond that are
+// recorded as rejected.
+type ReferralProgram struct {
+	ReferrerBonus  int64         `json:"referrerBonus" yaml:"referrerBonus"`
+	RefereeBonus   int64         `json:"refereeBonus" yaml:"refereeBonus"`
+	Currency       Currency      `json:"currency" yaml:"currency"`
+	MinDeposit     int64         `json:"minDeposit" yaml:"minDeposit"`
+	QualifyWithin  time.Duration `json:"qualifyWithin" yaml:"qualifyWithin"`
+	MaxPerReferrer int           `json:"maxPerReferrer" yaml:"maxPerReferrer"`
+}
+
+// Referral is one user signing up with another's user name. The bonuses and
+// their transactions are set once it is paid.
+type Referral struct {
+	ID                  int        `json:"id"`
+	ReferrerID          int        `json:"referrerId"`
+	RefereeID           int        `json:"refereeId"`
+	Status              string     `json:"status"`
+	Reason              string     `json:"reason,omitempty"`
+	Currency            Currency   `json:"currency"`
+	ReferrerBonus       int64      `json:"referrerBonus"`
+	RefereeBonus        int64      `json:"refereeBonus"`
+	ReferrerTransaction int        `json:"referrerTransaction,omitempty"`
+	RefereeTransaction  int        `json:"refereeTransaction,omitempty"`
+	CreatedAt           time.Time  `json:"createdAt"`
+	ExpiresAt           time.Time  `json:"expiresAt"`
+	ClosedAt            *time.Time `json:"closedAt,omitempty"`
+}
+
+// Deposit is money paid into one of a user's accounts from a customer
+// account of another user.
+type Deposit struct {
+	Transaction
+	FromUserID int      `json:"fromUserId"`
+	Currency   Currency `json:"currency"`
+}
+
+// ReferralReport is a referrer's referrals, newest first, with what they have
+// earned and how many more they can make.
+type ReferralReport struct {
+	UserID    int         `json:"userId"`
+	Pending   int         `json:"pending"`
+	Paid      int         `json:"paid"`
+	Rejected  int         `json:"rejected"`
+	Expired   int         `json:"expired"`
+	Earned    Money       `json:"earned"`
+	Remaining int         `json:"remaining"`
+	Referrals []*Referral `json:"referrals"`
+}
+
+var defaultReferralProgram = ReferralProgram{
+	ReferrerBonus:  50_00,
+	RefereeBonus:   25_00,
+	Currency:       defaultCurrency,
+	MinDeposit:     100_00,
+	QualifyWithin:  90 * 24 * time.Hour,
+	MaxPerReferrer: 10,
+}
+
+func (p ReferralProgram) Validate() error {
+	if p.ReferrerBonus < 0 || p.RefereeBonus < 0 || p.MinDeposit < 0 {
+		return fmt.Errorf("Referral bonuses and minimum deposit cannot be negative")
+	}
+	if _, ok := minorUnits[p.Currency]; !ok {
+		return fmt.Errorf("Unsupported referral currency %q", p.Currency)
+	}
+	if p.QualifyWithin <= 0 {
+		return fmt.Errorf("Referral qualifying period must be positive")
+	}
+	if p.MaxPerReferrer < 0 {
+		return fmt.Errorf("Referral cap cannot be negative")
+	}
+	return nil
+}
+
+// newReferral records referee signing up with referrer's user name. Referrals
+// that look like someone referring themselves, or that come from staff, are
+// recorded as rejected with the reason rather than refusing the signup.
+func (p ReferralProgram) newReferral(referrer, referee *User, now time.Time) *Referral {
+	referral := &Referral{
+		ReferrerID: referrer.ID,
+		RefereeID:  referee.ID,
+		Status:     ReferralPending,
+		Currency:   p.Currency,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(p.QualifyWithin),
+	}
+
+	if reason := checkReferral(referrer, referee); reason != "" {
+		referral.Status = ReferralRejected
+		referral.Reason = reason
+		referral.ClosedAt = &now
+	}
+
+	return referral
+}
+
+// capReferral rejects a pending referral whose referrer already has
+// maxPerReferrer referrals pending or paid.
+func capReferral(referral *Referral, open, maxPerReferrer int) {
+	if referral.Status == ReferralPending && open >= maxPerReferrer {
+		referral.Status = ReferralRejected
+		referral.Reason = fmt.Sprintf("Referrer has reached the limit of %d referrals", maxPerReferrer)
+		referral.ClosedAt = &referral.CreatedAt
+	}
+}
+
+func checkReferral(referrer, referee *User) string {
+	if referrer.Role != Customer {
+		return "Only customers can refer"
+	}
+	if normalizeEmail(referrer.Email) == normalizeEmail(referee.Email) {
+		return "Self-referral: same email address"
+	}
+	if phone := digits(referee.PhoneNumber); phone != "" && phone == digits(referrer.PhoneNumber) {
+		return "Self-referral: same phone number"
+	}
+	return ""
+}
+
+// normalizeEmail lowercases the address and drops any +tag, so
+// jane+2@mail.com and Jane@mail.com are the same person.
+func normalizeEmail(email string) string {
+	email = strings.ToLower(strings.TrimSpace(email))
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok {
+		return email
+	}
+	local, _, _ = strings.Cut(local, "+")
+	return local + "@" + domain
+}
+
+func digits(s string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsDigit(r) {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// ReferralEngine pays referrals once they qualify and expires those that did
+// not in time.
+type ReferralEngine struct {
+	store   Storage
+	program ReferralProgram
+	now     func() time.Time
+}
+
+func NewReferralEngine(store Storage, program ReferralProgram) *ReferralEngine {
+	return &ReferralEngine{
+		store:   store,
+		program: program,
+		now:     time.Now,
+	}
+}
+
+// Run checks pending referrals every interval until ctx is done.
+func (e *ReferralEngine) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.CatchUp(); err != nil {
+				log.Println("Referral payouts failed:", err)
+			}
+		}
+	}
+}
+
+// CatchUp checks every pending referral. One that cannot be paid, say because
+// the account the deposit went to has since closed, is logged and tried again
+// next time rather than holding up the rest.
+func (e *ReferralEngine) CatchUp() error {
+	referrals, err := e.store.GetPendingReferrals()
+	if err != nil {
+		return err
+	}
+
+	now := e.now().UTC()
+	for _, referral := range referrals {
+		if err := e.check(referral, now); err != nil {
+			log.Printf("Referral %d: %v", referral.ID, err)
+		}
+	}
+
+	return nil
+}
+
+func (e *ReferralEngine) check(referral *Referral, now time.Time) error {
+	deposit, err := e.qualifyingDeposit(referral)
+	if err != nil {
+		return err
+	}
+	if deposit == nil {
+		if !now.Before(referral.ExpiresAt) {
+			return e.store.ExpireReferral(referral.ID, referral.ExpiresAt)
+		}
+		return nil
+	}
+
+	// The referrer is paid into their oldest Checking or Savings account in
+	// the program's currency, and not at all if they no longer have one.
+	referrerAccount := 0
+	if referrer, err := e.store.GetAccountByUserID(referral.ReferrerID); err == nil {
+		for _, account := range referrer.Accounts {
+			if account.Currency == referral.Currency && account.AccountType != CreditAccount {
+				referrerAccount = account.ID
+				break
+			}
+		}
+	}
+
+	referral.RefereeBonus = e.program.RefereeBonus
+	if referrerAccount != 0 {
+		referral.ReferrerBonus = e.program.ReferrerBonus
+	}
+	referral.ClosedAt = &now
+
+	return e.store.PayReferral(referral, referrerAccount, deposit.ToAccount, systemReferralPromo)
+}
+
+// qualifyingDeposit is the first deposit that qualifies the referral. Money
+// from the referrer does not count, so a referrer cannot fund their own
+// bonus.
+func (e *ReferralEngine) qualifyingDeposit(referral *Referral) (*Deposit, error) {
+	deposits, err := e.store.GetDeposits(referral.RefereeID, referral.CreatedAt, referral.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, deposit := range deposits {
+		if deposit.FromUserID != referral.ReferrerID && deposit.Currency == referral.Currency && deposit.Amount >= e.program.MinDeposit {
+			return deposit, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// GET /user/{id}/referrals
+func (s *APIServer) handleGetReferrals(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	referrals, err := s.store.GetReferralsByReferrer(id)
+	if err != nil {
+		return err
+	}
+
+	report := &ReferralReport{UserID: id, Earned: Money{Currency: s.referralProgram.Currency}, Referrals: referrals}
+	for _, referral := range referrals {
+		switch referral.Status {
+		case ReferralPending:
+			report.Pending++
+		case ReferralPaid:
+			report.Paid++
+			report.Earned.Amount += referral.ReferrerBonus
+		case ReferralRejected:
+			report.Rejected++
+		case ReferralExpired:
+			report.Expired++
+		}
+	}
+	report.Remaining = max(s.referralProgram.MaxPerReferrer-report.Pending-report.Paid, 0)
+
+	return WriteJSON(w, http.StatusOK, report)
+}
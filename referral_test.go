@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestReferee(t *testing.T, store Storage, email, phone string) (*User, *Account) {
+	user, account, err := NewUserAccount(email, "Password1", "New", "Customer", phone, 0, 0, Customer, Checking)
+	assert.Nil(t, err)
+	assert.Nil(t, store.CreateUser(user, account))
+
+	return user, account
+}
+
+func TestReferralIsPaidAfterFirstDeposit(t *testing.T) {
+	useTestJWTSecret(t)
+	store := NewMemoryStore()
+	referrer, referrerAccount := newTestCustomer(t, store, "referrer@mail.com", 1_000_00)
+	_, friend := newTestCustomer(t, store, "friend@mail.com", 1_000_00)
+	server := NewAPIServer(":0", store)
+
+	body := `{"email":"new@mail.com","password":"Password1","firstName":"New","lastName":"Customer","phoneNumber":"5551230000","accountType":"Checking","referrerID":"` + referrer.UserName + `"}`
+	rec := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleCreateAccount)(rec, httptest.NewRequest(http.MethodPost, "/account", bytes.NewReader([]byte(body))))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	referee := new(User)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(referee))
+	full, _ := store.GetAccountByUserID(referee.ID)
+	account := full.Accounts[0]
+	assert.Zero(t, account.Balance)
+
+	// Money from the referrer does not qualify the referral.
+	engine := NewReferralEngine(store, defaultReferralProgram)
+	_, err := store.Transfer(referrerAccount.ID, account.ID, 200_00, Transfer, "", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.CatchUp())
+	referrals, _ := store.GetReferralsByReferrer(referrer.ID)
+	assert.Equal(t, ReferralPending, referrals[0].Status)
+
+	_, err = store.Transfer(friend.ID, account.ID, 100_00, Transfer, "", nil)
+	assert.Nil(t, err)
+	assert.Nil(t, engine.CatchUp())
+	assert.Nil(t, engine.CatchUp())
+
+	after, _ := store.GetAccountByID(account.ID)
+	assert.Equal(t, int64(300_00+25_00), after.Balance)
+	referrerAfter, _ := store.GetAccountByID(referrerAccount.ID)
+	assert.Equal(t, int64(800_00+50_00), referrerAfter.Balance)
+
+	req := httptest.NewRequest(http.MethodGet, "/user/1/referrals", nil)
+	req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(referrer.ID)})
+	rec = httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleGetReferrals)(rec, req)
+
+	report := new(ReferralReport)
+	assert.Nil(t, json.NewDecoder(rec.Body).Decode(report))
+	assert.Equal(t, 1, report.Paid)
+	assert.Equal(t, int64(50_00), report.Earned.Amount)
+	assert.Equal(t, defaultReferralProgram.MaxPerReferrer-1, report.Remaining)
+	assert.NotZero(t, report.Referrals[0].RefereeTransaction)
+}
+
+func TestReferralFraudChecksAndCap(t *testing.T) {
+	store := NewMemoryStore()
+	program := defaultReferralProgram
+	program.MaxPerReferrer = 1
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	referrer, _ := newTestCustomer(t, store, "jane@mail.com", 0)
+	sameEmail, _ := newTestReferee(t, store, "Jane+savings@mail.com", "5550000001")
+	samePhone, _ := newTestReferee(t, store, "other@mail.com", "(555) 555-5555")
+	first, _ := newTestReferee(t, store, "first@mail.com", "5550000002")
+	second, _ := newTestReferee(t, store, "second@mail.com", "5550000003")
+
+	for _, referee := range []*User{sameEmail, samePhone, first, second} {
+		assert.Nil(t, store.CreateReferral(program.newReferral(referrer, referee, now), program.MaxPerReferrer))
+	}
+	assert.Equal(t, http.StatusConflict, problemFor(store.CreateReferral(program.newReferral(referrer, first, now), program.MaxPerReferrer)).Status)
+
+	referrals, _ := store.GetReferralsByReferrer(referrer.ID)
+	assert.Len(t, referrals, 4)
+	assert.Equal(t, ReferralRejected, referrals[3].Status)
+	assert.Contains(t, referrals[3].Reason, "same email")
+	assert.Equal(t, ReferralRejected, referrals[2].Status)
+	assert.Contains(t, referrals[2].Reason, "same phone")
+	assert.Equal(t, ReferralPending, referrals[1].Status)
+	assert.Equal(t, ReferralRejected, referrals[0].Status)
+	assert.Contains(t, referrals[0].Reason, "limit of 1")
+
+	// Without a deposit the pending referral expires.
+	engine := NewReferralEngine(store, program)
+	engine.now = func() time.Time { return now.Add(program.QualifyWithin) }
+	assert.Nil(t, engine.CatchUp())
+	referrals, _ = store.GetReferralsByReferrer(referrer.ID)
+	assert.Equal(t, ReferralExpired, referrals[1].Status)
+}
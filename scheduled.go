@@ -0,0 +1,498 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Schedules that are not a cron rule.
+const (
+	ScheduleOnce    = "once"
+	ScheduleDaily   = "daily"
+	ScheduleWeekly  = "weekly"
+	ScheduleMonthly = "monthly"
+)
+
+const (
+	ScheduledActive    = "active"
+	ScheduledPaused    = "paused"
+	ScheduledCancelled = "cancelled"
+	ScheduledCompleted = "completed"
+	ScheduledFailed    = "failed"
+)
+
+const (
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+// A failed run is retried after 1, 2, 4 and 8 minutes. When the last attempt
+// fails too, a one-off transfer is marked failed and a recurring one moves on
+// to its next occurrence.
+const (
+	maxScheduledAttempts   = 5
+	scheduledRetryBase     = time.Minute
+	scheduledTransferBatch = 100
+)
+
+// ScheduledTransfer moves Amount from FromAccount to ToAccount on Schedule,
+// starting at StartAt. NextRunAt is the next time it is due, including
+// retries, and Attempts the number of failed attempts at the current
+// occurrence.
+type ScheduledTransfer struct {
+	ID          int       `json:"id"`
+	UserID      int       `json:"userId"`
+	FromAccount int       `json:"fromAccount"`
+	ToAccount   int       `json:"toAccount"`
+	Amount      int64     `json:"amount"`
+	Description string    `json:"description"`
+	Schedule    string    `json:"schedule"`
+	StartAt     time.Time `json:"startAt"`
+	NextRunAt   time.Time `json:"nextRunAt"`
+	Status      string    `json:"status"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"lastError,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// ScheduledTransferRun is one attempt at a scheduled transfer.
+type ScheduledTransferRun struct {
+	ID                  int       `json:"id"`
+	ScheduledTransferID int       `json:"scheduledTransferId"`
+	Attempt             int       `json:"attempt"`
+	RanAt               time.Time `json:"ranAt"`
+	Status              string    `json:"status"`
+	TransactionID       int       `json:"transactionId,omitempty"`
+	Error               string    `json:"error,omitempty"`
+}
+
+type ScheduledTransferDetail struct {
+	*ScheduledTransfer
+	Runs []*ScheduledTransferRun `json:"runs"`
+}
+
+type CreateScheduledTransferRequest struct {
+	FromAccount int        `json:"fromAccount"`
+	ToAccount   int        `json:"toAccount"`
+	Amount      int64      `json:"amount"`
+	Description string     `json:"description"`
+	Schedule    string     `json:"schedule"`
+	StartAt     *time.Time `json:"startAt"`
+}
+
+// Schedule gives the occurrences of a scheduled transfer.
+type Schedule interface {
+	// Next returns the first occurrence after after, or the zero time when
+	// there is none.
+	Next(after time.Time) time.Time
+}
+
+type onceSchedule struct {
+	at time.Time
+}
+
+func (s onceSchedule) Next(after time.Time) time.Time {
+	if s.at.After(after) {
+		return s.at
+	}
+	return time.Time{}
+}
+
+// dailySchedule repeats every days days at the time of day of start.
+type dailySchedule struct {
+	start time.Time
+	days  int
+}
+
+func (s dailySchedule) Next(after time.Time) time.Time {
+	if s.start.After(after) {
+		return s.start
+	}
+	period := time.Duration(s.days) * 24 * time.Hour
+	return s.start.Add((after.Sub(s.start)/period + 1) * period)
+}
+
+// monthlySchedule repeats on the day of month of start, or the last day of
+// shorter months.
+type monthlySchedule struct {
+	start time.Time
+}
+
+func (s monthlySchedule) occurrence(n int) time.Time {
+	first := time.Date(s.start.Year(), s.start.Month()+time.Month(n), 1, s.start.Hour(), s.start.Minute(), s.start.Second(), 0, time.UTC)
+	return first.AddDate(0, 0, min(s.start.Day(), daysInMonth(first))-1)
+}
+
+func (s monthlySchedule) Next(after time.Time) time.Time {
+	n := (after.Year()-s.start.Year())*12 + int(after.Month()) - int(s.start.Month()) - 1
+	for n = max(n, 0); ; n++ {
+		if t := s.occurrence(n); t.After(after) {
+			return t
+		}
+	}
+}
+
+// parseSchedule reads once, daily, weekly, monthly or a cron rule. The named
+// schedules start at start; a cron rule first runs at its first match from
+// start on.
+func parseSchedule(rule string, start time.Time) (Schedule, error) {
+	start = start.UTC().Truncate(time.Second)
+
+	switch rule {
+	case ScheduleOnce:
+		return onceSchedule{at: start}, nil
+	case ScheduleDaily:
+		return dailySchedule{start: start, days: 1}, nil
+	case ScheduleWeekly:
+		return dailySchedule{start: start, days: 7}, nil
+	case ScheduleMonthly:
+		return monthlySchedule{start: start}, nil
+	}
+
+	cron, err := parseCron(rule)
+	if err != nil {
+		return nil, invalidField("schedule", "Schedule must be 'once', 'daily', 'weekly', 'monthly' or a cron rule: %s", err)
+	}
+	return cron, nil
+}
+
+// firstRun is when a new scheduled transfer is first due.
+func firstRun(schedule Schedule, start time.Time) time.Time {
+	return schedule.Next(start.UTC().Truncate(time.Second).Add(-time.Second))
+}
+
+// recordRun updates st after an attempt at now that failed with runErr, or
+// succeeded when runErr is nil.
+func (st *ScheduledTransfer) recordRun(now time.Time, runErr error) error {
+	schedule, err := parseSchedule(st.Schedule, st.StartAt)
+	if err != nil {
+		return err
+	}
+
+	st.UpdatedAt = now
+	if runErr != nil {
+		st.Attempts++
+		st.LastError = runError(runErr)
+		if st.Attempts < maxScheduledAttempts {
+			st.NextRunAt = now.Add(scheduledRetryBase << (st.Attempts - 1))
+			return nil
+		}
+	} else {
+		st.LastError = ""
+	}
+
+	st.Attempts = 0
+	st.NextRunAt = schedule.Next(now)
+	if st.NextRunAt.IsZero() {
+		st.Status = ScheduledCompleted
+		if runErr != nil {
+			st.Status = ScheduledFailed
+		}
+	}
+
+	return nil
+}
+
+// runError is how a failed run is shown to the user, the same message a
+// failed transfer request would get.
+func runError(err error) string {
+	return problemFor(err).Detail
+}
+
+// TransferScheduler runs scheduled transfers that are due. Several servers
+// may run one against the same database: each transfer is claimed with a row
+// lock, so only one of them runs it.
+type TransferScheduler struct {
+	store      Storage
+	limitRules []LimitRule
+	now        func() time.Time
+}
+
+func NewTransferScheduler(store Storage, limitRules []LimitRule) *TransferScheduler {
+	return &TransferScheduler{
+		store:      store,
+		limitRules: limitRules,
+		now:        time.Now,
+	}
+}
+
+// Run runs due transfers once and then again every interval until ctx is
+// done.
+func (sch *TransferScheduler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := sch.RunDue(); err != nil {
+			log.Println("Running scheduled transfers failed:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// RunDue runs every transfer due now. A transfer that fails is recorded and
+// retried later; only storage failures are returned.
+func (sch *TransferScheduler) RunDue() error {
+	for {
+		now := sch.now().UTC()
+		due, err := sch.store.GetDueScheduledTransfers(now, scheduledTransferBatch)
+		if err != nil {
+			return err
+		}
+
+		ran := 0
+		for _, st := range due {
+			limits, err := sch.limits(st)
+			if err != nil {
+				return fmt.Errorf("Scheduled transfer %d: %w", st.ID, err)
+			}
+			run, err := sch.store.RunScheduledTransfer(st, now, limits)
+			if err != nil {
+				return fmt.Errorf("Scheduled transfer %d: %w", st.ID, err)
+			}
+			if run != nil {
+				ran++
+			}
+		}
+
+		// Stop when every due transfer was seen, or the rest are being run
+		// by another server.
+		if len(due) < scheduledTransferBatch || ran == 0 {
+			return nil
+		}
+	}
+}
+
+// limits are the limits of the user who scheduled the transfer, as if they
+// had made it themselves.
+func (sch *TransferScheduler) limits(st *ScheduledTransfer) ([]TransferLimits, error) {
+	account, err := sch.store.GetAccountByID(st.FromAccount)
+	var missing *NotFoundError
+	if errors.As(err, &missing) {
+		// The transfer itself fails and the failure is recorded.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	role := Customer
+	if user, err := sch.store.GetUserByID(st.UserID); err == nil {
+		role = user.Role
+	}
+
+	limits, _, err := resolveTransferLimits(sch.store, sch.limitRules, account, role)
+	return limits, err
+}
+
+// scheduledTransferOwner resolves the user who created the scheduled
+// transfer in the id path variable.
+func scheduledTransferOwner(store Storage) ownerResolver {
+	return func(r *http.Request) (int, error) {
+		id, err := getID(r)
+		if err != nil {
+			return 0, err
+		}
+
+		st, err := store.GetScheduledTransfer(id)
+		if err != nil {
+			return 0, err
+		}
+
+		return st.UserID, nil
+	}
+}
+
+// GET or POST /scheduled-transfers
+func (s *APIServer) handleScheduledTransfers(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case "GET":
+		p := principalFromContext(r.Context())
+		if p == nil {
+			return unauthorized("Authentication required")
+		}
+
+		transfers, err := s.store.GetScheduledTransfersByUser(p.UserID)
+		if err != nil {
+			return err
+		}
+		return WriteJSON(w, http.StatusOK, transfers)
+	case "POST":
+		return s.handleCreateScheduledTransfer(w, r)
+	}
+
+	return methodNotAllowed(r.Method)
+}
+
+func (s *APIServer) handleCreateScheduledTransfer(w http.ResponseWriter, r *http.Request) error {
+	if err := s.requireVerifiedEmail(r); err != nil {
+		return err
+	}
+
+	req := new(CreateScheduledTransferRequest)
+	if err := readJSON(r, req); err != nil {
+		return err
+	}
+
+	now := s.now().UTC()
+	start := now
+	if req.StartAt != nil {
+		start = req.StartAt.UTC()
+	}
+
+	if req.Amount <= 0 {
+		return invalidField("amount", "Transfer amount must be greater than zero")
+	}
+	if req.FromAccount == req.ToAccount {
+		return invalidField("toAccount", "Cannot transfer to the same account")
+	}
+	if start.Before(now.Add(-time.Minute)) {
+		return invalidField("startAt", "Start time is in the past")
+	}
+
+	schedule, err := parseSchedule(req.Schedule, start)
+	if err != nil {
+		return err
+	}
+	next := firstRun(schedule, start)
+	if next.IsZero() {
+		return invalidField("schedule", "Schedule never runs")
+	}
+
+	fromAccount, err := s.store.GetAccountByID(req.FromAccount)
+	if err != nil {
+		return err
+	}
+	if !authorizeRequest(r, ActionWrite, fromAccount.UserID) {
+		return forbidden("Permission Denied")
+	}
+	toAccount, err := s.store.GetAccountByID(req.ToAccount)
+	if err != nil {
+		return err
+	}
+	if toAccount.Currency != fromAccount.Currency {
+		return invalidField("toAccount", "Scheduled transfers must be between accounts in the same currency")
+	}
+
+	st := &ScheduledTransfer{
+		UserID:      principalFromContext(r.Context()).UserID,
+		FromAccount: req.FromAccount,
+		ToAccount:   req.ToAccount,
+		Amount:      req.Amount,
+		Description: req.Description,
+		Schedule:    req.Schedule,
+		StartAt:     start.Truncate(time.Second),
+		NextRunAt:   next,
+		Status:      ScheduledActive,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if err := s.store.CreateScheduledTransfer(st); err != nil {
+		return err
+	}
+	s.audit(r, &AuditEvent{Action: AuditScheduleTransfer, TargetType: "scheduled_transfer", TargetID: strconv.Itoa(st.ID), Changes: auditChanges(nil, st)})
+
+	return WriteJSON(w, http.StatusCreated, st)
+}
+
+// GET or DELETE /scheduled-transfers/{id}, where DELETE cancels the transfer
+func (s *APIServer) handleScheduledTransfer(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" && r.Method != "DELETE" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "DELETE" {
+		return s.setScheduledTransferStatus(w, r, id, ScheduledCancelled)
+	}
+
+	st, err := s.store.GetScheduledTransfer(id)
+	if err != nil {
+		return err
+	}
+	runs, err := s.store.GetScheduledTransferRuns(id)
+	if err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusOK, ScheduledTransferDetail{ScheduledTransfer: st, Runs: runs})
+}
+
+// POST /scheduled-transfers/{id}/{action} where action is pause or resume
+func (s *APIServer) handleScheduledTransferAction(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	switch action := mux.Vars(r)["action"]; action {
+	case "pause":
+		return s.setScheduledTransferStatus(w, r, id, ScheduledPaused)
+	case "resume":
+		return s.setScheduledTransferStatus(w, r, id, ScheduledActive)
+	default:
+		return notFound("Unknown action %s", action)
+	}
+}
+
+// setScheduledTransferStatus pauses, resumes or cancels a transfer. Only
+// active transfers can be paused and only paused ones resumed; a resumed
+// transfer skips the occurrences it missed while paused.
+func (s *APIServer) setScheduledTransferStatus(w http.ResponseWriter, r *http.Request, id int, status string) error {
+	st, err := s.store.GetScheduledTransfer(id)
+	if err != nil {
+		return err
+	}
+	before := *st
+
+	switch {
+	case status == ScheduledPaused && st.Status != ScheduledActive,
+		status == ScheduledActive && st.Status != ScheduledPaused,
+		status == ScheduledCancelled && st.Status != ScheduledActive && st.Status != ScheduledPaused:
+		return conflict("Scheduled transfer %d is %s", id, st.Status)
+	}
+
+	now := s.now().UTC()
+	if status == ScheduledActive && st.NextRunAt.Before(now) {
+		schedule, err := parseSchedule(st.Schedule, st.StartAt)
+		if err != nil {
+			return err
+		}
+		st.Attempts = 0
+		st.NextRunAt = schedule.Next(now)
+		if st.NextRunAt.IsZero() {
+			// A one-off transfer whose time passed while paused runs now.
+			st.NextRunAt = now
+		}
+	}
+	st.Status = status
+	st.UpdatedAt = now
+
+	if err := s.store.UpdateScheduledTransfer(st, &before); err != nil {
+		return err
+	}
+	s.audit(r, &AuditEvent{Action: AuditScheduleTransfer, TargetType: "scheduled_transfer", TargetID: strconv.Itoa(id), Changes: auditChanges(&before, st)})
+
+	return WriteJSON(w, http.StatusOK, st)
+}
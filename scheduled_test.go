@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCronNext(t *testing.T) {
+	friday := time.Date(2024, 5, 3, 10, 0, 0, 0, time.UTC)
+
+	cases := map[string]time.Time{
+		"30 9 * * 1-5":  time.Date(2024, 5, 6, 9, 30, 0, 0, time.UTC),
+		"*/15 * * * *":  time.Date(2024, 5, 3, 10, 15, 0, 0, time.UTC),
+		"0 0 1 */3 *":   time.Date(2024, 7, 1, 0, 0, 0, 0, time.UTC),
+		"0 12 15 * 0":   time.Date(2024, 5, 5, 12, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":    time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC),
+		"0 0 30 2 *":    {},
+		"0 8 * * 7":     time.Date(2024, 5, 5, 8, 0, 0, 0, time.UTC),
+		"5,10 10 3 5 *": time.Date(2024, 5, 3, 10, 5, 0, 0, time.UTC),
+	}
+
+	for rule, want := range cases {
+		cron, err := parseCron(rule)
+		assert.Nil(t, err, rule)
+		assert.Equal(t, want, cron.Next(friday), rule)
+	}
+
+	for _, rule := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *"} {
+		_, err := parseCron(rule)
+		assert.NotNil(t, err, rule)
+	}
+}
+
+func TestMonthlyScheduleClampsToMonthEnd(t *testing.T) {
+	start := time.Date(2024, 1, 31, 9, 0, 0, 0, time.UTC)
+	schedule, err := parseSchedule(ScheduleMonthly, start)
+	assert.Nil(t, err)
+
+	assert.Equal(t, start, firstRun(schedule, start))
+	feb := schedule.Next(start)
+	assert.Equal(t, time.Date(2024, 2, 29, 9, 0, 0, 0, time.UTC), feb)
+	assert.Equal(t, time.Date(2024, 3, 31, 9, 0, 0, 0, time.UTC), schedule.Next(feb))
+}
+
+func TestSchedulerRunsOnceAndRetries(t *testing.T) {
+	store := NewMemoryStore()
+	user, from := newTestCustomer(t, store, "rent@mail.com", 30_00)
+	_, to := newTestCustomer(t, store, "landlord@mail.com", 0)
+
+	start := time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+	st := &ScheduledTransfer{
+		UserID:      user.ID,
+		FromAccount: from.ID,
+		ToAccount:   to.ID,
+		Amount:      20_00,
+		Schedule:    ScheduleDaily,
+		StartAt:     start,
+		NextRunAt:   start,
+		Status:      ScheduledActive,
+	}
+	assert.Nil(t, store.CreateScheduledTransfer(st))
+
+	now := start.Add(time.Minute)
+	scheduler := NewTransferScheduler(store, nil)
+	scheduler.now = func() time.Time { return now }
+
+	// Running twice at the same time moves the money once.
+	assert.Nil(t, scheduler.RunDue())
+	assert.Nil(t, scheduler.RunDue())
+	runs, _ := store.GetScheduledTransferRuns(st.ID)
+	assert.Len(t, runs, 1)
+	assert.Equal(t, RunSucceeded, runs[0].Status)
+
+	saved, _ := store.GetScheduledTransfer(st.ID)
+	assert.Equal(t, start.AddDate(0, 0, 1), saved.NextRunAt)
+
+	// The next day there is not enough left, so the run is retried with
+	// backoff until it gives up on that day.
+	now = start.AddDate(0, 0, 1)
+	for attempt := 1; attempt <= maxScheduledAttempts; attempt++ {
+		assert.Nil(t, scheduler.RunDue())
+		saved, _ = store.GetScheduledTransfer(st.ID)
+		if attempt < maxScheduledAttempts {
+			assert.Equal(t, attempt, saved.Attempts)
+			assert.Equal(t, now.Add(scheduledRetryBase<<(attempt-1)), saved.NextRunAt)
+			now = saved.NextRunAt
+		}
+	}
+	assert.Equal(t, 0, saved.Attempts)
+	assert.Equal(t, start.AddDate(0, 0, 2), saved.NextRunAt)
+	assert.Equal(t, "Insufficient funds", saved.LastError)
+
+	runs, _ = store.GetScheduledTransferRuns(st.ID)
+	assert.Len(t, runs, 1+maxScheduledAttempts)
+}
+
+func TestPauseAndResumeScheduledTransfer(t *testing.T) {
+	store := NewMemoryStore()
+	user, from := newTestCustomer(t, store, "sweep@mail.com", 100_00)
+	_, to := newTestCustomer(t, store, "savings@mail.com", 0)
+	server := NewAPIServer(":0", store)
+
+	call := func(h apiFunc, method, path, body string, vars map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		req = mux.SetURLVars(req, vars)
+		req = req.WithContext(withPrincipal(req.Context(), &Principal{UserID: user.ID, Role: Customer}))
+		rec := httptest.NewRecorder()
+		makeHTTPHandleFunc(h)(rec, req)
+		return rec
+	}
+
+	body := `{"fromAccount":` + strconv.Itoa(from.ID) + `,"toAccount":` + strconv.Itoa(to.ID) + `,"amount":500,"schedule":"0 18 * * 5"}`
+	rec := call(server.handleScheduledTransfers, http.MethodPost, "/scheduled-transfers", body, nil)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+
+	vars := map[string]string{"id": "1", "action": "pause"}
+	assert.Equal(t, http.StatusOK, call(server.handleScheduledTransferAction, http.MethodPost, "/scheduled-transfers/1/pause", "", vars).Code)
+	assert.Equal(t, http.StatusConflict, call(server.handleScheduledTransferAction, http.MethodPost, "/scheduled-transfers/1/pause", "", vars).Code)
+
+	st, _ := store.GetScheduledTransfer(1)
+	assert.Equal(t, ScheduledPaused, st.Status)
+	due, _ := store.GetDueScheduledTransfers(st.NextRunAt, 10)
+	assert.Empty(t, due)
+
+	vars["action"] = "resume"
+	assert.Equal(t, http.StatusOK, call(server.handleScheduledTransferAction, http.MethodPost, "/scheduled-transfers/1/resume", "", vars).Code)
+	assert.Equal(t, http.StatusOK, call(server.handleScheduledTransfer, http.MethodDelete, "/scheduled-transfers/1", "", vars).Code)
+
+	st, _ = store.GetScheduledTransfer(1)
+	assert.Equal(t, ScheduledCancelled, st.Status)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	StatementCSV = "csv"
+	StatementPDF = "pdf"
+)
+
+var statementFormats = []string{StatementCSV, StatementPDF}
+
+// Statement is one calendar month of an account, in UTC.
+type Statement struct {
+	Account        *Account
+	Period         time.Time
+	OpeningBalance int64
+	ClosingBalance int64
+	MoneyIn        int64
+	MoneyOut       int64
+	Interest       int64
+	// Credit is the closed billing cycle of a Credit account.
+	Credit *CreditCycle
+	// Transactions are oldest first.
+	Transactions []*TransactionHistoryEntry
+}
+
+// StoredStatement is a rendered statement for a closed period. It is kept so
+// the same statement is always served byte for byte, whatever changes later.
+type StoredStatement struct {
+	AccountID int
+	Period    string
+	Format    string
+	Content   []byte
+	CreatedAt time.Time
+}
+
+func parseStatementPeriod(v string) (time.Time, error) {
+	period, err := time.Parse("2006-01", v)
+	if err != nil {
+		return period, invalidField("period", "Invalid statement period %s, use YYYY-MM", v)
+	}
+	return period, nil
+}
+
+// statementFormat is taken from the format query parameter, then the Accept
+// header, and is CSV by default.
+func statementFormat(r *http.Request) (string, error) {
+	if v := r.URL.Query().Get("format"); v != "" {
+		for _, format := range statementFormats {
+			if v == format {
+				return format, nil
+			}
+		}
+		return "", invalidField("format", "Statement format must be 'csv' or 'pdf'")
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "application/pdf") {
+		return StatementPDF, nil
+	}
+	return StatementCSV, nil
+}
+
+func statementContentType(format string) string {
+	if format == StatementPDF {
+		return "application/pdf"
+	}
+	return "text/csv; charset=utf-8"
+}
+
+// buildStatement reads everything posted to the account during period.
+func buildStatement(store Storage, account *Account, period time.Time) (*Statement, error) {
+	from, to := period, period.AddDate(0, 1, 0)
+
+	opening, err := store.GetBalanceAt(account.ID, from)
+	if err != nil {
+		return nil, err
+	}
+	closing, err := store.GetBalanceAt(account.ID, to)
+	if err != nil {
+		return nil, err
+	}
+
+	interestSource, err := store.GetSystemAccount(systemInterestExpense, account.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	statement := &Statement{
+		Account:        account,
+		Period:         period,
+		OpeningBalance: opening,
+		ClosingBalance: closing,
+	}
+	if account.AccountType == CreditAccount {
+		statement.Credit, err = store.GetCreditCycle(account.ID, period.Format("2006-01"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// History comes newest first, a page at a time.
+	filter := TransactionFilter{From: from, To: to, Limit: maxHistoryLimit}
+	for {
+		entries, err := store.GetTransactionHistory(account.ID, filter)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			statement.Transactions = append([]*TransactionHistoryEntry{entry}, statement.Transactions...)
+
+			effect := entry.balanceEffect(account.ID)
+			if effect > 0 {
+				statement.MoneyIn += effect
+			} else {
+				statement.MoneyOut -= effect
+			}
+			if entry.FromAccount == interestSource.ID {
+				statement.Interest += effect
+			}
+		}
+
+		if len(entries) < filter.Limit {
+			return statement, nil
+		}
+		filter.Cursor = entries[len(entries)-1].ID
+	}
+}
+
+func (st *Statement) render(format string) ([]byte, error) {
+	if format == StatementPDF {
+		return st.PDF(), nil
+	}
+	return st.CSV()
+}
+
+// CSV has one row per transaction between the opening and closing balance
+// rows, followed by the totals.
+func (st *Statement) CSV() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	w := csv.NewWriter(buf)
+
+	w.Write([]string{"date", "description", "type", "amount", "balance"})
+	w.Write([]string{st.Period.Format("2006-01-02"), "Opening balance", "", "", st.money(st.OpeningBalance)})
+	for _, t := range st.Transactions {
+		w.Write([]string{
+			t.CreatedAt.UTC().Format("2006-01-02"),
+			t.Description,
+			t.TransactionType.String(),
+			st.money(t.balanceEffect(st.Account.ID)),
+			st.money(t.RunningBalance),
+		})
+	}
+	w.Write([]string{st.periodEnd().Format("2006-01-02"), "Closing balance", "", "", st.money(st.ClosingBalance)})
+	w.Write([]string{"", "Money in", "", st.money(st.MoneyIn), ""})
+	w.Write([]string{"", "Money out", "", st.money(-st.MoneyOut), ""})
+	w.Write([]string{"", "Interest paid", "", st.money(st.Interest), ""})
+	if c := st.Credit; c != nil {
+		w.Write([]string{"", "Interest charged", "", st.money(-c.InterestCharged), ""})
+		w.Write([]string{"", "Statement balance", "", st.money(c.StatementBalance), ""})
+		w.Write([]string{c.payBy().Format("2006-01-02"), "Minimum payment due", "", st.money(c.MinimumPayment), ""})
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// PDF lays the statement out as fixed width text.
+func (st *Statement) PDF() []byte {
+	const descriptionWidth = 40
+
+	lines := []string{
+		"Go Bank account statement",
+		"",
+		fmt.Sprintf("Account number:  %d", st.Account.AccountNumber),
+		fmt.Sprintf("Account type:    %s", st.Account.AccountType),
+		fmt.Sprintf("Currency:        %s", st.Account.Currency),
+		fmt.Sprintf("Period:          %s to %s", st.Period.Format("2006-01-02"), st.periodEnd().Format("2006-01-02")),
+		"",
+		fmt.Sprintf("Opening balance: %14s", st.money(st.OpeningBalance)),
+		fmt.Sprintf("Money in:        %14s", st.money(st.MoneyIn)),
+		fmt.Sprintf("Money out:       %14s", st.money(-st.MoneyOut)),
+		fmt.Sprintf("Interest paid:   %14s", st.money(st.Interest)),
+		fmt.Sprintf("Closing balance: %14s", st.money(st.ClosingBalance)),
+	}
+	if c := st.Credit; c != nil {
+		lines = append(lines,
+			"",
+			fmt.Sprintf("Credit limit:      %14s", st.money(st.Account.CreditLimit)),
+			fmt.Sprintf("Interest charged:  %14s", st.money(c.InterestCharged)),
+			fmt.Sprintf("Statement balance: %14s", st.money(c.StatementBalance)),
+			fmt.Sprintf("Minimum payment:   %14s due by %s", st.money(c.MinimumPayment), c.payBy().Format("2006-01-02")),
+		)
+	}
+	lines = append(lines,
+		"",
+		fmt.Sprintf("%-10s  %-*s  %-8s  %14s  %14s", "Date", descriptionWidth, "Description", "Type", "Amount", "Balance"),
+		strings.Repeat("-", 10+2+descriptionWidth+2+8+2+14+2+14),
+	)
+
+	if len(st.Transactions) == 0 {
+		lines = append(lines, "No transactions in this period.")
+	}
+	for _, t := range st.Transactions {
+		description := t.Description
+		if len(description) > descriptionWidth {
+			description = description[:descriptionWidth-3] + "..."
+		}
+		lines = append(lines, fmt.Sprintf("%-10s  %-*s  %-8s  %14s  %14s",
+			t.CreatedAt.UTC().Format("2006-01-02"),
+			descriptionWidth, description,
+			t.TransactionType,
+			st.money(t.balanceEffect(st.Account.ID)),
+			st.money(t.RunningBalance),
+		))
+	}
+
+	return renderTextPDF(lines)
+}
+
+// periodEnd is the last day of the statement period.
+func (st *Statement) periodEnd() time.Time {
+	return st.Period.AddDate(0, 1, -1)
+}
+
+// formatAmount writes minor units as a decimal, 12345 as 123.45.
+func formatAmount(amount int64) string {
+	return formatMinor(amount, 2)
+}
+
+// money writes an amount in the account's currency.
+func (st *Statement) money(amount int64) string {
+	return formatMinor(amount, st.Account.Currency.MinorUnits())
+}
+
+// statementClosed reports whether nothing can be posted into period any
+// more. Interest for the last day of a period is dated inside it but only
+// posted once that day has been accrued, so an interest earning account's
+// period closes when the accrual catches up rather than at midnight. A Credit
+// account's period closes with its billing cycle.
+func (s *APIServer) statementClosed(account *Account, period time.Time) (bool, error) {
+	end := period.AddDate(0, 1, 0)
+	if s.now().Before(end) {
+		return false, nil
+	}
+
+	if account.AccountType == CreditAccount {
+		cycle, err := s.store.GetCreditCycle(account.ID, period.Format("2006-01"))
+		return cycle != nil, err
+	}
+
+	for _, product := range s.interestProducts {
+		if product.AccountType != account.AccountType {
+			continue
+		}
+
+		last, err := s.store.GetLastInterestAccrual(account.ID)
+		if err != nil {
+			return false, err
+		}
+		return !last.Before(end.AddDate(0, 0, -1)), nil
+	}
+
+	return true, nil
+}
+
+// statement returns the rendered statement. Closed periods are rendered in
+// every format on first request and stored, later requests are served from
+// storage.
+func (s *APIServer) statement(account *Account, period time.Time, format string) ([]byte, error) {
+	key := period.Format("2006-01")
+
+	closed, err := s.statementClosed(account, period)
+	if err != nil {
+		return nil, err
+	}
+
+	if closed {
+		stored, err := s.store.GetStatement(account.ID, key, format)
+		if err != nil {
+			return nil, err
+		}
+		if stored != nil {
+			return stored.Content, nil
+		}
+	}
+
+	statement, err := buildStatement(s.store, account, period)
+	if err != nil {
+		return nil, err
+	}
+
+	if !closed {
+		return statement.render(format)
+	}
+
+	for _, f := range statementFormats {
+		content, err := statement.render(f)
+		if err != nil {
+			return nil, err
+		}
+
+		err = s.store.SaveStatement(&StoredStatement{
+			AccountID: account.ID,
+			Period:    key,
+			Format:    f,
+			Content:   content,
+			CreatedAt: s.now().UTC(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Another request may have stored the statement first; serve theirs.
+	stored, err := s.store.GetStatement(account.ID, key, format)
+	if err != nil {
+		return nil, err
+	}
+	return stored.Content, nil
+}
+
+// GET /accounts/{id}/statements/{period}
+func (s *APIServer) handleGetStatement(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "GET" {
+		return methodNotAllowed(r.Method)
+	}
+
+	id, err := getID(r)
+	if err != nil {
+		return err
+	}
+
+	period, err := parseStatementPeriod(mux.Vars(r)["period"])
+	if err != nil {
+		return err
+	}
+
+	format, err := statementFormat(r)
+	if err != nil {
+		return err
+	}
+
+	account, err := s.store.GetAccountByID(id)
+	if err != nil {
+		return err
+	}
+
+	opened := account.CreatedAt.UTC()
+	if period.Before(time.Date(opened.Year(), opened.Month(), 1, 0, 0, 0, 0, time.UTC)) {
+		return notFound("Account %d was not open in %s", id, period.Format("2006-01"))
+	}
+	if period.After(s.now()) {
+		return notFound("No statement for %s yet", period.Format("2006-01"))
+	}
+
+	content, err := s.statement(account, period, format)
+	if err != nil {
+		return err
+	}
+
+	filename := "statement-" + strconv.FormatInt(account.AccountNumber, 10) + "-" + period.Format("2006-01") + "." + format
+	w.Header().Set("Content-Type", statementContentType(format))
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(content)
+	return err
+}
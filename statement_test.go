@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatementClosedPeriodIsStored(t *testing.T) {
+	store := NewMemoryStore()
+	_, from := newTestCustomer(t, store, "statement-from@mail.com", 100_00)
+	_, to := newTestCustomer(t, store, "statement-to@mail.com", 0)
+	_, err := store.Transfer(from.ID, to.ID, 25_50, Transfer, "Rent, May", nil)
+	assert.Nil(t, err)
+
+	server := NewAPIServer(":0", store)
+	period := time.Now().UTC().Format("2006-01")
+	get := func(format string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/accounts/1/statements/"+period+"?format="+format, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": strconv.Itoa(from.ID), "period": period})
+		rec := httptest.NewRecorder()
+		makeHTTPHandleFunc(server.handleGetStatement)(rec, req)
+		return rec
+	}
+
+	// The current month is still open and not stored.
+	rec := get(StatementCSV)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"Rent, May",Transfer,-25.50,74.50`)
+	stored, _ := store.GetStatement(from.ID, period, StatementCSV)
+	assert.Nil(t, stored)
+
+	server.now = func() time.Time { return time.Now().AddDate(0, 2, 0) }
+	csv, pdf := get(StatementCSV), get(StatementPDF)
+	assert.Equal(t, "application/pdf", pdf.Header().Get("Content-Type"))
+	assert.True(t, bytes.HasPrefix(pdf.Body.Bytes(), []byte("%PDF-")))
+
+	// Postings made after the period was stored do not change it.
+	_, err = store.Transfer(from.ID, to.ID, 1_00, Transfer, "Late", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, csv.Body.Bytes(), get(StatementCSV).Body.Bytes())
+	assert.Equal(t, pdf.Body.Bytes(), get(StatementPDF).Body.Bytes())
+}
+
+func TestStatementCSVTotals(t *testing.T) {
+	account := &Account{ID: 1, AccountNumber: 42}
+	statement := &Statement{
+		Account:        account,
+		Period:         time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+		OpeningBalance: 10_00,
+		ClosingBalance: 7_01,
+		MoneyIn:        1,
+		MoneyOut:       3_00,
+		Interest:       1,
+	}
+
+	content, err := statement.CSV()
+	assert.Nil(t, err)
+	assert.Contains(t, string(content), "2024-02-01,Opening balance,,,10.00\n")
+	assert.Contains(t, string(content), "2024-02-29,Closing balance,,,7.01\n")
+	assert.Contains(t, string(content), ",Money out,,-3.00,\n")
+	assert.Contains(t, string(content), ",Interest paid,,0.01,\n")
+}
+
+func TestPDFEscape(t *testing.T) {
+	assert.Equal(t, `Caf? \(ref\) 50\\50`, pdfEscape(`Café (ref) 50\50`))
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
@@ -11,22 +15,105 @@ import (
 type Storage interface {
 	CreateUser(*User, *Account) error
 	DeleteAccount(int) error
-	UpdateUser(int, map[string]string) error
+	UpdateUser(int, *UpdateUserRequest) (*User, error)
 	GetUsers() ([]*User, error)
 	GetAccounts() ([]*Account, error)
 	GetUserByID(int) (*User, error)
 	GetUserByEmail(string) (*User, error)
 	GetUserByUserName(string) (*User, error)
 	GetAccountByUserID(int) (*FullAccount, error)
+	CreateAccount(*Account) error
+	CloseAccount(int) error
+	Transfer(from, to int, amount int64, txType TransactionType, description string, event *AuditEvent, limits ...TransferLimits) (*Transaction, error)
+	TransferFX(c *FXConversion, txType TransactionType, description string, event *AuditEvent, limits ...TransferLimits) error
+	PostJournalEntry(*JournalEntry) error
+	ReverseJournalEntry(id int, description string, event *AuditEvent) (*JournalEntry, error)
+	GetJournalEntry(int) (*JournalEntry, error)
+	GetJournalEntriesByAccount(int) ([]*JournalEntry, error)
+	GetLedgerBalance(int) (*LedgerBalance, error)
+	GetAccountByID(int) (*Account, error)
+	GetTransactionHistory(accountID int, filter TransactionFilter) ([]*TransactionHistoryEntry, error)
+	GetAccountsByType(AccountType) ([]*Account, error)
+	GetSystemAccount(name string, currency Currency) (*Account, error)
+	GetBalanceAt(accountID int, at time.Time) (int64, error)
+	GetLastInterestAccrual(accountID int) (time.Time, error)
+	RecordInterestAccrual(*InterestAccrual) error
+	PostInterest(accountID int, through time.Time, systemAccount, description string) (*Transaction, error)
+	CreateRefreshToken(*RefreshToken) error
+	GetRefreshToken(tokenHash string) (*RefreshToken, error)
+	RotateRefreshToken(oldHash string, next *RefreshToken) error
+	RevokeRefreshTokenFamily(familyID string) error
+	RevokeAccessToken(jti string, expiresAt time.Time) error
+	IsAccessTokenRevoked(jti string) (bool, error)
+	UseToken(jti string, expiresAt time.Time) error
+	RevokeUserRefreshTokens(userID int) error
+	VerifyEmail(userID int, email string) error
+	SetPassword(userID int, hash string, changedAt time.Time) error
+	SaveTOTPEnrollment(*TOTPEnrollment) error
+	GetTOTPEnrollment(userID int) (*TOTPEnrollment, error)
+	EnableTOTP(userID int, recoveryCodeHashes []string) error
+	UseTOTPStep(userID int, step int64) error
+	UseRecoveryCode(userID int, codeHash string) error
+	BeginIdempotentRequest(*IdempotencyRecord) (*IdempotencyRecord, error)
+	CompleteIdempotentRequest(*IdempotencyRecord) error
+	ReleaseIdempotencyKey(scope, key string) error
+	DeleteExpiredIdempotencyKeys(now time.Time) error
+	AppendAuditEvent(*AuditEvent) error
+	GetAuditEvents(AuditFilter) ([]*AuditEvent, error)
+	GetAuditChain(afterID, limit int) ([]*AuditEvent, error)
+	GetStatement(accountID int, period, format string) (*StoredStatement, error)
+	SaveStatement(*StoredStatement) error
+	GetLimitOverride(accountID int) (*LimitOverride, error)
+	SetLimitOverride(override *LimitOverride, event *AuditEvent) error
+	DeleteLimitOverride(accountID int, event *AuditEvent) error
+	CreateScheduledTransfer(*ScheduledTransfer) error
+	GetScheduledTransfer(int) (*ScheduledTransfer, error)
+	GetScheduledTransfersByUser(userID int) ([]*ScheduledTransfer, error)
+	UpdateScheduledTransfer(st, previous *ScheduledTransfer) error
+	GetDueScheduledTransfers(now time.Time, limit int) ([]*ScheduledTransfer, error)
+	RunScheduledTransfer(st *ScheduledTransfer, now time.Time, limits []TransferLimits) (*ScheduledTransferRun, error)
+	GetScheduledTransferRuns(scheduledTransferID int) ([]*ScheduledTransferRun, error)
+	GetAccountBalance(accountID int, now time.Time) (*AccountBalance, error)
+	AuthorizeHold(hold *Hold, event *AuditEvent, limits ...TransferLimits) error
+	GetHold(int) (*Hold, error)
+	GetHoldsByAccount(accountID int) ([]*Hold, error)
+	CaptureHold(id int, amount int64, now time.Time, event *AuditEvent, limits ...TransferLimits) (*Hold, error)
+	VoidHold(id int, now time.Time, event *AuditEvent) (*Hold, error)
+	ExpireHolds(now time.Time) (int, error)
+	SetCreditLimit(accountID int, limit int64) error
+	GetInflow(accountID int, from, to time.Time) (int64, error)
+	GetCreditCycles(accountID int) ([]*CreditCycle, error)
+	GetCreditCycle(accountID int, period string) (*CreditCycle, error)
+	CloseCreditCycle(cycle *CreditCycle, systemAccount, description string) error
+	SettleCreditCycle(cycle *CreditCycle, systemAccount, description string) error
+	CreateReferral(r *Referral, maxPerReferrer int) error
+	GetReferralsByReferrer(userID int) ([]*Referral, error)
+	GetPendingReferrals() ([]*Referral, error)
+	GetDeposits(userID int, from, to time.Time) ([]*Deposit, error)
+	PayReferral(r *Referral, referrerAccount, refereeAccount int, systemAccount string) error
+	ExpireReferral(id int, at time.Time) error
+	GetLoginThrottle(key string) (*LoginThrottle, error)
+	RecordLoginFailure(key string, now time.Time, policy LoginPolicy) (*LoginThrottle, error)
+	ClearLoginFailures(key string) error
+	UpdateLastLogin(userID int, at time.Time) error
+	Ping(ctx context.Context) error
+	Close() error
 }
 
+const userColumns = `user_id, email, password, first_name, last_name, user_name, coalesce(phone_number, ''), coalesce(referrer_id, 0), created_at, coalesce(last_login, created_at), fk_role, is_active_user, email_verified, phone_verified, coalesce(password_changed_at, created_at)`
+
+const accountColumns = `account_id, fk_user, account_number, coalesce(balance, 0), created_at, fk_account_type, currency, credit_limit, is_active_account, is_system`
+
+// systemUserEmail is the bank's own user, created by migration 3, which owns
+// every system account. It is inactive so nobody can log in as it.
+const systemUserEmail = "system@go-bank.local"
+
 type PostgresStore struct {
 	db *sql.DB
 }
 
-func NewPostgresStore() (*PostgresStore, error) {
-	conStr := "user=postgres dbname=gobank password=postgres sslmode=disable"
-	db, err := sql.Open("postgres", conStr)
+func NewPostgresStore(dsn string) (*PostgresStore, error) {
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, err
 	}
@@ -39,159 +126,18 @@ func NewPostgresStore() (*PostgresStore, error) {
 	}, nil
 }
 
-func (s *PostgresStore) Init() error {
-	roleTable := s.CreateRoleTable()
-	if roleTable != nil {
-		return roleTable
-	}
-	userTable := s.CreateUserTable()
-	if userTable != nil {
-		return userTable
-	}
-	accTypeTable := s.CreateAccountTypeTable()
-	if accTypeTable != nil {
-		return accTypeTable
-	}
-	accTable := s.CreateAccountTable()
-	if accTable != nil {
-		return accTable
-	}
-	transTypeTable := s.CreateTransactionTypeTable()
-	if transTypeTable != nil {
-		return transTypeTable
-	}
-	transactionTable := s.CreateTransactionTable()
-	if transactionTable != nil {
-		return transactionTable
-	}
-
-	return nil
-}
-
-func (s *PostgresStore) CreateUserTable() error {
-	query := `create table if not exists user_profile (
-        user_id serial primary key,
-        email varchar(50) unique not null,
-        password varchar(100) not null,
-        first_name varchar(50) not null,
-        last_name varchar(50) not null,
-        user_name varchar(50) unique not null,
-        phone_number varchar(10),
-        referrer_id int,
-        created_at timestamp,
-        last_login timestamp,
-        fk_role int references role(role_id),
-        is_active_user boolean
-    )`
-
-	_, err := s.db.Exec(query)
-
-	return err
-}
-
-func (s *PostgresStore) CreateAccountTable() error {
-	query := `create table if not exists account (
-        account_id serial primary key,
-        fk_user serial references user_profile(user_id), 
-        account_number serial unique, 
-        balance bigint,
-        created_at timestamp,
-        fk_account_type int references account_type(account_type_id),
-        is_active_account boolean
-    )`
-
-	_, err := s.db.Exec(query)
-
-	return err
-}
-
-func (s *PostgresStore) CreateAccountTypeTable() error {
-	query := `create table if not exists account_type (
-        account_type_id serial primary key,
-        account_type_name varchar(20)
-    )`
-
-	_, err := s.db.Query(query)
-
-	if err == nil {
-		query := `insert into account_type (account_type_name)
-        select 'Checking' 
-        union all 
-        select 'Savings'
-        union all 
-        select 'Credit'
-        where (select count(*) from account_type) = 0`
-
-		_, err := s.db.Query(query)
-
-		return err
-	}
-
-	return err
-}
-
-func (s *PostgresStore) CreateRoleTable() error {
-	query := `create table if not exists role (
-        role_id serial primary key,
-        role_name varchar(10)
-    )`
-
-	_, err := s.db.Query(query)
-
-	if err == nil {
-		query := `insert into role(role_name)
-        select 'Admin'
-        union all 
-        select 'Employee'
-        union all 
-        select 'Customer'
-        where (select count(*) from role) = 0`
-
-		_, err := s.db.Query(query)
-		return err
-	}
-
-	return err
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
 }
 
-func (s *PostgresStore) CreateTransactionTable() error {
-	query := `create table if not exists transaction (
-        id serial primary key,
-        from_account int references account(account_id) not null,
-        to_account int references account(account_id) not null,
-        amount bigint not null,
-        description varchar(200),
-        created_at timestamp,
-        fk_transaction_type int references transaction_type(transaction_type_id)
-    )`
-
-	_, err := s.db.Query(query)
-
-	return err
+// Close closes the connection pool once no more requests are served.
+func (s *PostgresStore) Close() error {
+	return s.db.Close()
 }
 
-func (s *PostgresStore) CreateTransactionTypeTable() error {
-	query := `create table if not exists transaction_type (
-        transaction_type_id serial primary key,
-        transaction_name varchar(10)
-    )`
-
-	_, err := s.db.Query(query)
-
-	if err == nil {
-		query := `insert into transaction_type(transaction_name)
-        select 'Credit'
-        union all 
-        select 'Debit'
-        union all 
-        select 'Transfer'
-        where (select count(*) from transaction_type) = 0`
-
-		_, err := s.db.Query(query)
-		return err
-	}
-
-	return err
+// Init brings the schema up to date. See migrations.go for the tables.
+func (s *PostgresStore) Init() error {
+	return s.MigrateUp()
 }
 
 func (s *PostgresStore) CreateUser(user *User, account *Account) error {
@@ -199,7 +145,7 @@ func (s *PostgresStore) CreateUser(user *User, account *Account) error {
 	if user.Role == Admin {
 		query := `insert into user_profile (email, password, first_name, last_name, user_name, phone_number, created_at, last_login, fk_role, is_active_user) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
 
-		_, err := s.db.Query(
+		_, err := s.db.Exec(
 			query,
 			user.Email,
 			user.Password,
@@ -214,21 +160,35 @@ func (s *PostgresStore) CreateUser(user *User, account *Account) error {
 		)
 		if err != nil {
 			if strings.Contains(err.Error(), "duplicate") {
-				return fmt.Errorf("Email in use")
+				return conflict("Email in use")
 			}
 			return err
 		}
 	} else {
+		account.Currency = accountCurrency(account)
+		equity, err := s.openingBalanceAccount(account)
+		if err != nil {
+			return err
+		}
+
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+
+		// The account is opened empty and its opening balance posted below.
 		query := `with x as (
             insert into user_profile (email, password, first_name, last_name, user_name, phone_number, referrer_id, created_at, last_login, fk_role, is_active_user) values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
             returning user_id
         )
-    insert into account (fk_user, account_number, balance, created_at, fk_account_type, is_active_account)
-    select x.user_id, $12, $13, $14, $15, $16
-    from x;
+    insert into account (fk_user, account_number, balance, created_at, fk_account_type, currency, credit_limit, is_active_account)
+    select x.user_id, $12, 0, $13, $14, $15, $16, $17
+    from x
+    returning fk_user, account_id
     `
 
-		_, err := s.db.Query(
+		err = tx.QueryRow(
 			query,
 			user.Email,
 			user.Password,
@@ -242,64 +202,115 @@ func (s *PostgresStore) CreateUser(user *User, account *Account) error {
 			user.Role,
 			user.IsActive,
 			account.AccountNumber,
-			account.Balance,
 			account.CreatedAt,
 			account.AccountType,
+			account.Currency,
+			account.CreditLimit,
 			account.IsActiveAccount,
-		)
+		).Scan(&user.ID, &account.ID)
 		if err != nil {
 			if strings.Contains(err.Error(), "duplicate") && strings.Contains(err.Error(), "user") {
-				return fmt.Errorf("Email in use")
+				return conflict("Email in use")
 			} else if strings.Contains(err.Error(), "duplicate") && strings.Contains(err.Error(), "account") {
 				return fmt.Errorf("Something went wrong, please try registering again")
 			}
 			return err
 		}
+		account.UserID = user.ID
+
+		if equity != nil {
+			if err := openingBalanceTx(tx, account, equity.ID); err != nil {
+				return err
+			}
+		}
+
+		return tx.Commit()
 	}
 
 	return nil
 }
 
-func (s *PostgresStore) UpdateUser(id int, userUpdates map[string]string) error {
-	// var setValues []string
-	var values []interface{}
+// openingBalanceAccount is the system account that pays in the account's
+// opening balance, or nil when it opens empty.
+func (s *PostgresStore) openingBalanceAccount(account *Account) (*Account, error) {
+	if account.Balance <= 0 {
+		return nil, nil
+	}
+	return s.GetSystemAccount(systemOpeningBalance, account.Currency)
+}
 
-	var queryStrings []string
+// UpdateUser changes the profile fields set in update. Column names come from
+// this function, never from the request. Changing the email or phone number
+// marks it unverified again.
+func (s *PostgresStore) UpdateUser(id int, update *UpdateUserRequest) (*User, error) {
+	sets := []string{}
+	args := []interface{}{id}
+	set := func(column string, value string) {
+		args = append(args, value)
+		sets = append(sets, fmt.Sprintf("%s = $%d", column, len(args)))
+	}
 
-	for k, v := range userUpdates {
-        value := "'" + v + "'"
-		queryStrings = append(queryStrings, fmt.Sprintf("%s = %s", k, value))
+	if update.Email != nil {
+		set("email", *update.Email)
+		sets = append(sets, fmt.Sprintf("email_verified = email_verified and email = $%d", len(args)))
+	}
+	if update.FirstName != nil {
+		set("first_name", *update.FirstName)
+	}
+	if update.LastName != nil {
+		set("last_name", *update.LastName)
+	}
+	if update.UserName != nil {
+		set("user_name", *update.UserName)
+	}
+	if update.PhoneNumber != nil {
+		set("phone_number", *update.PhoneNumber)
+		sets = append(sets, fmt.Sprintf("phone_verified = phone_verified and coalesce(phone_number, '') = $%d", len(args)))
 	}
 
-	fmt.Println(values)
+	if len(sets) == 0 {
+		return s.GetUserByID(id)
+	}
 
-	query := fmt.Sprintf("update user_profile set %s where user_id = %d", strings.Join(queryStrings, ", "), id)
-	fmt.Println(query)
+	rows, err := s.db.Query(`update user_profile
+        set `+strings.Join(sets, ", ")+`
+        where user_id = $1 and is_active_user = true
+        returning `+userColumns, args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate") {
+			return nil, conflict("Email or user name in use")
+		}
+		return nil, err
+	}
+	defer rows.Close()
 
-	_, err := s.db.Query(query, values...)
+	for rows.Next() {
+		return scanIntoUser(rows)
+	}
 
-	return err
+	return nil, notFound("Account %d not found", id)
 }
 
 func (s *PostgresStore) DeleteAccount(id int) error {
-	_, accErr := s.db.Query(`update account
+	_, accErr := s.db.Exec(`update account
     set is_active_account = false
     where fk_user = $1`, id)
 	if accErr != nil {
 		return accErr
 	}
 
-	_, err := s.db.Query(`update user_profile 
+	_, err := s.db.Exec(`update user_profile 
         set is_active_user = false 
         where user_id = $1`, id)
 	return err
 }
 
 func (s *PostgresStore) GetUsers() ([]*User, error) {
-	rows, err := s.db.Query("select * from user where is_active = true")
+	rows, err := s.db.Query("select " + userColumns + " from user_profile where is_active_user = true")
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	users := []*User{}
 
@@ -315,10 +326,11 @@ func (s *PostgresStore) GetUsers() ([]*User, error) {
 }
 
 func (s *PostgresStore) GetAccounts() ([]*Account, error) {
-	rows, err := s.db.Query("select * from account where is_active = true")
+	rows, err := s.db.Query("select " + accountColumns + " from account where is_active_account = true")
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	accounts := []*Account{}
 
@@ -334,75 +346,2456 @@ func (s *PostgresStore) GetAccounts() ([]*Account, error) {
 }
 
 func (s *PostgresStore) GetUserByID(id int) (*User, error) {
-	rows, err := s.db.Query("select * from user_profile where is_active_user = true and user_id = $1", id)
+	user, err := scanIntoUser(s.db.QueryRow("select "+userColumns+" from user_profile where is_active_user = true and user_id = $1", id))
+	if err == sql.ErrNoRows {
+		return nil, notFound("Account %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *PostgresStore) GetUserByEmail(email string) (*User, error) {
+	user, err := scanIntoUser(s.db.QueryRow("select "+userColumns+" from user_profile where is_active_user = true and email = $1", email))
+	if err == sql.ErrNoRows {
+		return nil, notFound("User %v not found", email)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *PostgresStore) GetUserByUserName(username string) (*User, error) {
+	user, err := scanIntoUser(s.db.QueryRow("select "+userColumns+" from user_profile where is_active_user = true and user_name = $1", username))
+	if err == sql.ErrNoRows {
+		return nil, notFound("User %v not found", username)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (s *PostgresStore) GetAccountByID(id int) (*Account, error) {
+	rows, err := s.db.Query("select "+accountColumns+" from account where account_id = $1", id)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
 	for rows.Next() {
-		return scanIntoUser(rows)
+		return scanIntoAccount(rows)
 	}
 
-	return nil, fmt.Errorf("Account %d not found", id)
+	return nil, notFound("Account %d not found", id)
 }
 
-func (s *PostgresStore) GetUserByEmail(email string) (*User, error) {
-	rows, err := s.db.Query("select * from user_profile where is_active_user = true and email = $1", email)
+// GetTransactionHistory returns the account's transactions newest first. The
+// running balance is summed forward over every posting to the account, in
+// journal order and before any filter is applied, so it is correct on every
+// page and counts postings that have no transaction.
+func (s *PostgresStore) GetTransactionHistory(accountID int, filter TransactionFilter) ([]*TransactionHistoryEntry, error) {
+	args := []interface{}{accountID, Credit}
+	where := []string{"true"}
+
+	addFilter := func(clause string, value interface{}) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+
+	if !filter.From.IsZero() {
+		addFilter("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addFilter("created_at < $%d", filter.To)
+	}
+	if filter.Type != 0 {
+		addFilter("fk_transaction_type = $%d", filter.Type)
+	}
+	if filter.MinAmount != 0 {
+		addFilter("amount >= $%d", filter.MinAmount)
+	}
+	if filter.MaxAmount != 0 {
+		addFilter("amount <= $%d", filter.MaxAmount)
+	}
+	if filter.Counterparty != 0 {
+		addFilter("(case when from_account = $1 then to_account else from_account end) = $%d", filter.Counterparty)
+	}
+	if filter.Cursor != 0 {
+		addFilter("id < $%d", filter.Cursor)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	args = append(args, limit)
+
+	// Running balances are summed forward through the account's postings,
+	// which hold every change to its balance, including the ones that have no
+	// transaction.
+	query := fmt.Sprintf(`with balances as (
+            select e.fk_transaction,
+                sum(sum(case when p.fk_transaction_type = $2 then p.amount else -p.amount end)) over (order by e.id) as balance,
+                e.id as entry_id
+            from journal_entry e
+            join posting p on p.fk_journal_entry = e.id
+            where p.fk_account = $1
+            group by e.id
+        )
+        select id, from_account, to_account, amount, description, created_at, fk_transaction_type, running_balance
+        from (
+            select t.id, t.from_account, t.to_account, t.amount, coalesce(t.description, '') as description,
+                t.created_at, t.fk_transaction_type,
+                coalesce((select b.balance from balances b where b.fk_transaction = t.id order by b.entry_id desc limit 1), 0) as running_balance
+            from transaction t
+            where t.from_account = $1 or t.to_account = $1
+        ) history
+        where %s
+        order by id desc
+        limit $%d`, strings.Join(where, " and "), len(args))
+
+	rows, err := s.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	entries := []*TransactionHistoryEntry{}
 	for rows.Next() {
-		return scanIntoUser(rows)
+		entry := new(TransactionHistoryEntry)
+		err := rows.Scan(
+			&entry.ID,
+			&entry.FromAccount,
+			&entry.ToAccount,
+			&entry.Amount,
+			&entry.Description,
+			&entry.CreatedAt,
+			&entry.TransactionType,
+			&entry.RunningBalance,
+		)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
 	}
 
-	return nil, fmt.Errorf("User %v not found", email)
+	return entries, rows.Err()
 }
 
-func (s *PostgresStore) GetUserByUserName(username string) (*User, error) {
-	rows, err := s.db.Query("select * from user_profile where is_active_user = true and user_name = $1", username)
+// GetAccountsByType returns every open account of the type, system accounts
+// included, in the order they were opened.
+func (s *PostgresStore) GetAccountsByType(accType AccountType) ([]*Account, error) {
+	rows, err := s.db.Query("select "+accountColumns+" from account where fk_account_type = $1 and is_active_account = true order by account_id", accType)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
+
+	accounts := []*Account{}
 	for rows.Next() {
-		return scanIntoUser(rows)
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts = append(accounts, account)
 	}
 
-	return nil, fmt.Errorf("User %v not found", username)
+	return accounts, rows.Err()
 }
 
-func (s *PostgresStore) GetAccountByUserID(id int) (*FullAccount, error) {
-	return nil, nil
+// GetSystemAccount returns the bank-owned account with the given name in
+// currency, opening it the first time it is asked for.
+func (s *PostgresStore) GetSystemAccount(name string, currency Currency) (*Account, error) {
+	account, err := s.findSystemAccount(name, currency)
+	if err != nil || account != nil {
+		return account, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var accountID int
+	err = tx.QueryRow(`insert into account (fk_user, balance, created_at, fk_account_type, currency, is_active_account, is_system)
+        select user_id, 0, $2, $3, $4, true, true
+        from user_profile
+        where email = $1
+        returning account_id`, systemUserEmail, time.Now().UTC(), Checking, currency).Scan(&accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	// When another instance opened the account first, roll back and use theirs.
+	result, err := tx.Exec(`insert into system_account (name, currency, fk_account) values ($1, $2, $3) on conflict (name, currency) do nothing`, name, currency, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 1 {
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+	}
+
+	account, err = s.findSystemAccount(name, currency)
+	if err == nil && account == nil {
+		return nil, fmt.Errorf("System account %s in %s not found", name, currency)
+	}
+
+	return account, err
 }
 
-func scanIntoUser(rows *sql.Rows) (*User, error) {
-	user := new(User)
-	err := rows.Scan(
-		&user.ID,
-		&user.Email,
-		&user.Password,
-		&user.FirstName,
-		&user.LastName,
-		&user.UserName,
-		&user.PhoneNumber,
-		&user.ReferrerID,
-		&user.CreatedAt,
-		&user.LastLogin,
-		&user.Role,
-		&user.IsActive,
-	)
+func (s *PostgresStore) findSystemAccount(name string, currency Currency) (*Account, error) {
+	rows, err := s.db.Query("select "+accountColumns+` from account
+        where account_id = (select fk_account from system_account where name = $1 and currency = $2)`, name, currency)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	return user, err
+	for rows.Next() {
+		return scanIntoAccount(rows)
+	}
+
+	return nil, rows.Err()
 }
 
-func scanIntoAccount(rows *sql.Rows) (*Account, error) {
-	account := new(Account)
-	err := rows.Scan(
-		&account.ID,
-		&account.AccountNumber,
-		&account.Balance,
-		&account.CreatedAt,
-		&account.AccountType,
-		&account.IsActiveAccount,
+// GetBalanceAt sums the account's postings from journal entries made before
+// the given time, so it counts the same changes as the history's running
+// balances, including ones that have no transaction.
+func (s *PostgresStore) GetBalanceAt(accountID int, at time.Time) (int64, error) {
+	var balance int64
+	err := s.db.QueryRow(`select coalesce((
+            select sum(case when p.fk_transaction_type = $3 then p.amount else -p.amount end)
+            from posting p
+            join journal_entry e on e.id = p.fk_journal_entry
+            where p.fk_account = a.account_id and e.created_at < $2
+        ), 0)
+        from account a
+        where a.account_id = $1`, accountID, at, Credit).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, notFound("Account %d not found", accountID)
+	}
+
+	return balance, err
+}
+
+// GetLastInterestAccrual returns the zero time when the account has never
+// accrued interest.
+func (s *PostgresStore) GetLastInterestAccrual(accountID int) (time.Time, error) {
+	var last sql.NullTime
+	err := s.db.QueryRow(`select max(accrual_date) from interest_accrual where fk_account = $1`, accountID).Scan(&last)
+
+	return last.Time, err
+}
+
+// RecordInterestAccrual is idempotent: a day that was already accrued keeps
+// its original amount.
+func (s *PostgresStore) RecordInterestAccrual(accrual *InterestAccrual) error {
+	_, err := s.db.Exec(`insert into interest_accrual (fk_account, accrual_date, balance, apy_basis_points, amount_micros)
+        values ($1, $2, $3, $4, $5)
+        on conflict (fk_account, accrual_date) do nothing`,
+		accrual.AccountID,
+		accrual.Date,
+		accrual.Balance,
+		accrual.APYBasisPoints,
+		accrual.AmountMicros,
 	)
 
-	return account, err
+	return err
+}
+
+// PostInterest pays out every unpaid accrual up to and including through as
+// a single Credit from the named system account in the account's currency,
+// rounded to the nearest minor unit and dated the last second of through. The
+// accruals are marked paid in the same transaction, so interest is never paid
+// twice. It returns nil when the accruals come to less than half a minor
+// unit; they stay unpaid and are carried into the next payout.
+func (s *PostgresStore) PostInterest(accountID int, through time.Time, systemAccount, description string) (*Transaction, error) {
+	account, err := s.GetAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+	source, err := s.GetSystemAccount(systemAccount, account.Currency)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if err := lockAccounts(tx, []int{accountID}); err != nil {
+		return nil, err
+	}
+
+	var micros int64
+	err = tx.QueryRow(`select coalesce(sum(amount_micros), 0)
+        from interest_accrual
+        where fk_account = $1 and accrual_date <= $2 and not posted`, accountID, through).Scan(&micros)
+	if err != nil {
+		return nil, err
+	}
+
+	amount := roundMicros(micros)
+	if amount <= 0 {
+		return nil, nil
+	}
+
+	transaction, err := transferTx(tx, source.ID, accountID, amount, Credit, description, interestValueDate(through))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`update interest_accrual
+        set posted = true, fk_transaction = $3
+        where fk_account = $1 and accrual_date <= $2 and not posted`, accountID, through, transaction.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return transaction, nil
+}
+
+// GetAccountByUserID returns the user together with all of their open
+// accounts.
+func (s *PostgresStore) GetAccountByUserID(id int) (*FullAccount, error) {
+	user, err := s.GetUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query("select "+accountColumns+" from account where fk_user = $1 and is_active_account = true order by account_id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fullAccount := &FullAccount{User: *user, Accounts: []Account{}}
+	for rows.Next() {
+		account, err := scanIntoAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		fullAccount.Accounts = append(fullAccount.Accounts, *account)
+	}
+
+	return fullAccount, rows.Err()
+}
+
+func (s *PostgresStore) CreateAccount(account *Account) error {
+	account.Currency = accountCurrency(account)
+	equity, err := s.openingBalanceAccount(account)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`insert into account (fk_user, account_number, balance, created_at, fk_account_type, currency, credit_limit, is_active_account)
+        select user_id, $2, 0, $3, $4, $5, $6, $7
+        from user_profile
+        where user_id = $1 and is_active_user = true
+        returning account_id`,
+		account.UserID,
+		account.AccountNumber,
+		account.CreatedAt,
+		account.AccountType,
+		account.Currency,
+		account.CreditLimit,
+		account.IsActiveAccount,
+	).Scan(&account.ID)
+	if err == sql.ErrNoRows {
+		return notFound("Account %d not found", account.UserID)
+	}
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate") {
+			return fmt.Errorf("Something went wrong, please try again")
+		}
+		return err
+	}
+
+	if equity != nil {
+		if err := openingBalanceTx(tx, account, equity.ID); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CloseAccount deactivates a single account. The balance must be zero, so no
+// money is stranded in a closed account.
+func (s *PostgresStore) CloseAccount(id int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockAccounts(tx, []int{id}); err != nil {
+		return err
+	}
+
+	var balance int64
+	if err := tx.QueryRow(`select coalesce(balance, 0) from account where account_id = $1`, id).Scan(&balance); err != nil {
+		return err
+	}
+	if balance != 0 {
+		return unprocessable("Account balance must be zero to close it")
+	}
+
+	// A pending hold could not be captured once the account is closed.
+	held, err := heldAmount(tx, id, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if held != 0 {
+		return unprocessable("Account has pending holds, capture or void them before closing it")
+	}
+
+	if _, err := tx.Exec(`update account set is_active_account = false where account_id = $1`, id); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Transfer moves amount from one account to another and records it in the
+// transaction table. Both balance updates and the transaction row are written
+// in a single database transaction, so either all of them land or none do.
+// Transfer refuses the transfer when it breaks any of limits, checked after
+// the accounts are locked. event, when given, is audited in the same
+// transaction.
+func (s *PostgresStore) Transfer(from, to int, amount int64, txType TransactionType, description string, event *AuditEvent, limits ...TransferLimits) (*Transaction, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	transaction, err := limitedTransferTx(tx, from, to, amount, txType, description, time.Now().UTC(), limits)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := appendAuditEventTx(tx, event.about(transaction.ID, nil, transaction)); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return transaction, nil
+}
+
+// TransferFX moves c.Source out of c.FromAccount and c.Target into
+// c.ToAccount through the FX system accounts of the two currencies, and
+// records the conversion, all in one database transaction. Limits apply to
+// the source leg.
+func (s *PostgresStore) TransferFX(c *FXConversion, txType TransactionType, description string, event *AuditEvent, limits ...TransferLimits) error {
+	sourceFX, err := s.GetSystemAccount(systemFX, c.Source.Currency)
+	if err != nil {
+		return err
+	}
+	targetFX, err := s.GetSystemAccount(systemFX, c.Target.Currency)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	out, err := limitedTransferTx(tx, c.FromAccount, sourceFX.ID, c.Source.Amount, txType, description, c.CreatedAt, limits)
+	if err != nil {
+		return err
+	}
+	in, err := transferTx(tx, targetFX.ID, c.ToAccount, c.Target.Amount, txType, description, c.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`insert into fx_conversion (from_account, to_account, source_amount, source_currency, target_amount, target_currency, mid_rate, spread_bps, applied_rate, rate_as_of, from_transaction, to_transaction, created_at)
+        values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+        returning id`,
+		c.FromAccount,
+		c.ToAccount,
+		c.Source.Amount,
+		c.Source.Currency,
+		c.Target.Amount,
+		c.Target.Currency,
+		c.MidRate.String(),
+		c.SpreadBps,
+		c.AppliedRate.String(),
+		c.RateAsOf,
+		out.ID,
+		in.ID,
+		c.CreatedAt,
+	).Scan(&c.ID)
+	if err != nil {
+		return err
+	}
+
+	c.FromTransaction = out.ID
+	c.ToTransaction = in.ID
+
+	if err := appendAuditEventTx(tx, event.about(c.ID, nil, c)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// limitedTransferTx is transferTx refused when it breaks any of limits,
+// checked once the accounts are locked.
+func limitedTransferTx(tx *sql.Tx, from, to int, amount int64, txType TransactionType, description string, now time.Time, limits []TransferLimits) (*Transaction, error) {
+	if len(limits) > 0 {
+		if err := lockAccounts(tx, []int{from, to}); err != nil {
+			return nil, err
+		}
+		if err := checkLimitsTx(tx, from, amount, now, limits); err != nil {
+			return nil, err
+		}
+	}
+
+	return transferTx(tx, from, to, amount, txType, description, now)
+}
+
+// checkLimitsTx refuses moving amount out of from when it breaks any of
+// limits. The caller has locked the account.
+func checkLimitsTx(tx *sql.Tx, from int, amount int64, now time.Time, limits []TransferLimits) error {
+	return checkTransferLimits(limits, amount, now, func(since time.Time) (int64, int, error) {
+		var (
+			total int64
+			count int
+		)
+		err := tx.QueryRow(`select coalesce(sum(amount), 0), count(*) from transaction where from_account = $1 and created_at >= $2`, from, since).Scan(&total, &count)
+		return total, count, err
+	})
+}
+
+// transferTx is Transfer inside a transaction the caller owns, so other
+// writes can commit or roll back together with the money movement. System
+// accounts may go negative; customer accounts only as far as their credit
+// limit. createdAt is the value date of the transaction.
+func transferTx(tx *sql.Tx, from, to int, amount int64, txType TransactionType, description string, createdAt time.Time) (*Transaction, error) {
+	if amount <= 0 {
+		return nil, invalidField("amount", "Transfer amount must be greater than zero")
+	}
+	if from == to {
+		return nil, unprocessable("Cannot transfer to the same account")
+	}
+
+	if err := lockAccounts(tx, []int{from, to}); err != nil {
+		return nil, err
+	}
+	if err := checkFunds(tx, from, amount, createdAt); err != nil {
+		return nil, err
+	}
+
+	transaction := &Transaction{
+		FromAccount:     from,
+		ToAccount:       to,
+		Amount:          amount,
+		Description:     description,
+		CreatedAt:       createdAt,
+		TransactionType: txType,
+	}
+	if err := insertTransferTx(tx, transaction); err != nil {
+		return nil, err
+	}
+
+	return transaction, nil
+}
+
+// checkFunds refuses to take amount from an account that does not have it
+// available, counting its holds and credit limit. System accounts can go
+// negative. The caller must have locked the account.
+func checkFunds(tx *sql.Tx, accountID int, amount int64, now time.Time) error {
+	var (
+		balance     int64
+		creditLimit int64
+		isSystem    bool
+	)
+	if err := tx.QueryRow(`select coalesce(balance, 0), credit_limit, is_system from account where account_id = $1`, accountID).Scan(&balance, &creditLimit, &isSystem); err != nil {
+		return err
+	}
+	if isSystem {
+		return nil
+	}
+
+	held, err := heldAmount(tx, accountID, now)
+	if err != nil {
+		return err
+	}
+	if balance-held+creditLimit < amount {
+		return unprocessable("Insufficient funds")
+	}
+	return nil
+}
+
+// openingBalanceTx pays a new account's opening balance in from the bank's
+// equity, so the journal and the transaction history account for all of it.
+// The account must have been inserted with a zero balance.
+func openingBalanceTx(tx *sql.Tx, account *Account, equity int) error {
+	return insertTransferTx(tx, &Transaction{
+		FromAccount:     equity,
+		ToAccount:       account.ID,
+		Amount:          account.Balance,
+		Description:     openingBalanceDescription,
+		CreatedAt:       account.CreatedAt,
+		TransactionType: Credit,
+	})
+}
+
+// insertTransferTx writes the transaction row and its journal entry. The
+// caller must have locked both accounts and decided the money may move.
+func insertTransferTx(tx *sql.Tx, transaction *Transaction) error {
+	err := tx.QueryRow(`insert into transaction (from_account, to_account, amount, description, created_at, fk_transaction_type)
+        values ($1, $2, $3, $4, $5, $6)
+        returning id`,
+		transaction.FromAccount,
+		transaction.ToAccount,
+		transaction.Amount,
+		transaction.Description,
+		transaction.CreatedAt,
+		transaction.TransactionType,
+	).Scan(&transaction.ID)
+	if err != nil {
+		return err
+	}
+
+	entry := NewTransferEntry(transaction.FromAccount, transaction.ToAccount, transaction.Amount, transaction.Description)
+	entry.TransactionID = transaction.ID
+	entry.CreatedAt = transaction.CreatedAt
+	return insertJournalEntry(tx, entry)
+}
+
+func (s *PostgresStore) PostJournalEntry(entry *JournalEntry) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockAccounts(tx, entry.accountIDs()); err != nil {
+		return err
+	}
+	if err := insertJournalEntry(tx, entry); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ReverseJournalEntry posts an entry that undoes the given one. When the
+// original entry belongs to a transfer, a matching transaction row is written
+// in the opposite direction so the account history shows the reversal too.
+func (s *PostgresStore) ReverseJournalEntry(id int, description string, event *AuditEvent) (*JournalEntry, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	original, err := getJournalEntry(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if original.ReversesEntry != 0 {
+		return nil, unprocessable("Journal entry %d is itself a reversal", id)
+	}
+
+	var reversed int
+	if err := tx.QueryRow(`select count(*) from journal_entry where reverses_entry = $1`, id).Scan(&reversed); err != nil {
+		return nil, err
+	}
+	if reversed > 0 {
+		return nil, conflict("Journal entry %d has already been reversed", id)
+	}
+
+	reversal := original.Reversal(description)
+
+	if err := lockAccounts(tx, reversal.accountIDs()); err != nil {
+		return nil, err
+	}
+
+	// Reversing takes the money back, so like a transfer it cannot take more
+	// than an account has available.
+	effects := reversal.balanceEffects()
+	for _, accountID := range reversal.accountIDs() {
+		if effect := effects[accountID]; effect < 0 {
+			if err := checkFunds(tx, accountID, -effect, reversal.CreatedAt); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if original.TransactionID != 0 {
+		err := tx.QueryRow(`insert into transaction (from_account, to_account, amount, description, created_at, fk_transaction_type)
+            select to_account, from_account, amount, $2, $3, fk_transaction_type
+            from transaction
+            where id = $1
+            returning id`, original.TransactionID, description, reversal.CreatedAt).Scan(&reversal.TransactionID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := insertJournalEntry(tx, reversal); err != nil {
+		return nil, err
+	}
+
+	if err := appendAuditEventTx(tx, event.about(id, nil, reversal)); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return reversal, nil
+}
+
+func (s *PostgresStore) GetJournalEntry(id int) (*JournalEntry, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	return getJournalEntry(tx, id)
+}
+
+func (s *PostgresStore) GetJournalEntriesByAccount(accountID int) ([]*JournalEntry, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`select distinct fk_journal_entry from posting where fk_account = $1 order by fk_journal_entry`, accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int{}
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	entries := []*JournalEntry{}
+	for _, id := range ids {
+		entry, err := getJournalEntry(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// GetLedgerBalance compares the stored account balance with the balance
+// derived from the account's postings.
+func (s *PostgresStore) GetLedgerBalance(accountID int) (*LedgerBalance, error) {
+	ledger := &LedgerBalance{AccountID: accountID}
+
+	err := s.db.QueryRow(`select coalesce(a.balance, 0),
+            coalesce((select sum(case when p.fk_transaction_type = $2 then p.amount else -p.amount end)
+                from posting p
+                where p.fk_account = a.account_id), 0)
+        from account a
+        where a.account_id = $1`, accountID, Credit).Scan(&ledger.Balance, &ledger.LedgerBalance)
+	if err == sql.ErrNoRows {
+		return nil, notFound("Account %d not found", accountID)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ledger.InBalance = ledger.Balance == ledger.LedgerBalance
+
+	return ledger, nil
+}
+
+// lockAccounts takes row locks on the given accounts in account_id order, so
+// two transactions touching the same accounts cannot deadlock, and checks that
+// every account exists, is active and holds the same currency.
+func lockAccounts(tx *sql.Tx, ids []int) error {
+	sorted := append([]int{}, ids...)
+	sort.Ints(sorted)
+
+	active := map[int]bool{}
+	currencies := map[int]Currency{}
+	for _, id := range sorted {
+		var (
+			isActive bool
+			currency Currency
+		)
+		err := tx.QueryRow(`select is_active_account, currency from account where account_id = $1 for update`, id).Scan(&isActive, &currency)
+		if err == sql.ErrNoRows {
+			return notFound("Account %d not found", id)
+		}
+		if err != nil {
+			return err
+		}
+		active[id] = isActive
+		currencies[id] = currency
+	}
+
+	for _, id := range ids {
+		if !active[id] {
+			return unprocessable("Account %d is not active", id)
+		}
+	}
+
+	return checkSameCurrency(ids, currencies)
+}
+
+// insertJournalEntry writes the entry and its postings and applies each
+// posting to the cached account balance. The caller must already hold locks
+// on every account in the entry.
+func insertJournalEntry(tx *sql.Tx, entry *JournalEntry) error {
+	if err := entry.Validate(); err != nil {
+		return err
+	}
+	if entry.CreatedAt.IsZero() {
+		entry.CreatedAt = time.Now().UTC()
+	}
+
+	err := tx.QueryRow(`insert into journal_entry (description, fk_transaction, reverses_entry, created_at)
+        values ($1, nullif($2, 0), nullif($3, 0), $4)
+        returning id`,
+		entry.Description,
+		entry.TransactionID,
+		entry.ReversesEntry,
+		entry.CreatedAt,
+	).Scan(&entry.ID)
+	if err != nil {
+		return err
+	}
+
+	for i := range entry.Postings {
+		p := &entry.Postings[i]
+		p.EntryID = entry.ID
+
+		err := tx.QueryRow(`insert into posting (fk_journal_entry, fk_account, fk_transaction_type, amount)
+            values ($1, $2, $3, $4)
+            returning id`, p.EntryID, p.AccountID, p.Type, p.Amount).Scan(&p.ID)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`update account set balance = coalesce(balance, 0) + $1 where account_id = $2`, p.balanceEffect(), p.AccountID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func getJournalEntry(tx *sql.Tx, id int) (*JournalEntry, error) {
+	entry := new(JournalEntry)
+	err := tx.QueryRow(`select id, coalesce(description, ''), coalesce(fk_transaction, 0), coalesce(reverses_entry, 0), created_at
+        from journal_entry
+        where id = $1`, id).Scan(
+		&entry.ID,
+		&entry.Description,
+		&entry.TransactionID,
+		&entry.ReversesEntry,
+		&entry.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, notFound("Journal entry %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`select id, fk_journal_entry, fk_account, fk_transaction_type, amount
+        from posting
+        where fk_journal_entry = $1
+        order by id`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Posting
+		if err := rows.Scan(&p.ID, &p.EntryID, &p.AccountID, &p.Type, &p.Amount); err != nil {
+			return nil, err
+		}
+		entry.Postings = append(entry.Postings, p)
+	}
+
+	return entry, rows.Err()
+}
+
+func (s *PostgresStore) CreateRefreshToken(token *RefreshToken) error {
+	return s.db.QueryRow(`insert into refresh_token (fk_user, token_hash, family_id, created_at, expires_at)
+        values ($1, $2, $3, $4, $5)
+        returning id`,
+		token.UserID,
+		token.TokenHash,
+		token.FamilyID,
+		token.CreatedAt,
+		token.ExpiresAt,
+	).Scan(&token.ID)
+}
+
+func (s *PostgresStore) GetRefreshToken(tokenHash string) (*RefreshToken, error) {
+	token := new(RefreshToken)
+	var replacedBy sql.NullString
+	err := s.db.QueryRow(`select id, fk_user, token_hash, family_id, created_at, expires_at, revoked_at, replaced_by
+        from refresh_token
+        where token_hash = $1`, tokenHash).Scan(
+		&token.ID,
+		&token.UserID,
+		&token.TokenHash,
+		&token.FamilyID,
+		&token.CreatedAt,
+		&token.ExpiresAt,
+		&token.RevokedAt,
+		&replacedBy,
+	)
+	if err == sql.ErrNoRows {
+		return nil, notFound("Refresh token not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	token.ReplacedBy = replacedBy.String
+
+	return token, nil
+}
+
+// RotateRefreshToken revokes the old token and stores its replacement in one
+// transaction. It fails when the old token was already revoked, so two
+// concurrent refreshes with the same token cannot both succeed.
+func (s *PostgresStore) RotateRefreshToken(oldHash string, next *RefreshToken) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`update refresh_token
+        set revoked_at = $2, replaced_by = $3
+        where token_hash = $1 and revoked_at is null`, oldHash, next.CreatedAt, next.TokenHash)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return conflict("Refresh token already used")
+	}
+
+	err = tx.QueryRow(`insert into refresh_token (fk_user, token_hash, family_id, created_at, expires_at)
+        values ($1, $2, $3, $4, $5)
+        returning id`,
+		next.UserID,
+		next.TokenHash,
+		next.FamilyID,
+		next.CreatedAt,
+		next.ExpiresAt,
+	).Scan(&next.ID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) RevokeRefreshTokenFamily(familyID string) error {
+	_, err := s.db.Exec(`update refresh_token
+        set revoked_at = $2
+        where family_id = $1 and revoked_at is null`, familyID, time.Now().UTC())
+
+	return err
+}
+
+func (s *PostgresStore) RevokeAccessToken(jti string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`insert into revoked_token (jti, expires_at)
+        values ($1, $2)
+        on conflict (jti) do nothing`, jti, expiresAt)
+
+	return err
+}
+
+// UseToken records a single use token as used, and refuses one that already
+// was.
+func (s *PostgresStore) UseToken(jti string, expiresAt time.Time) error {
+	_, err := s.db.Exec(`insert into revoked_token (jti, expires_at) values ($1, $2)`, jti, expiresAt)
+	if err != nil && strings.Contains(err.Error(), "duplicate") {
+		return invalidField("token", "Link has already been used")
+	}
+
+	return err
+}
+
+func (s *PostgresStore) RevokeUserRefreshTokens(userID int) error {
+	_, err := s.db.Exec(`update refresh_token
+        set revoked_at = $2
+        where fk_user = $1 and revoked_at is null`, userID, time.Now().UTC())
+
+	return err
+}
+
+// VerifyEmail marks the user's email verified, as long as it is still the
+// address that was verified.
+func (s *PostgresStore) VerifyEmail(userID int, email string) error {
+	result, err := s.db.Exec(`update user_profile set email_verified = true where user_id = $1 and email = $2 and is_active_user`, userID, email)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return invalidField("token", "Link is invalid or has expired")
+	}
+	return nil
+}
+
+func (s *PostgresStore) SetPassword(userID int, hash string, changedAt time.Time) error {
+	result, err := s.db.Exec(`update user_profile set password = $1, password_changed_at = $2 where user_id = $3 and is_active_user`, hash, changedAt, userID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return notFound("Account %d not found", userID)
+	}
+	return err
+}
+
+func (s *PostgresStore) IsAccessTokenRevoked(jti string) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRow(`select exists(select 1 from revoked_token where jti = $1)`, jti).Scan(&revoked)
+
+	return revoked, err
+}
+
+// SaveTOTPEnrollment stores a new pending secret for the user, replacing any
+// earlier pending one. It refuses to replace an enabled enrollment.
+func (s *PostgresStore) SaveTOTPEnrollment(enrollment *TOTPEnrollment) error {
+	result, err := s.db.Exec(`insert into user_totp (fk_user, secret, enabled, created_at, last_used_step)
+        values ($1, $2, false, $3, 0)
+        on conflict (fk_user) do update
+        set secret = excluded.secret, created_at = excluded.created_at, confirmed_at = null, last_used_step = 0
+        where user_totp.enabled = false`, enrollment.UserID, enrollment.Secret, enrollment.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return conflict("Two-factor authentication is already enabled")
+	}
+
+	return nil
+}
+
+// GetTOTPEnrollment returns nil without an error when the user never
+// started enrollment.
+func (s *PostgresStore) GetTOTPEnrollment(userID int) (*TOTPEnrollment, error) {
+	enrollment := new(TOTPEnrollment)
+	err := s.db.QueryRow(`select fk_user, secret, enabled, created_at, confirmed_at, last_used_step
+        from user_totp
+        where fk_user = $1`, userID).Scan(
+		&enrollment.UserID,
+		&enrollment.Secret,
+		&enrollment.Enabled,
+		&enrollment.CreatedAt,
+		&enrollment.ConfirmedAt,
+		&enrollment.LastUsedStep,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return enrollment, nil
+}
+
+// EnableTOTP turns on a pending enrollment and replaces the user's recovery
+// codes.
+func (s *PostgresStore) EnableTOTP(userID int, recoveryCodeHashes []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`update user_totp
+        set enabled = true, confirmed_at = $2
+        where fk_user = $1 and enabled = false`, userID, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return conflict("No pending two-factor enrollment")
+	}
+
+	if _, err := tx.Exec(`delete from recovery_code where fk_user = $1`, userID); err != nil {
+		return err
+	}
+	for _, hash := range recoveryCodeHashes {
+		if _, err := tx.Exec(`insert into recovery_code (fk_user, code_hash) values ($1, $2)`, userID, hash); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseTOTPStep records the time step of an accepted code. It fails when the
+// step is not newer than the last one used.
+func (s *PostgresStore) UseTOTPStep(userID int, step int64) error {
+	result, err := s.db.Exec(`update user_totp
+        set last_used_step = $2
+        where fk_user = $1 and last_used_step < $2`, userID, step)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return conflict("Two-factor code already used")
+	}
+
+	return nil
+}
+
+func (s *PostgresStore) UseRecoveryCode(userID int, codeHash string) error {
+	result, err := s.db.Exec(`update recovery_code
+        set used_at = $3
+        where fk_user = $1 and code_hash = $2 and used_at is null`, userID, codeHash, time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n != 1 {
+		return notFound("Recovery code not found")
+	}
+
+	return nil
+}
+
+func scanIntoUser(row interface{ Scan(...any) error }) (*User, error) {
+	user := new(User)
+	err := row.Scan(
+		&user.ID,
+		&user.Email,
+		&user.Password,
+		&user.FirstName,
+		&user.LastName,
+		&user.UserName,
+		&user.PhoneNumber,
+		&user.ReferrerID,
+		&user.CreatedAt,
+		&user.LastLogin,
+		&user.Role,
+		&user.IsActive,
+		&user.EmailVerified,
+		&user.PhoneVerified,
+		&user.PasswordChangedAt,
+	)
+
+	return user, err
+}
+
+func scanIntoAccount(rows *sql.Rows) (*Account, error) {
+	account := new(Account)
+	err := rows.Scan(
+		&account.ID,
+		&account.UserID,
+		&account.AccountNumber,
+		&account.Balance,
+		&account.CreatedAt,
+		&account.AccountType,
+		&account.Currency,
+		&account.CreditLimit,
+		&account.IsActiveAccount,
+		&account.IsSystem,
+	)
+
+	return account, err
+}
+
+// BeginIdempotentRequest claims the record's key for a new request. When the
+// key is already taken and has not expired, it returns the existing record
+// instead and claims nothing.
+func (s *PostgresStore) BeginIdempotentRequest(record *IdempotencyRecord) (*IdempotencyRecord, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`delete from idempotency_key
+        where scope = $1 and idempotency_key = $2 and expires_at <= $3`, record.Scope, record.Key, record.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := tx.Exec(`insert into idempotency_key (scope, idempotency_key, request_hash, completed, created_at, expires_at)
+        values ($1, $2, $3, false, $4, $5)
+        on conflict (scope, idempotency_key) do nothing`,
+		record.Scope,
+		record.Key,
+		record.RequestHash,
+		record.CreatedAt,
+		record.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if n == 1 {
+		return nil, tx.Commit()
+	}
+
+	existing := new(IdempotencyRecord)
+	err = tx.QueryRow(`select scope, idempotency_key, request_hash, completed, coalesce(status_code, 0), coalesce(response_body, ''), created_at, expires_at
+        from idempotency_key
+        where scope = $1 and idempotency_key = $2`, record.Scope, record.Key).Scan(
+		&existing.Scope,
+		&existing.Key,
+		&existing.RequestHash,
+		&existing.Completed,
+		&existing.StatusCode,
+		&existing.Body,
+		&existing.CreatedAt,
+		&existing.ExpiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return existing, tx.Commit()
+}
+
+func (s *PostgresStore) CompleteIdempotentRequest(record *IdempotencyRecord) error {
+	_, err := s.db.Exec(`update idempotency_key
+        set completed = true, status_code = $3, response_body = $4, expires_at = $5
+        where scope = $1 and idempotency_key = $2`, record.Scope, record.Key, record.StatusCode, record.Body, record.ExpiresAt)
+
+	return err
+}
+
+func (s *PostgresStore) ReleaseIdempotencyKey(scope, key string) error {
+	_, err := s.db.Exec(`delete from idempotency_key
+        where scope = $1 and idempotency_key = $2 and completed = false`, scope, key)
+
+	return err
+}
+
+func (s *PostgresStore) DeleteExpiredIdempotencyKeys(now time.Time) error {
+	_, err := s.db.Exec(`delete from idempotency_key where expires_at <= $1`, now)
+
+	return err
+}
+
+const auditColumns = `id, created_at, actor_id, actor_role, action, target_type, target_id, coalesce(changes, ''), ip, request_id, prev_hash, hash`
+
+// AppendAuditEvent adds event to the end of the hash chain.
+func (s *PostgresStore) AppendAuditEvent(event *AuditEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := appendAuditEventTx(tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// appendAuditEventTx adds event, if there is one, to the end of the hash
+// chain as part of tx, so it is committed together with the action it
+// records or not at all. The advisory lock keeps concurrent appends from
+// linking to the same previous event; it is taken after any account locks.
+func appendAuditEventTx(tx *sql.Tx, event *AuditEvent) error {
+	if event == nil {
+		return nil
+	}
+
+	if _, err := tx.Exec(`select pg_advisory_xact_lock($1)`, auditChainLockKey); err != nil {
+		return err
+	}
+
+	var prevHash string
+	err := tx.QueryRow(`select hash from audit_log order by id desc limit 1`).Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	event.seal(prevHash)
+
+	var changes interface{}
+	if len(event.Changes) > 0 {
+		changes = string(event.Changes)
+	}
+
+	return tx.QueryRow(`insert into audit_log (created_at, actor_id, actor_role, action, target_type, target_id, changes, ip, request_id, prev_hash, hash)
+        values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+        returning id`,
+		event.CreatedAt,
+		event.ActorID,
+		event.ActorRole,
+		event.Action,
+		event.TargetType,
+		event.TargetID,
+		changes,
+		event.IP,
+		event.RequestID,
+		event.PrevHash,
+		event.Hash,
+	).Scan(&event.ID)
+}
+
+// GetAuditEvents returns matching events, newest first.
+func (s *PostgresStore) GetAuditEvents(filter AuditFilter) ([]*AuditEvent, error) {
+	args := []interface{}{}
+	where := []string{"true"}
+
+	addFilter := func(clause string, value interface{}) {
+		args = append(args, value)
+		where = append(where, fmt.Sprintf(clause, len(args)))
+	}
+
+	if filter.ActorID != 0 {
+		addFilter("actor_id = $%d", filter.ActorID)
+	}
+	if filter.Action != "" {
+		addFilter("action = $%d", filter.Action)
+	}
+	if filter.TargetType != "" {
+		addFilter("target_type = $%d", filter.TargetType)
+	}
+	if filter.TargetID != "" {
+		addFilter("target_id = $%d", filter.TargetID)
+	}
+	if !filter.From.IsZero() {
+		addFilter("created_at >= $%d", filter.From)
+	}
+	if !filter.To.IsZero() {
+		addFilter("created_at < $%d", filter.To)
+	}
+	if filter.Cursor != 0 {
+		addFilter("id < $%d", filter.Cursor)
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	args = append(args, limit)
+
+	return s.queryAuditEvents(fmt.Sprintf(`select `+auditColumns+`
+        from audit_log
+        where %s
+        order by id desc
+        limit $%d`, strings.Join(where, " and "), len(args)), args...)
+}
+
+// GetAuditChain returns events after afterID in chain order.
+func (s *PostgresStore) GetAuditChain(afterID, limit int) ([]*AuditEvent, error) {
+	return s.queryAuditEvents(`select `+auditColumns+`
+        from audit_log
+        where id > $1
+        order by id
+        limit $2`, afterID, limit)
+}
+
+func (s *PostgresStore) queryAuditEvents(query string, args ...interface{}) ([]*AuditEvent, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []*AuditEvent{}
+	for rows.Next() {
+		event := new(AuditEvent)
+		var changes string
+		err := rows.Scan(
+			&event.ID,
+			&event.CreatedAt,
+			&event.ActorID,
+			&event.ActorRole,
+			&event.Action,
+			&event.TargetType,
+			&event.TargetID,
+			&changes,
+			&event.IP,
+			&event.RequestID,
+			&event.PrevHash,
+			&event.Hash,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if changes != "" {
+			event.Changes = json.RawMessage(changes)
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+// GetStatement returns nil when the statement has not been stored.
+func (s *PostgresStore) GetStatement(accountID int, period, format string) (*StoredStatement, error) {
+	statement := &StoredStatement{AccountID: accountID, Period: period, Format: format}
+	err := s.db.QueryRow(`select content, created_at
+        from account_statement
+        where fk_account = $1 and period = $2 and format = $3`, accountID, period, format).Scan(&statement.Content, &statement.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return statement, nil
+}
+
+// SaveStatement keeps the first statement stored for a period and format.
+func (s *PostgresStore) SaveStatement(statement *StoredStatement) error {
+	_, err := s.db.Exec(`insert into account_statement (fk_account, period, format, content, created_at)
+        values ($1, $2, $3, $4, $5)
+        on conflict (fk_account, period, format) do nothing`,
+		statement.AccountID,
+		statement.Period,
+		statement.Format,
+		statement.Content,
+		statement.CreatedAt,
+	)
+
+	return err
+}
+
+// GetLimitOverride returns nil when the account has no override.
+func (s *PostgresStore) GetLimitOverride(accountID int) (*LimitOverride, error) {
+	override := &LimitOverride{AccountID: accountID}
+	var windowSeconds int64
+	err := s.db.QueryRow(`select max_transaction, daily_outflow, monthly_outflow, velocity_count, velocity_window_seconds, reason, set_by, updated_at
+        from account_limit_override
+        where fk_account = $1`, accountID).Scan(
+		&override.MaxTransaction,
+		&override.DailyOutflow,
+		&override.MonthlyOutflow,
+		&override.VelocityCount,
+		&windowSeconds,
+		&override.Reason,
+		&override.SetBy,
+		&override.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	override.VelocityWindow = Duration(time.Duration(windowSeconds) * time.Second)
+	return override, nil
+}
+
+// SetLimitOverride saves override and its audit event together.
+func (s *PostgresStore) SetLimitOverride(override *LimitOverride, event *AuditEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`insert into account_limit_override (fk_account, max_transaction, daily_outflow, monthly_outflow, velocity_count, velocity_window_seconds, reason, set_by, updated_at)
+        values ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+        on conflict (fk_account) do update set
+            max_transaction = excluded.max_transaction,
+            daily_outflow = excluded.daily_outflow,
+            monthly_outflow = excluded.monthly_outflow,
+            velocity_count = excluded.velocity_count,
+            velocity_window_seconds = excluded.velocity_window_seconds,
+            reason = excluded.reason,
+            set_by = excluded.set_by,
+            updated_at = excluded.updated_at`,
+		override.AccountID,
+		override.MaxTransaction,
+		override.DailyOutflow,
+		override.MonthlyOutflow,
+		override.VelocityCount,
+		int64(time.Duration(override.VelocityWindow)/time.Second),
+		override.Reason,
+		override.SetBy,
+		override.UpdatedAt,
+	)
+	if err != nil {
+		return err
+	}
+
+	if err := appendAuditEventTx(tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteLimitOverride removes the override and writes its audit event together.
+func (s *PostgresStore) DeleteLimitOverride(accountID int, event *AuditEvent) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`delete from account_limit_override where fk_account = $1`, accountID); err != nil {
+		return err
+	}
+
+	if err := appendAuditEventTx(tx, event); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const scheduledTransferColumns = `id, fk_user, from_account, to_account, amount, description, schedule, start_at, next_run_at, status, attempts, last_error, created_at, updated_at`
+
+func scanIntoScheduledTransfer(row interface{ Scan(...any) error }) (*ScheduledTransfer, error) {
+	st := new(ScheduledTransfer)
+	err := row.Scan(
+		&st.ID,
+		&st.UserID,
+		&st.FromAccount,
+		&st.ToAccount,
+		&st.Amount,
+		&st.Description,
+		&st.Schedule,
+		&st.StartAt,
+		&st.NextRunAt,
+		&st.Status,
+		&st.Attempts,
+		&st.LastError,
+		&st.CreatedAt,
+		&st.UpdatedAt,
+	)
+
+	return st, err
+}
+
+func (s *PostgresStore) CreateScheduledTransfer(st *ScheduledTransfer) error {
+	return s.db.QueryRow(`insert into scheduled_transfer (fk_user, from_account, to_account, amount, description, schedule, start_at, next_run_at, status, attempts, last_error, created_at, updated_at)
+        values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+        returning id`,
+		st.UserID,
+		st.FromAccount,
+		st.ToAccount,
+		st.Amount,
+		st.Description,
+		st.Schedule,
+		st.StartAt,
+		st.NextRunAt,
+		st.Status,
+		st.Attempts,
+		st.LastError,
+		st.CreatedAt,
+		st.UpdatedAt,
+	).Scan(&st.ID)
+}
+
+func (s *PostgresStore) GetScheduledTransfer(id int) (*ScheduledTransfer, error) {
+	st, err := scanIntoScheduledTransfer(s.db.QueryRow(`select `+scheduledTransferColumns+` from scheduled_transfer where id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFound("Scheduled transfer %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+func (s *PostgresStore) GetScheduledTransfersByUser(userID int) ([]*ScheduledTransfer, error) {
+	return s.queryScheduledTransfers(`select `+scheduledTransferColumns+`
+        from scheduled_transfer
+        where fk_user = $1
+        order by id`, userID)
+}
+
+// UpdateScheduledTransfer saves a status change made by a user. It fails
+// with a conflict when the transfer ran or changed since previous was read.
+func (s *PostgresStore) UpdateScheduledTransfer(st, previous *ScheduledTransfer) error {
+	result, err := s.db.Exec(`update scheduled_transfer
+        set status = $1, next_run_at = $2, attempts = $3, updated_at = $4
+        where id = $5 and status = $6 and next_run_at = $7 and attempts = $8`,
+		st.Status,
+		st.NextRunAt,
+		st.Attempts,
+		st.UpdatedAt,
+		st.ID,
+		previous.Status,
+		previous.NextRunAt,
+		previous.Attempts,
+	)
+	if err != nil {
+		return err
+	}
+
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return conflict("Scheduled transfer %d changed, try again", st.ID)
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetDueScheduledTransfers(now time.Time, limit int) ([]*ScheduledTransfer, error) {
+	return s.queryScheduledTransfers(`select `+scheduledTransferColumns+`
+        from scheduled_transfer
+        where status = $1 and next_run_at <= $2
+        order by next_run_at
+        limit $3`, ScheduledActive, now, limit)
+}
+
+// RunScheduledTransfer runs st if it is still due, in one transaction with
+// the run record and the move to its next run, so it runs exactly once. A
+// transfer locked by another server is skipped rather than waited for, and
+// both it and one that is no longer due return a nil run.
+func (s *PostgresStore) RunScheduledTransfer(st *ScheduledTransfer, now time.Time, limits []TransferLimits) (*ScheduledTransferRun, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	current, err := scanIntoScheduledTransfer(tx.QueryRow(`select `+scheduledTransferColumns+`
+        from scheduled_transfer
+        where id = $1 and status = $2 and next_run_at <= $3
+        for update skip locked`, st.ID, ScheduledActive, now))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	run := &ScheduledTransferRun{
+		ScheduledTransferID: current.ID,
+		Attempt:             current.Attempts + 1,
+		RanAt:               now,
+		Status:              RunSucceeded,
+	}
+
+	// A failed transfer rolls back to here, so the failure is still recorded.
+	if _, err := tx.Exec(`savepoint scheduled_transfer_run`); err != nil {
+		return nil, err
+	}
+	transaction, runErr := limitedTransferTx(tx, current.FromAccount, current.ToAccount, current.Amount, Transfer, current.Description, now, limits)
+	if runErr != nil {
+		if _, err := tx.Exec(`rollback to savepoint scheduled_transfer_run`); err != nil {
+			return nil, err
+		}
+		run.Status = RunFailed
+		run.Error = runError(runErr)
+	} else {
+		run.TransactionID = transaction.ID
+	}
+
+	if err := current.recordRun(now, runErr); err != nil {
+		return nil, err
+	}
+
+	err = tx.QueryRow(`insert into scheduled_transfer_run (fk_scheduled_transfer, attempt, ran_at, status, fk_transaction, error)
+        values ($1, $2, $3, $4, nullif($5, 0), $6)
+        returning id`,
+		run.ScheduledTransferID,
+		run.Attempt,
+		run.RanAt,
+		run.Status,
+		run.TransactionID,
+		run.Error,
+	).Scan(&run.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`update scheduled_transfer
+        set next_run_at = $1, attempts = $2, status = $3, last_error = $4, updated_at = $5
+        where id = $6`,
+		current.NextRunAt,
+		current.Attempts,
+		current.Status,
+		current.LastError,
+		current.UpdatedAt,
+		current.ID,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+func (s *PostgresStore) GetScheduledTransferRuns(scheduledTransferID int) ([]*ScheduledTransferRun, error) {
+	rows, err := s.db.Query(`select id, fk_scheduled_transfer, attempt, ran_at, status, coalesce(fk_transaction, 0), error
+        from scheduled_transfer_run
+        where fk_scheduled_transfer = $1
+        order by id`, scheduledTransferID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	runs := []*ScheduledTransferRun{}
+	for rows.Next() {
+		run := new(ScheduledTransferRun)
+		err := rows.Scan(
+			&run.ID,
+			&run.ScheduledTransferID,
+			&run.Attempt,
+			&run.RanAt,
+			&run.Status,
+			&run.TransactionID,
+			&run.Error,
+		)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+func (s *PostgresStore) queryScheduledTransfers(query string, args ...interface{}) ([]*ScheduledTransfer, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transfers := []*ScheduledTransfer{}
+	for rows.Next() {
+		st, err := scanIntoScheduledTransfer(rows)
+		if err != nil {
+			return nil, err
+		}
+		transfers = append(transfers, st)
+	}
+
+	return transfers, rows.Err()
+}
+
+const holdColumns = `id, fk_account, to_account, amount, captured_amount, description, status, coalesce(fk_transaction, 0), created_at, expires_at, closed_at`
+
+func scanIntoHold(row interface{ Scan(...any) error }) (*Hold, error) {
+	hold := new(Hold)
+	var closedAt sql.NullTime
+	err := row.Scan(
+		&hold.ID,
+		&hold.AccountID,
+		&hold.ToAccount,
+		&hold.Amount,
+		&hold.CapturedAmount,
+		&hold.Description,
+		&hold.Status,
+		&hold.TransactionID,
+		&hold.CreatedAt,
+		&hold.ExpiresAt,
+		&closedAt,
+	)
+	if closedAt.Valid {
+		hold.ClosedAt = &closedAt.Time
+	}
+
+	return hold, err
+}
+
+// heldAmount is the total of the account's pending holds that have not
+// expired by now.
+func heldAmount(q interface {
+	QueryRow(string, ...any) *sql.Row
+}, accountID int, now time.Time) (int64, error) {
+	var held int64
+	err := q.QueryRow(`select coalesce(sum(amount), 0)
+        from account_hold
+        where fk_account = $1 and status = $2 and expires_at > $3`, accountID, HoldPending, now).Scan(&held)
+
+	return held, err
+}
+
+func (s *PostgresStore) GetAccountBalance(accountID int, now time.Time) (*AccountBalance, error) {
+	account, err := s.GetAccountByID(accountID)
+	if err != nil {
+		return nil, err
+	}
+
+	held, err := heldAmount(s.db, accountID, now)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccountBalance{
+		AccountID:        accountID,
+		LedgerBalance:    account.Balance,
+		HeldAmount:       held,
+		AvailableBalance: account.Balance - held + account.CreditLimit,
+	}, nil
+}
+
+// AuthorizeHold reserves the hold's amount when the available balance
+// covers it and a transfer of the amount would be within limits.
+func (s *PostgresStore) AuthorizeHold(hold *Hold, event *AuditEvent, limits ...TransferLimits) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockAccounts(tx, []int{hold.AccountID}); err != nil {
+		return err
+	}
+	if err := checkLimitsTx(tx, hold.AccountID, hold.Amount, hold.CreatedAt, limits); err != nil {
+		return err
+	}
+	if err := checkFunds(tx, hold.AccountID, hold.Amount, hold.CreatedAt); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow(`insert into account_hold (fk_account, to_account, amount, captured_amount, description, status, created_at, expires_at)
+        values ($1, $2, $3, 0, $4, $5, $6, $7)
+        returning id`,
+		hold.AccountID,
+		hold.ToAccount,
+		hold.Amount,
+		hold.Description,
+		hold.Status,
+		hold.CreatedAt,
+		hold.ExpiresAt,
+	).Scan(&hold.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := appendAuditEventTx(tx, event.about(hold.ID, nil, hold)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetHold(id int) (*Hold, error) {
+	hold, err := scanIntoHold(s.db.QueryRow(`select `+holdColumns+` from account_hold where id = $1`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFound("Hold %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+func (s *PostgresStore) GetHoldsByAccount(accountID int) ([]*Hold, error) {
+	rows, err := s.db.Query(`select `+holdColumns+` from account_hold where fk_account = $1 order by id desc`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := []*Hold{}
+	for rows.Next() {
+		hold, err := scanIntoHold(rows)
+		if err != nil {
+			return nil, err
+		}
+		holds = append(holds, hold)
+	}
+
+	return holds, rows.Err()
+}
+
+// CaptureHold posts amount of the hold, or all of it when amount is zero, as
+// a Debit to the hold's destination and releases the rest. The hold is
+// closed before the transfer so its own reservation does not count against
+// it. Like any transfer, the capture is refused when it breaks limits.
+func (s *PostgresStore) CaptureHold(id int, amount int64, now time.Time, event *AuditEvent, limits ...TransferLimits) (*Hold, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	hold, err := scanIntoHold(tx.QueryRow(`select `+holdColumns+` from account_hold where id = $1 for update`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFound("Hold %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	amount, err = checkHoldCapture(hold, amount, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`update account_hold set status = $1, captured_amount = $2, closed_at = $3 where id = $4`, HoldCaptured, amount, now, id); err != nil {
+		return nil, err
+	}
+
+	transaction, err := limitedTransferTx(tx, hold.AccountID, hold.ToAccount, amount, Debit, hold.Description, now, limits)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`update account_hold set fk_transaction = $1 where id = $2`, transaction.ID, id); err != nil {
+		return nil, err
+	}
+
+	before := *hold
+	hold.Status = HoldCaptured
+	hold.CapturedAmount = amount
+	hold.TransactionID = transaction.ID
+	hold.ClosedAt = &now
+
+	if err := appendAuditEventTx(tx, event.about(id, &before, hold)); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+func (s *PostgresStore) VoidHold(id int, now time.Time, event *AuditEvent) (*Hold, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	hold, err := scanIntoHold(tx.QueryRow(`select `+holdColumns+` from account_hold where id = $1 for update`, id))
+	if err == sql.ErrNoRows {
+		return nil, notFound("Hold %d not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := checkHoldPending(hold, now); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`update account_hold set status = $1, closed_at = $2 where id = $3`, HoldReleased, now, id); err != nil {
+		return nil, err
+	}
+
+	before := *hold
+	hold.Status = HoldReleased
+	hold.ClosedAt = &now
+
+	if err := appendAuditEventTx(tx, event.about(id, &before, hold)); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+// ExpireHolds closes pending holds whose expiry has passed and returns how
+// many it closed.
+func (s *PostgresStore) ExpireHolds(now time.Time) (int, error) {
+	result, err := s.db.Exec(`update account_hold
+        set status = $1, closed_at = expires_at
+        where status = $2 and expires_at <= $3`, HoldExpired, HoldPending, now)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+func (s *PostgresStore) SetCreditLimit(accountID int, limit int64) error {
+	result, err := s.db.Exec(`update account set credit_limit = $1 where account_id = $2`, limit, accountID)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return notFound("Account %d not found", accountID)
+	}
+	return err
+}
+
+// GetInflow is the total paid into the account from from up to, but not
+// including, to.
+func (s *PostgresStore) GetInflow(accountID int, from, to time.Time) (int64, error) {
+	var total int64
+	err := s.db.QueryRow(`select coalesce(sum(amount), 0)
+        from transaction
+        where to_account = $1 and created_at >= $2 and created_at < $3`, accountID, from, to).Scan(&total)
+
+	return total, err
+}
+
+const creditCycleColumns = `fk_account, period, closed_at, statement_balance, minimum_payment, interest_charged, due_date, settled, paid_by_due, late_fee`
+
+func scanIntoCreditCycle(row interface{ Scan(...any) error }) (*CreditCycle, error) {
+	cycle := new(CreditCycle)
+	err := row.Scan(
+		&cycle.AccountID,
+		&cycle.Period,
+		&cycle.ClosedAt,
+		&cycle.StatementBalance,
+		&cycle.MinimumPayment,
+		&cycle.InterestCharged,
+		&cycle.DueDate,
+		&cycle.Settled,
+		&cycle.PaidByDue,
+		&cycle.LateFee,
+	)
+
+	return cycle, err
+}
+
+func (s *PostgresStore) GetCreditCycles(accountID int) ([]*CreditCycle, error) {
+	rows, err := s.db.Query(`select `+creditCycleColumns+` from credit_cycle where fk_account = $1 order by period desc`, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cycles := []*CreditCycle{}
+	for rows.Next() {
+		cycle, err := scanIntoCreditCycle(rows)
+		if err != nil {
+			return nil, err
+		}
+		cycles = append(cycles, cycle)
+	}
+
+	return cycles, rows.Err()
+}
+
+// GetCreditCycle returns nil when the cycle has not closed.
+func (s *PostgresStore) GetCreditCycle(accountID int, period string) (*CreditCycle, error) {
+	cycle, err := scanIntoCreditCycle(s.db.QueryRow(`select `+creditCycleColumns+` from credit_cycle where fk_account = $1 and period = $2`, accountID, period))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return cycle, nil
+}
+
+// chargeTx moves amount out of a customer account into a system account
+// whatever the customer's available balance, for charges the customer has
+// already agreed to such as interest and fees.
+func chargeTx(tx *sql.Tx, from int, systemAccount *Account, amount int64, description string, createdAt time.Time) error {
+	if err := lockAccounts(tx, []int{from, systemAccount.ID}); err != nil {
+		return err
+	}
+
+	return insertTransferTx(tx, &Transaction{
+		FromAccount:     from,
+		ToAccount:       systemAccount.ID,
+		Amount:          amount,
+		Description:     description,
+		CreatedAt:       createdAt,
+		TransactionType: Debit,
+	})
+}
+
+// CloseCreditCycle charges the cycle's interest to the account, dated just
+// before the cycle closed, and records the cycle. A cycle can only be closed
+// once.
+func (s *PostgresStore) CloseCreditCycle(cycle *CreditCycle, systemAccount, description string) error {
+	account, err := s.GetAccountByID(cycle.AccountID)
+	if err != nil {
+		return err
+	}
+	income, err := s.GetSystemAccount(systemAccount, account.Currency)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`insert into credit_cycle (`+creditCycleColumns+`)
+        values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`,
+		cycle.AccountID,
+		cycle.Period,
+		cycle.ClosedAt,
+		cycle.StatementBalance,
+		cycle.MinimumPayment,
+		cycle.InterestCharged,
+		cycle.DueDate,
+		cycle.Settled,
+		cycle.PaidByDue,
+		cycle.LateFee,
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate") {
+			return conflict("Cycle %s of account %d is already closed", cycle.Period, cycle.AccountID)
+		}
+		return err
+	}
+
+	if cycle.InterestCharged > 0 {
+		if err := chargeTx(tx, cycle.AccountID, income, cycle.InterestCharged, description, creditCharge(cycle.ClosedAt)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// SettleCreditCycle records what was paid by the due date and charges the
+// late fee, if any, dated just before the due date.
+func (s *PostgresStore) SettleCreditCycle(cycle *CreditCycle, systemAccount, description string) error {
+	account, err := s.GetAccountByID(cycle.AccountID)
+	if err != nil {
+		return err
+	}
+	income, err := s.GetSystemAccount(systemAccount, account.Currency)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`update credit_cycle
+        set settled = true, paid_by_due = $1, late_fee = $2
+        where fk_account = $3 and period = $4 and not settled`, cycle.PaidByDue, cycle.LateFee, cycle.AccountID, cycle.Period)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return conflict("Cycle %s of account %d is already settled", cycle.Period, cycle.AccountID)
+	}
+
+	if cycle.LateFee > 0 {
+		if err := chargeTx(tx, cycle.AccountID, income, cycle.LateFee, description, creditCharge(cycle.DueDate)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const referralColumns = `id, fk_referrer, fk_referee, status, reason, currency, referrer_bonus, referee_bonus, coalesce(referrer_transaction, 0), coalesce(referee_transaction, 0), created_at, expires_at, closed_at`
+
+func scanIntoReferral(row interface{ Scan(...any) error }) (*Referral, error) {
+	referral := new(Referral)
+	var closedAt sql.NullTime
+	err := row.Scan(
+		&referral.ID,
+		&referral.ReferrerID,
+		&referral.RefereeID,
+		&referral.Status,
+		&referral.Reason,
+		&referral.Currency,
+		&referral.ReferrerBonus,
+		&referral.RefereeBonus,
+		&referral.ReferrerTransaction,
+		&referral.RefereeTransaction,
+		&referral.CreatedAt,
+		&referral.ExpiresAt,
+		&closedAt,
+	)
+	if closedAt.Valid {
+		referral.ClosedAt = &closedAt.Time
+	}
+
+	return referral, err
+}
+
+func (s *PostgresStore) queryReferrals(query string, args ...any) ([]*Referral, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	referrals := []*Referral{}
+	for rows.Next() {
+		referral, err := scanIntoReferral(rows)
+		if err != nil {
+			return nil, err
+		}
+		referrals = append(referrals, referral)
+	}
+
+	return referrals, rows.Err()
+}
+
+// CreateReferral records the referral, rejecting it instead when the referrer
+// already has maxPerReferrer referrals pending or paid. The referrer's row is
+// locked so concurrent signups count each other.
+func (s *PostgresStore) CreateReferral(r *Referral, maxPerReferrer int) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`select user_id from user_profile where user_id = $1 for update`, r.ReferrerID); err != nil {
+		return err
+	}
+
+	var open int
+	err = tx.QueryRow(`select count(*) from referral where fk_referrer = $1 and status in ($2, $3)`, r.ReferrerID, ReferralPending, ReferralPaid).Scan(&open)
+	if err != nil {
+		return err
+	}
+	capReferral(r, open, maxPerReferrer)
+
+	err = tx.QueryRow(`insert into referral (fk_referrer, fk_referee, status, reason, currency, created_at, expires_at, closed_at)
+        values ($1, $2, $3, $4, $5, $6, $7, $8)
+        returning id`,
+		r.ReferrerID,
+		r.RefereeID,
+		r.Status,
+		r.Reason,
+		r.Currency,
+		r.CreatedAt,
+		r.ExpiresAt,
+		r.ClosedAt,
+	).Scan(&r.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate") {
+			return conflict("User %d was already referred", r.RefereeID)
+		}
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) GetReferralsByReferrer(userID int) ([]*Referral, error) {
+	return s.queryReferrals(`select `+referralColumns+` from referral where fk_referrer = $1 order by id desc`, userID)
+}
+
+func (s *PostgresStore) GetPendingReferrals() ([]*Referral, error) {
+	return s.queryReferrals(`select `+referralColumns+` from referral where status = $1 order by id`, ReferralPending)
+}
+
+// GetDeposits returns the transactions from from up to, but not including, to
+// that paid into the user's accounts from customer accounts of other users,
+// oldest first.
+func (s *PostgresStore) GetDeposits(userID int, from, to time.Time) ([]*Deposit, error) {
+	rows, err := s.db.Query(`select t.id, t.from_account, t.to_account, t.amount, coalesce(t.description, ''), t.created_at, t.fk_transaction_type, source.fk_user, target.currency
+        from transaction t
+        join account target on target.account_id = t.to_account
+        join account source on source.account_id = t.from_account
+        where target.fk_user = $1 and source.fk_user <> $1 and not source.is_system
+        and t.created_at >= $2 and t.created_at < $3
+        order by t.created_at, t.id`, userID, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deposits := []*Deposit{}
+	for rows.Next() {
+		deposit := new(Deposit)
+		err := rows.Scan(
+			&deposit.ID,
+			&deposit.FromAccount,
+			&deposit.ToAccount,
+			&deposit.Amount,
+			&deposit.Description,
+			&deposit.CreatedAt,
+			&deposit.TransactionType,
+			&deposit.FromUserID,
+			&deposit.Currency,
+		)
+		if err != nil {
+			return nil, err
+		}
+		deposits = append(deposits, deposit)
+	}
+
+	return deposits, rows.Err()
+}
+
+// PayReferral pays each bonus that is set from the named system account in
+// the referral's currency and marks the referral paid, all in one
+// transaction. A referral can only be paid while it is pending.
+func (s *PostgresStore) PayReferral(r *Referral, referrerAccount, refereeAccount int, systemAccount string) error {
+	promo, err := s.GetSystemAccount(systemAccount, r.Currency)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var status string
+	err = tx.QueryRow(`select status from referral where id = $1 for update`, r.ID).Scan(&status)
+	if err == sql.ErrNoRows {
+		return notFound("Referral %d not found", r.ID)
+	}
+	if err != nil {
+		return err
+	}
+	if status != ReferralPending {
+		return conflict("Referral %d is %s", r.ID, status)
+	}
+
+	if r.ReferrerBonus > 0 {
+		transaction, err := transferTx(tx, promo.ID, referrerAccount, r.ReferrerBonus, Credit, referralDescription, *r.ClosedAt)
+		if err != nil {
+			return err
+		}
+		r.ReferrerTransaction = transaction.ID
+	}
+	if r.RefereeBonus > 0 {
+		transaction, err := transferTx(tx, promo.ID, refereeAccount, r.RefereeBonus, Credit, referralDescription, *r.ClosedAt)
+		if err != nil {
+			return err
+		}
+		r.RefereeTransaction = transaction.ID
+	}
+
+	r.Status = ReferralPaid
+	_, err = tx.Exec(`update referral
+        set status = $1, referrer_bonus = $2, referee_bonus = $3, referrer_transaction = nullif($4, 0), referee_transaction = nullif($5, 0), closed_at = $6
+        where id = $7`,
+		r.Status,
+		r.ReferrerBonus,
+		r.RefereeBonus,
+		r.ReferrerTransaction,
+		r.RefereeTransaction,
+		r.ClosedAt,
+		r.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *PostgresStore) ExpireReferral(id int, at time.Time) error {
+	result, err := s.db.Exec(`update referral set status = $1, closed_at = $2 where id = $3 and status = $4`, ReferralExpired, at, id, ReferralPending)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return conflict("Referral %d is not pending", id)
+	}
+	return nil
+}
+
+// GetLoginThrottle returns the failed logins for key, or none if there are
+// none.
+func (s *PostgresStore) GetLoginThrottle(key string) (*LoginThrottle, error) {
+	throttle := &LoginThrottle{Key: key}
+	err := s.db.QueryRow(`select failures, last_failure, locked_until from login_throttle where key = $1`, key).
+		Scan(&throttle.Failures, &throttle.LastFailure, &throttle.LockedUntil)
+	if err == sql.ErrNoRows {
+		return throttle, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return throttle, nil
+}
+
+// RecordLoginFailure counts a failed login with the throttle row locked, so
+// concurrent guesses are all counted.
+func (s *PostgresStore) RecordLoginFailure(key string, now time.Time, policy LoginPolicy) (*LoginThrottle, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`insert into login_throttle (key, failures, last_failure) values ($1, 0, $2)
+        on conflict (key) do nothing`, key, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	throttle := &LoginThrottle{Key: key}
+	err = tx.QueryRow(`select failures, last_failure, locked_until from login_throttle where key = $1 for update`, key).
+		Scan(&throttle.Failures, &throttle.LastFailure, &throttle.LockedUntil)
+	if err != nil {
+		return nil, err
+	}
+
+	policy.fail(throttle, now)
+
+	_, err = tx.Exec(`update login_throttle set failures = $1, last_failure = $2, locked_until = $3 where key = $4`,
+		throttle.Failures, throttle.LastFailure, throttle.LockedUntil, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return throttle, tx.Commit()
+}
+
+func (s *PostgresStore) ClearLoginFailures(key string) error {
+	_, err := s.db.Exec(`delete from login_throttle where key = $1`, key)
+
+	return err
+}
+
+func (s *PostgresStore) UpdateLastLogin(userID int, at time.Time) error {
+	_, err := s.db.Exec(`update user_profile set last_login = $1 where user_id = $2`, at, userID)
+
+	return err
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	tokenIssuer     = "go-bank"
+	accessTokenTTL  = 15 * time.Minute
+	refreshTokenTTL = 7 * 24 * time.Hour
+)
+
+// authClaims are the claims of an access token. The subject is the user id.
+// Purpose is empty for a full session token and set on the partial tokens of
+// a two step login and on tokens mailed to the user, which also carry a
+// Binding.
+type authClaims struct {
+	Role    Role   `json:"role"`
+	Purpose string `json:"purpose,omitempty"`
+	Binding string `json:"bnd,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// RefreshToken is the server side record of an opaque refresh token. Only the
+// hash of the token is stored. Every refresh replaces the token with a new one
+// in the same family; presenting a token that was already replaced revokes
+// the whole family, since it means the token was stolen.
+type RefreshToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"userId"`
+	TokenHash  string     `json:"-"`
+	FamilyID   string     `json:"familyId"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	ExpiresAt  time.Time  `json:"expiresAt"`
+	RevokedAt  *time.Time `json:"revokedAt"`
+	ReplacedBy string     `json:"-"`
+}
+
+// signingSecret signs and verifies every JWT. It is set once from the
+// configuration at startup.
+var signingSecret []byte
+
+func setJWTSecret(secret string) {
+	signingSecret = []byte(secret)
+}
+
+func jwtSecret() ([]byte, error) {
+	if len(signingSecret) == 0 {
+		return nil, fmt.Errorf("No JWT secret configured")
+	}
+	return signingSecret, nil
+}
+
+func newAccessClaims(user *User) *authClaims {
+	now := time.Now().UTC()
+
+	return &authClaims{
+		Role: user.Role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
+			Subject:   strconv.Itoa(user.ID),
+			ID:        randomToken(16),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
+		},
+	}
+}
+
+func newPartialClaims(user *User, purpose string) *authClaims {
+	claims := newAccessClaims(user)
+	claims.Purpose = purpose
+	claims.ExpiresAt = jwt.NewNumericDate(claims.IssuedAt.Time.Add(mfaTokenTTL))
+
+	return claims
+}
+
+func signJWT(claims *authClaims) (string, error) {
+	secret, err := jwtSecret()
+	if err != nil {
+		return "", err
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+}
+
+func newRefreshToken(userID int, familyID string, now time.Time) (string, *RefreshToken) {
+	token := randomToken(32)
+	if familyID == "" {
+		familyID = randomToken(16)
+	}
+
+	return token, &RefreshToken{
+		UserID:    userID,
+		TokenHash: hashToken(token),
+		FamilyID:  familyID,
+		CreatedAt: now,
+		ExpiresAt: now.Add(refreshTokenTTL),
+	}
+}
+
+func (t *RefreshToken) isRevoked() bool {
+	return t.RevokedAt != nil
+}
+
+func (t *RefreshToken) isExpired(now time.Time) bool {
+	return !now.Before(t.ExpiresAt)
+}
+
+// randomToken returns n random bytes encoded for use in URLs and headers.
+func randomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignJWTRequiresSecret(t *testing.T) {
+	useTestJWTSecret(t)
+	setJWTSecret("")
+
+	_, err := createJWT(&User{ID: 1, Role: Customer})
+	assert.NotNil(t, err)
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	useTestJWTSecret(t)
+
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "refresh@mail.com", 0)
+	server := NewAPIServer(":0", store)
+
+	login, err := server.issueTokens(user, "")
+	assert.Nil(t, err)
+
+	refresh := func(token string) (int, *LoginResponse) {
+		body, _ := json.Marshal(RefreshTokenRequest{RefreshToken: token})
+		rec := httptest.NewRecorder()
+		makeHTTPHandleFunc(server.handleRefreshToken)(rec, httptest.NewRequest("POST", "/token/refresh", bytes.NewReader(body)))
+
+		response := new(LoginResponse)
+		json.NewDecoder(rec.Body).Decode(response)
+		return rec.Code, response
+	}
+
+	code, rotated := refresh(login.RefreshToken)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotEqual(t, login.RefreshToken, rotated.RefreshToken)
+
+	// Replaying the first token revokes the whole family, including the
+	// token that replaced it.
+	code, _ = refresh(login.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+	code, _ = refresh(rotated.RefreshToken)
+	assert.Equal(t, http.StatusUnauthorized, code)
+}
+
+func TestRefreshTokenExpires(t *testing.T) {
+	useTestJWTSecret(t)
+
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "expired@mail.com", 0)
+	server := NewAPIServer(":0", store)
+	now := time.Now()
+	server.now = func() time.Time { return now }
+
+	login, err := server.issueTokens(user, "")
+	assert.Nil(t, err)
+
+	now = now.Add(refreshTokenTTL + time.Second)
+	body, _ := json.Marshal(RefreshTokenRequest{RefreshToken: login.RefreshToken})
+	rec := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleRefreshToken)(rec, httptest.NewRequest("POST", "/token/refresh", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+}
+
+func TestLogoutRevokesAccessToken(t *testing.T) {
+	useTestJWTSecret(t)
+
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "logout@mail.com", 0)
+	server := NewAPIServer(":0", store)
+
+	login, err := server.issueTokens(user, "")
+	assert.Nil(t, err)
+
+	logout := withJWTAuth(makeHTTPHandleFunc(server.handleLogout), store)
+	call := func() int {
+		req := httptest.NewRequest("POST", "/logout", nil)
+		req.Header.Set("x-jwt-token", login.Token)
+		rec := httptest.NewRecorder()
+		logout(rec, req)
+		return rec.Code
+	}
+
+	assert.Equal(t, http.StatusOK, call())
+	assert.Equal(t, http.StatusUnauthorized, call())
+}
+
+func useTestJWTSecret(t *testing.T) {
+	previous := signingSecret
+	setJWTSecret("test-secret")
+	t.Cleanup(func() { signingSecret = previous })
+}
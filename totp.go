@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP as described in RFC 6238, with the defaults every authenticator app
+// understands: HMAC-SHA1, six digits and a 30 second step.
+const (
+	totpDigits        = 6
+	totpPeriod        = 30
+	totpSkew          = 1
+	totpSecretSize    = 20
+	recoveryCodeCount = 10
+	mfaTokenTTL       = 5 * time.Minute
+)
+
+// Token purposes for the partial tokens handed out during a two step login.
+const (
+	purposeMFA       = "mfa"
+	purposeMFAEnroll = "mfa_enroll"
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// TOTPEnrollment is a user's TOTP secret. It only protects logins once it is
+// enabled, which happens after the user proves they can produce a code.
+type TOTPEnrollment struct {
+	UserID       int        `json:"userId"`
+	Secret       string     `json:"-"`
+	Enabled      bool       `json:"enabled"`
+	CreatedAt    time.Time  `json:"createdAt"`
+	ConfirmedAt  *time.Time `json:"confirmedAt"`
+	LastUsedStep int64      `json:"-"`
+}
+
+func generateTOTPSecret() string {
+	b := make([]byte, totpSecretSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return totpEncoding.EncodeToString(b)
+}
+
+// totpURI is the otpauth:// URI authenticator apps read from a QR code.
+func totpURI(secret, accountName string) string {
+	label := url.PathEscape(tokenIssuer + ":" + accountName)
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", tokenIssuer)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+func totpCodeAt(secret string, step int64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", fmt.Errorf("Invalid TOTP secret")
+	}
+
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+func totpCode(secret string, t time.Time) (string, error) {
+	return totpCodeAt(secret, totpStep(t))
+}
+
+// verifyTOTP checks code against the steps around t and returns the step it
+// matched, which the caller records so the same code cannot be used twice.
+func verifyTOTP(secret, code string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpStep(t)
+	for step := current - totpSkew; step <= current+totpSkew; step++ {
+		expected, err := totpCodeAt(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+
+	return 0, false
+}
+
+// generateRecoveryCodes returns one-time codes to show the user once, and the
+// hashes to store.
+func generateRecoveryCodes() ([]string, []string) {
+	codes := make([]string, 0, recoveryCodeCount)
+	hashes := make([]string, 0, recoveryCodeCount)
+
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			panic(err)
+		}
+		raw := strings.ToLower(totpEncoding.EncodeToString(b))
+		code := raw[:4] + "-" + raw[4:]
+
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes
+}
+
+func hashRecoveryCode(code string) string {
+	normalized := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(normalized)
+}
+
+// requiresMFA reports whether the user must have TOTP enabled to log in.
+func requiresMFA(user *User) bool {
+	return user.Role == Admin || user.Role == Employee
+}
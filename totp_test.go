@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// The SHA1 test vectors from RFC 6238, appendix B, cut down to six digits.
+func TestTOTPCodeRFC6238(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	vectors := map[int64]string{
+		59:         "287082",
+		1111111109: "081804",
+		1111111111: "050471",
+		1234567890: "005924",
+		2000000000: "279037",
+	}
+
+	for unix, want := range vectors {
+		code, err := totpCode(secret, time.Unix(unix, 0))
+		assert.Nil(t, err)
+		assert.Equal(t, want, code, "time %d", unix)
+	}
+}
+
+func TestVerifyTOTPSkew(t *testing.T) {
+	secret := generateTOTPSecret()
+	now := time.Unix(1700000000, 0)
+
+	previous, _ := totpCode(secret, now.Add(-totpPeriod*time.Second))
+	_, ok := verifyTOTP(secret, previous, now)
+	assert.True(t, ok)
+
+	stale, _ := totpCode(secret, now.Add(-3*totpPeriod*time.Second))
+	_, ok = verifyTOTP(secret, stale, now)
+	assert.False(t, ok)
+}
+
+func TestTwoStepLogin(t *testing.T) {
+	useTestJWTSecret(t)
+
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "mfa@mail.com", 0)
+	server := NewAPIServer(":0", store)
+	server.now = func() time.Time { return now }
+
+	post := func(handler http.HandlerFunc, token string, body any) *httptest.ResponseRecorder {
+		b, _ := json.Marshal(body)
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(b))
+		req.Header.Set("x-jwt-token", token)
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec
+	}
+
+	session, err := server.issueTokens(user, "")
+	assert.Nil(t, err)
+
+	enroll := withTokenPurpose(makeHTTPHandleFunc(server.handleTOTPEnroll), store, "", purposeMFAEnroll)
+	rec := post(enroll, session.Token, nil)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	enrolled := new(TOTPEnrollResponse)
+	json.NewDecoder(rec.Body).Decode(enrolled)
+
+	code, _ := totpCode(enrolled.Secret, now)
+	confirm := withTokenPurpose(makeHTTPHandleFunc(server.handleTOTPConfirm), store, "", purposeMFAEnroll)
+	rec = post(confirm, session.Token, TOTPVerifyRequest{Code: code})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	confirmed := new(TOTPConfirmResponse)
+	json.NewDecoder(rec.Body).Decode(confirmed)
+	assert.Len(t, confirmed.RecoveryCodes, recoveryCodeCount)
+
+	rec = post(makeHTTPHandleFunc(server.handleLogin), "", LoginRequest{Email: "mfa@mail.com", Password: "Password1"})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	challenge := new(MFAChallengeResponse)
+	json.NewDecoder(rec.Body).Decode(challenge)
+	assert.NotEmpty(t, challenge.MFAToken)
+
+	// A partial token is not a session.
+	logout := withJWTAuth(makeHTTPHandleFunc(server.handleLogout), store)
+	assert.Equal(t, http.StatusUnauthorized, post(logout, challenge.MFAToken, nil).Code)
+
+	loginMFA := withTokenPurpose(makeHTTPHandleFunc(server.handleLoginMFA), store, purposeMFA)
+
+	// The code used to confirm enrollment cannot be replayed.
+	assert.Equal(t, http.StatusUnauthorized, post(loginMFA, challenge.MFAToken, TOTPVerifyRequest{Code: code}).Code)
+
+	now = now.Add(totpPeriod * time.Second)
+	code, _ = totpCode(enrolled.Secret, now)
+	rec = post(loginMFA, challenge.MFAToken, TOTPVerifyRequest{Code: code})
+	assert.Equal(t, http.StatusOK, rec.Code)
+	login := new(LoginResponse)
+	json.NewDecoder(rec.Body).Decode(login)
+	assert.NotEmpty(t, login.Token)
+
+	// The partial token is single use, and so is each recovery code.
+	assert.Equal(t, http.StatusUnauthorized, post(loginMFA, challenge.MFAToken, TOTPVerifyRequest{RecoveryCode: confirmed.RecoveryCodes[0]}).Code)
+
+	rec = post(makeHTTPHandleFunc(server.handleLogin), "", LoginRequest{Email: "mfa@mail.com", Password: "Password1"})
+	json.NewDecoder(rec.Body).Decode(challenge)
+	assert.Equal(t, http.StatusOK, post(loginMFA, challenge.MFAToken, TOTPVerifyRequest{RecoveryCode: confirmed.RecoveryCodes[0]}).Code)
+
+	rec = post(makeHTTPHandleFunc(server.handleLogin), "", LoginRequest{Email: "mfa@mail.com", Password: "Password1"})
+	json.NewDecoder(rec.Body).Decode(challenge)
+	assert.Equal(t, http.StatusUnauthorized, post(loginMFA, challenge.MFAToken, TOTPVerifyRequest{RecoveryCode: confirmed.RecoveryCodes[0]}).Code)
+}
+
+func TestStaffMustEnrollTOTP(t *testing.T) {
+	useTestJWTSecret(t)
+
+	store := NewMemoryStore()
+	admin, err := NewAdminAccount("admin@mail.com", "Password1", "Admin", "User", "")
+	assert.Nil(t, err)
+	assert.Nil(t, store.CreateUser(admin, &Account{}))
+	server := NewAPIServer(":0", store)
+
+	body, _ := json.Marshal(LoginRequest{Email: "admin@mail.com", Password: "Password1"})
+	rec := httptest.NewRecorder()
+	makeHTTPHandleFunc(server.handleLogin)(rec, httptest.NewRequest("POST", "/login", bytes.NewReader(body)))
+
+	challenge := new(MFAChallengeResponse)
+	json.NewDecoder(rec.Body).Decode(challenge)
+	assert.True(t, challenge.EnrollmentRequired)
+	assert.NotEmpty(t, challenge.MFAToken)
+}
+
+func TestWrongMFACodesAreThrottled(t *testing.T) {
+	useTestJWTSecret(t)
+
+	now := time.Unix(1700000000, 0)
+	store := NewMemoryStore()
+	user, _ := newTestCustomer(t, store, "guess@mail.com", 0)
+	server := NewAPIServer(":0", store)
+	server.now = func() time.Time { return now }
+	server.loginPolicy.MaxFailures = maxMFAAttempts + 3
+	server.loginPolicy.DelayAfter = server.loginPolicy.MaxFailures
+
+	secret := generateTOTPSecret()
+	assert.Nil(t, store.SaveTOTPEnrollment(&TOTPEnrollment{UserID: user.ID, Secret: secret, CreatedAt: now}))
+	assert.Nil(t, store.EnableTOTP(user.ID, nil))
+
+	challenge := func() string {
+		rec := postJSON(server.handleLogin, nil, LoginRequest{Email: user.Email, Password: "Password1"})
+		assert.Equal(t, http.StatusOK, rec.Code)
+		response := new(MFAChallengeResponse)
+		json.NewDecoder(rec.Body).Decode(response)
+		return response.MFAToken
+	}
+	loginMFA := withTokenPurpose(makeHTTPHandleFunc(server.handleLoginMFA), store, purposeMFA)
+	post := func(token, code string) int {
+		b, _ := json.Marshal(TOTPVerifyRequest{Code: code})
+		req := httptest.NewRequest("POST", "/", bytes.NewReader(b))
+		req.Header.Set("x-jwt-token", token)
+		rec := httptest.NewRecorder()
+		loginMFA(rec, req)
+		return rec.Code
+	}
+	wrong, _ := totpCode(secret, now.Add(time.Hour))
+	right, _ := totpCode(secret, now)
+
+	// A partial token stops working after maxMFAAttempts wrong codes.
+	token := challenge()
+	for i := 0; i < maxMFAAttempts; i++ {
+		assert.Equal(t, http.StatusUnauthorized, post(token, wrong))
+	}
+	assert.Equal(t, http.StatusUnauthorized, post(token, right))
+
+	// Entering the password again does not forget the wrong codes, and they
+	// lock the login out like wrong passwords do.
+	token = challenge()
+	for i := maxMFAAttempts; i < server.loginPolicy.MaxFailures; i++ {
+		assert.Equal(t, http.StatusUnauthorized, post(token, wrong))
+	}
+	assert.Equal(t, http.StatusTooManyRequests, post(token, right))
+	assert.Equal(t, http.StatusTooManyRequests, postJSON(server.handleLogin, nil, LoginRequest{Email: user.Email, Password: "Password1"}).Code)
+
+	throttle, err := store.GetLoginThrottle(loginKey(user.Email))
+	assert.Nil(t, err)
+	assert.Equal(t, server.loginPolicy.MaxFailures, throttle.Failures)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+// TransactionFilter narrows an account's transaction history. Zero values
+// mean "no filter". Cursor is the id of the last row of the previous page;
+// only older rows are returned.
+type TransactionFilter struct {
+	From         time.Time
+	To           time.Time
+	Type         TransactionType
+	MinAmount    int64
+	MaxAmount    int64
+	Counterparty int
+	Cursor       int
+	Limit        int
+}
+
+// TransactionHistoryEntry is a transaction as seen from one account, with the
+// account's balance right after the transaction was applied.
+type TransactionHistoryEntry struct {
+	Transaction
+	RunningBalance int64 `json:"runningBalance"`
+}
+
+type TransactionHistoryPage struct {
+	Transactions []*TransactionHistoryEntry `json:"transactions"`
+	NextCursor   string                     `json:"nextCursor,omitempty"`
+}
+
+func (t TransactionType) String() string {
+	switch t {
+	case Debit:
+		return "Debit"
+	case Credit:
+		return "Credit"
+	case Transfer:
+		return "Transfer"
+	}
+	return strconv.Itoa(int(t))
+}
+
+func parseTransactionType(name string) (TransactionType, error) {
+	switch name {
+	case "Debit":
+		return Debit, nil
+	case "Credit":
+		return Credit, nil
+	case "Transfer":
+		return Transfer, nil
+	}
+	return 0, invalidField("type", "Transaction type must be 'Debit', 'Credit' or 'Transfer'")
+}
+
+// parseTransactionFilter reads the filter from query parameters. Dates may be
+// given as YYYY-MM-DD or RFC 3339; a date-only "to" includes that whole day.
+func parseTransactionFilter(query url.Values) (TransactionFilter, error) {
+	filter := TransactionFilter{Limit: defaultHistoryLimit}
+
+	if v := query.Get("from"); v != "" {
+		from, _, err := parseHistoryTime(v)
+		if err != nil {
+			return filter, invalidField("from", "Invalid from date %s", v)
+		}
+		filter.From = from
+	}
+
+	if v := query.Get("to"); v != "" {
+		to, dateOnly, err := parseHistoryTime(v)
+		if err != nil {
+			return filter, invalidField("to", "Invalid to date %s", v)
+		}
+		if dateOnly {
+			to = to.AddDate(0, 0, 1)
+		}
+		filter.To = to
+	}
+
+	if v := query.Get("type"); v != "" {
+		txType, err := parseTransactionType(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.Type = txType
+	}
+
+	ints := []struct {
+		name string
+		dest *int64
+	}{
+		{"minAmount", &filter.MinAmount},
+		{"maxAmount", &filter.MaxAmount},
+	}
+	for _, param := range ints {
+		if v := query.Get(param.name); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return filter, invalidField(param.name, "Invalid %s %s", param.name, v)
+			}
+			*param.dest = n
+		}
+	}
+
+	if v := query.Get("counterparty"); v != "" {
+		id, err := strconv.Atoi(v)
+		if err != nil {
+			return filter, invalidField("counterparty", "Invalid counterparty %s", v)
+		}
+		filter.Counterparty = id
+	}
+
+	if v := query.Get("cursor"); v != "" {
+		cursor, err := decodeCursor(v)
+		if err != nil {
+			return filter, err
+		}
+		filter.Cursor = cursor
+	}
+
+	if v := query.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return filter, invalidField("limit", "Invalid limit %s", v)
+		}
+		if limit > maxHistoryLimit {
+			limit = maxHistoryLimit
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+func parseHistoryTime(v string) (time.Time, bool, error) {
+	if t, err := time.Parse("2006-01-02", v); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	return t, false, err
+}
+
+// matches reports whether t passes every filter except the cursor and limit,
+// as seen from accountID.
+func (f TransactionFilter) matches(accountID int, t *Transaction) bool {
+	if !f.From.IsZero() && t.CreatedAt.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !t.CreatedAt.Before(f.To) {
+		return false
+	}
+	if f.Type != 0 && t.TransactionType != f.Type {
+		return false
+	}
+	if f.MinAmount != 0 && t.Amount < f.MinAmount {
+		return false
+	}
+	if f.MaxAmount != 0 && t.Amount > f.MaxAmount {
+		return false
+	}
+	if f.Counterparty != 0 && t.counterparty(accountID) != f.Counterparty {
+		return false
+	}
+	return true
+}
+
+func (t *Transaction) counterparty(accountID int) int {
+	if t.FromAccount == accountID {
+		return t.ToAccount
+	}
+	return t.FromAccount
+}
+
+// balanceEffect is how much the transaction changed accountID's balance.
+func (t *Transaction) balanceEffect(accountID int) int64 {
+	if t.ToAccount == accountID {
+		return t.Amount
+	}
+	return -t.Amount
+}
+
+func encodeCursor(id int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(id)))
+}
+
+func decodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, invalidField("cursor", "Invalid cursor")
+	}
+	id, err := strconv.Atoi(string(raw))
+	if err != nil || id < 1 {
+		return 0, invalidField("cursor", "Invalid cursor")
+	}
+	return id, nil
+}
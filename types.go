@@ -22,6 +22,8 @@ type AccountType int
 const (
 	Checking AccountType = iota + 1
 	Savings
+	// CreditAccount is named apart from the Credit transaction type.
+	CreditAccount
 )
 
 type TransactionType int
@@ -34,15 +36,15 @@ const (
 
 type CreateUserRequest struct {
 	Email       string `json:"email"`
-	Password    string `json:"-"`
+	Password    string `json:"password"`
 	FirstName   string `json:"firstName"`
 	LastName    string `json:"lastName"`
 	UserName    string `json:"userName"`
 	PhoneNumber string `json:"phoneNumber"`
 	ReferrerID  string `json:"referrerID"`
-	Balance     int    `json:"balance"`
 	Role        string `json:"role"`
 	AccountType string `json:"accountType"`
+	Currency    string `json:"currency"`
 }
 
 type LoginRequest struct {
@@ -51,30 +53,83 @@ type LoginRequest struct {
 }
 
 type TransactionRequest struct {
-	FromAccount     int `json:"fromAccount"`
-	ToAccount       int `json:"toAccount"`
-	Amount          int `json:"amount"`
-	TransactionType int `json:"transactionType"`
+	FromAccount     int    `json:"fromAccount"`
+	ToAccount       int    `json:"toAccount"`
+	Amount          int    `json:"amount"`
+	TransactionType int    `json:"transactionType"`
+	Description     string `json:"description"`
+}
+
+type ReverseJournalEntryRequest struct {
+	Description string `json:"description"`
+}
+
+type AccountLedgerResponse struct {
+	Balance *LedgerBalance  `json:"balance"`
+	Entries []*JournalEntry `json:"entries"`
 }
 
 type LoginResponse struct {
-	UserName string `json:"userName"`
-	Token    string `json:"token"`
+	UserName     string    `json:"userName"`
+	Token        string    `json:"token"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+	RefreshToken string    `json:"refreshToken"`
+}
+
+type MFAChallengeResponse struct {
+	UserName           string    `json:"userName"`
+	MFAToken           string    `json:"mfaToken"`
+	ExpiresAt          time.Time `json:"expiresAt"`
+	EnrollmentRequired bool      `json:"enrollmentRequired"`
+}
+
+type TOTPVerifyRequest struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+type TOTPEnrollResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPConfirmResponse struct {
+	RecoveryCodes []string       `json:"recoveryCodes"`
+	Login         *LoginResponse `json:"login,omitempty"`
+}
+
+type RefreshTokenRequest struct {
+	RefreshToken string `json:"refreshToken"`
 }
 
 type User struct {
-	ID          int       `json:"user_id"`
-	Email       string    `json:"email"`
-	Password    string    `json:"-"`
-	FirstName   string    `json:"firstName"`
-	LastName    string    `json:"lastName"`
-	UserName    string    `json:"userName"`
-	PhoneNumber string    `json:"phoneNumber"`
-	ReferrerID  int       `json:"referrerID"`
-	CreatedAt   time.Time `json:"createdAt"`
-	LastLogin   time.Time `json:"lastLogin"`
-	Role        Role      `json:"role"`
-	IsActive    bool      `json:"isActive"`
+	ID            int       `json:"user_id"`
+	Email         string    `json:"email"`
+	Password      string    `json:"-"`
+	FirstName     string    `json:"firstName"`
+	LastName      string    `json:"lastName"`
+	UserName      string    `json:"userName"`
+	PhoneNumber   string    `json:"phoneNumber"`
+	ReferrerID    int       `json:"referrerID"`
+	CreatedAt     time.Time `json:"createdAt"`
+	LastLogin     time.Time `json:"lastLogin"`
+	Role          Role      `json:"role"`
+	IsActive      bool      `json:"isActive"`
+	EmailVerified bool      `json:"emailVerified"`
+	PhoneVerified bool      `json:"phoneVerified"`
+	// PasswordChangedAt is when the password was last reset. Access tokens
+	// issued before it are no longer accepted.
+	PasswordChangedAt time.Time `json:"-"`
+}
+
+// UpdateUserRequest holds the profile fields a user may change. Fields left
+// out of the request stay as they are.
+type UpdateUserRequest struct {
+	Email       *string `json:"email"`
+	FirstName   *string `json:"firstName"`
+	LastName    *string `json:"lastName"`
+	UserName    *string `json:"userName"`
+	PhoneNumber *string `json:"phoneNumber"`
 }
 
 type Account struct {
@@ -84,12 +139,30 @@ type Account struct {
 	Balance         int64       `json:"balance"`
 	CreatedAt       time.Time   `json:"createdAt"`
 	AccountType     AccountType `json:"accountType"`
+	Currency        Currency    `json:"currency"`
+	CreditLimit     int64       `json:"creditLimit,omitempty"`
 	IsActiveAccount bool        `json:"isActiveAccount"`
+	IsSystem        bool        `json:"isSystem"`
+}
+
+type Transaction struct {
+	ID              int             `json:"id"`
+	FromAccount     int             `json:"fromAccount"`
+	ToAccount       int             `json:"toAccount"`
+	Amount          int64           `json:"amount"`
+	Description     string          `json:"description"`
+	CreatedAt       time.Time       `json:"createdAt"`
+	TransactionType TransactionType `json:"transactionType"`
 }
 
 type FullAccount struct {
-	User     User
-	Accounts []Account
+	User     User      `json:"user"`
+	Accounts []Account `json:"accounts"`
+}
+
+type OpenAccountRequest struct {
+	AccountType string `json:"accountType"`
+	Currency    string `json:"currency"`
 }
 
 func NewAdminAccount(email, password, firstName, lastName, phoneNumber string) (*User, error) {
@@ -135,10 +208,47 @@ func NewUserAccount(email, password, firstName, lastName, phoneNumber string, re
 			Balance:         balance,
 			CreatedAt:       time.Now().UTC(),
 			AccountType:     accType,
+			Currency:        defaultCurrency,
 			IsActiveAccount: true,
 		}, nil
 }
 
+// NewAccount is an empty account for a user who is already registered.
+func NewAccount(userID int, accType AccountType, currency Currency) *Account {
+	return &Account{
+		UserID:          userID,
+		AccountNumber:   int64(rand.Intn(990000) + 100000),
+		CreatedAt:       time.Now().UTC(),
+		AccountType:     accType,
+		Currency:        currency,
+		IsActiveAccount: true,
+	}
+}
+
+func (t AccountType) String() string {
+	switch t {
+	case Checking:
+		return "Checking"
+	case Savings:
+		return "Savings"
+	case CreditAccount:
+		return "Credit"
+	}
+	return strconv.Itoa(int(t))
+}
+
+func parseAccountType(name string) (AccountType, error) {
+	switch name {
+	case "Checking":
+		return Checking, nil
+	case "Savings":
+		return Savings, nil
+	case "Credit":
+		return CreditAccount, nil
+	}
+	return 0, invalidField("accountType", "Must specifiy 'Checking', 'Savings' or 'Credit' account")
+}
+
 func hashPassword(password string) (string, error) {
 	hashedPW, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -8,7 +8,7 @@ import (
 )
 
 func TestNewAccount(t *testing.T) {
-	acc, err := NewAccount("email", "password", "firstname", "lastname", "phonenumber")
+	acc, err := NewAdminAccount("email", "password", "firstname", "lastname", "phonenumber")
     assert.Nil(t, err)
 
     fmt.Printf("%+v\n", acc)
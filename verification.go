@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Contact details a user can be asked to verify.
+const (
+	VerifyEmail = "email"
+	VerifyPhone = "phone"
+)
+
+// Purposes of the tokens mailed to users. Like the partial tokens of a two
+// step login they are never accepted as a session.
+const (
+	purposeVerifyEmail   = "verify_email"
+	purposeResetPassword = "reset_password"
+
+	verifyEmailTTL   = 48 * time.Hour
+	resetPasswordTTL = time.Hour
+)
+
+type TokenRequest struct {
+	Token string `json:"token"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// newActionToken signs a token mailed to the user for purpose. The binding
+// is what the token acts on, the email address being verified or a hash of
+// the password being reset, so it stops working once that changes. Each
+// token can be used once.
+func newActionToken(user *User, purpose, binding string, ttl time.Duration) (string, error) {
+	claims := newAccessClaims(user)
+	claims.Purpose = purpose
+	claims.Binding = binding
+	claims.ExpiresAt = jwt.NewNumericDate(claims.IssuedAt.Time.Add(ttl))
+
+	return signJWT(claims)
+}
+
+// useActionToken checks a mailed token for purpose, marks it used and returns
+// its user, who must be active and still have the binding the token was
+// issued for.
+func (s *APIServer) useActionToken(token, purpose string, binding func(*User) string) (*User, error) {
+	claims, err := validateJWT(token)
+	if err != nil || claims.Purpose != purpose {
+		return nil, invalidField("token", "Link is invalid or has expired")
+	}
+
+	userID, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, invalidField("token", "Link is invalid or has expired")
+	}
+	user, err := s.store.GetUserByID(userID)
+	if err != nil || binding(user) != claims.Binding {
+		return nil, invalidField("token", "Link is invalid or has expired")
+	}
+
+	if err := s.store.UseToken(claims.ID, claims.ExpiresAt.Time); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func passwordBinding(user *User) string {
+	return hashToken(user.Password)[:16]
+}
+
+func emailBinding(user *User) string {
+	return user.Email
+}
+
+// link is the address of a page of the web app with the token in its query.
+func (s *APIServer) link(path, token string) string {
+	return s.publicURL + path + "?token=" + url.QueryEscape(token)
+}
+
+// startVerification mails a link to verify an email address that was just
+// set or changed. Until the user follows it the address stays unverified.
+// Phone numbers are only logged until there is an SMS provider.
+func (s *APIServer) startVerification(user *User, field string) error {
+	if field != VerifyEmail {
+		log.Printf("User %d must verify their %s", user.ID, field)
+		return nil
+	}
+
+	token, err := newActionToken(user, purposeVerifyEmail, emailBinding(user), verifyEmailTTL)
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(&Email{
+		To:      user.Email,
+		Subject: "Verify your email address",
+		Body: fmt.Sprintf("Hi %s,\n\nPlease verify your email address by opening the link below within %d hours.\n\n%s\n",
+			user.FirstName, int(verifyEmailTTL.Hours()), s.link("/verify-email", token)),
+	})
+}
+
+// requireVerifiedEmail refuses customers who have not verified their email
+// address. Staff acting on a customer's behalf are not held to it.
+func (s *APIServer) requireVerifiedEmail(r *http.Request) error {
+	principal := principalFromContext(r.Context())
+	if principal == nil || principal.Role != Customer {
+		return nil
+	}
+
+	user, err := s.store.GetUserByID(principal.UserID)
+	if err != nil {
+		return err
+	}
+	if !user.EmailVerified {
+		return forbidden("Verify your email address before making transfers")
+	}
+	return nil
+}
+
+// POST /verify-email
+func (s *APIServer) handleVerifyEmail(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	req := new(TokenRequest)
+	if err := readJSON(r, req); err != nil {
+		return err
+	}
+
+	user, err := s.useActionToken(req.Token, purposeVerifyEmail, emailBinding)
+	if err != nil {
+		return err
+	}
+	if err := s.store.VerifyEmail(user.ID, user.Email); err != nil {
+		return err
+	}
+	s.audit(r, &AuditEvent{ActorID: user.ID, ActorRole: user.Role, Action: AuditEmailVerify, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"verified": user.Email})
+}
+
+// POST /verify-email/resend sends the caller a new verification link.
+func (s *APIServer) handleResendVerification(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	user, err := s.store.GetUserByID(principalFromContext(r.Context()).UserID)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return conflict("Email address is already verified")
+	}
+
+	if err := s.startVerification(user, VerifyEmail); err != nil {
+		return err
+	}
+
+	return WriteJSON(w, http.StatusAccepted, map[string]string{"sent": user.Email})
+}
+
+// POST /password-reset mails a reset link to the address if it belongs to a
+// user. The answer is the same either way so it does not reveal who has an
+// account.
+func (s *APIServer) handlePasswordReset(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	req := new(PasswordResetRequest)
+	if err := readJSON(r, req); err != nil {
+		return err
+	}
+
+	// A failure to send is only logged, since answering differently would
+	// give away that the address has an account.
+	if user, err := s.store.GetUserByEmail(req.Email); err == nil {
+		if err := s.sendPasswordReset(user); err != nil {
+			log.Println("Sending password reset failed:", err)
+		}
+	}
+
+	return WriteJSON(w, http.StatusAccepted, map[string]string{"sent": "If the address belongs to an account, a reset link is on its way"})
+}
+
+// sendPasswordReset mails the user a single-use link to choose a new
+// password.
+func (s *APIServer) sendPasswordReset(user *User) error {
+	token, err := newActionToken(user, purposeResetPassword, passwordBinding(user), resetPasswordTTL)
+	if err != nil {
+		return err
+	}
+
+	return s.mailer.Send(&Email{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your account. If it was you, open the link below within %d minutes to choose a new one. If not, you can ignore this email.\n\n%s\n",
+			user.FirstName, int(resetPasswordTTL.Minutes()), s.link("/reset-password", token)),
+	})
+}
+
+// POST /password-reset/confirm sets the new password and signs the user out
+// everywhere.
+func (s *APIServer) handlePasswordResetConfirm(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return methodNotAllowed(r.Method)
+	}
+
+	req := new(PasswordResetConfirmRequest)
+	if err := readJSON(r, req); err != nil {
+		return err
+	}
+	if !validPassword(req.Password) {
+		return invalidField("password", passwordRule)
+	}
+
+	user, err := s.useActionToken(req.Token, purposeResetPassword, passwordBinding)
+	if err != nil {
+		return err
+	}
+
+	hashed, err := hashPassword(req.Password)
+	if err != nil {
+		return err
+	}
+	// Tokens carry their issue time in whole seconds.
+	if err := s.store.SetPassword(user.ID, hashed, s.now().UTC().Truncate(time.Second)); err != nil {
+		return err
+	}
+	if err := s.store.RevokeUserRefreshTokens(user.ID); err != nil {
+		return err
+	}
+	s.audit(r, &AuditEvent{ActorID: user.ID, ActorRole: user.Role, Action: AuditPasswordReset, TargetType: "user", TargetID: strconv.Itoa(user.ID)})
+
+	err = s.mailer.Send(&Email{
+		To:      user.Email,
+		Subject: "Your password was changed",
+		Body:    fmt.Sprintf("Hi %s,\n\nThe password of your account was just reset and every session was signed out. If this was not you, contact us straight away.\n", user.FirstName),
+	})
+	if err != nil {
+		log.Println("Sending password change notice failed:", err)
+	}
+
+	return WriteJSON(w, http.StatusOK, map[string]string{"updated": "Password updated"})
+}
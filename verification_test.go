@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingMailer struct {
+	sent []*Email
+}
+
+func (m *recordingMailer) Send(e *Email) error {
+	m.sent = append(m.sent, e)
+	return nil
+}
+
+// token is the token in the link of the last email sent.
+func (m *recordingMailer) token(t *testing.T) string {
+	match := regexp.MustCompile(`token=(\S+)`).FindStringSubmatch(m.sent[len(m.sent)-1].Body)
+	assert.NotNil(t, match)
+	token, _ := url.QueryUnescape(match[1])
+	return token
+}
+
+func postJSON(h apiFunc, principal *Principal, v any) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(v)
+	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+	if principal != nil {
+		req = req.WithContext(withPrincipal(req.Context(), principal))
+	}
+	rec := httptest.NewRecorder()
+	makeHTTPHandleFunc(h)(rec, req)
+	return rec
+}
+
+func TestUnverifiedUserCannotTransferUntilVerified(t *testing.T) {
+	useTestJWTSecret(t)
+	store := NewMemoryStore()
+	mailer := &recordingMailer{}
+	server := NewAPIServer(":0", store)
+	server.mailer = mailer
+
+	user, account, err := NewUserAccount("unverified@mail.com", "Password1", "New", "Customer", "", 0, 100_00, Customer, Checking)
+	assert.Nil(t, err)
+	assert.Nil(t, store.CreateUser(user, account))
+	_, payee := newTestCustomer(t, store, "payee@mail.com", 0)
+
+	principal := &Principal{UserID: user.ID, Role: Customer}
+	transfer := TransactionRequest{FromAccount: account.ID, ToAccount: payee.ID, Amount: 10_00}
+	assert.Equal(t, http.StatusForbidden, postJSON(server.handleTransaction, principal, transfer).Code)
+
+	assert.Equal(t, http.StatusAccepted, postJSON(server.handleResendVerification, principal, nil).Code)
+	assert.Len(t, mailer.sent, 1)
+	assert.Equal(t, user.Email, mailer.sent[0].To)
+
+	token := mailer.token(t)
+	assert.Equal(t, http.StatusOK, postJSON(server.handleVerifyEmail, nil, TokenRequest{Token: token}).Code)
+	assert.Equal(t, http.StatusBadRequest, postJSON(server.handleVerifyEmail, nil, TokenRequest{Token: token}).Code)
+
+	verified, _ := store.GetUserByID(user.ID)
+	assert.True(t, verified.EmailVerified)
+	assert.Equal(t, http.StatusOK, postJSON(server.handleTransaction, principal, transfer).Code)
+}
+
+func TestPasswordReset(t *testing.T) {
+	useTestJWTSecret(t)
+	store := NewMemoryStore()
+	mailer := &recordingMailer{}
+	server := NewAPIServer(":0", store)
+	server.mailer = mailer
+	user, _ := newTestCustomer(t, store, "forgetful@mail.com", 0)
+
+	// Unknown addresses get the same answer and no mail.
+	assert.Equal(t, http.StatusAccepted, postJSON(server.handlePasswordReset, nil, PasswordResetRequest{Email: "nobody@mail.com"}).Code)
+	assert.Empty(t, mailer.sent)
+
+	assert.Equal(t, http.StatusAccepted, postJSON(server.handlePasswordReset, nil, PasswordResetRequest{Email: user.Email}).Code)
+	token := mailer.token(t)
+
+	// A verification token cannot be used to reset the password.
+	verify, _ := newActionToken(user, purposeVerifyEmail, user.Email, verifyEmailTTL)
+	assert.Equal(t, http.StatusBadRequest, postJSON(server.handlePasswordResetConfirm, nil, PasswordResetConfirmRequest{Token: verify, Password: "NewPassword2"}).Code)
+
+	assert.Equal(t, http.StatusBadRequest, postJSON(server.handlePasswordResetConfirm, nil, PasswordResetConfirmRequest{Token: token, Password: "weak"}).Code)
+	assert.Equal(t, http.StatusOK, postJSON(server.handlePasswordResetConfirm, nil, PasswordResetConfirmRequest{Token: token, Password: "NewPassword2"}).Code)
+	assert.Equal(t, http.StatusBadRequest, postJSON(server.handlePasswordResetConfirm, nil, PasswordResetConfirmRequest{Token: token, Password: "OtherPassword3"}).Code)
+
+	updated, _ := store.GetUserByID(user.ID)
+	assert.True(t, updated.validatePassword("NewPassword2"))
+	assert.Equal(t, "Your password was changed", mailer.sent[len(mailer.sent)-1].Subject)
+}
+
+func TestSignupChecksPassword(t *testing.T) {
+	useTestJWTSecret(t)
+	store := NewMemoryStore()
+	server := NewAPIServer(":0", store)
+	server.mailer = &recordingMailer{}
+
+	signup := map[string]string{"email": "signup@mail.com", "password": "weak", "firstName": "New", "lastName": "Customer", "accountType": "Checking"}
+	rec := postJSON(server.handleCreateAccount, nil, signup)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "password")
+
+	signup["password"] = "Password1"
+	assert.Equal(t, http.StatusOK, postJSON(server.handleCreateAccount, nil, signup).Code)
+
+	user, err := store.GetUserByEmail("signup@mail.com")
+	assert.Nil(t, err)
+	assert.True(t, user.validatePassword("Password1"))
+}
+
+func TestPasswordResetSignsOutAccessTokens(t *testing.T) {
+	useTestJWTSecret(t)
+	store := NewMemoryStore()
+	mailer := &recordingMailer{}
+	server := NewAPIServer(":0", store)
+	server.mailer = mailer
+	user, _ := newTestCustomer(t, store, "stolen@mail.com", 0)
+
+	token, err := createJWT(user)
+	assert.Nil(t, err)
+	signedIn := func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("x-jwt-token", token)
+		return principalFromToken(req, store) != nil
+	}
+	assert.True(t, signedIn())
+
+	// The reset happens a second after the token was issued.
+	server.now = func() time.Time { return time.Now().Add(time.Second) }
+	assert.Equal(t, http.StatusAccepted, postJSON(server.handlePasswordReset, nil, PasswordResetRequest{Email: user.Email}).Code)
+	assert.Equal(t, http.StatusOK, postJSON(server.handlePasswordResetConfirm, nil, PasswordResetConfirmRequest{Token: mailer.token(t), Password: "NewPassword2"}).Code)
+
+	assert.False(t, signedIn())
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(*Email) error { return fmt.Errorf("mail server down") }
+
+func TestPasswordResetAnswersAlikeWhenMailFails(t *testing.T) {
+	useTestJWTSecret(t)
+	store := NewMemoryStore()
+	server := NewAPIServer(":0", store)
+	server.mailer = failingMailer{}
+	user, _ := newTestCustomer(t, store, "unlucky@mail.com", 0)
+
+	known := postJSON(server.handlePasswordReset, nil, PasswordResetRequest{Email: user.Email})
+	unknown := postJSON(server.handlePasswordReset, nil, PasswordResetRequest{Email: "nobody@mail.com"})
+	assert.Equal(t, http.StatusAccepted, known.Code)
+	assert.Equal(t, unknown.Code, known.Code)
+	assert.Equal(t, unknown.Body.String(), known.Body.String())
+}